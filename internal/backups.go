@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+func NewBackupsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backups",
+		Short: "List and restore backups of files overwritten by pull",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list [set]",
+		Short: "List backup sets, or the files in one set",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   backupsListHandler,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "restore <set> [files or directories]...",
+		Short: "Restore files from a backup set",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   backupsRestoreHandler,
+	})
+	return cmd
+}
+
+func backupsListHandler(cmd *cobra.Command, args []string) {
+	database, err := openBackupsDB()
+	if err != nil {
+		fmt.Println("Failed to open local database:", err)
+		return
+	}
+	defer database.Close()
+
+	if len(args) == 1 {
+		set, err := db.GetBackupSetByName(database, args[0])
+		if err != nil {
+			fmt.Printf("Backup set %q not found.\n", args[0])
+			return
+		}
+		files, err := db.GetBackupFiles(database, set.ID)
+		if err != nil {
+			fmt.Println("Failed to read backup set:", err)
+			return
+		}
+		fmt.Printf("Files in backup set %s (%d):\n", set.Name, len(files))
+		for _, file := range files {
+			fmt.Printf("  %s\n", file.Path)
+		}
+		return
+	}
+
+	sets, err := db.GetBackupSets(database)
+	if err != nil {
+		fmt.Println("Failed to read backup sets:", err)
+		return
+	}
+	if len(sets) == 0 {
+		fmt.Println("No backups yet.")
+		return
+	}
+	fmt.Printf("Backup sets (%d):\n", len(sets))
+	for _, set := range sets {
+		fmt.Printf("  %s  %s  %d file(s)\n", set.Name, set.CreatedAt.Format("2006-01-02 15:04:05"), set.FileCount)
+	}
+}
+
+func backupsRestoreHandler(cmd *cobra.Command, args []string) {
+	database, err := openBackupsDB()
+	if err != nil {
+		fmt.Println("Failed to open local database:", err)
+		return
+	}
+	defer database.Close()
+
+	set, err := db.GetBackupSetByName(database, args[0])
+	if err != nil {
+		fmt.Printf("Backup set %q not found.\n", args[0])
+		return
+	}
+	files, err := db.GetBackupFiles(database, set.ID)
+	if err != nil {
+		fmt.Println("Failed to read backup set:", err)
+		return
+	}
+
+	filter := argsAsFullPaths(args[1:])
+	setDir := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncBackupsDir(), set.Name)
+	// Whatever the restore overwrites is itself backed up, so it can be undone
+	recorder := newBackupRecorder(database)
+
+	restored := 0
+	for _, file := range files {
+		if len(filter) > 0 && !pathMatchesAny(file.Path, filter) {
+			continue
+		}
+		if shared.PathExists(file.Path) {
+			if err := recorder.Backup(file.Path); err != nil {
+				fmt.Printf("Failed to back up %s, skipping: %v\n", file.Path, err)
+				continue
+			}
+		}
+		if err := shared.CopyPath(filepath.Join(setDir, file.BackupPath), file.Path); err != nil {
+			fmt.Printf("Failed to restore %s: %v\n", file.Path, err)
+			continue
+		}
+		fmt.Printf("✓ Restored: %s\n", file.Path)
+		restored++
+	}
+
+	if restored == 0 {
+		fmt.Println("No matching files found in backup set.")
+		return
+	}
+	if recorder.Name() != "" {
+		fmt.Printf("Previous versions saved to backup set %s.\n", recorder.Name())
+	}
+}
+
+func openBackupsDB() (*sql.DB, error) {
+	database, err := db.OpenLocalDB()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.EnsureBackupTables(database); err != nil {
+		database.Close()
+		return nil, err
+	}
+	return database, nil
+}
+
+// pathMatchesAny reports whether path is one of roots or lies below one.
+func pathMatchesAny(path string, roots []string) bool {
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// backupRecorder copies files into a timestamped backup set under
+// ~/.dot-sync/backups before they are overwritten. The set is only created
+// once the first file is backed up.
+type backupRecorder struct {
+	database *sql.DB
+	setID    int
+	name     string
+	dir      string
+}
+
+func newBackupRecorder(database *sql.DB) *backupRecorder {
+	return &backupRecorder{database: database}
+}
+
+// Name returns the name of the backup set, or "" if nothing was backed up.
+func (b *backupRecorder) Name() string {
+	return b.name
+}
+
+func (b *backupRecorder) Backup(path string) error {
+	if b.name == "" {
+		if err := b.createSet(); err != nil {
+			return err
+		}
+	}
+	// Mirror the portable path layout so backups are readable without the DB
+	rel := strings.TrimPrefix(shared.ToStoragePath(path), string(filepath.Separator))
+	// Symlinks are backed up as links
+	if err := shared.CopyPath(path, filepath.Join(b.dir, rel)); err != nil {
+		return err
+	}
+	return db.InsertBackupFile(b.database, b.setID, path, rel)
+}
+
+func (b *backupRecorder) createSet() error {
+	now := time.Now()
+	backupsDir := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncBackupsDir())
+	name := now.Format("20060102-150405")
+	// Several pulls within one second get distinct sets
+	for i := 2; shared.PathExists(filepath.Join(backupsDir, name)); i++ {
+		name = fmt.Sprintf("%s-%d", now.Format("20060102-150405"), i)
+	}
+	dir := filepath.Join(backupsDir, name)
+	if err := shared.EnsureDir(dir); err != nil {
+		return err
+	}
+	id, err := db.InsertBackupSet(b.database, name, now)
+	if err != nil {
+		return err
+	}
+	b.setID, b.name, b.dir = id, name, dir
+	return nil
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+)
+
+func setupBackupsHome(t *testing.T) string {
+	t.Helper()
+	oldHome := os.Getenv("HOME")
+	tempHome := t.TempDir()
+	os.Setenv("HOME", tempHome)
+	t.Cleanup(func() { os.Setenv("HOME", oldHome) })
+	os.MkdirAll(filepath.Join(tempHome, ".dot-sync"), 0700)
+	return tempHome
+}
+
+func TestNewBackupsCmd(t *testing.T) {
+	cmd := NewBackupsCmd()
+	if cmd == nil {
+		t.Fatal("NewBackupsCmd returned nil")
+	}
+	found := map[string]bool{}
+	for _, sub := range cmd.Commands() {
+		found[sub.Name()] = true
+	}
+	for _, name := range []string{"list", "restore"} {
+		if !found[name] {
+			t.Errorf("expected %q subcommand", name)
+		}
+	}
+}
+
+func TestBackupRecorderAndRestore(t *testing.T) {
+	home := setupBackupsHome(t)
+	rcFile := filepath.Join(home, ".zshrc")
+	vimrc := filepath.Join(home, ".vimrc")
+	os.WriteFile(rcFile, []byte("original zshrc\n"), 0600)
+	os.WriteFile(vimrc, []byte("original vimrc\n"), 0600)
+
+	database, err := openBackupsDB()
+	if err != nil {
+		t.Fatalf("openBackupsDB failed: %v", err)
+	}
+	recorder := newBackupRecorder(database)
+	if recorder.Name() != "" {
+		t.Error("expected no backup set before the first backup")
+	}
+	if err := recorder.Backup(rcFile); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := recorder.Backup(vimrc); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	setName := recorder.Name()
+	database.Close()
+
+	backupCopy := filepath.Join(home, ".dot-sync", "backups", setName, "HOME", ".zshrc")
+	if data, err := os.ReadFile(backupCopy); err != nil || string(data) != "original zshrc\n" {
+		t.Errorf("expected backup copy at %s: %v, %q", backupCopy, err, data)
+	}
+
+	output := captureStdout(func() { backupsListHandler(&cobra.Command{}, []string{}) })
+	if !strings.Contains(output, setName) || !strings.Contains(output, "2 file(s)") {
+		t.Errorf("expected backup set to be listed, got %q", output)
+	}
+	output = captureStdout(func() { backupsListHandler(&cobra.Command{}, []string{setName}) })
+	if !strings.Contains(output, rcFile) || !strings.Contains(output, vimrc) {
+		t.Errorf("expected set files to be listed, got %q", output)
+	}
+
+	// Simulate a bad pull, then roll back only .zshrc
+	os.WriteFile(rcFile, []byte("clobbered\n"), 0600)
+	os.WriteFile(vimrc, []byte("clobbered\n"), 0600)
+	output = captureStdout(func() { backupsRestoreHandler(&cobra.Command{}, []string{setName, rcFile}) })
+
+	if data, _ := os.ReadFile(rcFile); string(data) != "original zshrc\n" {
+		t.Errorf("expected .zshrc to be restored, got %q", data)
+	}
+	if data, _ := os.ReadFile(vimrc); string(data) != "clobbered\n" {
+		t.Errorf("expected .vimrc to be left alone, got %q", data)
+	}
+	if !strings.Contains(output, "Previous versions saved to backup set") {
+		t.Errorf("expected restore to back up the replaced file, got %q", output)
+	}
+
+	database, _ = db.OpenLocalDB()
+	defer database.Close()
+	sets, _ := db.GetBackupSets(database)
+	if len(sets) != 2 {
+		t.Errorf("expected restore to create a second backup set, got %d", len(sets))
+	}
+}
+
+func TestBackupsRestoreUnknownSet(t *testing.T) {
+	setupBackupsHome(t)
+	output := captureStdout(func() { backupsRestoreHandler(&cobra.Command{}, []string{"nope"}) })
+	if !strings.Contains(output, `Backup set "nope" not found.`) {
+		t.Errorf("expected not found message, got %q", output)
+	}
+}
+
+func TestBackupsListEmpty(t *testing.T) {
+	setupBackupsHome(t)
+	output := captureStdout(func() { backupsListHandler(&cobra.Command{}, []string{}) })
+	if !strings.Contains(output, "No backups yet.") {
+		t.Errorf("expected empty message, got %q", output)
+	}
+}
+
+func TestPathMatchesAny(t *testing.T) {
+	roots := []string{"/home/user/.config/nvim", "/home/user/.zshrc"}
+	testCases := map[string]bool{
+		"/home/user/.zshrc":                true,
+		"/home/user/.config/nvim/init.lua": true,
+		"/home/user/.config/nvim-old/x":    false,
+		"/home/user/.bashrc":               false,
+	}
+	for path, expected := range testCases {
+		if got := pathMatchesAny(path, roots); got != expected {
+			t.Errorf("pathMatchesAny(%q): expected %v, got %v", path, expected, got)
+		}
+	}
+}
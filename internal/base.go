@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+	"github.com/tylerkeyes/dot-sync/storage"
+)
+
+// The base store under ~/.dot-sync/base keeps, for each record, the version
+// this machine last exchanged with the remote. It is updated record by record,
+// so it stays accurate when only some records are synced or pulled.
+
+func baseCopyPath(id int) string {
+	return filepath.Join(shared.FindHomeDir(), shared.GetDotSyncBaseDir(), fmt.Sprintf("%d", id))
+}
+
+// updateBaseFile records stored as the last synced version of live, a file
+// of the record with the given id and path.
+func updateBaseFile(id int, recordPath, live, stored string) error {
+	rel, err := filepath.Rel(recordPath, live)
+	if err != nil {
+		return err
+	}
+	return replaceWithCopy(stored, filepath.Join(baseCopyPath(id), rel))
+}
+
+func removeBaseCopy(id int) error {
+	return os.RemoveAll(baseCopyPath(id))
+}
+
+// exportBase writes the last synced state of every record into dest: the
+// provider's base revision, decrypted, overlaid with the per-record base
+// store.
+func exportBase(sp storage.StorageProvider, dotSyncDir, dest string, codec *fileCodec) error {
+	if err := sp.ExportRevision(dotSyncDir, storage.RevisionBase, dest); err != nil {
+		return err
+	}
+	if err := codec.openFiles(dest); err != nil {
+		return err
+	}
+	baseRoot := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncBaseDir())
+	if !shared.PathExists(baseRoot) {
+		return nil
+	}
+	return shared.CopyDir(baseRoot, dest)
+}
+
+// replaceWithCopy makes dst an exact copy of src, which may be a file, a
+// directory or a symlink. A missing src removes dst.
+func replaceWithCopy(src, dst string) error {
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(src); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return shared.CopyPath(src, dst)
+}
@@ -0,0 +1,430 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// Once a key is set up with 'dot-sync keys', this machine has secrets or a
+// record is a template, the files/ tree that is pushed holds the stored form
+// of the records: the records marked with 'mark --encrypt' are
+// age-encrypted, secret values are replaced with placeholders and templates
+// are stored unrendered. The commands work on the live form of it
+// in ~/.dot-sync/plain/files, which never leaves the machine. sync converts
+// that copy into files/ before pushing, and pull converts files/ into it
+// after pulling. A file is only written again when its contents changed, so
+// unchanged files don't show up as remote changes.
+
+// errNoKey is returned when stored files are encrypted but this machine has
+// no key to decrypt them.
+var errNoKey = errors.New("stored files are encrypted but this machine has no key; import it with 'dot-sync keys import'")
+
+// fileCodec converts files between their stored and live forms. A nil
+// *fileCodec means the two are the same.
+type fileCodec struct {
+	// recipients are the keys recorded in state.db; empty when none is set
+	// up.
+	recipients []*age.X25519Recipient
+	// identities are this machine's secret keys; empty when it has none.
+	identities []*age.X25519Identity
+	// secrets is nil when this machine has none.
+	secrets *secrets
+	// templates maps the IDs of template records to their paths.
+	templates map[int]string
+	// machine holds what templates are rendered with; nil when there are no
+	// templates.
+	machine *templateData
+}
+
+// loadCodec returns the codec for the keys recorded in state.db, the
+// secrets of this machine and the template records, or nil when there are
+// none of them.
+func loadCodec() (*fileCodec, error) {
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		return nil, err
+	}
+	defer database.Close()
+	if err := db.EnsureRecipientsTable(database); err != nil {
+		return nil, err
+	}
+	stored, err := db.GetRecipients(database)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.EnsureFilesTable(database); err != nil {
+		return nil, err
+	}
+	records, err := db.GetAllFilePaths(database)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := newCodec(stored, records)
+	if err == nil && codec == nil {
+		// A live copy left from before would be out of date by the time
+		// it is used again
+		err = os.RemoveAll(filepath.Join(shared.FindHomeDir(), shared.GetDotSyncPlainDir(), "files"))
+	}
+	return codec, err
+}
+
+// peekCodec returns the codec like loadCodec, for dry runs: it neither
+// creates the tables it reads nor removes a live copy that is out of date.
+func peekCodec() (*fileCodec, error) {
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		return nil, err
+	}
+	defer database.Close()
+	var stored []db.Recipient
+	if exists, err := db.HasTable(database, "recipients"); err != nil {
+		return nil, err
+	} else if exists {
+		if stored, err = db.GetRecipients(database); err != nil {
+			return nil, err
+		}
+	}
+	var records []db.FileRecord
+	if exists, err := db.HasTable(database, "files"); err != nil {
+		return nil, err
+	} else if exists {
+		if records, err = db.GetAllFilePaths(database); err != nil {
+			return nil, err
+		}
+	}
+	return newCodec(stored, records)
+}
+
+// newCodec returns the codec for the stored recipients, the secrets of this
+// machine and the template records, or nil when there are none of them.
+func newCodec(stored []db.Recipient, records []db.FileRecord) (*fileCodec, error) {
+	codec := &fileCodec{templates: map[int]string{}}
+	for _, rec := range records {
+		if rec.Template {
+			codec.templates[rec.ID] = rec.Path
+		}
+	}
+	var err error
+	if codec.secrets, err = loadSecrets(); err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 && codec.secrets == nil && len(codec.templates) == 0 {
+		return nil, nil
+	}
+
+	for _, r := range stored {
+		recipient, err := age.ParseX25519Recipient(r.Key)
+		if err != nil {
+			return nil, err
+		}
+		codec.recipients = append(codec.recipients, recipient)
+	}
+	if codec.identities, err = loadIdentities(); err != nil {
+		return nil, err
+	}
+	if len(codec.templates) > 0 {
+		if codec.machine, err = loadTemplateData(); err != nil {
+			return nil, err
+		}
+		// Templates report the secrets they miss even without any
+		if codec.secrets == nil {
+			codec.secrets = newSecrets(map[string]secretEntry{})
+		}
+	}
+	return codec, nil
+}
+
+// stagingFilesDir returns the directory that holds the stored copy of each
+// record, files/<id>, as the commands read and write it.
+func stagingFilesDir(codec *fileCodec) string {
+	if codec == nil {
+		return filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir())
+	}
+	return filepath.Join(shared.FindHomeDir(), shared.GetDotSyncPlainDir(), "files")
+}
+
+func removePlainCopy(id int) error {
+	return os.RemoveAll(filepath.Join(shared.FindHomeDir(), shared.GetDotSyncPlainDir(), "files", fmt.Sprintf("%d", id)))
+}
+
+// ensurePlain converts files/ when there is no live copy yet, such as right
+// after a key or secret was set up.
+func (c *fileCodec) ensurePlain() error {
+	if c == nil || shared.PathExists(stagingFilesDir(c)) {
+		return nil
+	}
+	return c.openStaging()
+}
+
+// planFilesDir returns the directory dry runs read the stored copy of each
+// record from without writing it: the live copy when there is one, or else
+// one converted from files/ into a temporary directory, which cleanup
+// removes.
+func (c *fileCodec) planFilesDir() (dir string, cleanup func(), err error) {
+	dir = stagingFilesDir(c)
+	if c == nil || shared.PathExists(dir) {
+		return dir, func() {}, nil
+	}
+	tmp, err := os.MkdirTemp("", "dot-sync-plan-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(tmp) }
+	dir = filepath.Join(tmp, "files")
+	filesDir := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir())
+	if shared.PathExists(filesDir) {
+		err = shared.CopyDir(filesDir, dir)
+	} else {
+		err = shared.EnsureDir(dir)
+	}
+	if err == nil {
+		err = c.openFiles(dir)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// openStaging replaces the live copy with the contents of files/.
+func (c *fileCodec) openStaging() error {
+	if c == nil {
+		return nil
+	}
+	plain := stagingFilesDir(c)
+	next := plain + ".new"
+	if err := os.RemoveAll(next); err != nil {
+		return err
+	}
+	filesDir := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir())
+	if shared.PathExists(filesDir) {
+		if err := shared.CopyDir(filesDir, next); err != nil {
+			os.RemoveAll(next)
+			return err
+		}
+	} else if err := shared.EnsureDir(next); err != nil {
+		return err
+	}
+	if err := c.openFiles(next); err != nil {
+		os.RemoveAll(next)
+		return err
+	}
+	if err := os.RemoveAll(plain); err != nil {
+		return err
+	}
+	return os.Rename(next, plain)
+}
+
+// sealRecords converts the live copies of records into files/, encrypting
+// those of the records marked encrypted. A template already in files/ is
+// kept: the live copy is its output.
+func (c *fileCodec) sealRecords(records []db.FileRecord) error {
+	if c == nil {
+		return nil
+	}
+	filesDir := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir())
+	for _, rec := range records {
+		id := fmt.Sprintf("%d", rec.ID)
+		if _, err := os.Lstat(filepath.Join(filesDir, id)); err == nil && rec.Template {
+			continue
+		}
+		plain := filepath.Join(stagingFilesDir(c), id)
+		if _, err := os.Lstat(plain); os.IsNotExist(err) {
+			if err := os.RemoveAll(filepath.Join(filesDir, id)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.sealTree(plain, filepath.Join(filesDir, id), rec.Encrypted); err != nil {
+			return fmt.Errorf("failed to store %s: %w", rec.Path, err)
+		}
+	}
+	return nil
+}
+
+// sealTree makes dst the stored form of src, a file, directory or symlink,
+// with its files encrypted if encrypt is set. Symlinks are copied as they
+// are.
+func (c *fileCodec) sealTree(src, dst string, encrypt bool) error {
+	if err := removeMissing(src, dst); err != nil {
+		return err
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return shared.EnsureDir(target)
+		case d.Type()&fs.ModeSymlink != 0:
+			return shared.CopyLink(path, target)
+		}
+		return c.sealFile(path, target, encrypt)
+	})
+}
+
+// sealFile writes the stored form of src to dst, with secrets replaced by
+// placeholders and encrypted if encrypt is set, unless dst already holds the
+// same contents in that form.
+func (c *fileCodec) sealFile(src, dst string, encrypt bool) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	live, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	// current is what dst holds before encryption, and sealed whether it is
+	// already encrypted or not as asked
+	var current []byte
+	sealed := false
+	if stored, err := os.ReadFile(dst); err == nil {
+		switch {
+		case !isEncrypted(stored):
+			current, sealed = stored, !encrypt
+		case encrypt:
+			current, err = decryptWith(stored, c.identities)
+			sealed = err == nil
+		}
+	}
+	plaintext, err := c.secrets.hide(live, current)
+	if err != nil {
+		return err
+	}
+	if sealed && bytes.Equal(current, plaintext) {
+		return os.Chmod(dst, info.Mode().Perm())
+	}
+	contents := plaintext
+	if encrypt {
+		if contents, err = encryptFor(plaintext, c.recipients); err != nil {
+			return err
+		}
+	}
+	if err := shared.EnsureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	// Replace a link or directory that was stored here before
+	if info, err := os.Lstat(dst); err == nil && !info.Mode().IsRegular() {
+		if err := os.RemoveAll(dst); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(dst, contents, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chmod(dst, info.Mode().Perm())
+}
+
+// removeMissing deletes the entries of dst that src does not have, or has
+// as another kind of entry.
+func removeMissing(src, dst string) error {
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return nil
+	}
+	var stale []string
+	err := filepath.WalkDir(dst, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(filepath.Join(src, rel))
+		if err == nil && info.IsDir() == d.IsDir() && (info.Mode()&fs.ModeSymlink != 0) == (d.Type()&fs.ModeSymlink != 0) {
+			return nil
+		}
+		stale = append(stale, path)
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hideSecrets replaces the known secret values in data with placeholders,
+// given the stored form of data, if any, as for secrets.hide.
+func (c *fileCodec) hideSecrets(data, stored []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	return c.secrets.hide(data, stored)
+}
+
+// missingSecrets returns the names of the placeholders openFiles found no
+// value for.
+func (c *fileCodec) missingSecrets() []string {
+	if c == nil {
+		return nil
+	}
+	return c.secrets.missingNames()
+}
+
+// openFiles converts the stored files below dir, which may be an exported
+// revision holding a <id> entry per record, to their live form in place: it
+// decrypts them, renders templates and fills in the secret placeholders of
+// the other files. Files stored before encryption was set up are not
+// decrypted.
+func (c *fileCodec) openFiles(dir string) error {
+	if c == nil || !shared.PathExists(dir) {
+		return nil
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		live := data
+		if isEncrypted(data) {
+			if len(c.identities) == 0 {
+				return errNoKey
+			}
+			if live, err = decryptWith(data, c.identities); err != nil {
+				return fmt.Errorf("failed to decrypt %s: %w", path, err)
+			}
+		}
+		if name, ok := c.templateName(dir, path); ok {
+			live, err = c.render(name, live)
+		} else {
+			live, err = c.secrets.fill(live)
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(live, data) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, live, info.Mode().Perm())
+	})
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RemoteActivity records when this machine last pushed to and pulled from a
+// remote. It lives in local.db, since every machine has its own; zero times
+// mean never.
+type RemoteActivity struct {
+	LastPush time.Time
+	LastPull time.Time
+}
+
+func EnsureRemoteActivityTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS remote_activity (
+		name TEXT PRIMARY KEY,
+		last_push INTEGER NOT NULL DEFAULT 0,
+		last_pull INTEGER NOT NULL DEFAULT 0
+	)`)
+	return err
+}
+
+func RecordRemotePush(db *sql.DB, name string, at time.Time) error {
+	_, err := db.Exec(`INSERT INTO remote_activity (name, last_push) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET last_push = excluded.last_push`, name, at.Unix())
+	return err
+}
+
+func RecordRemotePull(db *sql.DB, name string, at time.Time) error {
+	_, err := db.Exec(`INSERT INTO remote_activity (name, last_pull) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET last_pull = excluded.last_pull`, name, at.Unix())
+	return err
+}
+
+// GetRemoteActivity returns the activity recorded for a remote, which is
+// empty when nothing was recorded yet.
+func GetRemoteActivity(db *sql.DB, name string) (RemoteActivity, error) {
+	var push, pull int64
+	err := db.QueryRow(`SELECT last_push, last_pull FROM remote_activity WHERE name = ?`, name).Scan(&push, &pull)
+	if err == sql.ErrNoRows {
+		return RemoteActivity{}, nil
+	}
+	if err != nil {
+		return RemoteActivity{}, err
+	}
+	var activity RemoteActivity
+	if push != 0 {
+		activity.LastPush = time.Unix(push, 0)
+	}
+	if pull != 0 {
+		activity.LastPull = time.Unix(pull, 0)
+	}
+	return activity, nil
+}
+
+func DeleteRemoteActivity(db *sql.DB, name string) error {
+	_, err := db.Exec(`DELETE FROM remote_activity WHERE name = ?`, name)
+	return err
+}
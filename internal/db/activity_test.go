@@ -0,0 +1,45 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestRemoteActivity(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	if err := EnsureRemoteActivityTable(db); err != nil {
+		t.Fatalf("EnsureRemoteActivityTable failed: %v", err)
+	}
+
+	if got, err := GetRemoteActivity(db, "origin"); err != nil || !got.LastPush.IsZero() || !got.LastPull.IsZero() {
+		t.Errorf("expected no activity, got %+v %v", got, err)
+	}
+
+	pushed := time.Unix(1700000000, 0)
+	pulled := pushed.Add(time.Hour)
+	if err := RecordRemotePush(db, "origin", pushed); err != nil {
+		t.Fatalf("RecordRemotePush failed: %v", err)
+	}
+	if err := RecordRemotePull(db, "origin", pulled); err != nil {
+		t.Fatalf("RecordRemotePull failed: %v", err)
+	}
+	RecordRemotePush(db, "backup", pulled)
+	got, err := GetRemoteActivity(db, "origin")
+	if err != nil || !got.LastPush.Equal(pushed) || !got.LastPull.Equal(pulled) {
+		t.Errorf("expected both times to be kept, got %+v %v", got, err)
+	}
+
+	if err := DeleteRemoteActivity(db, "origin"); err != nil {
+		t.Fatalf("DeleteRemoteActivity failed: %v", err)
+	}
+	if got, _ := GetRemoteActivity(db, "origin"); !got.LastPush.IsZero() {
+		t.Errorf("expected the activity to be deleted, got %+v", got)
+	}
+	if got, _ := GetRemoteActivity(db, "backup"); !got.LastPush.Equal(pulled) {
+		t.Errorf("expected other remotes to be kept, got %+v", got)
+	}
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+type BackupSet struct {
+	ID        int
+	Name      string
+	CreatedAt time.Time
+	FileCount int
+}
+
+type BackupFile struct {
+	ID    int
+	SetID int
+	// Path is the live location the file was copied from
+	Path string
+	// BackupPath is the location of the copy, relative to the set directory
+	BackupPath string
+}
+
+func EnsureBackupTables(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS backup_sets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE,
+		created_at INTEGER
+	)`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS backup_files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		set_id INTEGER REFERENCES backup_sets(id),
+		path TEXT,
+		backup_path TEXT
+	)`)
+	return err
+}
+
+func InsertBackupSet(db *sql.DB, name string, createdAt time.Time) (int, error) {
+	res, err := db.Exec(`INSERT INTO backup_sets (name, created_at) VALUES (?, ?)`, name, createdAt.Unix())
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func InsertBackupFile(db *sql.DB, setID int, path, backupPath string) error {
+	// Store paths portably like the files table does
+	_, err := db.Exec(`INSERT INTO backup_files (set_id, path, backup_path) VALUES (?, ?, ?)`,
+		setID, shared.ToStoragePath(path), backupPath)
+	return err
+}
+
+func GetBackupSets(db *sql.DB) ([]BackupSet, error) {
+	rows, err := db.Query(`SELECT s.id, s.name, s.created_at, COUNT(f.id)
+		FROM backup_sets s LEFT JOIN backup_files f ON f.set_id = s.id
+		GROUP BY s.id ORDER BY s.created_at DESC, s.id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sets []BackupSet
+	for rows.Next() {
+		var set BackupSet
+		var createdAt int64
+		if err := rows.Scan(&set.ID, &set.Name, &createdAt, &set.FileCount); err != nil {
+			return nil, err
+		}
+		set.CreatedAt = time.Unix(createdAt, 0)
+		sets = append(sets, set)
+	}
+	return sets, rows.Err()
+}
+
+func GetBackupSetByName(db *sql.DB, name string) (BackupSet, error) {
+	var set BackupSet
+	var createdAt int64
+	row := db.QueryRow(`SELECT s.id, s.name, s.created_at, COUNT(f.id)
+		FROM backup_sets s LEFT JOIN backup_files f ON f.set_id = s.id
+		WHERE s.name = ? GROUP BY s.id`, name)
+	if err := row.Scan(&set.ID, &set.Name, &createdAt, &set.FileCount); err != nil {
+		return BackupSet{}, err
+	}
+	set.CreatedAt = time.Unix(createdAt, 0)
+	return set, nil
+}
+
+func GetBackupFiles(db *sql.DB, setID int) ([]BackupFile, error) {
+	rows, err := db.Query(`SELECT id, set_id, path, backup_path FROM backup_files WHERE set_id = ? ORDER BY id`, setID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []BackupFile
+	for rows.Next() {
+		var file BackupFile
+		if err := rows.Scan(&file.ID, &file.SetID, &file.Path, &file.BackupPath); err != nil {
+			return nil, err
+		}
+		file.Path = shared.FromStoragePath(file.Path)
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
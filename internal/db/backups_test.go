@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestOpenLocalDB(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	temp := t.TempDir()
+	os.Setenv("HOME", temp)
+	defer os.Setenv("HOME", oldHome)
+
+	os.MkdirAll(filepath.Join(temp, ".dot-sync"), 0700)
+	db, err := OpenLocalDB()
+	if err != nil {
+		t.Fatalf("OpenLocalDB failed: %v", err)
+	}
+	defer db.Close()
+	if err := EnsureBackupTables(db); err != nil {
+		t.Fatalf("EnsureBackupTables failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(temp, ".dot-sync", "local.db")); err != nil {
+		t.Errorf("expected local.db to be created: %v", err)
+	}
+}
+
+func TestBackupSets(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", "/home/tester")
+	defer os.Setenv("HOME", oldHome)
+
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	if err := EnsureBackupTables(db); err != nil {
+		t.Fatalf("EnsureBackupTables failed: %v", err)
+	}
+
+	older, err := InsertBackupSet(db, "20260101-120000", time.Unix(1000, 0))
+	if err != nil {
+		t.Fatalf("InsertBackupSet failed: %v", err)
+	}
+	newer, _ := InsertBackupSet(db, "20260102-120000", time.Unix(2000, 0))
+	if err := InsertBackupFile(db, older, "/home/tester/.zshrc", "HOME/.zshrc"); err != nil {
+		t.Fatalf("InsertBackupFile failed: %v", err)
+	}
+	InsertBackupFile(db, older, "/etc/hosts", "etc/hosts")
+
+	sets, err := GetBackupSets(db)
+	if err != nil {
+		t.Fatalf("GetBackupSets failed: %v", err)
+	}
+	if len(sets) != 2 || sets[0].ID != newer || sets[1].ID != older {
+		t.Fatalf("expected newest set first, got %+v", sets)
+	}
+	if sets[1].FileCount != 2 || sets[0].FileCount != 0 {
+		t.Errorf("unexpected file counts: %+v", sets)
+	}
+
+	set, err := GetBackupSetByName(db, "20260101-120000")
+	if err != nil || set.ID != older {
+		t.Fatalf("GetBackupSetByName failed: %v, %+v", err, set)
+	}
+	if _, err := GetBackupSetByName(db, "missing"); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for missing set, got %v", err)
+	}
+
+	files, err := GetBackupFiles(db, older)
+	if err != nil {
+		t.Fatalf("GetBackupFiles failed: %v", err)
+	}
+	if len(files) != 2 || files[0].Path != "/home/tester/.zshrc" || files[0].BackupPath != "HOME/.zshrc" {
+		t.Errorf("unexpected backup files: %+v", files)
+	}
+
+	// Paths are stored portably
+	var stored string
+	db.QueryRow("SELECT path FROM backup_files WHERE id = ?", files[0].ID).Scan(&stored)
+	if stored != "HOME/.zshrc" {
+		t.Errorf("expected portable stored path, got %q", stored)
+	}
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"strings"
@@ -12,11 +13,37 @@ import (
 
 const dotSyncDBName = ".dot-sync/state.db"
 
+// localDBName holds state specific to this machine. Unlike state.db it is
+// never pushed to storage.
+const localDBName = ".dot-sync/local.db"
+
 type FileRecord struct {
 	ID   int
 	Path string
+	// Exclude holds gitignore-style patterns for files inside a tracked
+	// directory that are not synced.
+	Exclude []string
+	// Symlinks is the symlink policy of the record; "" means the default.
+	Symlinks string
+	// Encrypted records are stored encrypted to the recipients.
+	Encrypted bool
+	// Template records are stored as a text/template that is rendered for
+	// each machine.
+	Template bool
+}
+
+// fileColumns are columns added to the files table after its first release.
+// Databases created by older versions, including ones pulled from another
+// machine, gain them the next time they are read.
+var fileColumns = []struct{ name, definition string }{
+	{"exclude", "TEXT NOT NULL DEFAULT ''"},
+	{"symlinks", "TEXT NOT NULL DEFAULT ''"},
+	{"encrypted", "INTEGER NOT NULL DEFAULT 0"},
+	{"template", "INTEGER NOT NULL DEFAULT 0"},
 }
 
+const fileRecordColumns = "id, path, exclude, symlinks, encrypted, template"
+
 func OpenDotSyncDB() (*sql.DB, error) {
 	homeDir := shared.FindHomeDir()
 	if homeDir == "" {
@@ -26,11 +53,150 @@ func OpenDotSyncDB() (*sql.DB, error) {
 	return sql.Open("sqlite3", dbPath)
 }
 
+// OpenDotSyncDBAt opens a copy of state.db at path, such as the one staged in
+// a repository.
+func OpenDotSyncDBAt(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", path)
+}
+
+func OpenLocalDB() (*sql.DB, error) {
+	homeDir := shared.FindHomeDir()
+	if homeDir == "" {
+		return nil, fmt.Errorf("could not determine home directory")
+	}
+	dbPath := filepath.Join(homeDir, localDBName)
+	return sql.Open("sqlite3", dbPath)
+}
+
 func EnsureFilesTable(db *sql.DB) error {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS files (id INTEGER PRIMARY KEY AUTOINCREMENT, path TEXT)`)
+	if err != nil {
+		return err
+	}
+	return migrateFilesTable(db)
+}
+
+// migrateFilesTable adds any of fileColumns missing from an existing files
+// table.
+func migrateFilesTable(db *sql.DB) error {
+	return addMissingColumns(db, "files", fileColumns)
+}
+
+// addMissingColumns adds any of columns missing from an existing table.
+func addMissingColumns(db *sql.DB, table string, columns []struct{ name, definition string }) error {
+	existing, err := tableColumns(db, table)
+	if err != nil {
+		return err
+	}
+	// No table yet: queries report that on their own
+	if len(existing) == 0 {
+		return nil
+	}
+	for _, col := range columns {
+		if existing[col.name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, col.name, col.definition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the names of the columns of table, none if it does
+// not exist.
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	return existing, rows.Err()
+}
+
+// HasTable reports whether table exists, for readers that must not create
+// it.
+func HasTable(db *sql.DB, table string) (bool, error) {
+	existing, err := tableColumns(db, table)
+	return len(existing) > 0, err
+}
+
+// scanFileRecords reads rows selected with fileRecordColumns.
+func scanFileRecords(rows *sql.Rows) ([]FileRecord, error) {
+	defer rows.Close()
+	var records []FileRecord
+	for rows.Next() {
+		var rec FileRecord
+		var exclude string
+		if err := rows.Scan(&rec.ID, &rec.Path, &exclude, &rec.Symlinks, &rec.Encrypted, &rec.Template); err != nil {
+			return nil, err
+		}
+		// Convert storage path back to absolute path when retrieving
+		rec.Path = shared.FromStoragePath(rec.Path)
+		rec.Exclude = splitPatterns(exclude)
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// SetFileExcludes replaces the exclude patterns of the record with the given id.
+func SetFileExcludes(db *sql.DB, id int, patterns []string) error {
+	if err := migrateFilesTable(db); err != nil {
+		return err
+	}
+	_, err := db.Exec(`UPDATE files SET exclude = ? WHERE id = ?`, strings.Join(patterns, "\n"), id)
+	return err
+}
+
+// SetFileSymlinks sets the symlink policy of the record with the given id.
+func SetFileSymlinks(db *sql.DB, id int, policy string) error {
+	if err := migrateFilesTable(db); err != nil {
+		return err
+	}
+	_, err := db.Exec(`UPDATE files SET symlinks = ? WHERE id = ?`, policy, id)
+	return err
+}
+
+// SetFileEncrypted sets whether the record with the given id is stored
+// encrypted.
+func SetFileEncrypted(db *sql.DB, id int, encrypted bool) error {
+	if err := migrateFilesTable(db); err != nil {
+		return err
+	}
+	_, err := db.Exec(`UPDATE files SET encrypted = ? WHERE id = ?`, encrypted, id)
+	return err
+}
+
+// SetFileTemplate sets whether the record with the given id is stored as a
+// template.
+func SetFileTemplate(db *sql.DB, id int, template bool) error {
+	if err := migrateFilesTable(db); err != nil {
+		return err
+	}
+	_, err := db.Exec(`UPDATE files SET template = ? WHERE id = ?`, template, id)
 	return err
 }
 
+func splitPatterns(joined string) []string {
+	if joined == "" {
+		return nil
+	}
+	return strings.Split(joined, "\n")
+}
+
 func InsertFile(db *sql.DB, path string) error {
 	// Convert absolute path to storage path before inserting
 	storagePath := shared.ToStoragePath(path)
@@ -65,50 +231,264 @@ func InsertFiles(db *sql.DB, paths []string) error {
 }
 
 func GetAllFilePaths(db *sql.DB) ([]FileRecord, error) {
-	rows, err := db.Query("SELECT id, path FROM files")
-	if err != nil {
+	if err := migrateFilesTable(db); err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	var records []FileRecord
-	for rows.Next() {
-		var rec FileRecord
-		if err := rows.Scan(&rec.ID, &rec.Path); err != nil {
-			return nil, err
-		}
-		// Convert storage path back to absolute path when retrieving
-		rec.Path = shared.FromStoragePath(rec.Path)
-		records = append(records, rec)
+	rows, err := db.Query("SELECT " + fileRecordColumns + " FROM files")
+	if err != nil {
+		return nil, err
 	}
-	return records, rows.Err()
+	return scanFileRecords(rows)
+}
+
+// StorageRemote is a storage backend configured under a name. Sync and pull
+// use the default remote unless told otherwise.
+type StorageRemote struct {
+	ID          int
+	Name        string
+	StorageType string
+	Remote      string
+	IsDefault   bool
+	// Options holds the provider's settings beyond the remote, as given to
+	// 'storage init' or 'storage add'.
+	Options map[string]string
 }
 
+// storageColumns are columns added to the storage_provider table after its
+// first release, when it held a single unnamed provider.
+var storageColumns = []struct{ name, definition string }{
+	{"name", "TEXT"},
+	{"is_default", "INTEGER NOT NULL DEFAULT 0"},
+	{"options", "TEXT NOT NULL DEFAULT ''"},
+}
+
+const storageRemoteColumns = "id, name, storage_type, remote, is_default, options"
+
+// DefaultRemoteName is the name of the remote set up by 'storage init'.
+const DefaultRemoteName = "origin"
+
 func EnsureStorageTable(db *sql.DB) error {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS storage_provider (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		storage_type TEXT,
-		remote TEXT
+		remote TEXT,
+		name TEXT,
+		is_default INTEGER NOT NULL DEFAULT 0,
+		options TEXT NOT NULL DEFAULT ''
 	)`)
+	if err != nil {
+		return err
+	}
+	if err := addMissingColumns(db, "storage_provider", storageColumns); err != nil {
+		return err
+	}
+	return nameStorageRemotes(db)
+}
+
+// nameStorageRemotes names the providers recorded before remotes had names:
+// the latest one becomes the default remote.
+func nameStorageRemotes(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id FROM storage_provider WHERE name IS NULL OR name = '' ORDER BY id DESC`)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		name, err := unusedRemoteName(db, DefaultRemoteName)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(`UPDATE storage_provider SET name = ? WHERE id = ?`, name, id); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`UPDATE storage_provider SET is_default = 1
+		WHERE NOT EXISTS (SELECT 1 FROM storage_provider WHERE is_default = 1)
+		AND id = (SELECT MAX(id) FROM storage_provider)`)
 	return err
 }
 
-func InsertStorageProvider(db *sql.DB, storageType, remote string) error {
-	_, err := db.Exec(`INSERT INTO storage_provider (storage_type, remote) VALUES (?, ?)`, storageType, remote)
+// unusedRemoteName returns name, or name-2, name-3... if it is taken.
+func unusedRemoteName(db *sql.DB, name string) (string, error) {
+	candidate := name
+	for i := 2; ; i++ {
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM storage_provider WHERE name = ?`, candidate).Scan(&count); err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+func scanStorageRemote(row interface{ Scan(...any) error }) (StorageRemote, error) {
+	var r StorageRemote
+	var name sql.NullString
+	var options string
+	if err := row.Scan(&r.ID, &name, &r.StorageType, &r.Remote, &r.IsDefault, &options); err != nil {
+		return StorageRemote{}, err
+	}
+	r.Name = name.String
+	if options != "" {
+		if err := json.Unmarshal([]byte(options), &r.Options); err != nil {
+			return StorageRemote{}, fmt.Errorf("invalid options of remote %s: %w", r.Name, err)
+		}
+	}
+	return r, nil
+}
+
+// ListStorageRemotes returns the configured remotes in the order they were
+// added.
+func ListStorageRemotes(db *sql.DB) ([]StorageRemote, error) {
+	rows, err := db.Query("SELECT " + storageRemoteColumns + " FROM storage_provider ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var remotes []StorageRemote
+	for rows.Next() {
+		r, err := scanStorageRemote(rows)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, r)
+	}
+	return remotes, rows.Err()
+}
+
+// GetStorageRemote returns the remote with the given name, or sql.ErrNoRows.
+func GetStorageRemote(db *sql.DB, name string) (StorageRemote, error) {
+	return scanStorageRemote(db.QueryRow("SELECT "+storageRemoteColumns+" FROM storage_provider WHERE name = ?", name))
+}
+
+// GetDefaultStorageRemote returns the default remote, or sql.ErrNoRows when
+// none is configured.
+func GetDefaultStorageRemote(db *sql.DB) (StorageRemote, error) {
+	return scanStorageRemote(db.QueryRow("SELECT " + storageRemoteColumns + " FROM storage_provider ORDER BY is_default DESC, id DESC LIMIT 1"))
+}
+
+// AddStorageRemote adds a named remote. The first remote becomes the default.
+func AddStorageRemote(db *sql.DB, name, storageType, remote string) error {
+	if _, err := GetStorageRemote(db, name); err == nil {
+		return fmt.Errorf("remote %q already exists", name)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO storage_provider (name, storage_type, remote, is_default)
+		VALUES (?, ?, ?, NOT EXISTS (SELECT 1 FROM storage_provider))`, name, storageType, remote)
+	return err
+}
+
+// UpdateStorageRemote changes the provider and address of a named remote.
+func UpdateStorageRemote(db *sql.DB, name, storageType, remote string) error {
+	res, err := db.Exec(`UPDATE storage_provider SET storage_type = ?, remote = ? WHERE name = ?`, storageType, remote, name)
+	if err != nil {
+		return err
+	}
+	return requireRemoteChanged(res, name)
+}
+
+// SetStorageRemoteOptions replaces the provider settings of a named remote.
+func SetStorageRemoteOptions(db *sql.DB, name string, options map[string]string) error {
+	encoded := ""
+	if len(options) > 0 {
+		data, err := json.Marshal(options)
+		if err != nil {
+			return err
+		}
+		encoded = string(data)
+	}
+	res, err := db.Exec(`UPDATE storage_provider SET options = ? WHERE name = ?`, encoded, name)
+	if err != nil {
+		return err
+	}
+	return requireRemoteChanged(res, name)
+}
+
+// RemoveStorageRemote deletes a named remote. When it was the default, the
+// oldest remaining remote becomes the default.
+func RemoveStorageRemote(db *sql.DB, name string) error {
+	res, err := db.Exec(`DELETE FROM storage_provider WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	if err := requireRemoteChanged(res, name); err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE storage_provider SET is_default = 1
+		WHERE NOT EXISTS (SELECT 1 FROM storage_provider WHERE is_default = 1)
+		AND id = (SELECT MIN(id) FROM storage_provider)`)
+	return err
+}
+
+// SetDefaultStorageRemote makes the named remote the default.
+func SetDefaultStorageRemote(db *sql.DB, name string) error {
+	if _, err := GetStorageRemote(db, name); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no remote named %q", name)
+		}
+		return err
+	}
+	_, err := db.Exec(`UPDATE storage_provider SET is_default = (name = ?)`, name)
 	return err
 }
 
+func requireRemoteChanged(res sql.Result, name string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no remote named %q", name)
+	}
+	return nil
+}
+
+// InsertStorageProvider adds a provider and makes it the default remote,
+// named origin unless that name is taken.
+func InsertStorageProvider(db *sql.DB, storageType, remote string) error {
+	name, err := unusedRemoteName(db, DefaultRemoteName)
+	if err != nil {
+		return err
+	}
+	if err := AddStorageRemote(db, name, storageType, remote); err != nil {
+		return err
+	}
+	return SetDefaultStorageRemote(db, name)
+}
+
+// GetStorageProvider returns the provider type and address of the default
+// remote.
 func GetStorageProvider(db *sql.DB) (string, string, error) {
-	row := db.QueryRow("SELECT storage_type, remote FROM storage_provider ORDER BY id DESC LIMIT 1")
-	var storageType, remote string
-	if err := row.Scan(&storageType, &remote); err != nil {
+	r, err := GetDefaultStorageRemote(db)
+	if err != nil {
 		return "", "", err
 	}
-	return storageType, remote, nil
+	return r.StorageType, r.Remote, nil
 }
 
+// UpdateStorageProvider changes the provider and address of the default
+// remote.
 func UpdateStorageProvider(db *sql.DB, storageType, remote string) error {
-	_, err := db.Exec(`UPDATE storage_provider SET storage_type = ?, remote = ? WHERE id = (SELECT id FROM storage_provider ORDER BY id DESC LIMIT 1)`, storageType, remote)
-	return err
+	r, err := GetDefaultStorageRemote(db)
+	if err != nil {
+		return err
+	}
+	return UpdateStorageRemote(db, r.Name, storageType, remote)
 }
 
 func GetFileRecordsByPaths(db *sql.DB, paths []string) ([]FileRecord, error) {
@@ -122,8 +502,12 @@ func GetFileRecordsByPaths(db *sql.DB, paths []string) ([]FileRecord, error) {
 		storagePaths[i] = shared.ToStoragePath(path)
 	}
 
+	if err := migrateFilesTable(db); err != nil {
+		return nil, err
+	}
+
 	// Build the query with placeholders for the IN clause
-	query := "SELECT id, path FROM files WHERE path IN ("
+	query := "SELECT " + fileRecordColumns + " FROM files WHERE path IN ("
 	placeholders := make([]string, len(storagePaths))
 	args := make([]interface{}, len(storagePaths))
 
@@ -138,19 +522,7 @@ func GetFileRecordsByPaths(db *sql.DB, paths []string) ([]FileRecord, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var records []FileRecord
-	for rows.Next() {
-		var rec FileRecord
-		if err := rows.Scan(&rec.ID, &rec.Path); err != nil {
-			return nil, err
-		}
-		// Convert storage path back to absolute path when retrieving
-		rec.Path = shared.FromStoragePath(rec.Path)
-		records = append(records, rec)
-	}
-	return records, rows.Err()
+	return scanFileRecords(rows)
 }
 
 func DeleteFilesByIDs(db *sql.DB, ids []int) error {
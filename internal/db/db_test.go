@@ -3,6 +3,7 @@ package db
 import (
 	"database/sql"
 	"os"
+	"reflect"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -126,6 +127,67 @@ func TestGetAllFilePaths(t *testing.T) {
 	}
 }
 
+func TestSetFileExcludes(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	EnsureFilesTable(db)
+	InsertFile(db, "/tmp/nvim")
+	records, _ := GetAllFilePaths(db)
+	if len(records) != 1 || len(records[0].Exclude) != 0 {
+		t.Fatalf("expected one record without excludes, got %+v", records)
+	}
+
+	if err := SetFileExcludes(db, records[0].ID, []string{"lazy-lock.json", "plugin/"}); err != nil {
+		t.Fatalf("SetFileExcludes failed: %v", err)
+	}
+	records, _ = GetFileRecordsByPaths(db, []string{"/tmp/nvim"})
+	if len(records) != 1 || !reflect.DeepEqual(records[0].Exclude, []string{"lazy-lock.json", "plugin/"}) {
+		t.Errorf("expected excludes to be stored, got %+v", records)
+	}
+
+	SetFileExcludes(db, records[0].ID, nil)
+	records, _ = GetAllFilePaths(db)
+	if len(records[0].Exclude) != 0 {
+		t.Errorf("expected excludes to be cleared, got %v", records[0].Exclude)
+	}
+}
+
+func TestSetFileSymlinks(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	EnsureFilesTable(db)
+	InsertFile(db, "/tmp/bin")
+	records, _ := GetAllFilePaths(db)
+	if records[0].Symlinks != "" {
+		t.Fatalf("expected no symlink policy by default, got %q", records[0].Symlinks)
+	}
+
+	if err := SetFileSymlinks(db, records[0].ID, "follow"); err != nil {
+		t.Fatalf("SetFileSymlinks failed: %v", err)
+	}
+	records, _ = GetFileRecordsByPaths(db, []string{"/tmp/bin"})
+	if len(records) != 1 || records[0].Symlinks != "follow" {
+		t.Errorf("expected symlink policy to be stored, got %+v", records)
+	}
+}
+
+func TestFilesTableMigration(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	// Layout written by earlier versions
+	db.SetMaxOpenConns(1)
+	db.Exec(`CREATE TABLE files (id INTEGER PRIMARY KEY AUTOINCREMENT, path TEXT)`)
+	db.Exec(`INSERT INTO files (path) VALUES ('/tmp/old')`)
+
+	records, err := GetAllFilePaths(db)
+	if err != nil {
+		t.Fatalf("expected old databases to be migrated, got %v", err)
+	}
+	if len(records) != 1 || records[0].Path != "/tmp/old" || records[0].Exclude != nil {
+		t.Errorf("unexpected records %+v", records)
+	}
+}
+
 func TestEnsureStorageTable(t *testing.T) {
 	db, _ := sql.Open("sqlite3", ":memory:")
 	defer db.Close()
@@ -371,3 +433,97 @@ func TestDeleteFilesByIDs(t *testing.T) {
 		t.Errorf("Expected 1 record after non-existent delete, got %d", len(recordsAfterNonExistent))
 	}
 }
+
+func TestStorageRemotes(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+
+	// A table from before remotes had names
+	db.Exec(`CREATE TABLE storage_provider (id INTEGER PRIMARY KEY AUTOINCREMENT, storage_type TEXT, remote TEXT)`)
+	db.Exec(`INSERT INTO storage_provider (storage_type, remote) VALUES ('git', 'https://example.com/repo.git')`)
+	if err := EnsureStorageTable(db); err != nil {
+		t.Fatalf("EnsureStorageTable failed: %v", err)
+	}
+	origin, err := GetDefaultStorageRemote(db)
+	if err != nil || origin.Name != DefaultRemoteName || !origin.IsDefault {
+		t.Fatalf("expected the old provider to become the default origin, got %+v %v", origin, err)
+	}
+
+	if err := AddStorageRemote(db, "backup", "s3", "s3://bucket"); err != nil {
+		t.Fatalf("AddStorageRemote failed: %v", err)
+	}
+	if err := AddStorageRemote(db, "backup", "local", "/mnt/usb"); err == nil {
+		t.Error("expected a duplicate name to be rejected")
+	}
+	remotes, err := ListStorageRemotes(db)
+	if err != nil || len(remotes) != 2 || remotes[1].Name != "backup" || remotes[1].IsDefault {
+		t.Fatalf("unexpected remotes %+v %v", remotes, err)
+	}
+
+	if err := SetDefaultStorageRemote(db, "backup"); err != nil {
+		t.Fatalf("SetDefaultStorageRemote failed: %v", err)
+	}
+	if storageType, remote, _ := GetStorageProvider(db); storageType != "s3" || remote != "s3://bucket" {
+		t.Errorf("expected backup to be the default, got %s %s", storageType, remote)
+	}
+	if err := UpdateStorageRemote(db, "origin", "git", "https://example.com/new.git"); err != nil {
+		t.Fatalf("UpdateStorageRemote failed: %v", err)
+	}
+	if r, _ := GetStorageRemote(db, "origin"); r.Remote != "https://example.com/new.git" || r.IsDefault {
+		t.Errorf("unexpected origin %+v", r)
+	}
+	if err := SetStorageRemoteOptions(db, "backup", map[string]string{"region": "eu-west-1"}); err != nil {
+		t.Fatalf("SetStorageRemoteOptions failed: %v", err)
+	}
+	if r, _ := GetStorageRemote(db, "backup"); r.Options["region"] != "eu-west-1" {
+		t.Errorf("expected the options to be recorded, got %+v", r)
+	}
+	if r, _ := GetStorageRemote(db, "origin"); r.Options != nil {
+		t.Errorf("expected origin to have no options, got %+v", r)
+	}
+
+	if err := RemoveStorageRemote(db, "backup"); err != nil {
+		t.Fatalf("RemoveStorageRemote failed: %v", err)
+	}
+	if r, _ := GetDefaultStorageRemote(db); r.Name != "origin" || !r.IsDefault {
+		t.Errorf("expected origin to become the default, got %+v", r)
+	}
+	if err := RemoveStorageRemote(db, "backup"); err == nil {
+		t.Error("expected removing a missing remote to fail")
+	}
+}
+
+func TestSetFileEncrypted(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	EnsureFilesTable(db)
+	InsertFile(db, "/tmp/.netrc")
+	records, _ := GetAllFilePaths(db)
+	if records[0].Encrypted {
+		t.Fatal("expected records not to be encrypted by default")
+	}
+	if err := SetFileEncrypted(db, records[0].ID, true); err != nil {
+		t.Fatalf("SetFileEncrypted failed: %v", err)
+	}
+	records, _ = GetFileRecordsByPaths(db, []string{"/tmp/.netrc"})
+	if len(records) != 1 || !records[0].Encrypted {
+		t.Errorf("expected the record to be encrypted, got %+v", records)
+	}
+}
+
+func TestSetFileTemplate(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	EnsureFilesTable(db)
+	InsertFiles(db, []string{"/tmp/.gitconfig", "/tmp/.zshrc"})
+	records, _ := GetAllFilePaths(db)
+	if err := SetFileTemplate(db, records[0].ID, true); err != nil {
+		t.Fatalf("SetFileTemplate failed: %v", err)
+	}
+	records, _ = GetAllFilePaths(db)
+	if len(records) != 2 || !records[0].Template || records[1].Template {
+		t.Errorf("expected only the first record to be a template, got %+v", records)
+	}
+}
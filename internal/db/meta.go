@@ -0,0 +1,122 @@
+package db
+
+import (
+	"database/sql"
+	"os"
+	"path"
+	"time"
+)
+
+// FileMeta is the metadata recorded for a file or directory of a record when
+// it is synced, so pull can restore what the storage backend drops.
+type FileMeta struct {
+	RecordID int
+	// Rel is the path relative to the record, "." for the record itself,
+	// using forward slashes.
+	Rel     string
+	Mode    os.FileMode
+	ModTime time.Time
+	IsDir   bool
+}
+
+func EnsureFileMetaTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS file_meta (
+		record_id INTEGER,
+		rel TEXT,
+		mode INTEGER,
+		mtime INTEGER,
+		is_dir INTEGER,
+		PRIMARY KEY (record_id, rel)
+	)`)
+	return err
+}
+
+// ReplaceFileMeta replaces the metadata recorded for rel and everything below
+// it in the record with metas.
+func ReplaceFileMeta(db *sql.DB, recordID int, rel string, metas []FileMeta) error {
+	if err := EnsureFileMetaTable(db); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		_, err = tx.Exec(`DELETE FROM file_meta WHERE record_id = ?`, recordID)
+	} else {
+		_, err = tx.Exec(`DELETE FROM file_meta WHERE record_id = ? AND (rel = ? OR rel LIKE ? ESCAPE '\')`,
+			recordID, rel, escapeLike(rel)+"/%")
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO file_meta (record_id, rel, mode, mtime, is_dir) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, meta := range metas {
+		isDir := 0
+		if meta.IsDir {
+			isDir = 1
+		}
+		if _, err := stmt.Exec(recordID, path.Clean(meta.Rel), uint32(meta.Mode), meta.ModTime.UnixNano(), isDir); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetFileMeta returns the metadata recorded for a record keyed by Rel. A
+// database without the table has no metadata.
+func GetFileMeta(db *sql.DB, recordID int) (map[string]FileMeta, error) {
+	if err := EnsureFileMetaTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT rel, mode, mtime, is_dir FROM file_meta WHERE record_id = ?`, recordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	metas := make(map[string]FileMeta)
+	for rows.Next() {
+		meta := FileMeta{RecordID: recordID}
+		var mode uint32
+		var mtime int64
+		var isDir int
+		if err := rows.Scan(&meta.Rel, &mode, &mtime, &isDir); err != nil {
+			return nil, err
+		}
+		meta.Mode = os.FileMode(mode)
+		meta.ModTime = time.Unix(0, mtime)
+		meta.IsDir = isDir != 0
+		metas[meta.Rel] = meta
+	}
+	return metas, rows.Err()
+}
+
+func DeleteFileMeta(db *sql.DB, recordIDs []int) error {
+	if err := EnsureFileMetaTable(db); err != nil {
+		return err
+	}
+	for _, id := range recordIDs {
+		if _, err := db.Exec(`DELETE FROM file_meta WHERE record_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func escapeLike(s string) string {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' || s[i] == '_' || s[i] == '\\' {
+			out = append(out, '\\')
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestFileMeta(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	mtime := time.Unix(1700000000, 123)
+	metas := []FileMeta{
+		{Rel: ".", Mode: 0700, ModTime: mtime, IsDir: true},
+		{Rel: "config", Mode: 0600, ModTime: mtime},
+		{Rel: "keys/id_ed25519", Mode: 0600, ModTime: mtime},
+		{Rel: "keys_backup", Mode: 0644, ModTime: mtime},
+	}
+	if err := ReplaceFileMeta(db, 1, ".", metas); err != nil {
+		t.Fatalf("ReplaceFileMeta failed: %v", err)
+	}
+	ReplaceFileMeta(db, 2, ".", []FileMeta{{Rel: ".", Mode: 0755, ModTime: mtime}})
+
+	got, err := GetFileMeta(db, 1)
+	if err != nil {
+		t.Fatalf("GetFileMeta failed: %v", err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("expected 4 entries, got %v", got)
+	}
+	if meta := got["config"]; meta.Mode != 0600 || !meta.ModTime.Equal(mtime) || meta.IsDir {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+	if !got["."].IsDir {
+		t.Error("expected the record directory to be marked as a directory")
+	}
+
+	// Replacing a subtree leaves siblings with a common prefix alone
+	if err := ReplaceFileMeta(db, 1, "keys", []FileMeta{{Rel: "keys/id_rsa", Mode: 0400, ModTime: mtime}}); err != nil {
+		t.Fatalf("ReplaceFileMeta failed: %v", err)
+	}
+	got, _ = GetFileMeta(db, 1)
+	if _, ok := got["keys/id_ed25519"]; ok {
+		t.Error("expected old entries below the subtree to be removed")
+	}
+	if got["keys/id_rsa"].Mode != 0400 || got["keys_backup"].Mode != 0644 {
+		t.Errorf("unexpected metadata after subtree replace: %v", got)
+	}
+
+	if err := DeleteFileMeta(db, []int{1}); err != nil {
+		t.Fatalf("DeleteFileMeta failed: %v", err)
+	}
+	if got, _ := GetFileMeta(db, 1); len(got) != 0 {
+		t.Errorf("expected metadata to be deleted, got %v", got)
+	}
+	if got, _ := GetFileMeta(db, 2); len(got) != 1 {
+		t.Errorf("expected other records to be kept, got %v", got)
+	}
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"database/sql"
+)
+
+// Recipient is a public key that stored files are encrypted to. Recipients
+// live in state.db, so every machine encrypts to the same keys.
+type Recipient struct {
+	Key   string
+	Label string
+}
+
+func EnsureRecipientsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS recipients (
+		key TEXT PRIMARY KEY,
+		label TEXT NOT NULL DEFAULT ''
+	)`)
+	return err
+}
+
+// AddRecipient records a recipient, keeping the label of one recorded
+// before.
+func AddRecipient(db *sql.DB, key, label string) error {
+	_, err := db.Exec(`INSERT INTO recipients (key, label) VALUES (?, ?) ON CONFLICT(key) DO NOTHING`, key, label)
+	return err
+}
+
+// GetRecipients returns the recipients in the order they were added.
+func GetRecipients(db *sql.DB) ([]Recipient, error) {
+	rows, err := db.Query(`SELECT key, label FROM recipients ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var recipients []Recipient
+	for rows.Next() {
+		var r Recipient
+		if err := rows.Scan(&r.Key, &r.Label); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, rows.Err()
+}
@@ -0,0 +1,29 @@
+package db
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestRecipients(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	if err := EnsureRecipientsTable(db); err != nil {
+		t.Fatalf("EnsureRecipientsTable failed: %v", err)
+	}
+	if got, err := GetRecipients(db); err != nil || len(got) != 0 {
+		t.Errorf("expected no recipients, got %v %v", got, err)
+	}
+	AddRecipient(db, "age1b", "laptop")
+	AddRecipient(db, "age1a", "desktop")
+	if err := AddRecipient(db, "age1b", "renamed"); err != nil {
+		t.Fatalf("AddRecipient failed: %v", err)
+	}
+	want := []Recipient{{"age1b", "laptop"}, {"age1a", "desktop"}}
+	if got, err := GetRecipients(db); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v %v", want, got, err)
+	}
+}
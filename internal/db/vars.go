@@ -0,0 +1,50 @@
+package db
+
+import "database/sql"
+
+// Template variables are values defined per machine, such as a work email
+// address, that templates refer to by name. They live in local.db, since
+// every machine has its own.
+
+func EnsureTemplateVarsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS template_vars (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`)
+	return err
+}
+
+func SetTemplateVar(db *sql.DB, name, value string) error {
+	_, err := db.Exec(`INSERT INTO template_vars (name, value) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET value = excluded.value`, name, value)
+	return err
+}
+
+// GetTemplateVars returns every template variable by name.
+func GetTemplateVars(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query(`SELECT name, value FROM template_vars`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	vars := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		vars[name] = value
+	}
+	return vars, rows.Err()
+}
+
+// DeleteTemplateVar removes a template variable and reports whether it
+// existed.
+func DeleteTemplateVar(db *sql.DB, name string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM template_vars WHERE name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
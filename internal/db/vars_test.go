@@ -0,0 +1,36 @@
+package db
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestTemplateVars(t *testing.T) {
+	db, _ := sql.Open("sqlite3", ":memory:")
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if err := EnsureTemplateVarsTable(db); err != nil {
+		t.Fatalf("EnsureTemplateVarsTable failed: %v", err)
+	}
+
+	SetTemplateVar(db, "email", "alice@example.com")
+	SetTemplateVar(db, "profile", "personal")
+	if err := SetTemplateVar(db, "email", "alice@work.example.com"); err != nil {
+		t.Fatalf("SetTemplateVar failed: %v", err)
+	}
+	vars, err := GetTemplateVars(db)
+	expected := map[string]string{"email": "alice@work.example.com", "profile": "personal"}
+	if err != nil || !reflect.DeepEqual(vars, expected) {
+		t.Errorf("expected %v, got %v %v", expected, vars, err)
+	}
+
+	if removed, err := DeleteTemplateVar(db, "profile"); err != nil || !removed {
+		t.Errorf("expected the variable to be removed, got %v %v", removed, err)
+	}
+	if removed, _ := DeleteTemplateVar(db, "profile"); removed {
+		t.Error("expected removing a missing variable to report so")
+	}
+}
@@ -11,15 +11,19 @@ import (
 )
 
 func NewDeleteCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "delete [files or directories]...",
 		Short: "Delete files from sync tracking and remove them from storage",
 		Args:  cobra.MinimumNArgs(1),
 		Run:   deleteHandler,
 	}
+	cmd.Flags().Bool("dry-run", false, "List what would be untracked and removed without changing anything")
+	return cmd
 }
 
 func deleteHandler(cmd *cobra.Command, args []string) {
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
 	database, err := db.OpenDotSyncDB()
 	if err != nil {
 		fmt.Println("Failed to open .dot-sync.db:", err)
@@ -27,9 +31,12 @@ func deleteHandler(cmd *cobra.Command, args []string) {
 	}
 	defer database.Close()
 
-	if err := db.EnsureFilesTable(database); err != nil {
-		fmt.Println("Failed to ensure files table:", err)
-		return
+	// A dry run leaves state.db as it is
+	if !dryRun {
+		if err := db.EnsureFilesTable(database); err != nil {
+			fmt.Println("Failed to ensure files table:", err)
+			return
+		}
 	}
 
 	// Convert args to full paths for consistency
@@ -50,6 +57,20 @@ func deleteHandler(cmd *cobra.Command, args []string) {
 	// Get .dot-sync/files directory path
 	dotSyncFilesPath := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir())
 
+	if dryRun {
+		fmt.Println("Dry run: nothing will be untracked or removed.")
+		fmt.Printf("Would delete %d file(s) from tracking:\n", len(records))
+		for _, record := range records {
+			filePath := filepath.Join(dotSyncFilesPath, fmt.Sprintf("%d", record.ID))
+			if shared.PathExists(filePath) {
+				fmt.Printf("  - %s (and its stored copy)\n", record.Path)
+			} else {
+				fmt.Printf("  - %s (no stored copy)\n", record.Path)
+			}
+		}
+		return
+	}
+
 	// Delete files from .dot-sync/files directory
 	var deletedPaths []string
 	var failedPaths []string
@@ -70,6 +91,13 @@ func deleteHandler(cmd *cobra.Command, args []string) {
 			}
 		}
 
+		if err := removeBaseCopy(record.ID); err != nil {
+			fmt.Printf("Warning: failed to remove synced copy of %s: %v\n", record.Path, err)
+		}
+		if err := removePlainCopy(record.ID); err != nil {
+			fmt.Printf("Warning: failed to remove live copy of %s: %v\n", record.Path, err)
+		}
+
 		deletedPaths = append(deletedPaths, record.Path)
 		deletedIDs = append(deletedIDs, record.ID)
 	}
@@ -80,6 +108,9 @@ func deleteHandler(cmd *cobra.Command, args []string) {
 			fmt.Printf("Failed to delete records from database: %v\n", err)
 			return
 		}
+		if err := db.DeleteFileMeta(database, deletedIDs); err != nil {
+			fmt.Printf("Warning: failed to delete recorded permissions: %v\n", err)
+		}
 	}
 
 	// Report results
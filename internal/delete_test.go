@@ -405,3 +405,47 @@ func TestDeleteHandlerDatabaseError(t *testing.T) {
 		t.Errorf("expected database error message, got %q", output)
 	}
 }
+
+func TestDeleteHandlerDryRun(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	tempHome := t.TempDir()
+	os.Setenv("HOME", tempHome)
+	defer os.Setenv("HOME", oldHome)
+
+	dotSyncFilesPath := filepath.Join(tempHome, ".dot-sync", "files")
+	os.MkdirAll(dotSyncFilesPath, 0700)
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	db.EnsureFilesTable(database)
+
+	testPath := "/home/user/.bashrc"
+	db.InsertFile(database, testPath)
+	records, _ := db.GetFileRecordsByPaths(database, []string{testPath})
+	stored := filepath.Join(dotSyncFilesPath, fmt.Sprintf("%d", records[0].ID))
+	os.WriteFile(stored, []byte("content"), 0644)
+
+	cmd := NewDeleteCmd()
+	cmd.Flags().Set("dry-run", "true")
+	var buf bytes.Buffer
+	orig := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	deleteHandler(cmd, []string{testPath})
+	w.Close()
+	os.Stdout = orig
+	buf.ReadFrom(r)
+	output := buf.String()
+
+	if !strings.Contains(output, "Would delete 1 file(s) from tracking:") || !strings.Contains(output, testPath+" (and its stored copy)") {
+		t.Errorf("expected planned deletion to be listed, got %q", output)
+	}
+	if _, err := os.Stat(stored); err != nil {
+		t.Errorf("expected stored copy to remain: %v", err)
+	}
+	if remaining, _ := db.GetAllFilePaths(database); len(remaining) != 1 {
+		t.Errorf("expected record to remain, got %d records", len(remaining))
+	}
+}
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/diff"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+	"github.com/tylerkeyes/dot-sync/storage"
+)
+
+func NewDiffCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff [files or directories]...",
+		Short: "Show differences between live dotfiles and their stored copies",
+		Run:   diffHandler,
+	}
+	cmd.Flags().Bool("remote", false, "Diff against the fetched remote revision instead of the local staging copy")
+	addSelectionFlags(cmd)
+	return cmd
+}
+
+func diffHandler(cmd *cobra.Command, args []string) {
+	dotSyncDir := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncDir())
+	useRemote, _ := cmd.Flags().GetBool("remote")
+
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		fmt.Println("Failed to open .dot-sync.db:", err)
+		return
+	}
+	defer database.Close()
+
+	if err := db.EnsureFilesTable(database); err != nil {
+		fmt.Println("Failed to ensure files table:", err)
+		return
+	}
+
+	records, err := db.GetAllFilePaths(database)
+	if err != nil {
+		fmt.Println("Failed to read file paths from database:", err)
+		return
+	}
+
+	selected := selectionFromCmd(cmd, args, records)
+	if len(selected) == 0 {
+		fmt.Println("No matching files found in tracking database.")
+		return
+	}
+
+	codec, err := loadCodec()
+	if err != nil {
+		fmt.Println("Failed to load keys and secrets:", err)
+		return
+	}
+	if err := codec.ensurePlain(); err != nil {
+		fmt.Println("Failed to read stored files:", err)
+		return
+	}
+
+	storedRoot := stagingFilesDir(codec)
+	storedLabel := "stored"
+	if useRemote {
+		sp, ok := storageProviderFromCmd(cmd)
+		if !ok {
+			fmt.Println("No storage provider configured. Please run 'dot-sync storage init' first.")
+			return
+		}
+		if err := sp.Fetch(dotSyncDir); err != nil {
+			fmt.Println("Failed to fetch from storage:", err)
+			return
+		}
+		snapshotDir, err := os.MkdirTemp("", "dot-sync-diff-")
+		if err != nil {
+			fmt.Println("Failed to create temporary directory:", err)
+			return
+		}
+		defer os.RemoveAll(snapshotDir)
+		if err := sp.ExportRevision(dotSyncDir, storage.RevisionRemote, snapshotDir); err != nil {
+			fmt.Println("Failed to read remote state:", err)
+			return
+		}
+		if err := codec.openFiles(snapshotDir); err != nil {
+			fmt.Println("Failed to read remote state:", err)
+			return
+		}
+		storedRoot = snapshotDir
+		storedLabel = "remote"
+	}
+
+	ignores, err := loadIgnoreSet()
+	if err != nil {
+		fmt.Println("Failed to read ignore file:", err)
+		return
+	}
+
+	changed := false
+	for _, sel := range selected {
+		stored := filepath.Join(storedRoot, fmt.Sprintf("%d", sel.ID))
+		tree := recordTreeOptions(ignores, sel.FileRecord)
+		rels := sel.relSubpaths()
+		if len(rels) == 0 {
+			rels = []string{"."}
+		}
+		for _, rel := range rels {
+			opts := tree
+			opts.Ignore = tree.Ignore.Within(rel)
+			live := filepath.Join(sel.Path, rel)
+			differs, err := printRecordDiff(live, filepath.Join(stored, rel), storedLabel, opts)
+			if err != nil {
+				fmt.Printf("Failed to diff %s: %v\n", live, err)
+				continue
+			}
+			changed = changed || differs
+		}
+	}
+
+	if !changed {
+		fmt.Println("No differences.")
+	}
+}
+
+// printRecordDiff prints the differences between a live path and its stored
+// copy, recursing into directories and treating their entries according to
+// opts. It reports whether anything differed.
+func printRecordDiff(live, stored, storedLabel string, opts shared.TreeOptions) (bool, error) {
+	liveInfo, liveErr := shared.StatWith(live, opts)
+	storedInfo, storedErr := shared.StatWith(stored, opts)
+	if liveErr != nil && !os.IsNotExist(liveErr) {
+		return false, liveErr
+	}
+	if storedErr != nil && !os.IsNotExist(storedErr) {
+		return false, storedErr
+	}
+
+	liveIsDir := liveErr == nil && liveInfo.IsDir()
+	storedIsDir := storedErr == nil && storedInfo.IsDir()
+	if !liveIsDir && !storedIsDir {
+		return printFileDiff(live, stored, storedLabel, opts)
+	}
+	if liveErr == nil && storedErr == nil && liveIsDir != storedIsDir {
+		fmt.Printf("%s: file on one side, directory on the other\n", live)
+		return true, nil
+	}
+
+	files := map[string]bool{}
+	for _, root := range []string{live, stored} {
+		if !shared.PathExists(root) {
+			continue
+		}
+		rels, err := shared.ListFilesWith(root, opts)
+		if err != nil {
+			return false, err
+		}
+		for _, rel := range rels {
+			files[rel] = true
+		}
+	}
+
+	changed := false
+	for _, rel := range sortedKeys(files) {
+		differs, err := printFileDiff(filepath.Join(live, rel), filepath.Join(stored, rel), storedLabel, opts)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || differs
+	}
+	return changed, nil
+}
+
+func printFileDiff(live, stored, storedLabel string, opts shared.TreeOptions) (bool, error) {
+	liveData, liveExists, err := readIfExists(live, opts)
+	if err != nil {
+		return false, err
+	}
+	storedData, storedExists, err := readIfExists(stored, opts)
+	if err != nil {
+		return false, err
+	}
+	if liveExists == storedExists && string(liveData) == string(storedData) {
+		return false, nil
+	}
+
+	fromName := live
+	if !liveExists {
+		fromName = "/dev/null"
+	}
+	toName := fmt.Sprintf("%s (%s)", live, storedLabel)
+	if !storedExists {
+		toName = "/dev/null"
+	}
+
+	if diff.IsBinary(liveData) || diff.IsBinary(storedData) {
+		fmt.Printf("Binary files %s and %s differ\n", fromName, toName)
+		return true, nil
+	}
+	fmt.Print(diff.Unified(fromName, toName, string(liveData), string(storedData)))
+	return true, nil
+}
+
+// readIfExists reads a file, describing symlinks that opts keeps as links
+// by their target.
+func readIfExists(path string, opts shared.TreeOptions) ([]byte, bool, error) {
+	info, err := shared.StatWith(path, opts)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := shared.LinkTarget(path)
+		if err != nil {
+			return nil, false, err
+		}
+		return []byte("symlink to " + target + "\n"), true, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
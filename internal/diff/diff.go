@@ -0,0 +1,163 @@
+package diff
+
+import (
+	"bytes"
+	"strings"
+)
+
+type OpKind int
+
+const (
+	Equal OpKind = iota
+	Delete
+	Insert
+)
+
+// Edit is one step of an edit script turning a into b. A is the index of the
+// line in a (Equal, Delete) and B the index of the line in b (Equal, Insert).
+type Edit struct {
+	Kind OpKind
+	A    int
+	B    int
+}
+
+// maxEditDistance bounds the work done by Lines. Inputs that differ by more
+// lines than this are reported as a full replacement.
+const maxEditDistance = 2000
+
+// SplitLines splits s into lines, keeping the trailing newline on each line
+// so that a missing newline at end of file is preserved.
+func SplitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// IsBinary reports whether data looks like binary content, using the same
+// heuristic as git: a NUL byte within the first 8000 bytes.
+func IsBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// Lines computes a shortest edit script turning a into b using the Myers
+// algorithm.
+func Lines(a, b []string) []Edit {
+	// Strip the common prefix and suffix, which is usually most of a dotfile
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []Edit
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, Edit{Kind: Equal, A: i, B: i})
+	}
+	for _, e := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		edits = append(edits, Edit{Kind: e.Kind, A: e.A + prefix, B: e.B + prefix})
+	}
+	for i := 0; i < suffix; i++ {
+		edits = append(edits, Edit{Kind: Equal, A: len(a) - suffix + i, B: len(b) - suffix + i})
+	}
+	return edits
+}
+
+func myers(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return replaceAll(n, m)
+	}
+
+	limit := n + m
+	if limit > maxEditDistance {
+		limit = maxEditDistance
+	}
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	// trace[d] holds the furthest reaching x for diagonals -d-1..d+1 before
+	// step d, which is all the backtracking needs
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= limit && !found; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return replaceAll(n, m)
+	}
+
+	var reversed []Edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, Edit{Kind: Equal, A: x, B: y})
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, Edit{Kind: Insert, A: x, B: prevY})
+			} else {
+				reversed = append(reversed, Edit{Kind: Delete, A: prevX, B: y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	edits := make([]Edit, len(reversed))
+	for i, e := range reversed {
+		edits[len(reversed)-1-i] = e
+	}
+	return edits
+}
+
+func replaceAll(n, m int) []Edit {
+	edits := make([]Edit, 0, n+m)
+	for i := 0; i < n; i++ {
+		edits = append(edits, Edit{Kind: Delete, A: i, B: 0})
+	}
+	for j := 0; j < m; j++ {
+		edits = append(edits, Edit{Kind: Insert, A: n, B: j})
+	}
+	return edits
+}
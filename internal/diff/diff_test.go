@@ -0,0 +1,147 @@
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// apply replays an edit script to check it really turns a into b.
+func apply(a, b []string, edits []Edit) []string {
+	var out []string
+	for _, e := range edits {
+		switch e.Kind {
+		case Equal:
+			out = append(out, a[e.A])
+		case Insert:
+			out = append(out, b[e.B])
+		}
+	}
+	return out
+}
+
+func TestSplitLines(t *testing.T) {
+	testCases := []struct {
+		in       string
+		expected []string
+	}{
+		{"", nil},
+		{"one", []string{"one"}},
+		{"one\n", []string{"one\n"}},
+		{"one\ntwo", []string{"one\n", "two"}},
+		{"one\n\ntwo\n", []string{"one\n", "\n", "two\n"}},
+	}
+	for _, tc := range testCases {
+		if got := SplitLines(tc.in); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("SplitLines(%q): expected %q, got %q", tc.in, tc.expected, got)
+		}
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	if IsBinary([]byte("plain text\n")) {
+		t.Error("expected text not to be binary")
+	}
+	if !IsBinary([]byte{'a', 0, 'b'}) {
+		t.Error("expected NUL byte to mark content as binary")
+	}
+}
+
+func TestLines(t *testing.T) {
+	testCases := []struct {
+		name string
+		a    string
+		b    string
+	}{
+		{"equal", "a\nb\nc\n", "a\nb\nc\n"},
+		{"insert", "a\nc\n", "a\nb\nc\n"},
+		{"delete", "a\nb\nc\n", "a\nc\n"},
+		{"replace", "a\nb\nc\n", "a\nx\nc\n"},
+		{"from empty", "", "a\nb\n"},
+		{"to empty", "a\nb\n", ""},
+		{"interleaved", "a\nb\nc\nd\ne\n", "b\nc\nx\ne\nf\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := SplitLines(tc.a), SplitLines(tc.b)
+			edits := Lines(a, b)
+			if got := apply(a, b, edits); strings.Join(got, "") != tc.b {
+				t.Errorf("edit script produced %q, expected %q", strings.Join(got, ""), tc.b)
+			}
+		})
+	}
+}
+
+func TestLinesIsMinimal(t *testing.T) {
+	a := SplitLines("a\nb\nc\na\nb\nb\na\n")
+	b := SplitLines("c\nb\na\nb\na\nc\n")
+	changes := 0
+	for _, e := range Lines(a, b) {
+		if e.Kind != Equal {
+			changes++
+		}
+	}
+	// The classic Myers example has an edit distance of 5
+	if changes != 5 {
+		t.Errorf("expected 5 changes, got %d", changes)
+	}
+}
+
+func TestUnified(t *testing.T) {
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+	b := "one\ntwo\nthree\nFOUR\nfive\nsix\nseven\neight\nnine\nten\neleven\n"
+	expected := `--- a
++++ b
+@@ -1,10 +1,11 @@
+ one
+ two
+ three
+-four
++FOUR
+ five
+ six
+ seven
+ eight
+ nine
+ ten
++eleven
+`
+	if got := Unified("a", "b", a, b); got != expected {
+		t.Errorf("unexpected diff:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestUnifiedSeparateHunks(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 20; i++ {
+		line := strings.Repeat("x", i+1) + "\n"
+		a = append(a, line)
+		if i == 2 || i == 17 {
+			line = "changed\n"
+		}
+		b = append(b, line)
+	}
+	got := Unified("a", "b", strings.Join(a, ""), strings.Join(b, ""))
+	if strings.Count(got, "@@ -") != 2 {
+		t.Errorf("expected two hunks, got:\n%s", got)
+	}
+	if !strings.Contains(got, "@@ -1,6 +1,6 @@") || !strings.Contains(got, "@@ -15,6 +15,6 @@") {
+		t.Errorf("unexpected hunk headers:\n%s", got)
+	}
+}
+
+func TestUnifiedEdgeCases(t *testing.T) {
+	if got := Unified("a", "b", "same\n", "same\n"); got != "" {
+		t.Errorf("expected empty diff for equal input, got %q", got)
+	}
+
+	got := Unified("/dev/null", "b", "", "new\n")
+	if !strings.Contains(got, "@@ -0,0 +1 @@\n+new\n") {
+		t.Errorf("unexpected diff for new file: %q", got)
+	}
+
+	got = Unified("a", "b", "line\n", "line")
+	if !strings.Contains(got, "\\ No newline at end of file") {
+		t.Errorf("expected missing newline marker, got %q", got)
+	}
+}
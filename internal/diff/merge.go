@@ -0,0 +1,101 @@
+package diff
+
+import (
+	"strings"
+)
+
+// Merge3 performs a three-way line merge of ours and theirs against their
+// common ancestor base. Regions changed on only one side are taken from that
+// side; regions changed differently on both sides are written with git-style
+// conflict markers using the given labels. It reports whether the merge was
+// clean.
+func Merge3(base, ours, theirs, oursLabel, theirsLabel string) (string, bool) {
+	baseLines := SplitLines(base)
+	oursLines := SplitLines(ours)
+	theirsLines := SplitLines(theirs)
+	matchOurs := matches(baseLines, oursLines)
+	matchTheirs := matches(baseLines, theirsLines)
+
+	var sb strings.Builder
+	clean := true
+	i, o, t := 0, 0, 0
+	for i < len(baseLines) || o < len(oursLines) || t < len(theirsLines) {
+		// Stable line present unchanged in all three versions
+		if i < len(baseLines) && matchOurs[i] == o && matchTheirs[i] == t {
+			sb.WriteString(baseLines[i])
+			i, o, t = i+1, o+1, t+1
+			continue
+		}
+
+		// Find the next line common to all three to end the unstable region
+		j := i
+		for j < len(baseLines) && (matchOurs[j] < 0 || matchTheirs[j] < 0) {
+			j++
+		}
+		oEnd, tEnd := len(oursLines), len(theirsLines)
+		if j < len(baseLines) {
+			oEnd, tEnd = matchOurs[j], matchTheirs[j]
+		}
+
+		baseChunk := baseLines[i:j]
+		oursChunk := oursLines[o:oEnd]
+		theirsChunk := theirsLines[t:tEnd]
+		switch {
+		case equalLines(oursChunk, baseChunk):
+			writeLines(&sb, theirsChunk)
+		case equalLines(theirsChunk, baseChunk), equalLines(oursChunk, theirsChunk):
+			writeLines(&sb, oursChunk)
+		default:
+			clean = false
+			sb.WriteString("<<<<<<< " + oursLabel + "\n")
+			writeTerminated(&sb, oursChunk)
+			sb.WriteString("=======\n")
+			writeTerminated(&sb, theirsChunk)
+			sb.WriteString(">>>>>>> " + theirsLabel + "\n")
+		}
+		i, o, t = j, oEnd, tEnd
+	}
+	return sb.String(), clean
+}
+
+// matches maps each line of base to the index of the same line in other
+// according to a shortest edit script, or -1 when it was removed.
+func matches(base, other []string) []int {
+	result := make([]int, len(base))
+	for i := range result {
+		result[i] = -1
+	}
+	for _, e := range Lines(base, other) {
+		if e.Kind == Equal {
+			result[e.A] = e.B
+		}
+	}
+	return result
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(sb *strings.Builder, lines []string) {
+	for _, line := range lines {
+		sb.WriteString(line)
+	}
+}
+
+// writeTerminated writes lines making sure the last one ends in a newline so
+// the following conflict marker starts on its own line.
+func writeTerminated(sb *strings.Builder, lines []string) {
+	writeLines(sb, lines)
+	if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		sb.WriteString("\n")
+	}
+}
@@ -0,0 +1,89 @@
+package diff
+
+import (
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+	base := "alpha\nbeta\ngamma\ndelta\nepsilon\n"
+	testCases := []struct {
+		name     string
+		ours     string
+		theirs   string
+		expected string
+		clean    bool
+	}{
+		{
+			name:     "only ours changed",
+			ours:     "alpha\nBETA\ngamma\ndelta\nepsilon\n",
+			theirs:   base,
+			expected: "alpha\nBETA\ngamma\ndelta\nepsilon\n",
+			clean:    true,
+		},
+		{
+			name:     "only theirs changed",
+			ours:     base,
+			theirs:   "alpha\nbeta\ngamma\ndelta\nepsilon\nzeta\n",
+			expected: "alpha\nbeta\ngamma\ndelta\nepsilon\nzeta\n",
+			clean:    true,
+		},
+		{
+			name:     "separate regions",
+			ours:     "ALPHA\nbeta\ngamma\ndelta\nepsilon\n",
+			theirs:   "alpha\nbeta\ngamma\ndelta\nEPSILON\n",
+			expected: "ALPHA\nbeta\ngamma\ndelta\nEPSILON\n",
+			clean:    true,
+		},
+		{
+			name:     "same change on both sides",
+			ours:     "alpha\nbeta\nGAMMA\ndelta\nepsilon\n",
+			theirs:   "alpha\nbeta\nGAMMA\ndelta\nepsilon\n",
+			expected: "alpha\nbeta\nGAMMA\ndelta\nepsilon\n",
+			clean:    true,
+		},
+		{
+			name:     "deletion and insertion",
+			ours:     "alpha\ngamma\ndelta\nepsilon\n",
+			theirs:   "alpha\nbeta\ngamma\ndelta\ninserted\nepsilon\n",
+			expected: "alpha\ngamma\ndelta\ninserted\nepsilon\n",
+			clean:    true,
+		},
+		{
+			name:     "conflicting change",
+			ours:     "alpha\nbeta\nmine\ndelta\nepsilon\n",
+			theirs:   "alpha\nbeta\nyours\ndelta\nepsilon\n",
+			expected: "alpha\nbeta\n<<<<<<< local\nmine\n=======\nyours\n>>>>>>> remote\ndelta\nepsilon\n",
+			clean:    false,
+		},
+		{
+			name:     "conflict at end without newline",
+			ours:     "alpha\nbeta\ngamma\ndelta\nmine",
+			theirs:   "alpha\nbeta\ngamma\ndelta\nyours",
+			expected: "alpha\nbeta\ngamma\ndelta\n<<<<<<< local\nmine\n=======\nyours\n>>>>>>> remote\n",
+			clean:    false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			merged, clean := Merge3(base, tc.ours, tc.theirs, "local", "remote")
+			if clean != tc.clean {
+				t.Errorf("expected clean=%v, got %v", tc.clean, clean)
+			}
+			if merged != tc.expected {
+				t.Errorf("unexpected merge result:\n%q\nexpected:\n%q", merged, tc.expected)
+			}
+		})
+	}
+}
+
+func TestMerge3EmptyBase(t *testing.T) {
+	merged, clean := Merge3("", "same\n", "same\n", "local", "remote")
+	if !clean || merged != "same\n" {
+		t.Errorf("expected identical additions to merge cleanly, got %q, %v", merged, clean)
+	}
+	_, clean = Merge3("", "ours\n", "theirs\n", "local", "remote")
+	if clean {
+		t.Error("expected different additions to conflict")
+	}
+}
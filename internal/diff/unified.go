@@ -0,0 +1,123 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ContextLines is the number of unchanged lines shown around each change.
+const ContextLines = 3
+
+// Unified renders the differences between a and b as a unified diff with the
+// given file labels. It returns an empty string when the inputs are equal.
+func Unified(fromName, toName, a, b string) string {
+	aLines := SplitLines(a)
+	bLines := SplitLines(b)
+	edits := Lines(aLines, bLines)
+
+	var sb strings.Builder
+	for _, h := range hunks(edits) {
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		aStart, aCount, bStart, bCount := h.ranges()
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, e := range h {
+			switch e.Kind {
+			case Equal:
+				writeLine(&sb, " ", aLines[e.A])
+			case Delete:
+				writeLine(&sb, "-", aLines[e.A])
+			case Insert:
+				writeLine(&sb, "+", bLines[e.B])
+			}
+		}
+	}
+	return sb.String()
+}
+
+type hunk []Edit
+
+// hunks groups an edit script into runs of changes with up to ContextLines
+// of surrounding context, merging runs whose context would overlap.
+func hunks(edits []Edit) []hunk {
+	var result []hunk
+	i := 0
+	for i < len(edits) {
+		if edits[i].Kind == Equal {
+			i++
+			continue
+		}
+		start := i - ContextLines
+		if start < 0 {
+			start = 0
+		}
+		// Extend the hunk while the next change is close enough
+		end := i
+		for end < len(edits) {
+			if edits[end].Kind != Equal {
+				end++
+				continue
+			}
+			run := end
+			for run < len(edits) && edits[run].Kind == Equal {
+				run++
+			}
+			if run == len(edits) || run-end > 2*ContextLines {
+				break
+			}
+			end = run
+		}
+		stop := end + ContextLines
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+		result = append(result, hunk(edits[start:stop]))
+		i = stop
+	}
+	return result
+}
+
+// ranges returns the 0-based start and the line count of the hunk in a and b.
+func (h hunk) ranges() (aStart, aCount, bStart, bCount int) {
+	aStart, bStart = -1, -1
+	for _, e := range h {
+		if e.Kind != Insert {
+			if aStart < 0 {
+				aStart = e.A
+			}
+			aCount++
+		}
+		if e.Kind != Delete {
+			if bStart < 0 {
+				bStart = e.B
+			}
+			bCount++
+		}
+	}
+	if aStart < 0 {
+		aStart = h[0].A
+	}
+	if bStart < 0 {
+		bStart = h[0].B
+	}
+	return aStart, aCount, bStart, bCount
+}
+
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func writeLine(sb *strings.Builder, prefix, line string) {
+	sb.WriteString(prefix)
+	sb.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		sb.WriteString("\n\\ No newline at end of file\n")
+	}
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+func TestNewDiffCmd(t *testing.T) {
+	cmd := NewDiffCmd()
+	if cmd == nil {
+		t.Fatal("NewDiffCmd returned nil")
+	}
+	if !strings.Contains(cmd.Use, "diff") {
+		t.Errorf("expected Use to contain 'diff', got %q", cmd.Use)
+	}
+	if cmd.Run == nil {
+		t.Error("expected Run to be set")
+	}
+	if cmd.Flags().Lookup("remote") == nil {
+		t.Error("expected --remote flag to exist")
+	}
+}
+
+func TestDiffHandlerStagingCopy(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	tempHome := t.TempDir()
+	os.Setenv("HOME", tempHome)
+	defer os.Setenv("HOME", oldHome)
+
+	dotSyncFilesPath := filepath.Join(tempHome, ".dot-sync", "files")
+	os.MkdirAll(dotSyncFilesPath, 0700)
+
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	db.EnsureFilesTable(database)
+
+	rcFile := filepath.Join(tempHome, ".zshrc")
+	configDir := filepath.Join(tempHome, ".config", "app")
+	os.MkdirAll(configDir, 0700)
+	os.WriteFile(rcFile, []byte("export EDITOR=vim\n"), 0600)
+	os.WriteFile(filepath.Join(configDir, "settings"), []byte("theme=dark\n"), 0600)
+	os.WriteFile(filepath.Join(configDir, "image.bin"), []byte{0, 1, 2}, 0600)
+	db.InsertFiles(database, []string{rcFile, configDir})
+
+	records, _ := db.GetAllFilePaths(database)
+	for _, rec := range records {
+		if err := shared.CopyToDotSyncFilesByID(rec.ID, rec.Path, dotSyncFilesPath); err != nil {
+			t.Fatalf("Failed to stage %s: %v", rec.Path, err)
+		}
+	}
+
+	output := captureStdout(func() { diffHandler(NewDiffCmd(), []string{}) })
+	if !strings.Contains(output, "No differences.") {
+		t.Errorf("expected no differences right after staging, got %q", output)
+	}
+
+	os.WriteFile(rcFile, []byte("export EDITOR=nvim\n"), 0600)
+	os.WriteFile(filepath.Join(configDir, "settings"), []byte("theme=light\n"), 0600)
+	os.WriteFile(filepath.Join(configDir, "image.bin"), []byte{0, 9, 9}, 0600)
+
+	output = captureStdout(func() { diffHandler(NewDiffCmd(), []string{}) })
+	for _, expected := range []string{
+		"--- " + rcFile + "\n+++ " + rcFile + " (stored)",
+		"-export EDITOR=nvim\n+export EDITOR=vim\n",
+		"-theme=light\n+theme=dark\n",
+		"Binary files " + filepath.Join(configDir, "image.bin"),
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("expected output to contain %q, got %q", expected, output)
+		}
+	}
+
+	// Restricting to one path only diffs that record
+	output = captureStdout(func() { diffHandler(NewDiffCmd(), []string{rcFile}) })
+	if strings.Contains(output, "theme=") {
+		t.Errorf("expected only %s to be diffed, got %q", rcFile, output)
+	}
+
+	// A file inside a tracked directory narrows the diff to that file
+	output = captureStdout(func() { diffHandler(NewDiffCmd(), []string{filepath.Join(configDir, "settings")}) })
+	if !strings.Contains(output, "-theme=light\n+theme=dark\n") || strings.Contains(output, "image.bin") || strings.Contains(output, "EDITOR") {
+		t.Errorf("expected only the settings file to be diffed, got %q", output)
+	}
+}
+
+func TestDiffHandlerRemote(t *testing.T) {
+	cmd, remote := setupGitSync(t)
+	home := shared.FindHomeDir()
+
+	rcFile := filepath.Join(home, ".bashrc")
+	os.WriteFile(rcFile, []byte("alias ll='ls -l'\n"), 0600)
+	markHandler(cmd, []string{rcFile})
+	captureStdout(func() { syncHandler(cmd, []string{}) })
+
+	database, _ := db.OpenDotSyncDB()
+	records, _ := db.GetAllFilePaths(database)
+	database.Close()
+
+	clone := cloneRemote(t, remote)
+	os.WriteFile(filepath.Join(clone, "files", fmt.Sprintf("%d", records[0].ID)), []byte("alias ll='ls -la'\n"), 0600)
+	shared.RunCmd(clone, "git", "commit", "-am", "remote edit")
+	shared.RunCmd(clone, "git", "push")
+
+	diffCmd := NewDiffCmd()
+	diffCmd.SetContext(cmd.Context())
+	diffCmd.Flags().Set("remote", "true")
+	output := captureStdout(func() { diffHandler(diffCmd, []string{}) })
+	if !strings.Contains(output, "+++ "+rcFile+" (remote)") || !strings.Contains(output, "+alias ll='ls -la'") {
+		t.Errorf("expected diff against remote revision, got %q", output)
+	}
+
+	// The staging copy is untouched by the fetch
+	output = captureStdout(func() { diffHandler(NewDiffCmd(), []string{}) })
+	if !strings.Contains(output, "No differences.") {
+		t.Errorf("expected no differences against staging copy, got %q", output)
+	}
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// ignoreSet holds the global ignore patterns from ~/.dot-sync/ignore, which
+// is synced along with the files, and builds the rules for each record.
+type ignoreSet struct {
+	global []string
+}
+
+// loadIgnoreSet reads the global ignore file. A missing file means no
+// global patterns.
+func loadIgnoreSet() (*ignoreSet, error) {
+	data, err := os.ReadFile(filepath.Join(shared.FindHomeDir(), shared.GetDotSyncIgnoreFile()))
+	if os.IsNotExist(err) {
+		return &ignoreSet{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ignoreSet{global: shared.ParseIgnoreFile(data)}, nil
+}
+
+// recordTreeOptions returns how the files of rec are copied and compared:
+// its ignore rules and symlink policy, with link targets made portable.
+func recordTreeOptions(ignores *ignoreSet, rec db.FileRecord) shared.TreeOptions {
+	policy, err := shared.ParseSymlinkPolicy(rec.Symlinks)
+	if err != nil {
+		// A policy from a newer version falls back to the default
+		policy = shared.SymlinkStore
+	}
+	return shared.TreeOptions{Ignore: ignores.forRecord(rec), Symlinks: policy, PortableLinks: true}
+}
+
+// forRecord returns the rules for files inside rec. The record's own
+// patterns come last so they can re-include globally ignored files.
+func (s *ignoreSet) forRecord(rec db.FileRecord) *shared.IgnoreRules {
+	var lines []string
+	if s != nil {
+		lines = append(lines, s.global...)
+	}
+	return shared.NewIgnoreRules(append(lines, rec.Exclude...))
+}
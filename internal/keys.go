@@ -0,0 +1,338 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+func NewKeysCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "keys",
+		Short:       "Manage the key that encrypts the files marked with 'mark --encrypt'",
+		Annotations: map[string]string{shared.GetSkipStorageAnnotation(): "true"},
+	}
+	generateCmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Create a key to encrypt marked files with",
+		Args:  cobra.NoArgs,
+		Run:   keysGenerateHandler,
+	}
+	generateCmd.Flags().String("label", "", "Name to list the key under (default: this machine's hostname)")
+	cmd.AddCommand(generateCmd)
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Print this machine's secret key, to import it on another machine",
+		Args:  cobra.NoArgs,
+		Run:   keysExportHandler,
+	}
+	exportCmd.Flags().Bool("public", false, "Print the public key instead")
+	cmd.AddCommand(exportCmd)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "import <file>",
+		Short: "Import a secret key exported on another machine or made by age-keygen ('-' reads stdin)",
+		Args:  cobra.ExactArgs(1),
+		Run:   keysImportHandler,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the public keys encrypted files are encrypted to",
+		Args:  cobra.NoArgs,
+		Run:   keysListHandler,
+	})
+	return cmd
+}
+
+// identityPath is where this machine's secret key is kept: outside
+// ~/.dot-sync, so it is never pushed. DOT_SYNC_IDENTITY overrides it.
+func identityPath() (string, error) {
+	if path := os.Getenv("DOT_SYNC_IDENTITY"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dot-sync", "identity.txt"), nil
+}
+
+// loadIdentities returns the secret keys of this machine, none if it has
+// no identity file.
+func loadIdentities() ([]*age.X25519Identity, error) {
+	path, err := identityPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids, err := parseIdentities(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return ids, nil
+}
+
+// parseIdentities reads the secret keys of an identity file as written by
+// age-keygen.
+func parseIdentities(data []byte) ([]*age.X25519Identity, error) {
+	parsed, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]*age.X25519Identity, 0, len(parsed))
+	for _, id := range parsed {
+		x25519, ok := id.(*age.X25519Identity)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", id)
+		}
+		ids = append(ids, x25519)
+	}
+	return ids, nil
+}
+
+// isEncrypted reports whether data starts like an age file.
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("age-encryption.org/v1\n"))
+}
+
+// encryptFor encrypts plaintext so that any of recipients can decrypt it.
+func encryptFor(plaintext []byte, recipients []*age.X25519Recipient) ([]byte, error) {
+	rs := make([]age.Recipient, len(recipients))
+	for i, r := range recipients {
+		rs[i] = r
+	}
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, rs...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decryptWith decrypts an age file with the first of identities that can.
+func decryptWith(ciphertext []byte, identities []*age.X25519Identity) ([]byte, error) {
+	ids := make([]age.Identity, len(identities))
+	for i, id := range identities {
+		ids[i] = id
+	}
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), ids...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// writeIdentity saves a secret key in the format of age-keygen, readable
+// only by the user. An existing identity file is never replaced.
+func writeIdentity(id *age.X25519Identity) (string, error) {
+	path, err := identityPath()
+	if err != nil {
+		return "", err
+	}
+	if shared.PathExists(path) {
+		return "", fmt.Errorf("a key already exists at %s", path)
+	}
+	if err := shared.EnsureDir(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	contents := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), id.Recipient(), id)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(contents); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+func keysGenerateHandler(cmd *cobra.Command, args []string) {
+	label, _ := cmd.Flags().GetString("label")
+	if label == "" {
+		label, _ = os.Hostname()
+	}
+
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		fmt.Println("Failed to open .dot-sync.db:", err)
+		return
+	}
+	defer database.Close()
+	if err := db.EnsureRecipientsTable(database); err != nil {
+		fmt.Println("Failed to ensure recipients table:", err)
+		return
+	}
+	recipients, err := db.GetRecipients(database)
+	if err != nil {
+		fmt.Println("Failed to read keys:", err)
+		return
+	}
+	// Another key would leave the machines that have the first one unable
+	// to decrypt what this one encrypts
+	if len(recipients) > 0 {
+		fmt.Println("A key is already set up. Export it on a machine that has it with 'dot-sync keys export' and import it here with 'dot-sync keys import'.")
+		return
+	}
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		fmt.Println("Failed to generate key:", err)
+		return
+	}
+	path, err := writeIdentity(id)
+	if err != nil {
+		fmt.Println("Failed to save key:", err)
+		return
+	}
+	if err := db.AddRecipient(database, id.Recipient().String(), label); err != nil {
+		fmt.Println("Failed to record key:", err)
+		return
+	}
+	fmt.Printf("Created key %s in %s.\n", id.Recipient(), path)
+	fmt.Println("Choose the files to encrypt with 'dot-sync mark --encrypt <path>'. Keep a copy of the key somewhere safe:")
+	fmt.Println("without it they cannot be decrypted. Copy it to other machines with 'dot-sync keys export' and 'dot-sync keys import'.")
+}
+
+func keysExportHandler(cmd *cobra.Command, args []string) {
+	public, _ := cmd.Flags().GetBool("public")
+	ids, err := loadIdentities()
+	if err != nil {
+		fmt.Println("Failed to read key:", err)
+		return
+	}
+	if len(ids) == 0 {
+		fmt.Println("This machine has no key. Create one with 'dot-sync keys generate' or import one with 'dot-sync keys import'.")
+		return
+	}
+	for _, id := range ids {
+		if public {
+			fmt.Println(id.Recipient())
+		} else {
+			fmt.Println(id)
+		}
+	}
+}
+
+func keysImportHandler(cmd *cobra.Command, args []string) {
+	var data []byte
+	var err error
+	if args[0] == "-" {
+		data, err = io.ReadAll(cmd.InOrStdin())
+	} else {
+		data, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		fmt.Println("Failed to read key:", err)
+		return
+	}
+	ids, err := parseIdentities(data)
+	if err != nil {
+		fmt.Println("Failed to read key:", err)
+		return
+	}
+	if len(ids) != 1 {
+		fmt.Println("Expected a single secret key, found", len(ids))
+		return
+	}
+	id := ids[0]
+
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		fmt.Println("Failed to open .dot-sync.db:", err)
+		return
+	}
+	defer database.Close()
+	if err := db.EnsureRecipientsTable(database); err != nil {
+		fmt.Println("Failed to ensure recipients table:", err)
+		return
+	}
+	recipients, err := db.GetRecipients(database)
+	if err != nil {
+		fmt.Println("Failed to read keys:", err)
+		return
+	}
+	known := len(recipients) == 0
+	for _, r := range recipients {
+		known = known || r.Key == id.Recipient().String()
+	}
+	if !known {
+		fmt.Printf("Files are not encrypted to %s; import the key listed by 'dot-sync keys list'.\n", id.Recipient())
+		return
+	}
+
+	path, err := writeIdentity(id)
+	if err != nil {
+		fmt.Println("Failed to save key:", err)
+		return
+	}
+	if len(recipients) == 0 {
+		label, _ := os.Hostname()
+		if err := db.AddRecipient(database, id.Recipient().String(), label); err != nil {
+			fmt.Println("Failed to record key:", err)
+			return
+		}
+		fmt.Printf("Imported key %s into %s. Choose the files to encrypt with 'dot-sync mark --encrypt <path>'.\n", id.Recipient(), path)
+		return
+	}
+	fmt.Printf("Imported key %s into %s.\n", id.Recipient(), path)
+}
+
+func keysListHandler(cmd *cobra.Command, args []string) {
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		fmt.Println("Failed to open .dot-sync.db:", err)
+		return
+	}
+	defer database.Close()
+	if err := db.EnsureRecipientsTable(database); err != nil {
+		fmt.Println("Failed to ensure recipients table:", err)
+		return
+	}
+	recipients, err := db.GetRecipients(database)
+	if err != nil {
+		fmt.Println("Failed to read keys:", err)
+		return
+	}
+	if len(recipients) == 0 {
+		fmt.Println("No key is set up. Create one with 'dot-sync keys generate'.")
+		return
+	}
+	ids, err := loadIdentities()
+	if err != nil {
+		fmt.Println("Failed to read key:", err)
+		return
+	}
+	held := map[string]bool{}
+	for _, id := range ids {
+		held[id.Recipient().String()] = true
+	}
+	fmt.Println("Files marked encrypted are encrypted to (* marks keys this machine has):")
+	for _, r := range recipients {
+		marker := " "
+		if held[r.Key] {
+			marker = "*"
+		}
+		fmt.Printf("  %s %s  %s\n", marker, r.Key, strings.TrimSpace(r.Label))
+	}
+}
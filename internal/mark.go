@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"database/sql"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,16 +13,37 @@ import (
 )
 
 func NewMarkCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "mark [files or directories]...",
 		Short: "Mark a file or directory for syncing",
 		Args:  cobra.MinimumNArgs(0),
 		Run:   markHandler,
 	}
+	cmd.Flags().Bool("dry-run", false, "List what would be marked without changing the database")
+	cmd.Flags().StringSlice("exclude", nil, "Gitignore-style pattern for files inside the marked directories that are not synced (repeatable)")
+	cmd.Flags().Bool("reset-excludes", false, "Drop the exclude patterns already set on the marked paths")
+	cmd.Flags().String("symlinks", "", "How symlinks in the marked paths are synced: store (as links, the default), follow or skip")
+	cmd.Flags().Bool("encrypt", false, "Store the marked paths encrypted (--encrypt=false stores them readable again)")
+	cmd.Flags().Bool("template", false, "Store the marked files as templates rendered on each machine (--template=false stores the rendered file instead)")
+	return cmd
 }
 
 func markHandler(cmd *cobra.Command, args []string) {
 	// ctx := cmd.Context() // Only use if you need the storage provider
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	excludes, _ := cmd.Flags().GetStringSlice("exclude")
+	resetExcludes, _ := cmd.Flags().GetBool("reset-excludes")
+	symlinks, _ := cmd.Flags().GetString("symlinks")
+	if _, err := shared.ParseSymlinkPolicy(symlinks); err != nil {
+		fmt.Println("Invalid --symlinks:", err)
+		return
+	}
+	// Only an explicit --encrypt or --encrypt=false changes the flag
+	setEncrypt := cmd.Flags().Changed("encrypt")
+	encrypt, _ := cmd.Flags().GetBool("encrypt")
+	setTemplate := cmd.Flags().Changed("template")
+	asTemplate, _ := cmd.Flags().GetBool("template")
+
 	database, err := db.OpenDotSyncDB()
 	if err != nil {
 		fmt.Println("Failed to open .dot-sync.db:", err)
@@ -29,6 +51,11 @@ func markHandler(cmd *cobra.Command, args []string) {
 	}
 	defer database.Close()
 
+	if dryRun {
+		printMarkPlan(database, argsAsFullPaths(args), excludes, resetExcludes, symlinks, setEncrypt, encrypt, setTemplate, asTemplate)
+		return
+	}
+
 	if err := db.EnsureFilesTable(database); err != nil {
 		fmt.Println("Failed to ensure files table:", err)
 		return
@@ -39,12 +66,197 @@ func markHandler(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	// Add new entries from args
+	if setEncrypt && encrypt {
+		if err := db.EnsureRecipientsTable(database); err != nil {
+			fmt.Println("Failed to ensure recipients table:", err)
+			return
+		}
+		if recipients, err := db.GetRecipients(database); err != nil {
+			fmt.Println("Failed to read keys:", err)
+			return
+		} else if len(recipients) == 0 {
+			fmt.Println("No key to encrypt with. Set one up with 'dot-sync keys generate' first.")
+			return
+		}
+	}
+
+	// Add new entries from args; paths marked again only get their
+	// exclude patterns updated
 	absPaths := argsAsFullPaths(args)
-	if err := db.InsertFiles(database, absPaths); err != nil {
+	existing, err := db.GetFileRecordsByPaths(database, absPaths)
+	if err != nil {
+		fmt.Printf("Failed to query file records: %v\n", err)
+		return
+	}
+	tracked := make(map[string]bool, len(existing))
+	for _, rec := range existing {
+		tracked[rec.Path] = true
+	}
+	var newPaths []string
+	for _, path := range absPaths {
+		if !tracked[path] {
+			newPaths = append(newPaths, path)
+			tracked[path] = true
+		}
+	}
+	if err := db.InsertFiles(database, newPaths); err != nil {
 		fmt.Printf("Failed to mark entries: %v\n", err)
 	}
 	fmt.Println("Marked entries for syncing:", absPaths)
+
+	if len(excludes) == 0 && !resetExcludes && symlinks == "" && !setEncrypt && !setTemplate {
+		return
+	}
+	records, err := db.GetFileRecordsByPaths(database, absPaths)
+	if err != nil {
+		fmt.Printf("Failed to read marked entries: %v\n", err)
+		return
+	}
+	rendered := false
+	for _, rec := range records {
+		if symlinks != "" {
+			if err := db.SetFileSymlinks(database, rec.ID, symlinks); err != nil {
+				fmt.Printf("Failed to set symlink policy for %s: %v\n", rec.Path, err)
+			} else {
+				fmt.Printf("Symlinks in %s: %s\n", rec.Path, symlinks)
+			}
+			if symlinks == string(shared.SymlinkSkip) && shared.IsSymlink(rec.Path) {
+				fmt.Printf("Warning: %s is itself a symlink and will not be synced.\n", rec.Path)
+			}
+		}
+		if setEncrypt {
+			if err := db.SetFileEncrypted(database, rec.ID, encrypt); err != nil {
+				fmt.Printf("Failed to set encryption for %s: %v\n", rec.Path, err)
+			} else if encrypt {
+				fmt.Printf("Encrypting %s from the next sync on\n", rec.Path)
+			} else {
+				fmt.Printf("Storing %s unencrypted from the next sync on\n", rec.Path)
+			}
+		}
+		if setTemplate && asTemplate != rec.Template {
+			if markTemplate(database, rec, asTemplate) {
+				rendered = rendered || asTemplate
+			}
+		}
+		if len(excludes) == 0 && !resetExcludes {
+			continue
+		}
+		patterns := mergeExcludes(rec.Exclude, excludes, resetExcludes)
+		if err := db.SetFileExcludes(database, rec.ID, patterns); err != nil {
+			fmt.Printf("Failed to set exclude patterns for %s: %v\n", rec.Path, err)
+			continue
+		}
+		if len(patterns) == 0 {
+			fmt.Printf("Cleared exclude patterns for %s\n", rec.Path)
+		} else {
+			fmt.Printf("Excluding from %s: %s\n", rec.Path, strings.Join(patterns, ", "))
+		}
+	}
+	// Render the stored copies of the new templates right away
+	if rendered {
+		refreshStaging()
+	}
+}
+
+// markTemplate turns storing rec as a template on or off and reports whether
+// it did. Turning it off stores the rendered file in place of the template.
+func markTemplate(database *sql.DB, rec db.FileRecord, template bool) bool {
+	if template {
+		if info, err := os.Stat(rec.Path); err == nil && info.IsDir() {
+			fmt.Printf("Not storing %s as a template: templates must be files.\n", rec.Path)
+			return false
+		}
+		if err := checkTemplate(rec); err != nil {
+			fmt.Printf("Not storing %s as a template: it does not render: %v\n", rec.Path, err)
+			return false
+		}
+	} else if err := storeRendered(rec); err != nil {
+		fmt.Printf("Failed to store the rendered %s: %v\n", rec.Path, err)
+		return false
+	}
+	if err := db.SetFileTemplate(database, rec.ID, template); err != nil {
+		fmt.Printf("Failed to set template for %s: %v\n", rec.Path, err)
+		return false
+	}
+	if template {
+		fmt.Printf("Storing %s as a template; change it with 'dot-sync edit %s'\n", rec.Path, rec.Path)
+	} else {
+		fmt.Printf("Storing %s as a plain file; its rendered form replaces the template from the next sync on\n", rec.Path)
+	}
+	return true
+}
+
+// mergeExcludes appends the new patterns a record does not have yet, after
+// dropping the existing ones when reset is set.
+func mergeExcludes(existing, added []string, reset bool) []string {
+	var patterns []string
+	if !reset {
+		patterns = append(patterns, existing...)
+	}
+	for _, pattern := range added {
+		duplicate := false
+		for _, p := range patterns {
+			if p == pattern {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// printMarkPlan lists which paths mark would start tracking and the exclude
+// patterns, symlink policy, encryption and template flag they would end up
+// with.
+func printMarkPlan(database *sql.DB, absPaths, excludes []string, resetExcludes bool, symlinks string, setEncrypt, encrypt, setTemplate, template bool) {
+	fmt.Println("Dry run: the database will not be changed.")
+	if len(absPaths) == 0 {
+		fmt.Println("No changes.")
+		return
+	}
+
+	// A missing files table simply means nothing is tracked yet
+	tracked := make(map[string]bool)
+	existing := make(map[string][]string)
+	if records, err := db.GetFileRecordsByPaths(database, absPaths); err == nil {
+		for _, rec := range records {
+			tracked[rec.Path] = true
+			existing[rec.Path] = rec.Exclude
+		}
+	}
+	for _, path := range absPaths {
+		switch {
+		case tracked[path]:
+			fmt.Printf("  = already tracked: %s\n", path)
+		case !shared.PathExists(path):
+			fmt.Printf("  + would mark (does not exist yet): %s\n", path)
+		default:
+			fmt.Printf("  + would mark: %s\n", path)
+		}
+		if len(excludes) > 0 || resetExcludes {
+			if patterns := mergeExcludes(existing[path], excludes, resetExcludes); len(patterns) > 0 {
+				fmt.Printf("    would exclude: %s\n", strings.Join(patterns, ", "))
+			} else {
+				fmt.Println("    would clear exclude patterns")
+			}
+		}
+		if symlinks != "" {
+			fmt.Printf("    would sync symlinks with policy: %s\n", symlinks)
+		}
+		if setEncrypt && encrypt {
+			fmt.Println("    would store encrypted")
+		} else if setEncrypt {
+			fmt.Println("    would store unencrypted")
+		}
+		if setTemplate && template {
+			fmt.Println("    would store as a template")
+		} else if setTemplate {
+			fmt.Println("    would store the rendered file instead of a template")
+		}
+	}
 }
 
 func argsAsFullPaths(args []string) []string {
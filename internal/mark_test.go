@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
 )
 
 func TestMarkCommandArgs(t *testing.T) {
@@ -173,3 +174,127 @@ func TestMarkHandlerDatabaseError(t *testing.T) {
 		t.Errorf("expected database error message, got %q", output)
 	}
 }
+
+func TestMarkHandlerDryRun(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	tempHome := t.TempDir()
+	os.Setenv("HOME", tempHome)
+	defer os.Setenv("HOME", oldHome)
+	os.MkdirAll(filepath.Join(tempHome, ".dot-sync"), 0700)
+
+	existing := filepath.Join(tempHome, ".zshrc")
+	os.WriteFile(existing, []byte("x"), 0600)
+	tracked := filepath.Join(tempHome, ".vimrc")
+	database, _ := db.OpenDotSyncDB()
+	defer database.Close()
+	db.EnsureFilesTable(database)
+	db.InsertFile(database, tracked)
+
+	cmd := NewMarkCmd()
+	cmd.Flags().Set("dry-run", "true")
+	var buf bytes.Buffer
+	orig := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	markHandler(cmd, []string{existing, tracked})
+	w.Close()
+	os.Stdout = orig
+	buf.ReadFrom(r)
+	output := buf.String()
+
+	if !strings.Contains(output, "would mark: "+existing) {
+		t.Errorf("expected %s to be listed, got %q", existing, output)
+	}
+	if !strings.Contains(output, "already tracked: "+tracked) {
+		t.Errorf("expected %s to be reported as tracked, got %q", tracked, output)
+	}
+	records, _ := db.GetAllFilePaths(database)
+	if len(records) != 1 {
+		t.Errorf("expected dry run not to insert records, got %d", len(records))
+	}
+}
+
+func TestMarkHandlerExclude(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	tempHome := t.TempDir()
+	os.Setenv("HOME", tempHome)
+	defer os.Setenv("HOME", oldHome)
+	os.MkdirAll(filepath.Join(tempHome, ".dot-sync"), 0700)
+
+	nvimDir := filepath.Join(tempHome, ".config", "nvim")
+	os.MkdirAll(nvimDir, 0700)
+
+	cmd := NewMarkCmd()
+	cmd.Flags().Set("exclude", "lazy-lock.json")
+	captureStdout(func() { markHandler(cmd, []string{nvimDir}) })
+
+	// Marking again adds to the existing patterns
+	cmd = NewMarkCmd()
+	cmd.Flags().Set("exclude", "plugin/")
+	cmd.Flags().Set("exclude", "lazy-lock.json")
+	output := captureStdout(func() { markHandler(cmd, []string{nvimDir}) })
+	if !strings.Contains(output, "Excluding from "+nvimDir+": lazy-lock.json, plugin/") {
+		t.Errorf("expected patterns to be reported, got %q", output)
+	}
+
+	database, _ := db.OpenDotSyncDB()
+	defer database.Close()
+	records, _ := db.GetAllFilePaths(database)
+	if len(records) != 1 || !reflect.DeepEqual(records[0].Exclude, []string{"lazy-lock.json", "plugin/"}) {
+		t.Fatalf("expected merged excludes, got %+v", records)
+	}
+
+	cmd = NewMarkCmd()
+	cmd.Flags().Set("reset-excludes", "true")
+	output = captureStdout(func() { markHandler(cmd, []string{nvimDir}) })
+	if !strings.Contains(output, "Cleared exclude patterns for "+nvimDir) {
+		t.Errorf("expected patterns to be cleared, got %q", output)
+	}
+	records, _ = db.GetAllFilePaths(database)
+	if len(records[0].Exclude) != 0 {
+		t.Errorf("expected no excludes, got %v", records[0].Exclude)
+	}
+}
+
+func TestMarkHandlerEncrypt(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	tempHome := t.TempDir()
+	os.Setenv("HOME", tempHome)
+	defer os.Setenv("HOME", oldHome)
+	os.MkdirAll(filepath.Join(tempHome, ".dot-sync"), 0700)
+	netrc := filepath.Join(tempHome, ".netrc")
+	os.WriteFile(netrc, []byte("machine example.com\n"), 0600)
+
+	cmd := NewMarkCmd()
+	cmd.Flags().Set("encrypt", "true")
+	output := captureStdout(func() { markHandler(cmd, []string{netrc}) })
+	if !strings.Contains(output, "No key to encrypt with") {
+		t.Fatalf("expected marking encrypted without a key to be refused, got %q", output)
+	}
+
+	database, _ := db.OpenDotSyncDB()
+	defer database.Close()
+	db.EnsureRecipientsTable(database)
+	db.AddRecipient(database, "age1example", "laptop")
+	output = captureStdout(func() { markHandler(cmd, []string{netrc}) })
+	if !strings.Contains(output, "Encrypting "+netrc) {
+		t.Errorf("expected encryption to be reported, got %q", output)
+	}
+	records, _ := db.GetAllFilePaths(database)
+	if len(records) != 1 || !records[0].Encrypted {
+		t.Fatalf("expected the record to be marked encrypted, got %+v", records)
+	}
+
+	// Marking again without the flag keeps it; --encrypt=false clears it
+	captureStdout(func() { markHandler(NewMarkCmd(), []string{netrc}) })
+	cmd = NewMarkCmd()
+	cmd.Flags().Set("encrypt", "false")
+	output = captureStdout(func() { markHandler(cmd, []string{netrc}) })
+	if !strings.Contains(output, "Storing "+netrc+" unencrypted") {
+		t.Errorf("expected decryption to be reported, got %q", output)
+	}
+	records, _ = db.GetAllFilePaths(database)
+	if records[0].Encrypted {
+		t.Error("expected the record to be stored unencrypted again")
+	}
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// collectFileMeta records the mode and modification time of live and, for
+// directories, of everything below it that opts includes. Symlinks carry no
+// mode of their own and are left out. Paths are relative to root, the path
+// of the record live belongs to.
+func collectFileMeta(root, live string, opts shared.TreeOptions) ([]db.FileMeta, error) {
+	var metas []db.FileMeta
+	add := func(path string, info fs.FileInfo) error {
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		recordRel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		metas = append(metas, db.FileMeta{
+			Rel:     filepath.ToSlash(recordRel),
+			Mode:    info.Mode().Perm(),
+			ModTime: info.ModTime(),
+			IsDir:   info.IsDir(),
+		})
+		return nil
+	}
+	info, err := shared.StatWith(live, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := add(live, info); err != nil || !info.IsDir() {
+		return metas, err
+	}
+	err = shared.WalkTree(live, opts, func(rel, path string, info fs.FileInfo) error {
+		return add(path, info)
+	})
+	return metas, err
+}
+
+// recordSyncedMeta stores the metadata of a synced part in the state
+// database, which is pushed along with the files.
+func recordSyncedMeta(database *sql.DB, part syncPart) error {
+	metas, err := collectFileMeta(part.Root, part.Live, part.Tree)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(part.Root, part.Live)
+	if err != nil {
+		return err
+	}
+	return db.ReplaceFileMeta(database, part.RecordID, filepath.ToSlash(rel), metas)
+}
+
+// restoreFileMeta gives a file written or confirmed by pull the mode recorded
+// at sync time and, when preserveMtime is set, its modification time.
+func restoreFileMeta(metas map[string]db.FileMeta, root string, step restoreStep, preserveMtime bool) error {
+	switch step.Action {
+	case actionUpToDate, actionCreate, actionFastForward, actionMerge:
+	default:
+		// The live file kept local content, so it keeps its local mode too
+		return nil
+	}
+	rel, err := filepath.Rel(root, step.Live)
+	if err != nil {
+		return err
+	}
+	meta, ok := metas[filepath.ToSlash(rel)]
+	// Changing the mode of a stored link would change what it points to
+	if !ok || (step.Symlinks != shared.SymlinkFollow && shared.IsSymlink(step.Live)) {
+		return nil
+	}
+	if err := os.Chmod(step.Live, meta.Mode); err != nil {
+		return err
+	}
+	// Merged files are new content, so only copies keep the original time
+	if preserveMtime && (step.Action == actionCreate || step.Action == actionFastForward) {
+		return os.Chtimes(step.Live, meta.ModTime, meta.ModTime)
+	}
+	return nil
+}
+
+// restoreDirModes gives the directories of a record the modes recorded at
+// sync time, limited to those below one of within when it is non-empty.
+func restoreDirModes(metas map[string]db.FileMeta, root string, within []string) error {
+	for rel, meta := range metas {
+		if !meta.IsDir {
+			continue
+		}
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if len(within) > 0 && !pathMatchesAny(path, within) {
+			continue
+		}
+		if info, err := os.Lstat(path); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := os.Chmod(path, meta.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileMode returns the permission bits of path, or 0 if it does not exist.
+func fileMode(path string) os.FileMode {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Mode().Perm()
+}
+
+// exposedSensitiveFile returns a warning when path looks like a private key
+// or credentials file and can be read by other users, or "" otherwise.
+func exposedSensitiveFile(path string) string {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() || info.Mode().Perm()&0077 == 0 || !isSensitivePath(path) {
+		return ""
+	}
+	return fmt.Sprintf("Warning: %s is readable by other users (mode %04o); consider 'chmod 600 %s'.",
+		path, info.Mode().Perm(), path)
+}
+
+// isSensitivePath reports whether path is a private key, credentials file or
+// other file that should only be readable by its owner.
+func isSensitivePath(path string) bool {
+	name := filepath.Base(path)
+	switch name {
+	case ".netrc", ".pgpass", ".git-credentials", "credentials", ".vault-token":
+		return true
+	}
+	if strings.HasSuffix(name, ".pem") || strings.HasSuffix(name, ".key") {
+		return true
+	}
+	for _, dir := range []string{".ssh", ".gnupg"} {
+		if !pathMatchesAny(path, []string{filepath.Join(shared.FindHomeDir(), dir)}) {
+			continue
+		}
+		// Public keys and host lists are meant to be readable
+		if strings.HasSuffix(name, ".pub") || strings.HasPrefix(name, "known_hosts") || name == "authorized_keys" {
+			return false
+		}
+		return true
+	}
+	return isSSHKeyName(name)
+}
+
+// isSSHKeyName reports whether name is one of the default names ssh-keygen
+// gives private keys, which are also kept outside ~/.ssh.
+func isSSHKeyName(name string) bool {
+	switch name {
+	case "id_rsa", "id_dsa", "id_ecdsa", "id_ed25519", "id_ecdsa_sk", "id_ed25519_sk":
+		return true
+	}
+	return false
+}
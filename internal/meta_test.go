@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+func TestIsSensitivePath(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", "/home/user")
+	defer os.Setenv("HOME", oldHome)
+
+	testCases := []struct {
+		path      string
+		sensitive bool
+	}{
+		{"/home/user/.ssh/id_ed25519", true},
+		{"/home/user/.ssh/config", true},
+		{"/home/user/.ssh/id_ed25519.pub", false},
+		{"/home/user/.ssh/known_hosts", false},
+		{"/home/user/.gnupg/private-keys-v1.d/key", true},
+		{"/home/user/.netrc", true},
+		{"/home/user/.aws/credentials", true},
+		{"/home/user/certs/server.pem", true},
+		{"/home/user/backup/id_rsa", true},
+		{"/home/user/backup/id_ed25519_sk", true},
+		{"/home/user/bin/id_lookup.sh", false},
+		{"/home/user/.zshrc", false},
+		{"/home/user/bin/deploy", false},
+	}
+	for _, tc := range testCases {
+		if got := isSensitivePath(tc.path); got != tc.sensitive {
+			t.Errorf("isSensitivePath(%q) = %v, expected %v", tc.path, got, tc.sensitive)
+		}
+	}
+}
+
+func TestExposedSensitiveFile(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	tempHome := t.TempDir()
+	os.Setenv("HOME", tempHome)
+	defer os.Setenv("HOME", oldHome)
+
+	key := filepath.Join(tempHome, ".ssh", "id_ed25519")
+	os.MkdirAll(filepath.Dir(key), 0700)
+	os.WriteFile(key, []byte("key"), 0600)
+	if warning := exposedSensitiveFile(key); warning != "" {
+		t.Errorf("expected no warning for a private key, got %q", warning)
+	}
+	os.Chmod(key, 0644)
+	if warning := exposedSensitiveFile(key); warning == "" {
+		t.Error("expected a warning for a readable key")
+	}
+
+	script := filepath.Join(tempHome, "script.sh")
+	os.WriteFile(script, []byte("echo"), 0755)
+	if warning := exposedSensitiveFile(script); warning != "" {
+		t.Errorf("expected no warning for ordinary files, got %q", warning)
+	}
+}
+
+func TestCollectFileMeta(t *testing.T) {
+	temp := t.TempDir()
+	root := filepath.Join(temp, "bin")
+	os.MkdirAll(filepath.Join(root, "lib"), 0750)
+	os.WriteFile(filepath.Join(root, "deploy"), []byte("#!/bin/sh"), 0755)
+	os.WriteFile(filepath.Join(root, "lib", "common.sh"), []byte(""), 0644)
+	os.Chmod(filepath.Join(root, "lib"), 0750)
+
+	metas, err := collectFileMeta(root, filepath.Join(root, "lib"), shared.TreeOptions{})
+	if err != nil {
+		t.Fatalf("collectFileMeta failed: %v", err)
+	}
+	modes := map[string]os.FileMode{}
+	for _, meta := range metas {
+		modes[meta.Rel] = meta.Mode
+	}
+	expected := map[string]os.FileMode{"lib": 0750, "lib/common.sh": 0644}
+	if len(modes) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, modes)
+	}
+	for rel, mode := range expected {
+		if modes[rel] != mode {
+			t.Errorf("expected %s to have mode %v, got %v", rel, mode, modes[rel])
+		}
+	}
+}
@@ -8,15 +8,21 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/tylerkeyes/dot-sync/internal/db"
 	"github.com/tylerkeyes/dot-sync/internal/shared"
-	"github.com/tylerkeyes/dot-sync/internal/storage"
+	"github.com/tylerkeyes/dot-sync/storage"
 )
 
 func NewPullCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "pull",
+	cmd := &cobra.Command{
+		Use:   "pull [files or directories]...",
 		Short: "Pull dotfiles from remote storage",
 		Run:   pullHandler,
 	}
+	cmd.Flags().String("conflict-style", conflictStyleMarkers, "How to record conflicts that cannot be merged (markers, sidecar)")
+	cmd.Flags().Bool("dry-run", false, "List what would be restored or overwritten without changing anything")
+	cmd.Flags().Bool("preserve-mtime", false, "Give restored files the modification time they had when they were synced")
+	cmd.Flags().Bool("allow-external-links", false, "Restore symlinks that point outside the home directory")
+	addSelectionFlags(cmd)
+	return cmd
 }
 
 func pullHandler(cmd *cobra.Command, args []string) {
@@ -26,9 +32,15 @@ func pullHandler(cmd *cobra.Command, args []string) {
 	dotSyncFilesPath := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir())
 	dotSyncDir := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncDir())
 
-	// Ensure the .dot-sync/files directory exists
-	if err := shared.EnsureDir(dotSyncFilesPath); err != nil {
-		fmt.Printf("Failed to create .dot-sync/files directory: %v\n", err)
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	preserveMtime, _ := cmd.Flags().GetBool("preserve-mtime")
+	allowExternalLinks, _ := cmd.Flags().GetBool("allow-external-links")
+	conflictStyle, _ := cmd.Flags().GetString("conflict-style")
+	if conflictStyle == "" {
+		conflictStyle = conflictStyleMarkers
+	}
+	if conflictStyle != conflictStyleMarkers && conflictStyle != conflictStyleSidecar {
+		fmt.Printf("Unknown conflict style %q (expected %s or %s)\n", conflictStyle, conflictStyleMarkers, conflictStyleSidecar)
 		return
 	}
 
@@ -40,11 +52,54 @@ func pullHandler(cmd *cobra.Command, args []string) {
 		return
 	}
 
+	if dryRun {
+		printPullPlan(cmd, args, sp, dotSyncDir, conflictStyle, allowExternalLinks)
+		return
+	}
+
+	// Ensure the .dot-sync/files directory exists
+	if err := shared.EnsureDir(dotSyncFilesPath); err != nil {
+		fmt.Printf("Failed to create .dot-sync/files directory: %v\n", err)
+		return
+	}
+
+	// Keep the last synced state so local edits can be merged with remote ones
+	baseDir, err := os.MkdirTemp("", "dot-sync-base-")
+	if err != nil {
+		fmt.Println("Failed to create temporary directory:", err)
+		return
+	}
+	defer os.RemoveAll(baseDir)
+	codec, err := loadCodec()
+	if err != nil {
+		fmt.Println("Failed to load keys and secrets:", err)
+		return
+	}
+	if err := exportBase(sp, dotSyncDir, baseDir, codec); err != nil {
+		fmt.Println("Failed to read last synced state:", err)
+		return
+	}
+
 	// Pull from remote storage
 	if err := sp.PullFromStorage(dotSyncDir); err != nil {
 		fmt.Println("Failed to pull from storage:", err)
 		return
 	}
+	recordRemoteActivity("", db.RecordRemotePull)
+
+	// The pulled database may have set up encryption
+	if codec, err = loadCodec(); err != nil {
+		fmt.Println("Failed to load keys and secrets:", err)
+		return
+	}
+	if err := codec.openStaging(); err != nil {
+		fmt.Println("Failed to read stored files:", err)
+		return
+	}
+	for _, name := range codec.missingSecrets() {
+		fmt.Printf("Warning: secret %s has no value on this machine, its placeholder is kept (set it with 'dot-sync secrets set %s').\n", name, name)
+	}
+	dotSyncFilesPath = stagingFilesDir(codec)
 
 	// Open database to get file mappings
 	database, err := db.OpenDotSyncDB()
@@ -66,44 +121,228 @@ func pullHandler(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	// Copy files from .dot-sync/files/{id} back to their original locations
-	for _, rec := range records {
-		srcPath := filepath.Join(dotSyncFilesPath, fmt.Sprintf("%d", rec.ID))
-		dstPath := rec.Path
+	selected := selectionFromCmd(cmd, args, records)
+	if len(selected) == 0 {
+		fmt.Println("No matching files found in tracking database.")
+		return
+	}
+
+	// The pulled ignore file applies from now on
+	ignores, err := loadIgnoreSet()
+	if err != nil {
+		fmt.Println("Failed to read ignore file:", err)
+		return
+	}
+
+	// Files about to be overwritten are backed up first
+	localDB, err := openBackupsDB()
+	if err != nil {
+		fmt.Println("Failed to open local database:", err)
+		return
+	}
+	defer localDB.Close()
+	backups := newBackupRecorder(localDB)
+
+	// Bring each original location up to date with .dot-sync/files/{id}
+	conflicts := 0
+	for _, sel := range selected {
+		rec := sel.FileRecord
+		id := fmt.Sprintf("%d", rec.ID)
+		srcPath := filepath.Join(dotSyncFilesPath, id)
 
 		// Check if source file exists in .dot-sync/files
-		if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+		if !shared.PathExists(srcPath) {
 			fmt.Printf("Warning: File with ID %d not found in storage, skipping %s\n", rec.ID, rec.Path)
 			continue
 		}
 
-		// Ensure destination directory exists
-		if err := shared.EnsureDir(filepath.Dir(dstPath)); err != nil {
-			fmt.Printf("Failed to create directory for %s: %v\n", dstPath, err)
+		steps, err := planSelectionRestore(sel, srcPath, filepath.Join(baseDir, id), recordTreeOptions(ignores, rec))
+		if err != nil {
+			fmt.Printf("Failed to compare %s with storage: %v\n", rec.Path, err)
 			continue
 		}
 
-		// Determine if it's a file or directory and copy accordingly
-		srcInfo, err := os.Lstat(srcPath)
+		metas, err := db.GetFileMeta(database, rec.ID)
 		if err != nil {
-			fmt.Printf("Failed to get info for %s: %v\n", srcPath, err)
-			continue
+			fmt.Printf("Warning: failed to read recorded permissions of %s: %v\n", rec.Path, err)
 		}
 
-		if srcInfo.IsDir() {
-			if err := shared.CopyDir(srcPath, dstPath); err != nil {
-				fmt.Printf("Failed to copy directory %s to %s: %v\n", srcPath, dstPath, err)
+		upToDate := true
+		for _, step := range steps {
+			if target := externalLinkTarget(step); target != "" && !allowExternalLinks {
+				fmt.Printf("✗ Refused: %s would link outside the home directory to %s (use --allow-external-links)\n", step.Live, target)
+				upToDate = false
 				continue
 			}
-		} else {
-			if err := shared.CopyFile(srcPath, dstPath); err != nil {
-				fmt.Printf("Failed to copy file %s to %s: %v\n", srcPath, dstPath, err)
-				continue
+			modeBefore := fileMode(step.Live)
+			if step.Action != actionUpToDate {
+				upToDate = false
+				if overwritesLive(step, conflictStyle) {
+					if err := backups.Backup(step.Live); err != nil {
+						fmt.Printf("Failed to back up %s, skipping: %v\n", step.Live, err)
+						continue
+					}
+				}
+				if err := applyRestoreStep(step, conflictStyle); err != nil {
+					fmt.Printf("Failed to restore %s: %v\n", step.Live, err)
+					continue
+				}
+				if step.Action == actionConflict {
+					conflicts++
+				}
+				fmt.Println(describeRestoreStep(step, conflictStyle))
 			}
+			if err := restoreFileMeta(metas, rec.Path, step, preserveMtime); err != nil {
+				fmt.Printf("Warning: failed to restore permissions of %s: %v\n", step.Live, err)
+			}
+			// Only warn about files this pull wrote or changed the mode of
+			if step.Action != actionUpToDate || fileMode(step.Live) != modeBefore {
+				if warning := exposedSensitiveFile(step.Live); warning != "" {
+					fmt.Println(warning)
+				}
+			}
+			// Records that were not pulled keep their old base, so their
+			// remote changes are still recognized as such later
+			if err := updateBaseFile(rec.ID, rec.Path, step.Live, step.Stored); err != nil {
+				fmt.Printf("Warning: failed to record synced copy of %s: %v\n", step.Live, err)
+			}
+		}
+		if err := restoreDirModes(metas, rec.Path, sel.Subpaths); err != nil {
+			fmt.Printf("Warning: failed to restore directory permissions of %s: %v\n", rec.Path, err)
 		}
+		if upToDate {
+			fmt.Printf("✓ Up to date: %s\n", rec.Path)
+		}
+	}
 
-		fmt.Printf("✓ Restored: %s\n", rec.Path)
+	if backups.Name() != "" {
+		fmt.Printf("Overwritten files were backed up to set %s (undo with 'dot-sync backups restore %s').\n", backups.Name(), backups.Name())
 	}
 
+	if conflicts > 0 {
+		fmt.Printf("Pull complete with %d conflict(s). Resolve them, then run 'dot-sync sync'.\n", conflicts)
+		return
+	}
 	fmt.Println("Pull complete.")
 }
+
+// printPullPlan lists what pull would do to each tracked file, comparing live
+// files with the fetched remote revision instead of resetting the staging
+// directory.
+func printPullPlan(cmd *cobra.Command, args []string, sp storage.StorageProvider, dotSyncDir, conflictStyle string, allowExternalLinks bool) {
+	fmt.Println("Dry run: no files will be changed.")
+
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		fmt.Println("Failed to open .dot-sync.db:", err)
+		return
+	}
+	defer database.Close()
+
+	records, err := db.GetAllFilePaths(database)
+	if err != nil {
+		fmt.Println("Failed to read file paths from database:", err)
+		return
+	}
+
+	if len(records) == 0 {
+		fmt.Println("No files found in database. Nothing to pull.")
+		return
+	}
+
+	selected := selectionFromCmd(cmd, args, records)
+	if len(selected) == 0 {
+		fmt.Println("No matching files found in tracking database.")
+		return
+	}
+
+	ignores, err := loadIgnoreSet()
+	if err != nil {
+		fmt.Println("Failed to read ignore file:", err)
+		return
+	}
+
+	snapshotDir, err := os.MkdirTemp("", "dot-sync-pull-")
+	if err != nil {
+		fmt.Println("Failed to create temporary directory:", err)
+		return
+	}
+	defer os.RemoveAll(snapshotDir)
+	// Fetching updates the remote-tracking state kept in .dot-sync, so the
+	// plan is made from a copy of it
+	fetchDir := filepath.Join(snapshotDir, "state")
+	if err := shared.CopyAll(dotSyncDir, fetchDir); err != nil {
+		fmt.Println("Failed to copy storage state:", err)
+		return
+	}
+	if err := sp.Fetch(fetchDir); err != nil {
+		fmt.Println("Failed to fetch from storage:", err)
+		return
+	}
+	baseRev := filepath.Join(snapshotDir, string(storage.RevisionBase))
+	remoteRev := filepath.Join(snapshotDir, string(storage.RevisionRemote))
+	codec, err := peekCodec()
+	if err != nil {
+		fmt.Println("Failed to load keys and secrets:", err)
+		return
+	}
+	if err := exportBase(sp, fetchDir, baseRev, codec); err != nil {
+		fmt.Println("Failed to read last synced state:", err)
+		return
+	}
+	if err := sp.ExportRevision(fetchDir, storage.RevisionRemote, remoteRev); err != nil {
+		fmt.Println("Failed to read remote state:", err)
+		return
+	}
+	if err := codec.openFiles(remoteRev); err != nil {
+		fmt.Println("Failed to read remote state:", err)
+		return
+	}
+
+	for _, sel := range selected {
+		rec := sel.FileRecord
+		id := fmt.Sprintf("%d", rec.ID)
+		srcPath := filepath.Join(remoteRev, id)
+		if !shared.PathExists(srcPath) {
+			fmt.Printf("  ✗ would skip, not found in storage: %s\n", rec.Path)
+			continue
+		}
+
+		steps, err := planSelectionRestore(sel, srcPath, filepath.Join(baseRev, id), recordTreeOptions(ignores, rec))
+		if err != nil {
+			fmt.Printf("  ✗ could not compare %s: %v\n", rec.Path, err)
+			continue
+		}
+		upToDate := true
+		for _, step := range steps {
+			if target := externalLinkTarget(step); target != "" && !allowExternalLinks {
+				fmt.Printf("  ✗ would refuse, links outside the home directory to %s: %s\n", target, step.Live)
+				upToDate = false
+				continue
+			}
+			if line := describePlannedStep(step, conflictStyle); line != "" {
+				fmt.Println(line)
+				upToDate = false
+			}
+		}
+		if upToDate {
+			fmt.Printf("  = up to date: %s\n", rec.Path)
+		}
+	}
+}
+
+// planSelectionRestore plans the restore of a selected record, keeping only
+// the steps inside its selected subpaths.
+func planSelectionRestore(sel recordSelection, stored, base string, opts shared.TreeOptions) ([]restoreStep, error) {
+	steps, err := planRestore(sel.Path, stored, base, opts)
+	if err != nil || len(sel.Subpaths) == 0 {
+		return steps, err
+	}
+	var kept []restoreStep
+	for _, step := range steps {
+		if pathMatchesAny(step.Live, sel.Subpaths) {
+			kept = append(kept, step)
+		}
+	}
+	return kept, nil
+}
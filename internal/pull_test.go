@@ -3,14 +3,19 @@ package internal
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
 	"github.com/tylerkeyes/dot-sync/internal/shared"
-	"github.com/tylerkeyes/dot-sync/internal/storage"
+	"github.com/tylerkeyes/dot-sync/storage"
 )
 
 func TestNewPullCmd(t *testing.T) {
@@ -118,3 +123,320 @@ func TestPullHandlerWithStorageProvider(t *testing.T) {
 		// Either error is acceptable in test environment
 	}
 }
+
+func TestPullHandlerMergesLocalAndRemoteChanges(t *testing.T) {
+	cmd, remote := setupGitSync(t)
+	home := shared.FindHomeDir()
+
+	mergeable := filepath.Join(home, ".zshrc")
+	conflicting := filepath.Join(home, ".vimrc")
+	remoteOnly := filepath.Join(home, ".bashrc")
+	os.WriteFile(mergeable, []byte("export A=1\nexport B=2\nexport C=3\n"), 0600)
+	os.WriteFile(conflicting, []byte("set number\n"), 0600)
+	os.WriteFile(remoteOnly, []byte("alias ll='ls -l'\n"), 0600)
+	markHandler(cmd, []string{mergeable, conflicting, remoteOnly})
+	captureStdout(func() { syncHandler(cmd, []string{}) })
+
+	database, _ := db.OpenDotSyncDB()
+	records, _ := db.GetAllFilePaths(database)
+	database.Close()
+	ids := map[string]string{}
+	for _, rec := range records {
+		ids[rec.Path] = fmt.Sprintf("%d", rec.ID)
+	}
+
+	// Another machine edits all three files
+	clone := cloneRemote(t, remote)
+	os.WriteFile(filepath.Join(clone, "files", ids[mergeable]), []byte("export A=1\nexport B=2\nexport C=remote\n"), 0600)
+	os.WriteFile(filepath.Join(clone, "files", ids[conflicting]), []byte("set relativenumber\n"), 0600)
+	os.WriteFile(filepath.Join(clone, "files", ids[remoteOnly]), []byte("alias ll='ls -la'\n"), 0600)
+	shared.RunCmd(clone, "git", "commit", "-am", "remote edit")
+	shared.RunCmd(clone, "git", "push")
+
+	// Local edits that were never synced
+	os.WriteFile(mergeable, []byte("export A=local\nexport B=2\nexport C=3\n"), 0600)
+	os.WriteFile(conflicting, []byte("set nonumber\n"), 0600)
+
+	output := captureStdout(func() { pullHandler(cmd, []string{}) })
+
+	if data, _ := os.ReadFile(mergeable); string(data) != "export A=local\nexport B=2\nexport C=remote\n" {
+		t.Errorf("expected both changes to be merged, got %q", data)
+	}
+	if mode := fileMode(mergeable); mode != 0600 {
+		t.Errorf("expected the merged file to keep mode 0600, got %v", mode)
+	}
+	if data, _ := os.ReadFile(remoteOnly); string(data) != "alias ll='ls -la'\n" {
+		t.Errorf("expected remote-only change to fast-forward, got %q", data)
+	}
+	data, _ := os.ReadFile(conflicting)
+	if !strings.Contains(string(data), "<<<<<<< local\nset nonumber\n=======\nset relativenumber\n>>>>>>> remote\n") {
+		t.Errorf("expected conflict markers, got %q", data)
+	}
+	if !strings.Contains(output, "Pull complete with 1 conflict(s)") {
+		t.Errorf("expected conflict summary, got %q", output)
+	}
+
+	// Every overwritten file was backed up first
+	localDB, _ := db.OpenLocalDB()
+	defer localDB.Close()
+	sets, err := db.GetBackupSets(localDB)
+	if err != nil || len(sets) != 1 {
+		t.Fatalf("expected one backup set, got %v, %v", sets, err)
+	}
+	backedUp := map[string]bool{}
+	files, _ := db.GetBackupFiles(localDB, sets[0].ID)
+	for _, file := range files {
+		backedUp[file.Path] = true
+	}
+	for _, path := range []string{mergeable, conflicting, remoteOnly} {
+		if !backedUp[path] {
+			t.Errorf("expected %s to be backed up, got %v", path, files)
+		}
+	}
+	if !strings.Contains(output, "backed up to set "+sets[0].Name) {
+		t.Errorf("expected backup set to be reported, got %q", output)
+	}
+}
+
+func TestPullHandlerInvalidConflictStyle(t *testing.T) {
+	cmd := NewPullCmd()
+	cmd.Flags().Set("conflict-style", "bogus")
+	output := captureStdout(func() { pullHandler(cmd, []string{}) })
+	if !strings.Contains(output, "Unknown conflict style") {
+		t.Errorf("expected unknown conflict style message, got %q", output)
+	}
+}
+
+func TestPullHandlerDryRun(t *testing.T) {
+	cmd, remote := setupGitSync(t)
+	home := shared.FindHomeDir()
+
+	rcFile := filepath.Join(home, ".zshrc")
+	os.WriteFile(rcFile, []byte("local\n"), 0600)
+	markHandler(cmd, []string{rcFile})
+	captureStdout(func() { syncHandler(cmd, []string{}) })
+
+	database, _ := db.OpenDotSyncDB()
+	records, _ := db.GetAllFilePaths(database)
+	database.Close()
+	stagingName := fmt.Sprintf("%d", records[0].ID)
+
+	clone := cloneRemote(t, remote)
+	os.WriteFile(filepath.Join(clone, "files", stagingName), []byte("remote\n"), 0600)
+	shared.RunCmd(clone, "git", "commit", "-am", "remote edit")
+	shared.RunCmd(clone, "git", "push")
+
+	dotSyncDir := filepath.Join(home, ".dot-sync")
+	tracking, _ := exec.Command("git", "-C", dotSyncDir, "for-each-ref", "refs/remotes").Output()
+
+	pullCmd := NewPullCmd()
+	pullCmd.SetContext(cmd.Context())
+	pullCmd.Flags().Set("dry-run", "true")
+	output := captureStdout(func() { pullHandler(pullCmd, []string{}) })
+
+	if !strings.Contains(output, "would overwrite (after backing it up): "+rcFile) {
+		t.Errorf("expected planned overwrite, got %q", output)
+	}
+	if data, _ := os.ReadFile(rcFile); string(data) != "local\n" {
+		t.Errorf("expected live file to be untouched, got %q", data)
+	}
+	staged := filepath.Join(home, ".dot-sync", "files", stagingName)
+	if data, _ := os.ReadFile(staged); string(data) != "local\n" {
+		t.Errorf("expected staging copy to be untouched, got %q", data)
+	}
+	if after, _ := exec.Command("git", "-C", dotSyncDir, "for-each-ref", "refs/remotes").Output(); string(after) != string(tracking) {
+		t.Errorf("expected the remote-tracking refs to stay %q, got %q", tracking, after)
+	}
+}
+
+func TestPullHandlerSelectedPaths(t *testing.T) {
+	cmd, remote := setupGitSync(t)
+	home := shared.FindHomeDir()
+
+	nvimDir := filepath.Join(home, ".config", "nvim")
+	os.MkdirAll(nvimDir, 0700)
+	initLua := filepath.Join(nvimDir, "init.lua")
+	rcFile := filepath.Join(home, ".zshrc")
+	os.WriteFile(initLua, []byte("old nvim\n"), 0600)
+	os.WriteFile(rcFile, []byte("old zsh\n"), 0600)
+	markHandler(cmd, []string{nvimDir, rcFile})
+	captureStdout(func() { syncHandler(cmd, []string{}) })
+
+	database, _ := db.OpenDotSyncDB()
+	records, _ := db.GetAllFilePaths(database)
+	database.Close()
+	ids := map[string]string{}
+	for _, rec := range records {
+		ids[rec.Path] = fmt.Sprintf("%d", rec.ID)
+	}
+
+	clone := cloneRemote(t, remote)
+	os.WriteFile(filepath.Join(clone, "files", ids[nvimDir], "init.lua"), []byte("new nvim\n"), 0600)
+	os.WriteFile(filepath.Join(clone, "files", ids[rcFile]), []byte("new zsh\n"), 0600)
+	shared.RunCmd(clone, "git", "commit", "-am", "remote edit")
+	shared.RunCmd(clone, "git", "push")
+
+	captureStdout(func() { pullHandler(cmd, []string{nvimDir}) })
+	if data, _ := os.ReadFile(initLua); string(data) != "new nvim\n" {
+		t.Errorf("expected selected directory to be pulled, got %q", data)
+	}
+	if data, _ := os.ReadFile(rcFile); string(data) != "old zsh\n" {
+		t.Errorf("expected other records to be left alone, got %q", data)
+	}
+
+	// Syncing everything must not push the stale copy over the remote change
+	output := captureStdout(func() { syncHandler(cmd, []string{}) })
+	if !strings.Contains(output, "Skipping "+rcFile) {
+		t.Errorf("expected unpulled record to be skipped, got %q", output)
+	}
+
+	// The change left behind is still recognized as a remote one
+	output = captureStdout(func() { pullHandler(cmd, []string{}) })
+	if data, _ := os.ReadFile(rcFile); string(data) != "new zsh\n" {
+		t.Errorf("expected remote change to fast-forward later, got %q (output %q)", data, output)
+	}
+}
+
+func TestPullHandlerNoMatchingPaths(t *testing.T) {
+	cmd, _ := setupGitSync(t)
+	home := shared.FindHomeDir()
+
+	rcFile := filepath.Join(home, ".zshrc")
+	os.WriteFile(rcFile, []byte("zsh\n"), 0600)
+	markHandler(cmd, []string{rcFile})
+	captureStdout(func() { syncHandler(cmd, []string{}) })
+
+	output := captureStdout(func() { pullHandler(cmd, []string{filepath.Join(home, ".vimrc")}) })
+	if !strings.Contains(output, "No matching files found") {
+		t.Errorf("expected no-match message, got %q", output)
+	}
+}
+
+func TestPullHandlerRestoresModes(t *testing.T) {
+	cmd, _ := setupGitSync(t)
+	home := shared.FindHomeDir()
+
+	sshDir := filepath.Join(home, ".ssh")
+	os.MkdirAll(sshDir, 0700)
+	os.Chmod(sshDir, 0700)
+	sshConfig := filepath.Join(sshDir, "config")
+	os.WriteFile(sshConfig, []byte("Host *\n"), 0600)
+	binDir := filepath.Join(home, "bin")
+	os.MkdirAll(binDir, 0755)
+	script := filepath.Join(binDir, "deploy")
+	os.WriteFile(script, []byte("#!/bin/sh\n"), 0755)
+	os.Chmod(script, 0755)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(script, mtime, mtime)
+	markHandler(cmd, []string{sshDir, binDir})
+	captureStdout(func() { syncHandler(cmd, []string{}) })
+
+	// A fresh machine: nothing but the storage repository
+	os.RemoveAll(sshDir)
+	os.RemoveAll(binDir)
+	os.RemoveAll(filepath.Join(home, ".dot-sync", "base"))
+
+	pullCmd := NewPullCmd()
+	pullCmd.SetContext(cmd.Context())
+	pullCmd.Flags().Set("preserve-mtime", "true")
+	output := captureStdout(func() { pullHandler(pullCmd, []string{}) })
+
+	for path, mode := range map[string]os.FileMode{sshDir: 0700, sshConfig: 0600, script: 0755} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("expected %s to be restored: %v (output %q)", path, err, output)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("expected %s to have mode %v, got %v", path, mode, info.Mode().Perm())
+		}
+	}
+	if info, _ := os.Stat(script); !info.ModTime().Equal(mtime) {
+		t.Errorf("expected mtime %v, got %v", mtime, info.ModTime())
+	}
+	if strings.Contains(output, "Warning: "+sshConfig) {
+		t.Errorf("expected no warning for a private file, got %q", output)
+	}
+}
+
+func TestPullHandlerWarnsAboutReadableSecrets(t *testing.T) {
+	cmd, _ := setupGitSync(t)
+	home := shared.FindHomeDir()
+
+	key := filepath.Join(home, ".ssh", "id_ed25519")
+	os.MkdirAll(filepath.Dir(key), 0700)
+	os.WriteFile(key, []byte("private\n"), 0644)
+	os.Chmod(key, 0644)
+	markHandler(cmd, []string{key})
+	captureStdout(func() { syncHandler(cmd, []string{}) })
+
+	os.Remove(key)
+	output := captureStdout(func() { pullHandler(cmd, []string{}) })
+	if !strings.Contains(output, "Warning: "+key+" is readable by other users (mode 0644)") {
+		t.Errorf("expected a warning about the readable key, got %q", output)
+	}
+}
+
+func TestPullHandlerRestoresSymlinks(t *testing.T) {
+	cmd, remote := setupGitSync(t)
+	home := shared.FindHomeDir()
+
+	os.MkdirAll(filepath.Join(home, "dotfiles"), 0755)
+	os.WriteFile(filepath.Join(home, "dotfiles", "vimrc"), []byte("set nu\n"), 0644)
+	vimrc := filepath.Join(home, ".vimrc")
+	os.Symlink(filepath.Join(home, "dotfiles", "vimrc"), vimrc)
+	appDir := filepath.Join(home, ".config", "app")
+	os.MkdirAll(filepath.Join(appDir, "v1"), 0755)
+	os.WriteFile(filepath.Join(appDir, "v1", "conf"), []byte("v1\n"), 0644)
+	os.Symlink("v1", filepath.Join(appDir, "current"))
+	markHandler(cmd, []string{vimrc, appDir})
+	captureStdout(func() { syncHandler(cmd, []string{}) })
+
+	// Links are stored as links, with targets in the home directory portable
+	database, _ := db.OpenDotSyncDB()
+	records, _ := db.GetFileRecordsByPaths(database, []string{vimrc, appDir})
+	database.Close()
+	clone := cloneRemote(t, remote)
+	ids := map[string]int{}
+	for _, rec := range records {
+		ids[rec.Path] = rec.ID
+	}
+	storedVimrc := filepath.Join(clone, "files", fmt.Sprintf("%d", ids[vimrc]))
+	if target, err := os.Readlink(storedVimrc); err != nil || target != "HOME/dotfiles/vimrc" {
+		t.Fatalf("expected a portable stored link, got %q (%v)", target, err)
+	}
+
+	if output := captureStdout(func() { statusHandler(cmd, []string{}) }); strings.Contains(output, string(stateModifiedLocally)) {
+		t.Errorf("expected synced links to be up to date, got %q", output)
+	}
+
+	// A link pointing outside the home directory arrives from another machine
+	storedApp := filepath.Join(clone, "files", fmt.Sprintf("%d", ids[appDir]))
+	os.Symlink("/etc/passwd", filepath.Join(storedApp, "passwd"))
+	shared.RunCmd(clone, "git", "add", ".")
+	shared.RunCmd(clone, "git", "commit", "-m", "external link")
+	shared.RunCmd(clone, "git", "push")
+
+	os.Remove(vimrc)
+	os.Remove(filepath.Join(appDir, "current"))
+	output := captureStdout(func() { pullHandler(cmd, []string{}) })
+	if target, err := os.Readlink(vimrc); err != nil || target != filepath.Join(home, "dotfiles", "vimrc") {
+		t.Errorf("expected .vimrc to be restored as a link, got %q (%v)", target, err)
+	}
+	if target, err := os.Readlink(filepath.Join(appDir, "current")); err != nil || target != "v1" {
+		t.Errorf("expected relative link to be restored, got %q (%v)", target, err)
+	}
+	if shared.PathExists(filepath.Join(appDir, "passwd")) {
+		t.Error("expected a link outside the home directory to be refused")
+	}
+	if !strings.Contains(output, "outside the home directory") {
+		t.Errorf("expected the refusal to be reported, got %q", output)
+	}
+
+	pullCmd := NewPullCmd()
+	pullCmd.SetContext(cmd.Context())
+	pullCmd.Flags().Set("allow-external-links", "true")
+	captureStdout(func() { pullHandler(pullCmd, []string{}) })
+	if target, err := os.Readlink(filepath.Join(appDir, "passwd")); err != nil || target != "/etc/passwd" {
+		t.Errorf("expected the external link with --allow-external-links, got %q (%v)", target, err)
+	}
+}
@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/tylerkeyes/dot-sync/internal/diff"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+type restoreAction int
+
+const (
+	// actionUpToDate means the live file already matches the stored copy.
+	actionUpToDate restoreAction = iota
+	// actionCreate writes a stored file that does not exist locally.
+	actionCreate
+	// actionFastForward overwrites a live file that has not changed since
+	// the last sync.
+	actionFastForward
+	// actionKeepLocal leaves a live file alone because only it changed.
+	actionKeepLocal
+	// actionMerge writes the clean three-way merge of both changes.
+	actionMerge
+	// actionConflict means both sides changed and could not be merged.
+	actionConflict
+)
+
+const (
+	conflictStyleMarkers = "markers"
+	conflictStyleSidecar = "sidecar"
+
+	// conflictSuffix is appended to a live path to hold the remote version
+	// when a conflict is recorded in a sidecar file.
+	conflictSuffix = ".dot-sync-conflict"
+)
+
+// restoreStep describes what pull does to a single live file.
+type restoreStep struct {
+	Action restoreAction
+	Live   string
+	Stored string
+	Base   string
+	// Merged holds the merge result, with conflict markers for conflicts
+	// in text files.
+	Merged string
+	// Binary is set when a side cannot be merged line by line: binary
+	// files and symlinks.
+	Binary bool
+	// Symlinks is the record's symlink policy.
+	Symlinks shared.SymlinkPolicy
+}
+
+// planRestore decides how to bring the live path of a record up to date with
+// its stored copy, using base (the last synced copy) to tell local edits from
+// remote ones. Directories are planned file by file, skipping files and
+// symlinks that opts leaves out; files that only exist locally are left alone.
+func planRestore(live, stored, base string, opts shared.TreeOptions) ([]restoreStep, error) {
+	storedInfo, err := shared.StatWith(stored, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !storedInfo.IsDir() {
+		if info, err := shared.StatWith(live, opts); err == nil && info.IsDir() {
+			return nil, fmt.Errorf("%s is a directory but the stored copy is a file", live)
+		}
+		step, err := planFileRestore(live, stored, base, opts)
+		if err != nil {
+			return nil, err
+		}
+		return []restoreStep{step}, nil
+	}
+
+	if info, err := shared.StatWith(live, opts); err == nil && !info.IsDir() {
+		return nil, fmt.Errorf("%s is a file but the stored copy is a directory", live)
+	}
+	rels, err := shared.ListFilesWith(stored, opts)
+	if err != nil {
+		return nil, err
+	}
+	var steps []restoreStep
+	for _, rel := range rels {
+		step, err := planFileRestore(filepath.Join(live, rel), filepath.Join(stored, rel), filepath.Join(base, rel), opts)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func planFileRestore(live, stored, base string, opts shared.TreeOptions) (restoreStep, error) {
+	step := restoreStep{Live: live, Stored: stored, Base: base, Symlinks: opts.Symlinks}
+	if !shared.PathExists(live) {
+		step.Action = actionCreate
+		return step, nil
+	}
+	if same, err := shared.SameContentWith(live, stored, opts); err != nil || same {
+		step.Action = actionUpToDate
+		return step, err
+	}
+	// Without a synced base there is nothing to merge against, so the
+	// stored copy wins as it always has
+	if !shared.PathExists(base) {
+		step.Action = actionFastForward
+		return step, nil
+	}
+	if same, err := shared.SameContentWith(live, base, opts); err != nil || same {
+		step.Action = actionFastForward
+		return step, err
+	}
+	if same, err := shared.SameContentWith(stored, base, opts); err != nil || same {
+		step.Action = actionKeepLocal
+		return step, err
+	}
+
+	var contents [3][]byte
+	for i, path := range []string{base, live, stored} {
+		// A link only has a target, so a change to it cannot be merged
+		if info, err := shared.StatWith(path, opts); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			step.Action = actionConflict
+			step.Binary = true
+			return step, nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return step, err
+		}
+		if diff.IsBinary(data) {
+			step.Action = actionConflict
+			step.Binary = true
+			return step, nil
+		}
+		contents[i] = data
+	}
+	merged, clean := diff.Merge3(string(contents[0]), string(contents[1]), string(contents[2]), "local", "remote")
+	step.Merged = merged
+	step.Action = actionMerge
+	if !clean {
+		step.Action = actionConflict
+	}
+	return step, nil
+}
+
+// applyRestoreStep performs a planned step. Conflicts in text files are
+// written as conflict markers unless the sidecar style is requested; binary
+// and symlink conflicts always keep the live file and save the remote copy
+// beside it.
+func applyRestoreStep(step restoreStep, conflictStyle string) error {
+	switch step.Action {
+	case actionCreate, actionFastForward:
+		return restoreCopy(step.Stored, step.Live, step.Symlinks)
+	case actionMerge:
+		return writeMerged(step)
+	case actionConflict:
+		if step.Binary || conflictStyle == conflictStyleSidecar {
+			return restoreCopy(step.Stored, step.Live+conflictSuffix, shared.SymlinkStore)
+		}
+		return writeMerged(step)
+	}
+	return nil
+}
+
+// writeMerged writes the merge result of step to the live path with the mode
+// of the live file, or of the stored copy when there is no live file any
+// more, so a private or executable file keeps its mode.
+func writeMerged(step restoreStep) error {
+	mode := fileMode(step.Live)
+	if mode == 0 {
+		mode = fileMode(step.Stored)
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := os.WriteFile(step.Live, []byte(step.Merged), mode); err != nil {
+		return err
+	}
+	return os.Chmod(step.Live, mode)
+}
+
+// restoreCopy writes the stored file or symlink src to dst. A live symlink at
+// dst is replaced unless the record follows links, in which case the file it
+// points to is written.
+func restoreCopy(src, dst string, policy shared.SymlinkPolicy) error {
+	if shared.IsSymlink(src) {
+		target, err := shared.LinkTarget(src)
+		if err != nil {
+			return err
+		}
+		return shared.WriteLink(target, dst)
+	}
+	if policy == shared.SymlinkFollow {
+		return shared.CopyFile(src, dst)
+	}
+	return shared.CopyPathWith(src, dst, shared.TreeOptions{})
+}
+
+// externalLinkTarget returns the target of the symlink a create or
+// fast-forward step would write when it points outside the home directory,
+// or "" otherwise. Relative targets are resolved against the link's
+// directory.
+func externalLinkTarget(step restoreStep) string {
+	if step.Action != actionCreate && step.Action != actionFastForward {
+		return ""
+	}
+	if !shared.IsSymlink(step.Stored) {
+		return ""
+	}
+	target, err := shared.LinkTarget(step.Stored)
+	if err != nil {
+		return ""
+	}
+	resolved := target
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(filepath.Dir(step.Live), resolved)
+	}
+	if pathMatchesAny(filepath.Clean(resolved), []string{shared.FindHomeDir()}) {
+		return ""
+	}
+	return target
+}
+
+// overwritesLive reports whether applying step replaces the contents of an
+// existing live file.
+func overwritesLive(step restoreStep, conflictStyle string) bool {
+	switch step.Action {
+	case actionFastForward, actionMerge:
+		return true
+	case actionConflict:
+		return !step.Binary && conflictStyle != conflictStyleSidecar
+	}
+	return false
+}
+
+// describeRestoreStep returns the line printed for a step, or "" for steps
+// that need no mention.
+func describeRestoreStep(step restoreStep, conflictStyle string) string {
+	switch step.Action {
+	case actionCreate, actionFastForward:
+		return fmt.Sprintf("✓ Restored: %s", step.Live)
+	case actionMerge:
+		return fmt.Sprintf("✓ Merged local and remote changes: %s", step.Live)
+	case actionKeepLocal:
+		return fmt.Sprintf("• Kept local changes: %s", step.Live)
+	case actionConflict:
+		if step.Binary || conflictStyle == conflictStyleSidecar {
+			return fmt.Sprintf("✗ Conflict: %s (remote version saved to %s)", step.Live, step.Live+conflictSuffix)
+		}
+		return fmt.Sprintf("✗ Conflict: %s (resolve the conflict markers)", step.Live)
+	}
+	return ""
+}
+
+// describePlannedStep returns the line printed for a step by a dry run, or ""
+// for steps that need no mention.
+func describePlannedStep(step restoreStep, conflictStyle string) string {
+	switch step.Action {
+	case actionCreate:
+		return fmt.Sprintf("  + would create: %s", step.Live)
+	case actionFastForward:
+		return fmt.Sprintf("  ~ would overwrite (after backing it up): %s", step.Live)
+	case actionMerge:
+		return fmt.Sprintf("  ~ would merge local and remote changes (after backing it up): %s", step.Live)
+	case actionKeepLocal:
+		return fmt.Sprintf("  = would keep local changes: %s", step.Live)
+	case actionConflict:
+		if step.Binary || conflictStyle == conflictStyleSidecar {
+			return fmt.Sprintf("  ✗ would conflict, remote version saved to %s", step.Live+conflictSuffix)
+		}
+		return fmt.Sprintf("  ✗ would conflict, writing conflict markers (after backing it up): %s", step.Live)
+	}
+	return ""
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+func TestPlanFileRestore(t *testing.T) {
+	temp := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(temp, name)
+		os.WriteFile(path, []byte(content), 0600)
+		return path
+	}
+	missing := filepath.Join(temp, "missing")
+	base := write("base", "one\ntwo\nthree\n")
+	remote := write("remote", "one\ntwo\nthree\nfour\n")
+	localEdit := write("local-edit", "ONE\ntwo\nthree\n")
+	localConflict := write("local-conflict", "one\ntwo\nthree\nFOUR\n")
+	binaryBase := write("binary-base", "a\x00b")
+	binaryLocal := write("binary-local", "a\x00c")
+	binaryRemote := write("binary-remote", "a\x00d")
+
+	testCases := []struct {
+		name     string
+		live     string
+		stored   string
+		base     string
+		expected restoreAction
+	}{
+		{"missing locally", missing, remote, base, actionCreate},
+		{"already equal", remote, remote, base, actionUpToDate},
+		{"no base", localEdit, remote, missing, actionFastForward},
+		{"only remote changed", base, remote, base, actionFastForward},
+		{"only local changed", localEdit, base, base, actionKeepLocal},
+		{"both changed cleanly", localEdit, remote, base, actionMerge},
+		{"both changed same lines", localConflict, remote, base, actionConflict},
+		{"binary conflict", binaryLocal, binaryRemote, binaryBase, actionConflict},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			step, err := planFileRestore(tc.live, tc.stored, tc.base, shared.TreeOptions{})
+			if err != nil {
+				t.Fatalf("planFileRestore failed: %v", err)
+			}
+			if step.Action != tc.expected {
+				t.Errorf("expected action %d, got %d", tc.expected, step.Action)
+			}
+		})
+	}
+
+	step, _ := planFileRestore(localEdit, remote, base, shared.TreeOptions{})
+	if step.Merged != "ONE\ntwo\nthree\nfour\n" {
+		t.Errorf("unexpected merge result %q", step.Merged)
+	}
+}
+
+func TestPlanRestoreDirectory(t *testing.T) {
+	temp := t.TempDir()
+	live := filepath.Join(temp, "live")
+	stored := filepath.Join(temp, "stored")
+	base := filepath.Join(temp, "base")
+	for _, dir := range []string{live, stored, base} {
+		os.MkdirAll(filepath.Join(dir, "sub"), 0700)
+		os.WriteFile(filepath.Join(dir, "sub", "same.txt"), []byte("same\n"), 0600)
+	}
+	os.WriteFile(filepath.Join(stored, "new.txt"), []byte("new\n"), 0600)
+	os.WriteFile(filepath.Join(live, "local-only.txt"), []byte("mine\n"), 0600)
+
+	steps, err := planRestore(live, stored, base, shared.TreeOptions{})
+	if err != nil {
+		t.Fatalf("planRestore failed: %v", err)
+	}
+	actions := map[string]restoreAction{}
+	for _, step := range steps {
+		rel, _ := filepath.Rel(live, step.Live)
+		actions[rel] = step.Action
+	}
+	if len(actions) != 2 {
+		t.Errorf("expected steps only for stored files, got %v", actions)
+	}
+	if actions["new.txt"] != actionCreate {
+		t.Errorf("expected new.txt to be created, got %d", actions["new.txt"])
+	}
+	if actions[filepath.Join("sub", "same.txt")] != actionUpToDate {
+		t.Errorf("expected sub/same.txt to be up to date, got %d", actions[filepath.Join("sub", "same.txt")])
+	}
+
+	// A stored directory cannot replace a live file
+	file := filepath.Join(temp, "file")
+	os.WriteFile(file, []byte("x"), 0600)
+	if _, err := planRestore(file, stored, base, shared.TreeOptions{}); err == nil {
+		t.Error("expected error when live path is a file and stored copy a directory")
+	}
+}
+
+func TestApplyRestoreStepConflictStyles(t *testing.T) {
+	temp := t.TempDir()
+	live := filepath.Join(temp, "live")
+	stored := filepath.Join(temp, "stored")
+	os.WriteFile(live, []byte("mine\n"), 0600)
+	os.WriteFile(stored, []byte("theirs\n"), 0600)
+	step := restoreStep{Action: actionConflict, Live: live, Stored: stored, Merged: "<<<<<<< local\nmine\n=======\ntheirs\n>>>>>>> remote\n"}
+
+	if err := applyRestoreStep(step, conflictStyleSidecar); err != nil {
+		t.Fatalf("applyRestoreStep failed: %v", err)
+	}
+	if data, _ := os.ReadFile(live); string(data) != "mine\n" {
+		t.Errorf("expected live file to be kept with sidecar style, got %q", data)
+	}
+	if data, _ := os.ReadFile(live + conflictSuffix); string(data) != "theirs\n" {
+		t.Errorf("expected sidecar to hold remote version, got %q", data)
+	}
+	if msg := describeRestoreStep(step, conflictStyleSidecar); !strings.Contains(msg, conflictSuffix) {
+		t.Errorf("expected description to mention sidecar, got %q", msg)
+	}
+
+	if err := applyRestoreStep(step, conflictStyleMarkers); err != nil {
+		t.Fatalf("applyRestoreStep failed: %v", err)
+	}
+	if data, _ := os.ReadFile(live); !strings.Contains(string(data), "<<<<<<< local") {
+		t.Errorf("expected conflict markers in live file, got %q", data)
+	}
+	if mode := fileMode(live); mode != 0600 {
+		t.Errorf("expected conflict markers to keep the live mode, got %v", mode)
+	}
+}
+
+func TestApplyRestoreStepMergeKeepsMode(t *testing.T) {
+	temp := t.TempDir()
+	live := filepath.Join(temp, "config")
+	stored := filepath.Join(temp, "stored")
+	os.WriteFile(live, []byte("Host a\n"), 0600)
+	os.WriteFile(stored, []byte("Host b\n"), 0755)
+	step := restoreStep{Action: actionMerge, Live: live, Stored: stored, Merged: "Host a\nHost b\n"}
+
+	if err := applyRestoreStep(step, conflictStyleMarkers); err != nil {
+		t.Fatalf("applyRestoreStep failed: %v", err)
+	}
+	if mode := fileMode(live); mode != 0600 {
+		t.Errorf("expected the merge to keep the live mode, got %v", mode)
+	}
+
+	// Without a live file the stored mode is used
+	os.Remove(live)
+	if err := applyRestoreStep(step, conflictStyleMarkers); err != nil {
+		t.Fatalf("applyRestoreStep failed: %v", err)
+	}
+	if mode := fileMode(live); mode != 0755 {
+		t.Errorf("expected the merge to take the stored mode, got %v", mode)
+	}
+}
@@ -0,0 +1,213 @@
+package scan
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// This package looks for credentials in files about to be synced: well-known
+// token formats, private keys and random-looking values assigned in config
+// files.
+
+// Rule reports every match of Pattern. When the pattern has a capture group,
+// the first group is the secret.
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// Finding is a suspected secret on a line of a file, counted from 1.
+type Finding struct {
+	Line int
+	Rule string
+	// Match is the suspected secret.
+	Match string
+}
+
+// Redacted shows enough of the match to find it without repeating it.
+func (f Finding) Redacted() string {
+	if len(f.Match) <= 8 {
+		return strings.Repeat("*", len(f.Match))
+	}
+	return f.Match[:4] + strings.Repeat("*", min(len(f.Match)-4, 16))
+}
+
+// EntropyRule is the name of the check for random-looking values.
+const EntropyRule = "high-entropy"
+
+var builtinRules = []Rule{
+	{"aws-access-key", regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`)},
+	{"aws-secret-key", regexp.MustCompile(`(?i)aws_?secret_?access_?key\s*[=:]\s*["']?([A-Za-z0-9/+]{40})\b`)},
+	{"github-token", regexp.MustCompile(`\b((?:ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36,})\b`)},
+	{"github-token", regexp.MustCompile(`\b(github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"npm-token", regexp.MustCompile(`\b(npm_[A-Za-z0-9]{36})\b`)},
+	{"slack-token", regexp.MustCompile(`\b(xox[abposr]-[A-Za-z0-9-]{10,})\b`)},
+	{"private-key", regexp.MustCompile(`-----BEGIN[A-Z ]*PRIVATE KEY( BLOCK)?-----`)},
+}
+
+// assignedValue finds values assigned in config files, such as key=value,
+// key: value or "key": "value", which the entropy check looks at.
+var assignedValue = regexp.MustCompile(`(?:[=:]\s*["']?|["'])([A-Za-z0-9+/_\-]{20,}={0,2})`)
+
+// minEntropy is the Shannon entropy, in bits per character, from which a
+// value counts as random. English words and paths stay well below it.
+const minEntropy = 4.0
+
+// Scanner checks file contents against the built-in rules and those of a
+// config file.
+type Scanner struct {
+	rules    []Rule
+	disabled map[string]bool
+	// allow holds patterns of lines whose findings are accepted.
+	allow []*regexp.Regexp
+	// allowFiles holds globs of paths that are not scanned.
+	allowFiles []string
+}
+
+// New returns a scanner with the built-in rules only.
+func New() *Scanner {
+	return &Scanner{rules: append([]Rule(nil), builtinRules...), disabled: map[string]bool{}}
+}
+
+// Parse reads a scanner config. Each line holds one directive; blank lines
+// and lines starting with # are skipped:
+//
+//	rule <name> <regexp>    report matches of regexp as name
+//	disable <name>          turn off a rule, e.g. high-entropy
+//	allow <regexp>          accept findings on lines matching regexp
+//	allow-file <glob>       don't scan matching paths ("~/" is the home directory)
+func Parse(data []byte, home string) (*Scanner, error) {
+	s := New()
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		directive, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+		if arg == "" {
+			return nil, fmt.Errorf("line %d: %s needs an argument", n+1, directive)
+		}
+		switch directive {
+		case "rule":
+			name, expr, _ := strings.Cut(arg, " ")
+			re, err := regexp.Compile(strings.TrimSpace(expr))
+			if err != nil || strings.TrimSpace(expr) == "" {
+				return nil, fmt.Errorf("line %d: rule %s needs a valid regexp: %v", n+1, name, err)
+			}
+			s.rules = append(s.rules, Rule{Name: name, Pattern: re})
+		case "disable":
+			s.disabled[arg] = true
+		case "allow":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			s.allow = append(s.allow, re)
+		case "allow-file":
+			if rest, ok := strings.CutPrefix(arg, "~/"); ok {
+				arg = filepath.Join(home, rest)
+			}
+			s.allowFiles = append(s.allowFiles, arg)
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive %q", n+1, directive)
+		}
+	}
+	return s, nil
+}
+
+// FileAllowed reports whether path is left out of the scan.
+func (s *Scanner) FileAllowed(path string) bool {
+	for _, pattern := range s.allowFiles {
+		if matched, _ := filepath.Match(pattern, path); matched || pattern == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan returns the findings in data. Binary data is not scanned.
+func (s *Scanner) Scan(data []byte) []Finding {
+	if bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return nil
+	}
+	var findings []Finding
+	for n, line := range strings.Split(string(data), "\n") {
+		if s.lineAllowed(line) {
+			continue
+		}
+		found := map[string]bool{}
+		add := func(rule, match string) {
+			if !found[match] {
+				found[match] = true
+				findings = append(findings, Finding{Line: n + 1, Rule: rule, Match: match})
+			}
+		}
+		for _, rule := range s.rules {
+			if s.disabled[rule.Name] {
+				continue
+			}
+			for _, m := range rule.Pattern.FindAllStringSubmatch(line, -1) {
+				match := m[0]
+				if len(m) > 1 && m[1] != "" {
+					match = m[1]
+				}
+				add(rule.Name, match)
+			}
+		}
+		if s.disabled[EntropyRule] {
+			continue
+		}
+		for _, m := range assignedValue.FindAllStringSubmatch(line, -1) {
+			if looksRandom(m[1]) {
+				add(EntropyRule, m[1])
+			}
+		}
+	}
+	return findings
+}
+
+func (s *Scanner) lineAllowed(line string) bool {
+	for _, re := range s.allow {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// looksRandom reports whether value mixes upper and lower case letters and
+// digits with high entropy, as generated tokens do. Hex strings such as
+// commit hashes are not reported.
+func looksRandom(value string) bool {
+	var upper, lower, digit bool
+	for _, c := range value {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+	}
+	return upper && lower && digit && entropy(value) >= minEntropy
+}
+
+// entropy is the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, c := range s {
+		counts[c]++
+	}
+	var h float64
+	for _, count := range counts {
+		p := float64(count) / float64(len(s))
+		h -= p * math.Log2(p)
+	}
+	return h
+}
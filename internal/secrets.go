@@ -0,0 +1,445 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// Stored files can hold placeholders such as {{ secret "npm_token" }} in
+// place of credentials. The values come from this machine only: from a
+// DOT_SYNC_SECRET_<NAME> environment variable, or from the secret store in
+// ~/.config/dot-sync/secrets.age, which is encrypted to this machine's key
+// and holds either a value or a command that prints it. pull fills the
+// placeholders in, and sync puts them back wherever a known value appears, so
+// the values never leave the machine.
+
+// secretEnvPrefix starts the environment variables that provide secrets.
+const secretEnvPrefix = "DOT_SYNC_SECRET_"
+
+// minSecretLength is the shortest value sync replaces with a placeholder.
+// Every occurrence of a value is replaced, so a short one would also hit
+// unrelated text.
+const minSecretLength = 8
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*secret\s+"([A-Za-z0-9_.-]+)"\s*\}\}`)
+
+// secretEntry is a secret in the store: its value, or a command printing it.
+type secretEntry struct {
+	Value   string `json:"value,omitempty"`
+	Command string `json:"command,omitempty"`
+}
+
+func NewSecretsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "secrets",
+		Short:       "Manage the values of the secret placeholders in stored files on this machine",
+		Annotations: map[string]string{shared.GetSkipStorageAnnotation(): "true"},
+	}
+	setCmd := &cobra.Command{
+		Use:   "set <name>",
+		Short: "Store the value of a secret, read from stdin",
+		Args:  cobra.ExactArgs(1),
+		Run:   secretsSetHandler,
+	}
+	setCmd.Flags().String("command", "", "Store a command that prints the value instead, such as 'pass show npm'")
+	cmd.AddCommand(setCmd)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the secrets known on this machine, without their values",
+		Args:  cobra.NoArgs,
+		Run:   secretsListHandler,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove a secret from the store",
+		Args:  cobra.ExactArgs(1),
+		Run:   secretsRemoveHandler,
+	})
+	return cmd
+}
+
+// secretsPath is where the secret store is kept: next to the key, outside
+// ~/.dot-sync. DOT_SYNC_SECRETS overrides it.
+func secretsPath() (string, error) {
+	if path := os.Getenv("DOT_SYNC_SECRETS"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dot-sync", "secrets.age"), nil
+}
+
+// readSecretStore returns the entries of the secret store, none if there is
+// no store.
+func readSecretStore() (map[string]secretEntry, error) {
+	path, err := secretsPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]secretEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids, err := loadIdentities()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("this machine has no key to open %s", path)
+	}
+	plaintext, err := decryptWith(data, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	entries := map[string]secretEntry{}
+	if err := json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// writeSecretStore encrypts entries to this machine's keys. An empty store
+// is removed.
+func writeSecretStore(entries map[string]secretEntry) error {
+	path, err := secretsPath()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	ids, err := loadIdentities()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("this machine has no key to encrypt the secret store with; create one with 'dot-sync keys generate' or import one with 'dot-sync keys import'")
+	}
+	var recipients []*age.X25519Recipient
+	for _, id := range ids {
+		recipients = append(recipients, id.Recipient())
+	}
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := encryptFor(plaintext, recipients)
+	if err != nil {
+		return err
+	}
+	if err := shared.EnsureDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	// Write next to the store and rename, so a failure keeps the old one
+	next := path + ".new"
+	if err := os.WriteFile(next, ciphertext, 0600); err != nil {
+		return err
+	}
+	return os.Rename(next, path)
+}
+
+// secretStoreExists reports whether this machine has a secret store,
+// without opening it.
+func secretStoreExists() bool {
+	path, err := secretsPath()
+	return err == nil && shared.PathExists(path)
+}
+
+// envSecrets returns the secrets provided by DOT_SYNC_SECRET_<NAME>
+// variables, under their lower case names.
+func envSecrets() map[string]string {
+	values := map[string]string{}
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if rest, ok := strings.CutPrefix(name, secretEnvPrefix); ok && rest != "" && value != "" {
+			values[strings.ToLower(rest)] = value
+		}
+	}
+	return values
+}
+
+// secretEnvName is the environment variable that provides the secret name.
+func secretEnvName(name string) string {
+	return secretEnvPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+func placeholder(name string) string {
+	return fmt.Sprintf(`{{ secret "%s" }}`, name)
+}
+
+// secrets resolves the values of secrets for one command. Commands in the
+// store run at most once.
+type secrets struct {
+	entries map[string]secretEntry
+	values  map[string]string
+	// missing holds the names of placeholders no value was found for.
+	missing map[string]bool
+}
+
+// loadSecrets returns the secrets of this machine, or nil when it has none.
+func loadSecrets() (*secrets, error) {
+	if !secretStoreExists() && len(envSecrets()) == 0 {
+		return nil, nil
+	}
+	entries, err := readSecretStore()
+	if err != nil {
+		return nil, err
+	}
+	return newSecrets(entries), nil
+}
+
+func newSecrets(entries map[string]secretEntry) *secrets {
+	return &secrets{entries: entries, values: map[string]string{}, missing: map[string]bool{}}
+}
+
+// value returns the value of the secret name, preferring the environment
+// over the store.
+func (s *secrets) value(name string) (string, bool, error) {
+	if value, ok := s.values[name]; ok {
+		return value, true, nil
+	}
+	value := os.Getenv(secretEnvName(name))
+	if value == "" {
+		entry, ok := s.entries[name]
+		if !ok {
+			return "", false, nil
+		}
+		value = entry.Value
+		if entry.Command != "" {
+			out, err := exec.Command("sh", "-c", entry.Command).Output()
+			if err != nil {
+				return "", false, fmt.Errorf("failed to run the command of secret %s: %w", name, err)
+			}
+			value = strings.TrimRight(string(out), "\r\n")
+		}
+	}
+	s.values[name] = value
+	return value, value != "", nil
+}
+
+// fill replaces the placeholders in data with their values. Placeholders
+// without a value stay as they are and are recorded as missing.
+func (s *secrets) fill(data []byte) ([]byte, error) {
+	if s == nil || isBinary(data) || !placeholderPattern.Match(data) {
+		return data, nil
+	}
+	var failed error
+	filled := placeholderPattern.ReplaceAllFunc(data, func(m []byte) []byte {
+		name := string(placeholderPattern.FindSubmatch(m)[1])
+		value, ok, err := s.value(name)
+		if err != nil && failed == nil {
+			failed = err
+		}
+		if !ok {
+			s.missing[name] = true
+			return m
+		}
+		return []byte(value)
+	})
+	return filled, failed
+}
+
+// hide replaces every known secret value in data with its placeholder,
+// longest values first so a value containing another is replaced whole.
+// stored is the current stored form of data, if any: an environment variable
+// stands for several spellings of a name, and the one its placeholders are
+// written with there is kept. Secrets kept as commands are only run when data
+// or its stored form has their placeholder. A value shorter than
+// minSecretLength would also replace unrelated text, so finding one in data
+// is an error rather than a reason to push it.
+func (s *secrets) hide(data, stored []byte) ([]byte, error) {
+	if s == nil || isBinary(data) {
+		return data, nil
+	}
+	used := map[string]bool{}
+	for _, text := range [][]byte{data, stored} {
+		for _, m := range placeholderPattern.FindAllSubmatch(text, -1) {
+			used[string(m[1])] = true
+		}
+	}
+	names := map[string]bool{}
+	for name, entry := range s.entries {
+		if entry.Command == "" || used[name] || os.Getenv(secretEnvName(name)) != "" {
+			names[name] = true
+		}
+	}
+	spelled := map[string]bool{}
+	for name := range used {
+		if os.Getenv(secretEnvName(name)) != "" {
+			names[name] = true
+			spelled[secretEnvName(name)] = true
+		}
+	}
+	for name := range envSecrets() {
+		if !spelled[secretEnvName(name)] {
+			names[name] = true
+		}
+	}
+	type known struct{ name, value string }
+	var values, short []known
+	for name := range names {
+		value, ok, err := s.value(name)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !ok:
+		case len(value) < minSecretLength:
+			short = append(short, known{name, value})
+		default:
+			values = append(values, known{name, value})
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i].value) != len(values[j].value) {
+			return len(values[i].value) > len(values[j].value)
+		}
+		return values[i].name < values[j].name
+	})
+	for _, v := range values {
+		data = bytes.ReplaceAll(data, []byte(v.value), []byte(placeholder(v.name)))
+	}
+	sort.Slice(short, func(i, j int) bool { return short[i].name < short[j].name })
+	for _, v := range short {
+		if bytes.Contains(data, []byte(v.value)) {
+			return nil, fmt.Errorf("the value of secret %s is shorter than %d bytes, too short to be replaced by its placeholder; use a longer value or encrypt the file with 'dot-sync mark --encrypt'", v.name, minSecretLength)
+		}
+	}
+	return data, nil
+}
+
+// missingNames returns the names of the placeholders left unfilled so far.
+func (s *secrets) missingNames() []string {
+	if s == nil {
+		return nil
+	}
+	var names []string
+	for name := range s.missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0
+}
+
+func secretsSetHandler(cmd *cobra.Command, args []string) {
+	name := args[0]
+	command, _ := cmd.Flags().GetString("command")
+	if !secretNamePattern.MatchString(name) {
+		fmt.Println("Secret names may only hold letters, digits, '_', '.' and '-'.")
+		return
+	}
+	entry := secretEntry{Command: command}
+	if command == "" {
+		line, err := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+		entry.Value = strings.TrimRight(line, "\r\n")
+		if entry.Value == "" {
+			fmt.Println("Failed to read the value from stdin:", err)
+			return
+		}
+		if len(entry.Value) < minSecretLength {
+			fmt.Printf("Refusing to store a value shorter than %d bytes: sync replaces every occurrence of it in tracked files.\n", minSecretLength)
+			return
+		}
+	}
+
+	entries, err := readSecretStore()
+	if err != nil {
+		fmt.Println("Failed to open secret store:", err)
+		return
+	}
+	entries[name] = entry
+	if err := writeSecretStore(entries); err != nil {
+		fmt.Println("Failed to save secret store:", err)
+		return
+	}
+	fmt.Printf("Stored secret %s. Use it in tracked files as %s.\n", name, placeholder(name))
+	refreshStaging()
+}
+
+func secretsRemoveHandler(cmd *cobra.Command, args []string) {
+	entries, err := readSecretStore()
+	if err != nil {
+		fmt.Println("Failed to open secret store:", err)
+		return
+	}
+	if _, ok := entries[args[0]]; !ok {
+		fmt.Printf("No secret named %s in the store.\n", args[0])
+		return
+	}
+	delete(entries, args[0])
+	if err := writeSecretStore(entries); err != nil {
+		fmt.Println("Failed to save secret store:", err)
+		return
+	}
+	fmt.Printf("Removed secret %s.\n", args[0])
+	refreshStaging()
+}
+
+func secretsListHandler(cmd *cobra.Command, args []string) {
+	entries, err := readSecretStore()
+	if err != nil {
+		fmt.Println("Failed to open secret store:", err)
+		return
+	}
+	sources := map[string]string{}
+	for name, entry := range entries {
+		sources[name] = "store"
+		if entry.Command != "" {
+			sources[name] = "command: " + entry.Command
+		}
+	}
+	for name := range envSecrets() {
+		sources[name] = "environment: " + secretEnvName(name)
+	}
+	if len(sources) == 0 {
+		fmt.Println("No secrets on this machine. Add one with 'dot-sync secrets set <name>'.")
+		return
+	}
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("Secrets on this machine:")
+	for _, name := range names {
+		fmt.Printf("  %-20s %s\n", name, sources[name])
+	}
+}
+
+// refreshStaging fills the placeholders of the files commands work on in
+// again after the secrets changed.
+func refreshStaging() {
+	codec, err := loadCodec()
+	if err == nil {
+		err = codec.openStaging()
+	}
+	if err != nil {
+		fmt.Println("Warning: failed to update the stored files with the new secrets:", err)
+	}
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/scan"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// loadScanner reads the secret scan config in ~/.dot-sync/scan. A missing
+// file means the built-in rules only.
+func loadScanner() (*scan.Scanner, error) {
+	data, err := os.ReadFile(filepath.Join(shared.FindHomeDir(), shared.GetDotSyncScanFile()))
+	if os.IsNotExist(err) {
+		return scan.New(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scan.Parse(data, shared.FindHomeDir())
+}
+
+// scanFinding is a suspected secret in a live file.
+type scanFinding struct {
+	Path string
+	scan.Finding
+}
+
+// scanPush looks for secrets in everything a sync would push: the live
+// files of parts as sync would store them, and the staged copies of every
+// other record, with known secrets already replaced by placeholders. A stored
+// template is scanned as the text that is pushed, not its rendering. Records
+// stored encrypted and allowed files are left out.
+func scanPush(scanner *scan.Scanner, codec *fileCodec, records []db.FileRecord, parts []syncPart, dotSyncFilesPath string) ([]scanFinding, error) {
+	var findings []scanFinding
+	filesDir := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir())
+	// storedPath is where the stored form of a staged path is kept
+	storedPath := func(staged string) string {
+		rel, err := filepath.Rel(dotSyncFilesPath, staged)
+		if err != nil {
+			return staged
+		}
+		return filepath.Join(filesDir, rel)
+	}
+	// live is the path a file is reported and allowed by, path the copy
+	// that is read and stored its stored form
+	scanFile := func(live, path, stored string) error {
+		if scanner.FileAllowed(live) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		current, _ := os.ReadFile(stored)
+		if data, err = codec.hideSecrets(data, current); err != nil {
+			return fmt.Errorf("%s: %w", live, err)
+		}
+		for _, f := range scanner.Scan(data) {
+			findings = append(findings, scanFinding{Path: live, Finding: f})
+		}
+		return nil
+	}
+	scanTree := func(live, path, stored string, tree shared.TreeOptions, skip func(path string) bool) error {
+		info, err := shared.StatWith(path, tree)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			return scanFile(live, path, stored)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		return shared.WalkTree(path, tree, func(rel, path string, info fs.FileInfo) error {
+			if skip(path) {
+				if info.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			return scanFile(filepath.Join(live, rel), path, filepath.Join(stored, rel))
+		})
+	}
+
+	// Staged copies that sync replaces are scanned in their live form
+	var replaced []string
+	for _, part := range parts {
+		if part.Encrypted || part.templateStored() {
+			continue
+		}
+		if !shared.PathExists(part.Live) {
+			continue
+		}
+		replaced = append(replaced, part.Staged)
+		if err := scanTree(part.Live, part.Live, storedPath(part.Staged), part.Tree, func(string) bool { return false }); err != nil {
+			return nil, err
+		}
+	}
+	isReplaced := func(path string) bool {
+		for _, staged := range replaced {
+			if path == staged || strings.HasPrefix(path, staged+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Whatever is staged is pushed as it is, ignored files included
+	for _, rec := range records {
+		if rec.Encrypted {
+			continue
+		}
+		id := fmt.Sprintf("%d", rec.ID)
+		staged := filepath.Join(dotSyncFilesPath, id)
+		// sync keeps a stored template as it is, next to its rendering
+		if _, err := os.Lstat(filepath.Join(filesDir, id)); err == nil && rec.Template {
+			staged = filepath.Join(filesDir, id)
+		}
+		if isReplaced(staged) {
+			continue
+		}
+		if err := scanTree(rec.Path, staged, storedPath(staged), shared.TreeOptions{}, isReplaced); err != nil {
+			return nil, err
+		}
+	}
+	return findings, nil
+}
+
+func printScanFindings(findings []scanFinding) {
+	for _, f := range findings {
+		fmt.Printf("  ✗ %s:%d: %s (%s)\n", f.Path, f.Line, f.Rule, f.Redacted())
+	}
+}
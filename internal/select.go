@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// recordSelection is a tracked record picked by path arguments and globs.
+type recordSelection struct {
+	db.FileRecord
+	// Subpaths narrows the selection to paths inside a tracked directory;
+	// empty means the whole record.
+	Subpaths []string
+}
+
+// addSelectionFlags adds the --include and --exclude flags read by
+// selectionFromCmd.
+func addSelectionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("include", nil, "Only process tracked paths matching this glob (repeatable)")
+	cmd.Flags().StringSlice("exclude", nil, "Skip tracked paths matching this glob (repeatable)")
+}
+
+// selectionFromCmd selects the records named by the command's path arguments
+// and --include/--exclude globs. With no arguments or globs every record is
+// selected.
+func selectionFromCmd(cmd *cobra.Command, args []string, records []db.FileRecord) []recordSelection {
+	include, _ := cmd.Flags().GetStringSlice("include")
+	exclude, _ := cmd.Flags().GetStringSlice("exclude")
+	return selectRecords(records, argsAsFullPaths(args), include, exclude)
+}
+
+// selectRecords keeps the records that are one of paths, lie below one of
+// them, or contain one of them; the latter are narrowed to those paths.
+// Records must then match an include glob, if any are given, and no exclude
+// glob.
+func selectRecords(records []db.FileRecord, paths, include, exclude []string) []recordSelection {
+	var selected []recordSelection
+	for _, rec := range records {
+		sel := recordSelection{FileRecord: rec}
+		if len(paths) > 0 && !pathMatchesAny(rec.Path, paths) {
+			for _, path := range paths {
+				if pathMatchesAny(path, []string{rec.Path}) {
+					sel.Subpaths = append(sel.Subpaths, filepath.Clean(path))
+				}
+			}
+			if len(sel.Subpaths) == 0 {
+				continue
+			}
+		}
+		if len(include) > 0 && !matchesAnyGlob(rec.Path, include) {
+			continue
+		}
+		if matchesAnyGlob(rec.Path, exclude) {
+			continue
+		}
+		selected = append(selected, sel)
+	}
+	return selected
+}
+
+// matchesAnyGlob reports whether path or one of its parent directories
+// matches one of patterns. A leading "~/" stands for the home directory and
+// patterns without a separator are matched against base names only.
+func matchesAnyGlob(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "~/") {
+			pattern = filepath.Join(shared.FindHomeDir(), pattern[2:])
+		}
+		nameOnly := !strings.Contains(pattern, string(filepath.Separator))
+		for p := path; ; p = filepath.Dir(p) {
+			subject := p
+			if nameOnly {
+				subject = filepath.Base(p)
+			}
+			if ok, _ := filepath.Match(pattern, subject); ok {
+				return true
+			}
+			if filepath.Dir(p) == p {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// relSubpaths returns the subpaths of a selection relative to its record.
+func (s recordSelection) relSubpaths() []string {
+	var rels []string
+	for _, sub := range s.Subpaths {
+		if rel, err := filepath.Rel(s.Path, sub); err == nil {
+			rels = append(rels, rel)
+		}
+	}
+	return rels
+}
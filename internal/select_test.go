@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/tylerkeyes/dot-sync/internal/db"
+)
+
+func TestSelectRecords(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", "/home/user")
+	defer os.Setenv("HOME", oldHome)
+
+	records := []db.FileRecord{
+		{ID: 1, Path: "/home/user/.zshrc"},
+		{ID: 2, Path: "/home/user/.config/nvim"},
+		{ID: 3, Path: "/home/user/.config/git/config"},
+	}
+
+	testCases := []struct {
+		name     string
+		paths    []string
+		include  []string
+		exclude  []string
+		expected []recordSelection
+	}{
+		{"everything", nil, nil, nil, []recordSelection{
+			{FileRecord: records[0]}, {FileRecord: records[1]}, {FileRecord: records[2]},
+		}},
+		{"exact path", []string{"/home/user/.zshrc"}, nil, nil, []recordSelection{
+			{FileRecord: records[0]},
+		}},
+		{"parent directory", []string{"/home/user/.config"}, nil, nil, []recordSelection{
+			{FileRecord: records[1]}, {FileRecord: records[2]},
+		}},
+		{"file inside tracked directory", []string{"/home/user/.config/nvim/init.lua"}, nil, nil, []recordSelection{
+			{FileRecord: records[1], Subpaths: []string{"/home/user/.config/nvim/init.lua"}},
+		}},
+		{"include glob", nil, []string{"~/.config/*"}, nil, []recordSelection{
+			{FileRecord: records[1]}, {FileRecord: records[2]},
+		}},
+		{"exclude base name", nil, nil, []string{".z*"}, []recordSelection{
+			{FileRecord: records[1]}, {FileRecord: records[2]},
+		}},
+		{"path and exclude", []string{"/home/user/.config"}, nil, []string{"~/.config/git"}, []recordSelection{
+			{FileRecord: records[1]},
+		}},
+		{"no match", []string{"/home/user/.bashrc"}, nil, nil, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := selectRecords(records, tc.paths, tc.include, tc.exclude)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRecordSelectionRelSubpaths(t *testing.T) {
+	sel := recordSelection{
+		FileRecord: db.FileRecord{ID: 2, Path: "/home/user/.config/nvim"},
+		Subpaths:   []string{"/home/user/.config/nvim/init.lua", "/home/user/.config/nvim/lua"},
+	}
+	expected := []string{"init.lua", "lua"}
+	if got := sel.relSubpaths(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,167 @@
+package shared
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// File comparison utilities
+
+// PathExists reports whether path exists, without following a final symlink.
+func PathExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// SameContent reports whether a and b hold the same content. Files are
+// compared byte for byte, symlinks by target and directories recursively,
+// skipping .git directories the same way CopyDir does. Two missing paths are
+// equal.
+func SameContent(a, b string) (bool, error) {
+	return SameContentWith(a, b, TreeOptions{})
+}
+
+// SameContentWith is SameContent with the entries of directories and
+// symlinks treated according to opts.
+func SameContentWith(a, b string, opts TreeOptions) (bool, error) {
+	aInfo, aErr := StatWith(a, opts)
+	bInfo, bErr := StatWith(b, opts)
+	if os.IsNotExist(aErr) && os.IsNotExist(bErr) {
+		return true, nil
+	}
+	if os.IsNotExist(aErr) || os.IsNotExist(bErr) {
+		return false, nil
+	}
+	if aErr != nil {
+		return false, aErr
+	}
+	if bErr != nil {
+		return false, bErr
+	}
+	if aInfo.IsDir() != bInfo.IsDir() {
+		return false, nil
+	}
+	if !aInfo.IsDir() {
+		return sameEntry(a, b, aInfo, bInfo)
+	}
+
+	aFiles, err := listEntries(a, opts)
+	if err != nil {
+		return false, err
+	}
+	bFiles, err := listEntries(b, opts)
+	if err != nil {
+		return false, err
+	}
+	if len(aFiles) != len(bFiles) {
+		return false, nil
+	}
+	for i, entry := range aFiles {
+		other := bFiles[i]
+		if other.rel != entry.rel {
+			return false, nil
+		}
+		same, err := sameEntry(filepath.Join(a, entry.rel), filepath.Join(b, entry.rel), entry.info, other.info)
+		if err != nil || !same {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ListFiles returns the paths of all non-directory entries below dir,
+// relative to dir and in lexical order. .git directories are skipped.
+func ListFiles(dir string) ([]string, error) {
+	return ListFilesWith(dir, TreeOptions{})
+}
+
+// ListFilesWith is ListFiles with entries treated according to opts.
+func ListFilesWith(dir string, opts TreeOptions) ([]string, error) {
+	entries, err := listEntries(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, len(entries))
+	for i, entry := range entries {
+		files[i] = entry.rel
+	}
+	return files, nil
+}
+
+// IsSymlink reports whether path is a symlink.
+func IsSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&fs.ModeSymlink != 0
+}
+
+type treeEntry struct {
+	rel  string
+	info fs.FileInfo
+}
+
+func listEntries(dir string, opts TreeOptions) ([]treeEntry, error) {
+	var entries []treeEntry
+	err := WalkTree(dir, opts, func(rel, path string, info fs.FileInfo) error {
+		if !info.IsDir() {
+			entries = append(entries, treeEntry{rel: rel, info: info})
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// statWith returns what opts makes of path: the link itself, what it points
+// to, or nothing.
+func StatWith(path string, opts TreeOptions) (fs.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return info, err
+	}
+	switch opts.Symlinks {
+	case SymlinkFollow:
+		return os.Stat(path)
+	case SymlinkSkip:
+		return nil, fs.ErrNotExist
+	}
+	return info, nil
+}
+
+func sameEntry(a, b string, aInfo, bInfo fs.FileInfo) (bool, error) {
+	aLink := aInfo.Mode()&fs.ModeSymlink != 0
+	bLink := bInfo.Mode()&fs.ModeSymlink != 0
+	if aLink != bLink {
+		return false, nil
+	}
+	if aLink {
+		return sameLink(a, b)
+	}
+	return sameFile(a, b)
+}
+
+// sameLink compares link targets, treating a target inside the home
+// directory and its portable form as equal.
+func sameLink(a, b string) (bool, error) {
+	aTarget, err := LinkTarget(a)
+	if err != nil {
+		return false, err
+	}
+	bTarget, err := LinkTarget(b)
+	if err != nil {
+		return false, err
+	}
+	return aTarget == bTarget, nil
+}
+
+func sameFile(a, b string) (bool, error) {
+	aData, err := os.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	bData, err := os.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aData, bData), nil
+}
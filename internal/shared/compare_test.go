@@ -0,0 +1,119 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSameContentFiles(t *testing.T) {
+	temp := t.TempDir()
+	a := filepath.Join(temp, "a.txt")
+	b := filepath.Join(temp, "b.txt")
+	os.WriteFile(a, []byte("same"), 0600)
+	os.WriteFile(b, []byte("same"), 0600)
+
+	if same, err := SameContent(a, b); err != nil || !same {
+		t.Errorf("expected identical files to match, got %v, %v", same, err)
+	}
+
+	os.WriteFile(b, []byte("different"), 0600)
+	if same, err := SameContent(a, b); err != nil || same {
+		t.Errorf("expected different files not to match, got %v, %v", same, err)
+	}
+}
+
+func TestSameContentMissing(t *testing.T) {
+	temp := t.TempDir()
+	a := filepath.Join(temp, "a.txt")
+	missing1 := filepath.Join(temp, "missing1")
+	missing2 := filepath.Join(temp, "missing2")
+	os.WriteFile(a, []byte("data"), 0600)
+
+	if same, err := SameContent(missing1, missing2); err != nil || !same {
+		t.Errorf("expected two missing paths to match, got %v, %v", same, err)
+	}
+	if same, err := SameContent(a, missing1); err != nil || same {
+		t.Errorf("expected existing and missing paths not to match, got %v, %v", same, err)
+	}
+}
+
+func TestSameContentDirs(t *testing.T) {
+	temp := t.TempDir()
+	a := filepath.Join(temp, "a")
+	b := filepath.Join(temp, "b")
+	for _, dir := range []string{a, b} {
+		os.MkdirAll(filepath.Join(dir, "sub"), 0700)
+		os.WriteFile(filepath.Join(dir, "sub", "file.txt"), []byte("nested"), 0600)
+	}
+	// .git contents are ignored
+	os.MkdirAll(filepath.Join(a, ".git"), 0700)
+	os.WriteFile(filepath.Join(a, ".git", "HEAD"), []byte("ref"), 0600)
+
+	if same, err := SameContent(a, b); err != nil || !same {
+		t.Errorf("expected identical directories to match, got %v, %v", same, err)
+	}
+
+	os.WriteFile(filepath.Join(b, "extra.txt"), []byte("extra"), 0600)
+	if same, err := SameContent(a, b); err != nil || same {
+		t.Errorf("expected directories with different entries not to match, got %v, %v", same, err)
+	}
+
+	// A file never matches a directory
+	file := filepath.Join(temp, "file")
+	os.WriteFile(file, []byte("nested"), 0600)
+	if same, err := SameContent(a, file); err != nil || same {
+		t.Errorf("expected file and directory not to match, got %v, %v", same, err)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	temp := t.TempDir()
+	os.MkdirAll(filepath.Join(temp, "b"), 0700)
+	os.MkdirAll(filepath.Join(temp, ".git"), 0700)
+	os.WriteFile(filepath.Join(temp, "a.txt"), []byte("a"), 0600)
+	os.WriteFile(filepath.Join(temp, "b", "c.txt"), []byte("c"), 0600)
+	os.WriteFile(filepath.Join(temp, ".git", "config"), []byte("x"), 0600)
+
+	files, err := ListFiles(temp)
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	expected := []string{"a.txt", filepath.Join("b", "c.txt")}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+}
+
+func TestSameContentWithIgnore(t *testing.T) {
+	temp := t.TempDir()
+	a := filepath.Join(temp, "a")
+	b := filepath.Join(temp, "b")
+	for _, dir := range []string{a, b} {
+		os.MkdirAll(dir, 0700)
+		os.WriteFile(filepath.Join(dir, "init.lua"), []byte("same"), 0600)
+	}
+	os.WriteFile(filepath.Join(a, "lazy-lock.json"), []byte("local"), 0600)
+
+	ignore := NewIgnoreRules([]string{"lazy-lock.json"})
+	if same, err := SameContentWith(a, b, TreeOptions{Ignore: ignore}); err != nil || !same {
+		t.Errorf("expected ignored files to be left out, got %v, %v", same, err)
+	}
+	if same, _ := SameContent(a, b); same {
+		t.Error("expected directories to differ without ignore rules")
+	}
+	if files, _ := ListFilesWith(a, TreeOptions{Ignore: ignore}); !reflect.DeepEqual(files, []string{"init.lua"}) {
+		t.Errorf("expected ignored file to be left out of the listing, got %v", files)
+	}
+}
+
+func TestPathExists(t *testing.T) {
+	temp := t.TempDir()
+	if !PathExists(temp) {
+		t.Error("expected temp dir to exist")
+	}
+	if PathExists(filepath.Join(temp, "nope")) {
+		t.Error("expected missing path not to exist")
+	}
+}
@@ -0,0 +1,154 @@
+package shared
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Ignore rules
+
+// IgnoreRules matches paths inside a tracked directory against
+// gitignore-style patterns. Later patterns take precedence over earlier ones,
+// "!" re-includes a path, a trailing "/" only matches directories, patterns
+// containing a "/" are anchored to the directory root and "**" matches any
+// number of directories. A nil *IgnoreRules ignores nothing.
+type IgnoreRules struct {
+	patterns []ignorePattern
+	prefix   string
+}
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// NewIgnoreRules parses patterns given one per line. Blank lines and lines
+// starting with "#" are skipped.
+func NewIgnoreRules(lines []string) *IgnoreRules {
+	rules := &IgnoreRules{}
+	for _, line := range lines {
+		if p, ok := parseIgnorePattern(line); ok {
+			rules.patterns = append(rules.patterns, p)
+		}
+	}
+	return rules
+}
+
+// ParseIgnoreFile splits the contents of an ignore file into lines for
+// NewIgnoreRules.
+func ParseIgnoreFile(data []byte) []string {
+	return strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+}
+
+// Within returns the same rules for paths relative to dir, a directory
+// below the original root.
+func (r *IgnoreRules) Within(dir string) *IgnoreRules {
+	if r == nil {
+		return nil
+	}
+	return &IgnoreRules{patterns: r.patterns, prefix: path.Join(r.prefix, filepath.ToSlash(dir))}
+}
+
+// Match reports whether rel, a path relative to the root, is ignored either
+// itself or through one of its parent directories.
+func (r *IgnoreRules) Match(rel string, isDir bool) bool {
+	if r == nil || len(r.patterns) == 0 {
+		return false
+	}
+	rel = path.Clean(path.Join(r.prefix, filepath.ToSlash(rel)))
+	if rel == "." || rel == "/" {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if r.matchOne(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return r.matchOne(rel, isDir)
+}
+
+func (r *IgnoreRules) matchOne(rel string, isDir bool) bool {
+	ignored := false
+	for _, p := range r.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(rel) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	line = strings.TrimRight(line, " \t")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+	var p ignorePattern
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignorePattern{}, false
+	}
+
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	if !anchored {
+		sb.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "**") && i+2 == len(line):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			if end := strings.IndexByte(line[i+1:], ']'); end >= 0 {
+				class := line[i+1 : i+1+end]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				sb.WriteString("[" + class + "]")
+				i += end + 1
+			} else {
+				sb.WriteString(regexp.QuoteMeta("["))
+			}
+		case c == '\\' && i+1 < len(line):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(line[i])))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return ignorePattern{}, false
+	}
+	p.re = re
+	return p, true
+}
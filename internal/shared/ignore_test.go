@@ -0,0 +1,75 @@
+package shared
+
+import "testing"
+
+func TestIgnoreRulesMatch(t *testing.T) {
+	rules := NewIgnoreRules([]string{
+		"# plugin state",
+		"lazy-lock.json",
+		"*.swp",
+		"node_modules/",
+		"/cache",
+		"docs/**/*.html",
+		"!keep.swp",
+		"",
+	})
+
+	testCases := []struct {
+		rel     string
+		isDir   bool
+		ignored bool
+	}{
+		{"lazy-lock.json", false, true},
+		{"sub/lazy-lock.json", false, true},
+		{"init.lua", false, false},
+		{"lua/.init.lua.swp", false, true},
+		{"keep.swp", false, false},
+		{"node_modules", true, true},
+		{"node_modules", false, false},
+		{"a/node_modules/pkg/index.js", false, true},
+		{"cache", true, true},
+		{"cache/entry", false, true},
+		{"lua/cache", true, false},
+		{"docs/index.html", false, true},
+		{"docs/api/v1/index.html", false, true},
+		{"docs/index.md", false, false},
+		{".", true, false},
+	}
+
+	for _, tc := range testCases {
+		if got := rules.Match(tc.rel, tc.isDir); got != tc.ignored {
+			t.Errorf("Match(%q, %v) = %v, expected %v", tc.rel, tc.isDir, got, tc.ignored)
+		}
+	}
+}
+
+func TestIgnoreRulesWithin(t *testing.T) {
+	rules := NewIgnoreRules([]string{"/plugin/", "*.log"})
+	within := rules.Within("plugin")
+	if !within.Match("packer.lua", false) {
+		t.Error("expected files below an ignored directory to be ignored")
+	}
+	if !within.Match(".", true) {
+		t.Error("expected the ignored directory itself to match")
+	}
+	if rules.Within("lua").Match("init.lua", false) {
+		t.Error("expected files in other directories to be kept")
+	}
+	if !rules.Within("lua").Match("debug.log", false) {
+		t.Error("expected unanchored patterns to apply below the directory")
+	}
+}
+
+func TestIgnoreRulesNil(t *testing.T) {
+	var rules *IgnoreRules
+	if rules.Match("anything", false) || rules.Within("dir").Match("file", false) {
+		t.Error("expected nil rules to ignore nothing")
+	}
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	lines := ParseIgnoreFile([]byte("a\r\nb\n"))
+	if len(lines) != 3 || lines[0] != "a" || lines[1] != "b" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+}
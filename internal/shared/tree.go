@@ -0,0 +1,261 @@
+package shared
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Directory tree utilities
+
+// SymlinkPolicy says how symlinks are copied, listed and compared.
+type SymlinkPolicy string
+
+const (
+	// SymlinkStore keeps links as links. It is the default.
+	SymlinkStore SymlinkPolicy = "store"
+	// SymlinkFollow replaces links with the files or directories they point to.
+	SymlinkFollow SymlinkPolicy = "follow"
+	// SymlinkSkip leaves links out.
+	SymlinkSkip SymlinkPolicy = "skip"
+)
+
+// ParseSymlinkPolicy validates a policy name; "" means SymlinkStore.
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	switch SymlinkPolicy(name) {
+	case "", SymlinkStore:
+		return SymlinkStore, nil
+	case SymlinkFollow, SymlinkSkip:
+		return SymlinkPolicy(name), nil
+	}
+	return "", fmt.Errorf("unknown symlink policy %q (expected %s, %s or %s)", name, SymlinkStore, SymlinkFollow, SymlinkSkip)
+}
+
+// TreeOptions controls which entries of a directory tree are copied, listed
+// and compared.
+type TreeOptions struct {
+	// Ignore skips matching paths, relative to the root of the tree.
+	Ignore *IgnoreRules
+	// Symlinks defaults to SymlinkStore.
+	Symlinks SymlinkPolicy
+	// PortableLinks writes absolute link targets inside the home directory
+	// in the form used by ToStoragePath, so they resolve on other machines.
+	PortableLinks bool
+}
+
+// WalkTree calls fn for every entry below root in lexical order, applying
+// opts: ignored entries and .git directories are left out, and symlinks are
+// reported as links, as what they point to, or not at all. Directories are
+// reported before their contents; returning fs.SkipDir for one skips them.
+func WalkTree(root string, opts TreeOptions, fn func(rel, path string, info fs.FileInfo) error) error {
+	return walkTree(root, "", opts, map[string]bool{}, fn)
+}
+
+func walkTree(dir, prefix string, opts TreeOptions, visiting map[string]bool, fn func(rel, path string, info fs.FileInfo) error) error {
+	// Followed links can lead back to a directory being walked
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		if visiting[real] {
+			return nil
+		}
+		visiting[real] = true
+		defer delete(visiting, real)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() == ".git" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		rel := filepath.Join(prefix, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			switch opts.Symlinks {
+			case SymlinkSkip:
+				continue
+			case SymlinkFollow:
+				// Dangling links have nothing to follow
+				if info, err = os.Stat(path); err != nil {
+					continue
+				}
+			}
+		}
+		if opts.Ignore.Match(rel, info.IsDir()) {
+			continue
+		}
+		if err := fn(rel, path, info); err != nil {
+			if err == fs.SkipDir && info.IsDir() {
+				continue
+			}
+			return err
+		}
+		if info.IsDir() {
+			if err := walkTree(path, rel, opts, visiting, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CopyPathWith copies src, a file, directory or symlink, to dst according
+// to opts.
+func CopyPathWith(src, dst string, opts TreeOptions) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		switch opts.Symlinks {
+		case SymlinkSkip:
+			return nil
+		case SymlinkFollow:
+			if info, err = os.Stat(src); err != nil {
+				return err
+			}
+		default:
+			return copyLink(src, dst, opts.PortableLinks)
+		}
+	}
+	if info.IsDir() {
+		return CopyDirWith(src, dst, opts)
+	}
+	return copyRegular(src, dst)
+}
+
+func CopyDirWith(src, dst string, opts TreeOptions) error {
+	if err := EnsureDir(dst); err != nil {
+		return err
+	}
+	return WalkTree(src, opts, func(rel, path string, info fs.FileInfo) error {
+		dstPath := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return EnsureDir(dstPath)
+		case info.Mode()&fs.ModeSymlink != 0:
+			return copyLink(path, dstPath, opts.PortableLinks)
+		}
+		return copyRegular(path, dstPath)
+	})
+}
+
+// CopyAll copies the tree at src to dst as it is, .git directories included.
+// Entries that are neither files, directories nor symlinks, such as sockets,
+// are left out.
+func CopyAll(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return EnsureDir(target)
+		case d.Type()&fs.ModeSymlink != 0:
+			return CopyLink(path, target)
+		case !d.Type().IsRegular():
+			return nil
+		}
+		return copyRegular(path, target)
+	})
+}
+
+// CopyLink recreates the symlink src at dst with the same target.
+func CopyLink(src, dst string) error {
+	return copyLink(src, dst, false)
+}
+
+func copyLink(src, dst string, portable bool) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if portable && filepath.IsAbs(target) {
+		target = ToStoragePath(target)
+	}
+	return WriteLink(target, dst)
+}
+
+// WriteLink makes dst a symlink to target, replacing a file or link already
+// there.
+func WriteLink(target, dst string) error {
+	if err := EnsureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(dst); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", dst)
+		}
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, dst)
+}
+
+// LinkTarget returns the target of the symlink at path, resolving the HOME
+// placeholder written for portable links.
+func LinkTarget(path string) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	return FromStoragePath(target), nil
+}
+
+// copyRegular copies a regular file, replacing a symlink at dst instead of
+// writing through it.
+func copyRegular(src, dst string) error {
+	if info, err := os.Lstat(dst); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+	return CopyFile(src, dst)
+}
+
+// RemoveExcluded deletes the entries below dir that opts leaves out, such as
+// files copied before an ignore pattern was added, or links when they are
+// no longer stored as links.
+func RemoveExcluded(dir string, opts TreeOptions) error {
+	if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+		return nil
+	}
+	var excluded []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		isLink := d.Type()&fs.ModeSymlink != 0
+		if opts.Ignore.Match(rel, d.IsDir()) || (isLink && opts.Symlinks != "" && opts.Symlinks != SymlinkStore) {
+			excluded = append(excluded, path)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range excluded {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
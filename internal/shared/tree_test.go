@@ -0,0 +1,135 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// linkTree creates a directory with a file, a link to it and a link to a
+// directory outside the tree.
+func linkTree(t *testing.T) string {
+	t.Helper()
+	temp := t.TempDir()
+	src := filepath.Join(temp, "src")
+	outside := filepath.Join(temp, "outside")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(outside, 0755)
+	os.WriteFile(filepath.Join(src, "real"), []byte("real"), 0644)
+	os.WriteFile(filepath.Join(outside, "theme"), []byte("theme"), 0644)
+	os.Symlink("real", filepath.Join(src, "alias"))
+	os.Symlink(outside, filepath.Join(src, "themes"))
+	return src
+}
+
+func TestParseSymlinkPolicy(t *testing.T) {
+	for name, expected := range map[string]SymlinkPolicy{"": SymlinkStore, "store": SymlinkStore, "follow": SymlinkFollow, "skip": SymlinkSkip} {
+		if policy, err := ParseSymlinkPolicy(name); err != nil || policy != expected {
+			t.Errorf("ParseSymlinkPolicy(%q) = %q, %v", name, policy, err)
+		}
+	}
+	if _, err := ParseSymlinkPolicy("copy"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestListFilesWithSymlinkPolicy(t *testing.T) {
+	src := linkTree(t)
+	testCases := []struct {
+		policy   SymlinkPolicy
+		expected []string
+	}{
+		{SymlinkStore, []string{"alias", "real", "themes"}},
+		{SymlinkFollow, []string{"alias", "real", filepath.Join("themes", "theme")}},
+		{SymlinkSkip, []string{"real"}},
+	}
+	for _, tc := range testCases {
+		files, err := ListFilesWith(src, TreeOptions{Symlinks: tc.policy})
+		if err != nil {
+			t.Fatalf("ListFilesWith failed: %v", err)
+		}
+		if !reflect.DeepEqual(files, tc.expected) {
+			t.Errorf("policy %s: expected %v, got %v", tc.policy, tc.expected, files)
+		}
+	}
+}
+
+func TestWalkTreeFollowCycle(t *testing.T) {
+	temp := t.TempDir()
+	os.MkdirAll(filepath.Join(temp, "a"), 0755)
+	os.WriteFile(filepath.Join(temp, "a", "file"), []byte("x"), 0644)
+	os.Symlink(temp, filepath.Join(temp, "a", "loop"))
+
+	files, err := ListFilesWith(temp, TreeOptions{Symlinks: SymlinkFollow})
+	if err != nil {
+		t.Fatalf("ListFilesWith failed: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{filepath.Join("a", "file")}) {
+		t.Errorf("expected the cycle to be cut, got %v", files)
+	}
+}
+
+func TestCopyPathWithSymlinks(t *testing.T) {
+	src := linkTree(t)
+
+	stored := filepath.Join(t.TempDir(), "stored")
+	if err := CopyPathWith(src, stored, TreeOptions{}); err != nil {
+		t.Fatalf("CopyPathWith failed: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(stored, "alias")); err != nil || target != "real" {
+		t.Errorf("expected alias to stay a link, got %q (%v)", target, err)
+	}
+	if !IsSymlink(filepath.Join(stored, "themes")) {
+		t.Error("expected themes to stay a link")
+	}
+
+	followed := filepath.Join(t.TempDir(), "followed")
+	CopyPathWith(src, followed, TreeOptions{Symlinks: SymlinkFollow})
+	if IsSymlink(filepath.Join(followed, "alias")) {
+		t.Error("expected alias to be copied as a file")
+	}
+	if data, _ := os.ReadFile(filepath.Join(followed, "themes", "theme")); string(data) != "theme" {
+		t.Errorf("expected the linked directory to be copied, got %q", data)
+	}
+
+	// Copying a link over a regular file replaces the file
+	dst := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(dst, []byte("old"), 0644)
+	if err := CopyPathWith(filepath.Join(src, "alias"), dst, TreeOptions{}); err != nil || !IsSymlink(dst) {
+		t.Errorf("expected dst to become a link, got %v", err)
+	}
+}
+
+func TestCopyPathWithPortableLinks(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	os.WriteFile(filepath.Join(home, "vimrc"), []byte("set nu"), 0644)
+	link := filepath.Join(home, ".vimrc")
+	os.Symlink(filepath.Join(home, "vimrc"), link)
+
+	stored := filepath.Join(t.TempDir(), "stored")
+	if err := CopyPathWith(link, stored, TreeOptions{PortableLinks: true}); err != nil {
+		t.Fatalf("CopyPathWith failed: %v", err)
+	}
+	if target, _ := os.Readlink(stored); target != "HOME/vimrc" {
+		t.Errorf("expected a portable target, got %q", target)
+	}
+	if target, _ := LinkTarget(stored); target != filepath.Join(home, "vimrc") {
+		t.Errorf("expected LinkTarget to expand HOME, got %q", target)
+	}
+	if same, err := SameContentWith(link, stored, TreeOptions{}); err != nil || !same {
+		t.Errorf("expected the stored link to match the live one, got %v %v", same, err)
+	}
+}
+
+func TestRemoveExcludedSymlinks(t *testing.T) {
+	src := linkTree(t)
+	if err := RemoveExcluded(src, TreeOptions{Symlinks: SymlinkSkip}); err != nil {
+		t.Fatalf("RemoveExcluded failed: %v", err)
+	}
+	files, _ := ListFilesWith(src, TreeOptions{})
+	if !reflect.DeepEqual(files, []string{"real"}) {
+		t.Errorf("expected links to be removed, got %v", files)
+	}
+}
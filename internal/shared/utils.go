@@ -3,7 +3,6 @@ package shared
 import (
 	"fmt"
 	"io"
-	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -20,6 +19,36 @@ func GetDotSyncFilesDir() string {
 	return ".dot-sync/files"
 }
 
+func GetDotSyncBackupsDir() string {
+	return ".dot-sync/backups"
+}
+
+func GetDotSyncBaseDir() string {
+	return ".dot-sync/base"
+}
+
+// GetDotSyncPlainDir holds the decrypted copy of files/ when encryption is
+// set up; like base/ it never leaves the machine.
+func GetDotSyncPlainDir() string {
+	return ".dot-sync/plain"
+}
+
+func GetDotSyncIgnoreFile() string {
+	return ".dot-sync/ignore"
+}
+
+// GetDotSyncScanFile holds the rules and allow list of the secret scan; it
+// is synced like the ignore file.
+func GetDotSyncScanFile() string {
+	return ".dot-sync/scan"
+}
+
+// GetSkipStorageAnnotation names the command annotation that marks a
+// command, and everything under it, as never touching the storage remote.
+func GetSkipStorageAnnotation() string {
+	return "skipStorage"
+}
+
 type contextKey string
 
 func GetStorageProviderKey() contextKey {
@@ -106,15 +135,13 @@ func FromStoragePath(storagePath string) string {
 // File copy utilities
 
 func CopyToDotSyncFilesByID(id int, filePath string, dotSyncFilesPath string) error {
-	info, err := os.Lstat(filePath)
-	if err != nil {
-		return err
-	}
-	dst := filepath.Join(dotSyncFilesPath, fmt.Sprintf("%d", id))
-	if info.IsDir() {
-		return CopyDir(filePath, dst)
-	}
-	return CopyFile(filePath, dst)
+	return CopyPathWith(filePath, filepath.Join(dotSyncFilesPath, fmt.Sprintf("%d", id)), TreeOptions{PortableLinks: true})
+}
+
+// CopyPath copies src to dst with CopyDir or CopyFile depending on what src
+// is. Symlinks are copied as links.
+func CopyPath(src, dst string) error {
+	return CopyPathWith(src, dst, TreeOptions{})
 }
 
 func CopyFile(src, dst string) error {
@@ -126,7 +153,12 @@ func CopyFile(src, dst string) error {
 		return err
 	}
 	defer srcFile.Close()
-	dstFile, err := os.Create(dst)
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	// New files get the permissions of the source; existing files keep theirs
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
 	if err != nil {
 		return err
 	}
@@ -136,23 +168,7 @@ func CopyFile(src, dst string) error {
 }
 
 func CopyDir(src, dst string) error {
-	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() && d.Name() == ".git" {
-			return fs.SkipDir
-		}
-		rel, err := filepath.Rel(src, path)
-		if err != nil {
-			return err
-		}
-		dstPath := filepath.Join(dst, rel)
-		if d.IsDir() {
-			return EnsureDir(dstPath)
-		}
-		return CopyFile(path, dstPath)
-	})
+	return CopyDirWith(src, dst, TreeOptions{})
 }
 
 func RunCmd(dir string, name string, args ...string) error {
@@ -53,6 +53,31 @@ func TestCopyFile(t *testing.T) {
 	}
 }
 
+func TestCopyFileMode(t *testing.T) {
+	temp := t.TempDir()
+	src := filepath.Join(temp, "script.sh")
+	os.WriteFile(src, []byte("#!/bin/sh\n"), 0700)
+	os.Chmod(src, 0755)
+
+	dst := filepath.Join(temp, "copy.sh")
+	if err := CopyFile(src, dst); err != nil {
+		t.Fatalf("CopyFile failed: %v", err)
+	}
+	if info, _ := os.Stat(dst); info.Mode().Perm() != 0755 {
+		t.Errorf("expected new file to get the source mode, got %v", info.Mode().Perm())
+	}
+
+	// Overwriting keeps the mode of the existing file
+	existing := filepath.Join(temp, "existing")
+	os.WriteFile(existing, []byte("old"), 0600)
+	if err := CopyFile(src, existing); err != nil {
+		t.Fatalf("CopyFile failed: %v", err)
+	}
+	if info, _ := os.Stat(existing); info.Mode().Perm() != 0600 {
+		t.Errorf("expected existing file to keep its mode, got %v", info.Mode().Perm())
+	}
+}
+
 func TestCopyDir(t *testing.T) {
 	temp := t.TempDir()
 	src := filepath.Join(temp, "src")
@@ -72,6 +97,39 @@ func TestCopyDir(t *testing.T) {
 	}
 }
 
+func TestCopyDirWithIgnore(t *testing.T) {
+	temp := t.TempDir()
+	src := filepath.Join(temp, "src")
+	dst := filepath.Join(temp, "dst")
+	os.MkdirAll(filepath.Join(src, "plugin"), 0700)
+	os.WriteFile(filepath.Join(src, "init.lua"), []byte("init"), 0600)
+	os.WriteFile(filepath.Join(src, "lazy-lock.json"), []byte("lock"), 0600)
+	os.WriteFile(filepath.Join(src, "plugin", "cache.bin"), []byte("cache"), 0600)
+
+	ignore := NewIgnoreRules([]string{"lazy-lock.json", "plugin/"})
+	if err := CopyDirWith(src, dst, TreeOptions{Ignore: ignore}); err != nil {
+		t.Fatalf("CopyDirWith failed: %v", err)
+	}
+	if !PathExists(filepath.Join(dst, "init.lua")) {
+		t.Error("expected init.lua to be copied")
+	}
+	for _, rel := range []string{"lazy-lock.json", "plugin"} {
+		if PathExists(filepath.Join(dst, rel)) {
+			t.Errorf("expected %s to be skipped", rel)
+		}
+	}
+
+	// Entries copied before the patterns existed are pruned
+	CopyDir(src, dst)
+	if err := RemoveExcluded(dst, TreeOptions{Ignore: ignore}); err != nil {
+		t.Fatalf("RemoveExcluded failed: %v", err)
+	}
+	files, _ := ListFiles(dst)
+	if len(files) != 1 || files[0] != "init.lua" {
+		t.Errorf("expected only init.lua to remain, got %v", files)
+	}
+}
+
 func TestCopyToDotSyncFilesByID(t *testing.T) {
 	temp := t.TempDir()
 	dotSyncFiles := filepath.Join(temp, "dot-sync-files")
@@ -2,9 +2,11 @@ package internal
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
 )
 
 func NewShowCmd() *cobra.Command {
@@ -42,5 +44,32 @@ func showHandler(cmd *cobra.Command, args []string) {
 	fmt.Printf("Files currently tracked for syncing (%d):\n", len(records))
 	for _, record := range records {
 		fmt.Printf("  %s\n", record.Path)
+		if len(record.Exclude) > 0 {
+			fmt.Printf("    exclude: %s\n", strings.Join(record.Exclude, ", "))
+		}
+		if record.Symlinks != "" && record.Symlinks != string(shared.SymlinkStore) {
+			fmt.Printf("    symlinks: %s\n", record.Symlinks)
+		}
+		if record.Encrypted {
+			fmt.Println("    encrypted")
+		}
+		if record.Template {
+			fmt.Println("    template")
+		}
+	}
+
+	ignores, err := loadIgnoreSet()
+	if err != nil {
+		fmt.Println("Failed to read ignore file:", err)
+		return
+	}
+	var global []string
+	for _, line := range ignores.global {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			global = append(global, line)
+		}
+	}
+	if len(global) > 0 {
+		fmt.Printf("Ignored in every tracked directory (~/%s): %s\n", shared.GetDotSyncIgnoreFile(), strings.Join(global, ", "))
 	}
 }
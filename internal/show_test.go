@@ -246,3 +246,49 @@ func TestShowHandlerWithDuplicateFiles(t *testing.T) {
 		t.Errorf("expected path to appear exactly twice due to duplicates, but appeared %d times", pathCount)
 	}
 }
+
+func TestShowHandlerListsIgnorePatterns(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	tempHome := t.TempDir()
+	os.Setenv("HOME", tempHome)
+	defer os.Setenv("HOME", oldHome)
+	os.MkdirAll(filepath.Join(tempHome, ".dot-sync"), 0700)
+	os.WriteFile(filepath.Join(tempHome, ".dot-sync", "ignore"), []byte("# comment\n*.swp\nnode_modules/\n"), 0600)
+
+	nvimDir := filepath.Join(tempHome, ".config", "nvim")
+	cmd := NewMarkCmd()
+	cmd.Flags().Set("exclude", "lazy-lock.json")
+	captureStdout(func() { markHandler(cmd, []string{nvimDir}) })
+
+	output := captureStdout(func() { showHandler(&cobra.Command{}, []string{}) })
+	if !strings.Contains(output, nvimDir+"\n    exclude: lazy-lock.json\n") {
+		t.Errorf("expected record excludes to be shown, got %q", output)
+	}
+	if !strings.Contains(output, "Ignored in every tracked directory (~/.dot-sync/ignore): *.swp, node_modules/") {
+		t.Errorf("expected global patterns to be shown, got %q", output)
+	}
+}
+
+func TestShowHandlerListsEncryptedRecords(t *testing.T) {
+	oldHome := os.Getenv("HOME")
+	tempHome := t.TempDir()
+	os.Setenv("HOME", tempHome)
+	defer os.Setenv("HOME", oldHome)
+	os.MkdirAll(filepath.Join(tempHome, ".dot-sync"), 0700)
+
+	netrc := filepath.Join(tempHome, ".netrc")
+	zshrc := filepath.Join(tempHome, ".zshrc")
+	captureStdout(func() { markHandler(&cobra.Command{}, []string{netrc, zshrc}) })
+	database, _ := db.OpenDotSyncDB()
+	records, _ := db.GetFileRecordsByPaths(database, []string{netrc})
+	db.SetFileEncrypted(database, records[0].ID, true)
+	database.Close()
+
+	output := captureStdout(func() { showHandler(&cobra.Command{}, []string{}) })
+	if !strings.Contains(output, netrc+"\n    encrypted\n") {
+		t.Errorf("expected the encrypted record to be shown as such, got %q", output)
+	}
+	if strings.Contains(output, zshrc+"\n    encrypted") {
+		t.Errorf("expected only the encrypted record to be shown as such, got %q", output)
+	}
+}
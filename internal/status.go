@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+	"github.com/tylerkeyes/dot-sync/storage"
+)
+
+type fileState string
+
+const (
+	stateUpToDate         fileState = "up-to-date"
+	stateModifiedLocally  fileState = "modified-locally"
+	stateModifiedRemotely fileState = "modified-remotely"
+	stateConflict         fileState = "conflict"
+	stateMissingLocally   fileState = "missing-locally"
+	stateMissingInStorage fileState = "missing-in-storage"
+)
+
+func NewStatusCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show how tracked files differ from storage and the remote",
+		Run:   statusHandler,
+	}
+}
+
+func statusHandler(cmd *cobra.Command, args []string) {
+	dotSyncDir := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncDir())
+
+	sp, ok := storageProviderFromCmd(cmd)
+	if !ok {
+		fmt.Println("No storage provider configured. Please run 'dot-sync storage init' first.")
+		return
+	}
+
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		fmt.Println("Failed to open .dot-sync.db:", err)
+		return
+	}
+	defer database.Close()
+
+	if err := db.EnsureFilesTable(database); err != nil {
+		fmt.Println("Failed to ensure files table:", err)
+		return
+	}
+
+	records, err := db.GetAllFilePaths(database)
+	if err != nil {
+		fmt.Println("Failed to read file paths from database:", err)
+		return
+	}
+
+	if len(records) == 0 {
+		fmt.Println("No files currently tracked for syncing.")
+		return
+	}
+
+	if err := sp.Fetch(dotSyncDir); err != nil {
+		fmt.Println("Failed to fetch from storage:", err)
+		return
+	}
+
+	snapshotDir, err := os.MkdirTemp("", "dot-sync-status-")
+	if err != nil {
+		fmt.Println("Failed to create temporary directory:", err)
+		return
+	}
+	defer os.RemoveAll(snapshotDir)
+
+	baseRev := filepath.Join(snapshotDir, string(storage.RevisionBase))
+	remoteRev := filepath.Join(snapshotDir, string(storage.RevisionRemote))
+	codec, err := loadCodec()
+	if err != nil {
+		fmt.Println("Failed to load keys and secrets:", err)
+		return
+	}
+	if err := codec.ensurePlain(); err != nil {
+		fmt.Println("Failed to read stored files:", err)
+		return
+	}
+	dotSyncFilesPath := stagingFilesDir(codec)
+	if err := exportBase(sp, dotSyncDir, baseRev, codec); err != nil {
+		fmt.Println("Failed to read last synced state:", err)
+		return
+	}
+	if err := sp.ExportRevision(dotSyncDir, storage.RevisionRemote, remoteRev); err != nil {
+		fmt.Println("Failed to read remote state:", err)
+		return
+	}
+	if err := codec.openFiles(remoteRev); err != nil {
+		fmt.Println("Failed to read remote state:", err)
+		return
+	}
+
+	ignores, err := loadIgnoreSet()
+	if err != nil {
+		fmt.Println("Failed to read ignore file:", err)
+		return
+	}
+
+	fmt.Printf("Status of tracked files (%d):\n", len(records))
+	for _, rec := range records {
+		id := fmt.Sprintf("%d", rec.ID)
+		state, err := classifyRecord(
+			rec.Path,
+			filepath.Join(dotSyncFilesPath, id),
+			filepath.Join(baseRev, id),
+			filepath.Join(remoteRev, id),
+			recordTreeOptions(ignores, rec),
+		)
+		if err != nil {
+			fmt.Printf("  %-18s %s: %v\n", "error", rec.Path, err)
+			continue
+		}
+		fmt.Printf("  %-18s %s\n", state, rec.Path)
+	}
+}
+
+// classifyRecord compares the live path of a record with its staged copy,
+// the last synced copy and the copy on the remote, leaving out files inside
+// directories according to opts.
+func classifyRecord(live, staged, base, remote string, opts shared.TreeOptions) (fileState, error) {
+	if _, err := shared.StatWith(live, opts); err != nil {
+		return stateMissingLocally, nil
+	}
+	if !shared.PathExists(staged) && !shared.PathExists(remote) {
+		return stateMissingInStorage, nil
+	}
+
+	// The staged copy only counts as a local change while it holds commits
+	// that have not reached the remote; after a selective pull it can match
+	// the remote while the live file still matches the base.
+	liveChanged, err := differs(live, base, opts)
+	if err != nil {
+		return "", err
+	}
+	stagedChanged, err := differs(staged, base, opts)
+	if err != nil {
+		return "", err
+	}
+	if stagedChanged {
+		if stagedChanged, err = differs(staged, remote, opts); err != nil {
+			return "", err
+		}
+	}
+	remoteChanged, err := differs(remote, base, opts)
+	if err != nil {
+		return "", err
+	}
+	if liveChanged && !stagedChanged {
+		if same, err := shared.SameContentWith(live, remote, opts); err != nil || same {
+			return stateUpToDate, err
+		}
+	}
+
+	localChanged := liveChanged || stagedChanged
+	switch {
+	case localChanged && remoteChanged:
+		return stateConflict, nil
+	case localChanged:
+		return stateModifiedLocally, nil
+	case remoteChanged:
+		return stateModifiedRemotely, nil
+	}
+	return stateUpToDate, nil
+}
+
+func differs(a, b string, opts shared.TreeOptions) (bool, error) {
+	same, err := shared.SameContentWith(a, b, opts)
+	return !same, err
+}
+
+// storageProviderFromCmd returns the storage provider loaded by the root
+// command, if any.
+func storageProviderFromCmd(cmd *cobra.Command) (storage.StorageProvider, bool) {
+	ctx := cmd.Context()
+	if ctx == nil {
+		return nil, false
+	}
+	sp, ok := ctx.Value(shared.GetStorageProviderKey()).(storage.StorageProvider)
+	return sp, ok && sp != nil
+}
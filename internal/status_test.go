@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+	"github.com/tylerkeyes/dot-sync/storage"
+)
+
+// captureStdout returns everything fn writes to stdout.
+func captureStdout(fn func()) string {
+	var buf bytes.Buffer
+	orig := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	fn()
+
+	w.Close()
+	os.Stdout = orig
+	buf.ReadFrom(r)
+	return buf.String()
+}
+
+// setupGitSync points HOME at a temporary directory, initializes git storage
+// against a local bare repository and returns a command carrying the
+// provider in its context along with the bare repository path.
+func setupGitSync(t *testing.T) (*cobra.Command, string) {
+	t.Helper()
+	oldHome := os.Getenv("HOME")
+	tempHome := t.TempDir()
+	os.Setenv("HOME", tempHome)
+	t.Cleanup(func() { os.Setenv("HOME", oldHome) })
+	t.Setenv("GIT_AUTHOR_NAME", "Test User")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "Test User")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if err := shared.RunCmd("", "git", "init", "--bare", remote); err != nil {
+		t.Skip("git not available for testing")
+	}
+
+	sp := &storage.GitStorage{RemoteURL: remote}
+	if err := sp.InitializeStorage(); err != nil {
+		t.Fatalf("InitializeStorage failed: %v", err)
+	}
+
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := db.EnsureFilesTable(database); err != nil {
+		t.Fatalf("Failed to ensure files table: %v", err)
+	}
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), shared.GetStorageProviderKey(), sp))
+	return cmd, remote
+}
+
+// cloneRemote clones the bare repository into a scratch working copy so tests
+// can push changes as if from another machine.
+func cloneRemote(t *testing.T, remote string) string {
+	t.Helper()
+	clone := filepath.Join(t.TempDir(), "clone")
+	if err := shared.RunCmd("", "git", "clone", remote, clone); err != nil {
+		t.Fatalf("git clone failed: %v", err)
+	}
+	return clone
+}
+
+func TestNewStatusCmd(t *testing.T) {
+	cmd := NewStatusCmd()
+	if cmd == nil {
+		t.Fatal("NewStatusCmd returned nil")
+	}
+	if !strings.Contains(cmd.Use, "status") {
+		t.Errorf("expected Use to contain 'status', got %q", cmd.Use)
+	}
+	if cmd.Run == nil {
+		t.Error("expected Run to be set")
+	}
+}
+
+func TestStatusHandlerNoStorageProvider(t *testing.T) {
+	cmd := &cobra.Command{}
+	output := captureStdout(func() { statusHandler(cmd, []string{}) })
+	if !strings.Contains(output, "No storage provider configured") {
+		t.Errorf("expected missing provider message, got %q", output)
+	}
+}
+
+func TestClassifyRecord(t *testing.T) {
+	temp := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(temp, name)
+		os.WriteFile(path, []byte(content), 0600)
+		return path
+	}
+	missing := filepath.Join(temp, "missing")
+	base := write("base", "base")
+	local := write("local", "local")
+	remote := write("remote", "remote")
+
+	testCases := []struct {
+		name     string
+		live     string
+		staged   string
+		base     string
+		remote   string
+		expected fileState
+	}{
+		{"up to date", base, base, base, base, stateUpToDate},
+		{"live edited", local, base, base, base, stateModifiedLocally},
+		{"staged not pushed", local, local, base, base, stateModifiedLocally},
+		{"remote moved", base, base, base, remote, stateModifiedRemotely},
+		{"both changed", local, base, base, remote, stateConflict},
+		{"remote pulled for other files", base, remote, base, remote, stateModifiedRemotely},
+		{"same change on both sides", remote, base, base, remote, stateUpToDate},
+		{"live missing", missing, base, base, base, stateMissingLocally},
+		{"never synced", base, missing, missing, missing, stateMissingInStorage},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state, err := classifyRecord(tc.live, tc.staged, tc.base, tc.remote, shared.TreeOptions{})
+			if err != nil {
+				t.Fatalf("classifyRecord failed: %v", err)
+			}
+			if state != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, state)
+			}
+		})
+	}
+}
+
+func TestStatusHandlerWithGitRemote(t *testing.T) {
+	cmd, remote := setupGitSync(t)
+	home := shared.FindHomeDir()
+
+	local := filepath.Join(home, ".vimrc")
+	remoteEdited := filepath.Join(home, ".bashrc")
+	untouched := filepath.Join(home, ".gitconfig")
+	for _, path := range []string{local, remoteEdited, untouched} {
+		os.WriteFile(path, []byte("original\n"), 0600)
+	}
+	markHandler(cmd, []string{local, remoteEdited, untouched})
+	captureStdout(func() { syncHandler(cmd, []string{}) })
+
+	database, _ := db.OpenDotSyncDB()
+	records, _ := db.GetFileRecordsByPaths(database, []string{remoteEdited})
+	database.Close()
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+
+	// Another machine pushes a change to .bashrc
+	clone := cloneRemote(t, remote)
+	os.WriteFile(filepath.Join(clone, "files", fmt.Sprintf("%d", records[0].ID)), []byte("remote\n"), 0600)
+	shared.RunCmd(clone, "git", "commit", "-am", "remote edit")
+	shared.RunCmd(clone, "git", "push")
+
+	os.WriteFile(local, []byte("local\n"), 0600)
+
+	output := captureStdout(func() { statusHandler(cmd, []string{}) })
+	expected := map[string]fileState{
+		local:        stateModifiedLocally,
+		remoteEdited: stateModifiedRemotely,
+		untouched:    stateUpToDate,
+	}
+	for path, state := range expected {
+		if !strings.Contains(output, string(state)+strings.Repeat(" ", 18-len(state))+" "+path) {
+			t.Errorf("expected %s to be %s, got %q", path, state, output)
+		}
+	}
+}
@@ -1,26 +1,39 @@
 package internal
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/scan"
 	"github.com/tylerkeyes/dot-sync/internal/shared"
-	"github.com/tylerkeyes/dot-sync/internal/storage"
+	"github.com/tylerkeyes/dot-sync/storage"
 )
 
 func NewSyncCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "sync",
+	cmd := &cobra.Command{
+		Use:   "sync [files or directories]...",
 		Short: "Sync dotfiles to remote storage",
 		Run:   syncHandler,
 	}
+	cmd.Flags().Bool("force", false, "Overwrite the remote even if it has changes that were not pulled")
+	cmd.Flags().Bool("dry-run", false, "List what would be copied and pushed without changing anything")
+	cmd.Flags().String("remote", "", "Push to the named remote instead of the default one")
+	cmd.Flags().Bool("all-remotes", false, "Push to every configured remote")
+	addSelectionFlags(cmd)
+	return cmd
 }
 
 func syncHandler(cmd *cobra.Command, args []string) {
-	dotSyncFilesPath := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir())
 	dotSyncDir := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncDir())
+	force, _ := cmd.Flags().GetBool("force")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
 
 	database, err := db.OpenDotSyncDB()
 	if err != nil {
@@ -35,18 +48,388 @@ func syncHandler(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	for _, rec := range records {
-		if err := shared.CopyToDotSyncFilesByID(rec.ID, rec.Path, dotSyncFilesPath); err != nil {
-			fmt.Printf("Failed to copy %s: %v\n", rec.Path, err)
+	selected := selectionFromCmd(cmd, args, records)
+	if len(records) > 0 && len(selected) == 0 {
+		fmt.Println("No matching files found in tracking database.")
+		return
+	}
+
+	ignores, err := loadIgnoreSet()
+	if err != nil {
+		fmt.Println("Failed to read ignore file:", err)
+		return
+	}
+
+	scanner, err := loadScanner()
+	if err != nil {
+		fmt.Println("Failed to read secret scan config:", err)
+		return
+	}
+
+	if dryRun {
+		codec, err := peekCodec()
+		if err != nil {
+			fmt.Println("Failed to load keys and secrets:", err)
+			return
+		}
+		dotSyncFilesPath, cleanup, err := codec.planFilesDir()
+		if err != nil {
+			fmt.Println("Failed to read stored files:", err)
+			return
+		}
+		defer cleanup()
+		printSyncPlan(records, selected, dotSyncFilesPath, ignores, scanner, codec)
+		return
+	}
+
+	codec, err := loadCodec()
+	if err != nil {
+		fmt.Println("Failed to load keys and secrets:", err)
+		return
+	}
+	if err := codec.ensurePlain(); err != nil {
+		fmt.Println("Failed to read stored files:", err)
+		return
+	}
+	dotSyncFilesPath := stagingFilesDir(codec)
+
+	remotes, err := syncRemotes(cmd)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var parts []syncPart
+	for _, sel := range selected {
+		for _, part := range syncParts(sel, dotSyncFilesPath, ignores) {
+			if part.ignored() {
+				fmt.Printf("Skipping %s: it matches an ignore pattern.\n", part.Live)
+				continue
+			}
+			if part.skippedLink() {
+				fmt.Printf("Skipping %s: it is a symlink and its symlink policy is skip.\n", part.Live)
+				// Drop a link stored before the policy was set
+				if shared.IsSymlink(part.Staged) {
+					os.Remove(part.Staged)
+				}
+				continue
+			}
+			if part.remoteAhead() {
+				fmt.Printf("Skipping %s: it has remote changes that were not pulled (run 'dot-sync pull %s').\n", part.Live, part.Live)
+				continue
+			}
+			if part.overwritesTemplate() {
+				fmt.Printf("Skipping %s: it was changed, but it is rendered from a template (change the template with 'dot-sync edit %s').\n", part.Live, part.Root)
+				continue
+			}
+			parts = append(parts, part)
+		}
+	}
+
+	// Secrets are caught before anything is staged, so a blocked sync
+	// leaves nothing behind for a later push. Every remote gets the whole
+	// staging directory, so records that are not synced now are scanned too.
+	findings, err := scanPush(scanner, codec, records, parts, dotSyncFilesPath)
+	if err != nil {
+		fmt.Println("Failed to scan for secrets:", err)
+		return
+	}
+	if len(findings) > 0 {
+		fmt.Println("Refusing to sync: these files look like they contain secrets:")
+		printScanFindings(findings)
+		fmt.Printf("Encrypt them with 'dot-sync mark --encrypt', or allow the findings in ~/%s.\n", shared.GetDotSyncScanFile())
+		return
+	}
+
+	var copied []syncPart
+	for _, part := range parts {
+		if err := shared.CopyPathWith(part.Live, part.Staged, part.Tree); err != nil {
+			fmt.Printf("Failed to copy %s: %v\n", part.Live, err)
+			continue
+		}
+		// Stop pushing files that were copied before a pattern or symlink
+		// policy was set
+		if err := shared.RemoveExcluded(part.Staged, part.Tree); err != nil {
+			fmt.Printf("Failed to remove ignored files from the stored copy of %s: %v\n", part.Live, err)
+		}
+		if err := recordSyncedMeta(database, part); err != nil {
+			fmt.Printf("Failed to record permissions of %s: %v\n", part.Live, err)
+		}
+		copied = append(copied, part)
+	}
+	if err := codec.sealRecords(records); err != nil {
+		fmt.Println("Failed to write stored files:", err)
+		return
+	}
+
+	pushedDefault, failed := false, false
+	for _, remote := range remotes {
+		if len(remotes) > 1 {
+			fmt.Printf("Syncing to %s (%s)...\n", remote.Name, remote.StorageType)
+		}
+		if pushToRemote(remote, dotSyncDir, records, force) {
+			pushedDefault = pushedDefault || remote.IsDefault
+		} else {
+			failed = true
+		}
+	}
+
+	// What was pushed to the default remote is now the last synced version
+	// on this machine
+	if pushedDefault {
+		for _, part := range copied {
+			if err := replaceWithCopy(part.Staged, part.Base); err != nil {
+				fmt.Printf("Warning: failed to record synced copy of %s: %v\n", part.Live, err)
+			}
+		}
+	}
+
+	if !failed {
+		fmt.Println("Sync complete.")
+	}
+}
+
+// syncRemotes returns the remotes selected with --remote or --all-remotes,
+// or the default remote loaded by the root command.
+func syncRemotes(cmd *cobra.Command) ([]*storage.Remote, error) {
+	name, _ := cmd.Flags().GetString("remote")
+	all, _ := cmd.Flags().GetBool("all-remotes")
+	switch {
+	case name != "" && all:
+		return nil, errors.New("--remote and --all-remotes cannot be used together")
+	case all:
+		return storage.OpenAllRemotes()
+	case name != "":
+		remote, err := storage.OpenRemote(name)
+		if err != nil {
+			return nil, err
+		}
+		return []*storage.Remote{remote}, nil
+	}
+	sp := cmd.Context().Value(shared.GetStorageProviderKey()).(storage.StorageProvider)
+	return []*storage.Remote{{StorageRemote: db.StorageRemote{IsDefault: true}, Provider: sp}}, nil
+}
+
+// pushToRemote pushes the staging directory and reports whether it
+// succeeded, explaining any failure.
+func pushToRemote(remote *storage.Remote, dotSyncDir string, records []db.FileRecord, force bool) bool {
+	err := remote.Provider.PushToStorage(dotSyncDir, storage.PushOptions{Force: force})
+	if err == nil {
+		recordRemoteActivity(remote.Name, db.RecordRemotePush)
+		return true
+	}
+	var conflictErr *storage.ConflictError
+	if !errors.As(err, &conflictErr) {
+		if remote.Name != "" {
+			fmt.Printf("Failed to push to %s: %v\n", remote.Name, err)
+		} else {
+			fmt.Println("Failed to push to storage:", err)
+		}
+		return false
+	}
+	if remote.IsDefault {
+		fmt.Println("Refusing to sync: the remote has changes that were not pulled.")
+	} else {
+		fmt.Printf("Refusing to sync to %s: it has changes that are not in local storage.\n", remote.Name)
+	}
+	if len(conflictErr.Paths) > 0 {
+		fmt.Println("Files changed on both sides:")
+		for _, path := range conflictingRecordPaths(records, conflictErr.Paths) {
+			fmt.Printf("  ✗ %s\n", path)
+		}
+	}
+	if remote.IsDefault {
+		fmt.Println("Run 'dot-sync pull' to merge the remote changes, or 'dot-sync sync --force' to overwrite them.")
+	} else {
+		fmt.Printf("Run 'dot-sync sync --remote %s --force' to overwrite them.\n", remote.Name)
+	}
+	return false
+}
+
+// recordRemoteActivity notes the time of a push or pull for 'storage show';
+// an empty name stands for the default remote. Failing to record only loses
+// that information, so errors are ignored.
+func recordRemoteActivity(name string, record func(*sql.DB, string, time.Time) error) {
+	if name == "" {
+		database, err := db.OpenDotSyncDB()
+		if err != nil {
+			return
+		}
+		remote, err := db.GetDefaultStorageRemote(database)
+		database.Close()
+		if err != nil {
+			return
 		}
+		name = remote.Name
+	}
+	database, err := db.OpenLocalDB()
+	if err != nil {
+		return
+	}
+	defer database.Close()
+	if db.EnsureRemoteActivityTable(database) == nil {
+		record(database, name, time.Now())
+	}
+}
+
+// syncPart is a record, or a path inside a tracked directory, that sync
+// copies into staging on its own.
+type syncPart struct {
+	RecordID int
+	// Root is the live path of the record the part belongs to.
+	Root   string
+	Live   string
+	Staged string
+	Base   string
+	// Tree holds the record's ignore rules, relative to Live, and its
+	// symlink policy.
+	Tree shared.TreeOptions
+	// Encrypted is set when the record is stored encrypted.
+	Encrypted bool
+	// Template is set when the record is stored as a template.
+	Template bool
+}
+
+func syncParts(sel recordSelection, dotSyncFilesPath string, ignores *ignoreSet) []syncPart {
+	staged := filepath.Join(dotSyncFilesPath, fmt.Sprintf("%d", sel.ID))
+	base := baseCopyPath(sel.ID)
+	tree := recordTreeOptions(ignores, sel.FileRecord)
+	rels := sel.relSubpaths()
+	if len(rels) == 0 {
+		return []syncPart{{RecordID: sel.ID, Root: sel.Path, Live: sel.Path, Staged: staged, Base: base, Tree: tree, Encrypted: sel.Encrypted, Template: sel.Template}}
+	}
+	parts := make([]syncPart, 0, len(rels))
+	for _, rel := range rels {
+		subtree := tree
+		subtree.Ignore = tree.Ignore.Within(rel)
+		parts = append(parts, syncPart{
+			RecordID:  sel.ID,
+			Root:      sel.Path,
+			Live:      filepath.Join(sel.Path, rel),
+			Staged:    filepath.Join(staged, rel),
+			Base:      filepath.Join(base, rel),
+			Tree:      subtree,
+			Encrypted: sel.Encrypted,
+			Template:  sel.Template,
+		})
 	}
+	return parts
+}
+
+// ignored reports whether the part itself, a path inside a tracked
+// directory, matches the record's ignore rules.
+func (p syncPart) ignored() bool {
+	info, err := os.Lstat(p.Live)
+	return p.Tree.Ignore.Match(".", err == nil && info.IsDir())
+}
+
+// skippedLink reports whether the part is a symlink that the record's
+// policy leaves out.
+func (p syncPart) skippedLink() bool {
+	return p.Tree.Symlinks == shared.SymlinkSkip && shared.IsSymlink(p.Live)
+}
+
+// remoteAhead reports whether staging holds a version pulled for another
+// part while this live copy was left untouched, in which case copying it
+// would silently revert the remote change.
+func (p syncPart) remoteAhead() bool {
+	if !shared.PathExists(p.Base) || !shared.PathExists(p.Staged) {
+		return false
+	}
+	liveSame, err := shared.SameContentWith(p.Live, p.Base, p.Tree)
+	if err != nil || !liveSame {
+		return false
+	}
+	stagedSame, err := shared.SameContentWith(p.Staged, p.Base, p.Tree)
+	return err == nil && !stagedSame
+}
+
+// templateStored reports whether the part belongs to a template record
+// whose template is already stored, which sync leaves as it is.
+func (p syncPart) templateStored() bool {
+	_, err := os.Lstat(filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir(), fmt.Sprintf("%d", p.RecordID)))
+	return p.Template && err == nil
+}
+
+// overwritesTemplate reports whether the live copy differs from the output
+// of the stored template, so copying it would replace the template with a
+// rendered file.
+func (p syncPart) overwritesTemplate() bool {
+	if !p.templateStored() {
+		return false
+	}
+	same, err := shared.SameContentWith(p.Live, p.Staged, p.Tree)
+	return err != nil || !same
+}
 
-	ctx := cmd.Context()
-	sp := ctx.Value(shared.GetStorageProviderKey()).(storage.StorageProvider)
-	if err := sp.PushToStorage(dotSyncDir); err != nil {
-		fmt.Println("Failed to push to storage:", err)
+// printSyncPlan lists what sync would copy into staging, and the secrets
+// that would stop it, without touching the filesystem or the remote.
+func printSyncPlan(records []db.FileRecord, selected []recordSelection, dotSyncFilesPath string, ignores *ignoreSet, scanner *scan.Scanner, codec *fileCodec) {
+	fmt.Println("Dry run: nothing will be copied or pushed.")
+	var parts []syncPart
+	for _, sel := range selected {
+		for _, part := range syncParts(sel, dotSyncFilesPath, ignores) {
+			if shared.PathExists(part.Live) && !part.ignored() && !part.skippedLink() && !part.remoteAhead() && !part.overwritesTemplate() {
+				parts = append(parts, part)
+			}
+			switch {
+			case !shared.PathExists(part.Live):
+				fmt.Printf("  ✗ would fail, missing locally: %s\n", part.Live)
+			case part.ignored():
+				fmt.Printf("  = would skip, ignored: %s\n", part.Live)
+			case part.skippedLink():
+				fmt.Printf("  = would skip, symlink: %s\n", part.Live)
+			case part.remoteAhead():
+				fmt.Printf("  ✗ would skip, remote changes not pulled: %s\n", part.Live)
+			case part.overwritesTemplate():
+				fmt.Printf("  ✗ would skip, changed but rendered from a template: %s\n", part.Live)
+			case !shared.PathExists(part.Staged):
+				fmt.Printf("  + would add: %s\n", part.Live)
+			default:
+				same, err := shared.SameContentWith(part.Live, part.Staged, part.Tree)
+				if err != nil {
+					fmt.Printf("  ✗ could not compare %s: %v\n", part.Live, err)
+				} else if same {
+					fmt.Printf("  = unchanged: %s\n", part.Live)
+				} else {
+					fmt.Printf("  ~ would update: %s\n", part.Live)
+				}
+			}
+		}
+	}
+	findings, err := scanPush(scanner, codec, records, parts, dotSyncFilesPath)
+	if err != nil {
+		fmt.Println("Failed to scan for secrets:", err)
 		return
 	}
+	if len(findings) > 0 {
+		fmt.Println("Would refuse to sync: these files look like they contain secrets:")
+		printScanFindings(findings)
+		return
+	}
+	fmt.Println("Would commit the staged files and push them to remote storage.")
+}
 
-	fmt.Println("Sync complete.")
+// conflictingRecordPaths maps staging paths such as "files/3/init.lua" back to
+// the live paths of the records they belong to.
+func conflictingRecordPaths(records []db.FileRecord, stagingPaths []string) []string {
+	byID := make(map[string]string, len(records))
+	for _, rec := range records {
+		byID[fmt.Sprintf("%d", rec.ID)] = rec.Path
+	}
+
+	var paths []string
+	for _, stagingPath := range stagingPaths {
+		parts := strings.SplitN(strings.TrimPrefix(filepath.ToSlash(stagingPath), "files/"), "/", 2)
+		livePath, ok := byID[parts[0]]
+		if !ok {
+			paths = append(paths, stagingPath)
+			continue
+		}
+		if len(parts) == 2 {
+			livePath = filepath.Join(livePath, filepath.FromSlash(parts[1]))
+		}
+		paths = append(paths, livePath)
+	}
+	return paths
 }
@@ -0,0 +1,452 @@
+package internal
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// Records marked with 'mark --template' are stored as Go text/templates and
+// rendered for each machine: the stored form is the template and the live
+// form its output. Templates see the details of the machine and the
+// variables set on it with 'dot-sync vars', and can use secrets:
+//
+//	email = {{ .Vars.email }}
+//	{{ if eq .OS "darwin" }}export PATH=/opt/homebrew/bin:$PATH{{ end }}
+//	token = {{ secret "npm_token" }}
+//
+// sync never stores a rendered file over its template; the template is
+// changed with 'dot-sync edit'.
+
+// templateData is what templates are executed with.
+type templateData struct {
+	Hostname string
+	OS       string
+	Arch     string
+	Username string
+	Home     string
+	// Vars holds the variables set with 'dot-sync vars set'.
+	Vars map[string]string
+}
+
+var templateVarPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func NewEditCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:         "edit <file>",
+		Short:       "Edit the template of a tracked file and render it in place",
+		Args:        cobra.ExactArgs(1),
+		Run:         editHandler,
+		Annotations: map[string]string{shared.GetSkipStorageAnnotation(): "true"},
+	}
+}
+
+func NewVarsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:         "vars",
+		Short:       "Manage the variables templates are rendered with on this machine",
+		Annotations: map[string]string{shared.GetSkipStorageAnnotation(): "true"},
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "set <name> <value>",
+		Short: "Set a variable, used in templates as {{ .Vars.<name> }}",
+		Args:  cobra.ExactArgs(2),
+		Run:   varsSetHandler,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the values templates see on this machine",
+		Args:  cobra.NoArgs,
+		Run:   varsListHandler,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove a variable",
+		Args:  cobra.ExactArgs(1),
+		Run:   varsRemoveHandler,
+	})
+	return cmd
+}
+
+func openVarsDB() (*sql.DB, error) {
+	database, err := db.OpenLocalDB()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.EnsureTemplateVarsTable(database); err != nil {
+		database.Close()
+		return nil, err
+	}
+	return database, nil
+}
+
+// loadTemplateData collects the details of this machine and its variables.
+func loadTemplateData() (*templateData, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	database, err := openVarsDB()
+	if err != nil {
+		return nil, err
+	}
+	defer database.Close()
+	vars, err := db.GetTemplateVars(database)
+	if err != nil {
+		return nil, err
+	}
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	return &templateData{
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Username: username,
+		Home:     shared.FindHomeDir(),
+		Vars:     vars,
+	}, nil
+}
+
+// templateName returns the live path of the file at path, inside a dir
+// holding a <id> entry per record, if it belongs to a template record.
+func (c *fileCodec) templateName(dir, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", false
+	}
+	id, rest, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return "", false
+	}
+	root, ok := c.templates[n]
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(root, filepath.FromSlash(rest)), true
+}
+
+// render executes text, the template of the file name, for this machine.
+// Secrets without a value keep their placeholder.
+func (c *fileCodec) render(name string, text []byte) ([]byte, error) {
+	if c.secrets == nil {
+		c.secrets = newSecrets(map[string]secretEntry{})
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(template.FuncMap{
+		"secret": func(secret string) (string, error) {
+			value, ok, err := c.secrets.value(secret)
+			if err != nil || ok {
+				return value, err
+			}
+			c.secrets.missing[secret] = true
+			return placeholder(secret), nil
+		},
+	}).Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, c.machine); err != nil {
+		if strings.Contains(err.Error(), "map has no entry for key") {
+			return nil, fmt.Errorf("%w (set it with 'dot-sync vars set')", err)
+		}
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// readTemplate returns the stored template of rec, decrypted, or nil if it
+// was not stored yet.
+func (c *fileCodec) readTemplate(rec db.FileRecord) ([]byte, error) {
+	path := filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir(), fmt.Sprintf("%d", rec.ID))
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("the stored copy of %s is not a file", rec.Path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !isEncrypted(data) {
+		return data, err
+	}
+	if len(c.identities) == 0 {
+		return nil, errNoKey
+	}
+	return decryptWith(data, c.identities)
+}
+
+// checkTemplate renders what becomes the template of rec when it is marked
+// as one, the stored copy or else the live file, the way pull would on this
+// machine, so a file that is no template at all is refused up front.
+func checkTemplate(rec db.FileRecord) error {
+	codec := &fileCodec{}
+	var err error
+	if codec.secrets, err = loadSecrets(); err != nil {
+		return err
+	}
+	if codec.identities, err = loadIdentities(); err != nil {
+		return err
+	}
+	if codec.machine, err = loadTemplateData(); err != nil {
+		return err
+	}
+	text, err := codec.readTemplate(rec)
+	if err != nil {
+		return err
+	}
+	if text == nil {
+		text, err = os.ReadFile(rec.Path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = codec.render(rec.Path, text)
+	return err
+}
+
+// storeRendered replaces the stored template of rec with its output on this
+// machine, for when rec stops being a template. It runs while rec is still
+// marked as one.
+func storeRendered(rec db.FileRecord) error {
+	codec, err := loadCodec()
+	if err != nil {
+		return err
+	}
+	if err := codec.ensurePlain(); err != nil {
+		return err
+	}
+	rec.Template = false
+	return codec.sealRecords([]db.FileRecord{rec})
+}
+
+// runEditor opens path in $VISUAL or $EDITOR, vi if neither is set.
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	// The editor may come with arguments, such as "code --wait"
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func editHandler(cmd *cobra.Command, args []string) {
+	path := argsAsFullPaths(args)[0]
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		fmt.Println("Failed to open .dot-sync.db:", err)
+		return
+	}
+	defer database.Close()
+	records, err := db.GetFileRecordsByPaths(database, []string{path})
+	if err != nil {
+		fmt.Println("Failed to query file records:", err)
+		return
+	}
+	if len(records) == 0 {
+		fmt.Printf("%s is not tracked.\n", path)
+		return
+	}
+	rec := records[0]
+	if !rec.Template {
+		fmt.Printf("%s is not a template. Mark it with 'dot-sync mark --template %s' first.\n", rec.Path, rec.Path)
+		return
+	}
+
+	codec, err := loadCodec()
+	if err != nil {
+		fmt.Println("Failed to load keys and secrets:", err)
+		return
+	}
+	if err := codec.ensurePlain(); err != nil {
+		fmt.Println("Failed to read stored files:", err)
+		return
+	}
+	text, err := codec.readTemplate(rec)
+	if err != nil {
+		fmt.Println("Failed to read the template:", err)
+		return
+	}
+	stored := text != nil
+	// A template not synced yet starts from the live file
+	if !stored {
+		if text, err = os.ReadFile(rec.Path); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Failed to read the template:", err)
+			return
+		}
+	}
+
+	draftDir, err := os.MkdirTemp("", "dot-sync-edit-")
+	if err != nil {
+		fmt.Println("Failed to create temporary directory:", err)
+		return
+	}
+	// Keep the name, so editors recognize the file type
+	draft := filepath.Join(draftDir, filepath.Base(rec.Path))
+	if err := os.WriteFile(draft, text, 0600); err != nil {
+		fmt.Println("Failed to write the template for editing:", err)
+		os.RemoveAll(draftDir)
+		return
+	}
+	if err := runEditor(draft); err != nil {
+		fmt.Println("Failed to run the editor:", err)
+		os.RemoveAll(draftDir)
+		return
+	}
+	edited, err := os.ReadFile(draft)
+	if err != nil {
+		fmt.Println("Failed to read the edited template:", err)
+		os.RemoveAll(draftDir)
+		return
+	}
+	if stored && bytes.Equal(edited, text) {
+		fmt.Printf("No changes to the template of %s.\n", rec.Path)
+		os.RemoveAll(draftDir)
+		return
+	}
+	rendered, err := codec.render(rec.Path, edited)
+	if err != nil {
+		fmt.Println("The template was not saved, it does not render:", err)
+		fmt.Printf("Your edit is kept in %s.\n", draft)
+		return
+	}
+	defer os.RemoveAll(draftDir)
+
+	staged := filepath.Join(stagingFilesDir(codec), fmt.Sprintf("%d", rec.ID))
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(rec.Path); err == nil {
+		mode = info.Mode().Perm()
+		// Changes made to the rendered file are replaced, so keep a copy
+		if same, err := shared.SameContent(rec.Path, staged); err != nil || !same {
+			name, err := backupLive(rec.Path)
+			if err != nil {
+				fmt.Printf("Failed to back up %s, the template was not saved: %v\n", rec.Path, err)
+				return
+			}
+			fmt.Printf("Local changes to %s were backed up to set %s (undo with 'dot-sync backups restore %s').\n", rec.Path, name, name)
+		}
+	}
+	os.Chmod(draft, mode)
+	if err := codec.sealFile(draft, filepath.Join(shared.FindHomeDir(), shared.GetDotSyncFilesDir(), fmt.Sprintf("%d", rec.ID)), rec.Encrypted); err != nil {
+		fmt.Printf("Failed to store the template of %s: %v\n", rec.Path, err)
+		return
+	}
+	for _, dst := range []string{staged, rec.Path} {
+		if err := shared.EnsureDir(filepath.Dir(dst)); err == nil {
+			err = os.WriteFile(dst, rendered, mode)
+		}
+		if err != nil {
+			fmt.Printf("Failed to write %s: %v\n", dst, err)
+			return
+		}
+	}
+	for _, name := range codec.missingSecrets() {
+		fmt.Printf("Warning: secret %s has no value on this machine, its placeholder is kept (set it with 'dot-sync secrets set %s').\n", name, name)
+	}
+	fmt.Printf("Rendered %s from its new template. Run 'dot-sync sync' to push the template.\n", rec.Path)
+}
+
+// backupLive copies path into a new backup set and returns the set's name.
+func backupLive(path string) (string, error) {
+	database, err := openBackupsDB()
+	if err != nil {
+		return "", err
+	}
+	defer database.Close()
+	backups := newBackupRecorder(database)
+	if err := backups.Backup(path); err != nil {
+		return "", err
+	}
+	return backups.Name(), nil
+}
+
+func varsSetHandler(cmd *cobra.Command, args []string) {
+	if !templateVarPattern.MatchString(args[0]) {
+		fmt.Println("Variable names may only hold letters, digits and '_', and may not start with a digit.")
+		return
+	}
+	database, err := openVarsDB()
+	if err != nil {
+		fmt.Println("Failed to open local database:", err)
+		return
+	}
+	defer database.Close()
+	if err := db.SetTemplateVar(database, args[0], args[1]); err != nil {
+		fmt.Println("Failed to set variable:", err)
+		return
+	}
+	fmt.Printf("Set %s. Use it in templates as {{ .Vars.%s }}.\n", args[0], args[0])
+	refreshStaging()
+}
+
+func varsRemoveHandler(cmd *cobra.Command, args []string) {
+	database, err := openVarsDB()
+	if err != nil {
+		fmt.Println("Failed to open local database:", err)
+		return
+	}
+	defer database.Close()
+	removed, err := db.DeleteTemplateVar(database, args[0])
+	if err != nil {
+		fmt.Println("Failed to remove variable:", err)
+		return
+	}
+	if !removed {
+		fmt.Printf("No variable named %s.\n", args[0])
+		return
+	}
+	fmt.Printf("Removed variable %s.\n", args[0])
+	refreshStaging()
+}
+
+func varsListHandler(cmd *cobra.Command, args []string) {
+	data, err := loadTemplateData()
+	if err != nil {
+		fmt.Println("Failed to read variables:", err)
+		return
+	}
+	fmt.Println("Templates on this machine see:")
+	fmt.Printf("  %-20s %s\n", ".Hostname", data.Hostname)
+	fmt.Printf("  %-20s %s\n", ".OS", data.OS)
+	fmt.Printf("  %-20s %s\n", ".Arch", data.Arch)
+	fmt.Printf("  %-20s %s\n", ".Username", data.Username)
+	fmt.Printf("  %-20s %s\n", ".Home", data.Home)
+	var names []string
+	for name := range data.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %-20s %s\n", ".Vars."+name, data.Vars[name])
+	}
+	if len(names) == 0 {
+		fmt.Println("No variables set. Add one with 'dot-sync vars set <name> <value>'.")
+	}
+}
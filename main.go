@@ -11,7 +11,7 @@ import (
 	"github.com/tylerkeyes/dot-sync/internal"
 	"github.com/tylerkeyes/dot-sync/internal/db"
 	"github.com/tylerkeyes/dot-sync/internal/shared"
-	"github.com/tylerkeyes/dot-sync/internal/storage"
+	"github.com/tylerkeyes/dot-sync/storage"
 )
 
 var rootCmd = &cobra.Command{
@@ -19,8 +19,7 @@ var rootCmd = &cobra.Command{
 	Short: "A CLI tool for dotfile syncing",
 	Long:  `dot-sync is a CLI tool for managing and syncing dotfiles.`,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-		// Skip check for 'storage init' command
-		if len(os.Args) > 2 && os.Args[1] == "storage" && os.Args[2] == "init" {
+		if skipsStorage(cmd) {
 			return nil
 		}
 		// Open DB and check for storage provider
@@ -32,25 +31,20 @@ var rootCmd = &cobra.Command{
 		if err := db.EnsureStorageTable(database); err != nil {
 			return fmt.Errorf("failed to ensure storage_provider table: %w", err)
 		}
-
-		row := database.QueryRow("SELECT storage_type, remote FROM storage_provider ORDER BY id DESC LIMIT 1")
-		var storageType, remote string
-		if err := row.Scan(&storageType, &remote); err != nil {
+		remote, err := db.GetDefaultStorageRemote(database)
+		if err != nil {
 			if err == sql.ErrNoRows {
 				fmt.Println("No storage provider configured. Please run: dot-sync storage init")
 				os.Exit(1)
 			}
 			return fmt.Errorf("failed to read storage provider: %v", err)
 		}
-		// Only support git for now
-		var sp storage.StorageProvider
-		if storageType == "git" {
-			sp = &storage.GitStorage{RemoteURL: remote}
-			if err := sp.InitializeStorage(); err != nil {
-				return fmt.Errorf("failed to initialize storage provider: %v", err)
-			}
-		} else {
-			return fmt.Errorf("unsupported storage provider: %s", storageType)
+		sp, err := storage.NewProvider(remote.StorageType, storage.RemoteConfig{Name: remote.Name, Remote: remote.Remote, Options: remote.Options})
+		if err != nil {
+			return err
+		}
+		if err := sp.InitializeStorage(); err != nil {
+			return fmt.Errorf("failed to initialize storage provider: %v", err)
 		}
 		ctx := context.WithValue(cmd.Context(), shared.GetStorageProviderKey(), sp)
 		cmd.SetContext(ctx)
@@ -58,12 +52,30 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// skipsStorage reports whether cmd or one of its parents is annotated as
+// never touching the storage remote.
+func skipsStorage(cmd *cobra.Command) bool {
+	for c := cmd; c != nil; c = c.Parent() {
+		if c.Annotations[shared.GetSkipStorageAnnotation()] == "true" {
+			return true
+		}
+	}
+	return false
+}
+
 func init() {
 	rootCmd.AddCommand(internal.NewSyncCmd())
 	rootCmd.AddCommand(internal.NewPullCmd())
 	rootCmd.AddCommand(internal.NewMarkCmd())
 	rootCmd.AddCommand(internal.NewShowCmd())
 	rootCmd.AddCommand(internal.NewDeleteCmd())
+	rootCmd.AddCommand(internal.NewStatusCmd())
+	rootCmd.AddCommand(internal.NewDiffCmd())
+	rootCmd.AddCommand(internal.NewBackupsCmd())
+	rootCmd.AddCommand(internal.NewKeysCmd())
+	rootCmd.AddCommand(internal.NewSecretsCmd())
+	rootCmd.AddCommand(internal.NewEditCmd())
+	rootCmd.AddCommand(internal.NewVarsCmd())
 	rootCmd.AddCommand(storage.NewStorageProviderCmd())
 
 	home := shared.FindHomeDir()
@@ -80,12 +80,11 @@ func TestExecute(t *testing.T) {
 
 func TestPersistentPreRunE_StorageInit(t *testing.T) {
 	// Test that storage init command is skipped
-	oldArgs := os.Args
-	os.Args = []string{"dot-sync", "storage", "init"}
-	defer func() { os.Args = oldArgs }()
-
-	cmd := &cobra.Command{}
-	err := rootCmd.PersistentPreRunE(cmd, []string{})
+	cmd, _, err := rootCmd.Find([]string{"storage", "init"})
+	if err != nil {
+		t.Fatalf("failed to find storage init: %v", err)
+	}
+	err = rootCmd.PersistentPreRunE(cmd, []string{})
 
 	// Should return nil (no error) for storage init command
 	if err != nil {
@@ -139,3 +138,26 @@ func TestPersistentPreRunE_DatabaseError(t *testing.T) {
 		t.Errorf("expected database error message, got: %v", err)
 	}
 }
+
+func TestSkipsStorage(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		skip bool
+	}{
+		{[]string{"storage", "list"}, true},
+		{[]string{"keys"}, true},
+		{[]string{"secrets", "set"}, true},
+		{[]string{"vars", "list"}, true},
+		{[]string{"edit"}, true},
+		{[]string{"sync"}, false},
+		{[]string{"status"}, false},
+	} {
+		cmd, _, err := rootCmd.Find(tc.args)
+		if err != nil {
+			t.Fatalf("failed to find %v: %v", tc.args, err)
+		}
+		if got := skipsStorage(cmd); got != tc.skip {
+			t.Errorf("skipsStorage(%v) = %v, want %v", tc.args, got, tc.skip)
+		}
+	}
+}
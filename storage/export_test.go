@@ -0,0 +1,12 @@
+package storage
+
+// UnregisterProvider removes a provider registered by a test, so its
+// options stop showing up in the storage commands of other tests.
+func UnregisterProvider(name string) {
+	for i, p := range providers {
+		if p.Name == name {
+			providers = append(providers[:i], providers[i+1:]...)
+			return
+		}
+	}
+}
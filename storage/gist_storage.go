@@ -0,0 +1,421 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// GistStorage keeps the remote copy in a GitHub gist. Gists hold a flat list
+// of text files, so every staged file becomes one gist file, named after its
+// record, and an index file maps each gist file name to its staging path and
+// to the dotfile it holds, such as ~/.config/nvim/init.lua. Binary and empty
+// files are stored base64-encoded with a ".b64" suffix.
+//
+// The remote is the gist's ID or URL. The token comes from
+// DOT_SYNC_GIST_TOKEN or GITHUB_TOKEN and needs the gist scope.
+type GistStorage struct {
+	RemoteURL string
+	ID        string
+	// APIURL is the base URL of the REST API; empty means GITHUB_API_URL or
+	// https://api.github.com.
+	APIURL string
+	// Client is used for requests; nil means a client with a timeout.
+	Client *http.Client
+}
+
+const (
+	gistIndexName    = "dot-sync-index.json"
+	gistManifestName = "manifest.json"
+	gistBinarySuffix = ".b64"
+)
+
+var gistIDPattern = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+
+func init() {
+	RegisterProvider(Provider{
+		Name:       "gist",
+		RemoteHint: "the gist ID or URL",
+		New: func(cfg RemoteConfig) (StorageProvider, error) {
+			return NewGistStorage(cfg.Remote)
+		},
+	})
+}
+
+// NewGistStorage parses a remote holding a gist ID or a gist URL such as
+// https://gist.github.com/alice/<id>.
+func NewGistStorage(remote string) (*GistStorage, error) {
+	id := remote
+	if strings.Contains(remote, "://") {
+		u, err := url.Parse(remote)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gist remote %q: %w", remote, err)
+		}
+		id = strings.TrimSuffix(path.Base(strings.TrimRight(u.Path, "/")), ".git")
+	}
+	if !gistIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid gist remote %q (expected a gist ID or URL)", remote)
+	}
+	return &GistStorage{RemoteURL: remote, ID: id}, nil
+}
+
+func (s *GistStorage) InitializeStorage() error {
+	home := shared.FindHomeDir()
+	dir := filepath.Join(home, shared.GetDotSyncDir())
+	filesDir := filepath.Join(home, shared.GetDotSyncFilesDir())
+
+	if err := shared.EnsureDir(dir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	if err := shared.EnsureDir(filesDir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filesDir, err)
+	}
+	return nil
+}
+
+// mirror returns the mirror of the staging directory filePath, whose
+// state.db names the dotfiles listed in the index.
+func (s *GistStorage) mirror(filePath string) *mirror {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
+	store := &gistStore{storage: s, client: client, stateDB: filepath.Join(filePath, "state.db")}
+	return &mirror{store: store, name: mirrorName("gist", s.ID)}
+}
+
+func (s *GistStorage) PushToStorage(filePath string, opts PushOptions) error {
+	return s.mirror(filePath).PushToStorage(filePath, opts)
+}
+
+func (s *GistStorage) PullFromStorage(filePath string) error {
+	return s.mirror(filePath).PullFromStorage(filePath)
+}
+
+func (s *GistStorage) Fetch(filePath string) error {
+	return s.mirror(filePath).Fetch(filePath)
+}
+
+func (s *GistStorage) ExportRevision(filePath string, rev Revision, dest string) error {
+	return s.mirror(filePath).ExportRevision(filePath, rev, dest)
+}
+
+func (s *GistStorage) Check(filePath string) error {
+	return s.mirror(filePath).Check()
+}
+
+func (s *GistStorage) localStateKey() string {
+	return mirrorName("gist", s.ID)
+}
+
+func (s *GistStorage) removeLocalState(filePath string) error {
+	return s.mirror(filePath).removeCache(filePath)
+}
+
+func (s *GistStorage) apiURL() string {
+	if s.APIURL != "" {
+		return strings.TrimRight(s.APIURL, "/")
+	}
+	if api := os.Getenv("GITHUB_API_URL"); api != "" {
+		return strings.TrimRight(api, "/")
+	}
+	return "https://api.github.com"
+}
+
+// gistIndexEntry describes a gist file in the index: the staging path it
+// mirrors and, for the files of a record, the dotfile it holds.
+type gistIndexEntry struct {
+	Key  string `json:"key"`
+	Path string `json:"path,omitempty"`
+}
+
+type gistFile struct {
+	Content   string `json:"content"`
+	Truncated bool   `json:"truncated"`
+	RawURL    string `json:"raw_url"`
+}
+
+// gistStore reads the whole gist once and sends all changes of a push in a
+// single update, which becomes one revision in the gist's history.
+type gistStore struct {
+	storage *GistStorage
+	client  *http.Client
+	// stateDB is the staged state.db, read for the record paths.
+	stateDB string
+	loaded  bool
+	files   map[string]gistFile
+	// names maps mirror keys to gist file names, as stored in the index.
+	names map[string]string
+	// pending holds new content by gist file name; nil deletes the file.
+	pending map[string]*string
+}
+
+func (s *gistStore) request(method, target string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := gistToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var doc struct {
+			Message string `json:"message"`
+		}
+		msg := resp.Status
+		if json.Unmarshal(data, &doc) == nil && doc.Message != "" {
+			msg += ": " + doc.Message
+		}
+		if (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusNotFound) && gistToken() == "" {
+			msg += " (set DOT_SYNC_GIST_TOKEN or GITHUB_TOKEN)"
+		}
+		return nil, fmt.Errorf("gist %s %s: %s", method, s.storage.ID, msg)
+	}
+	return data, nil
+}
+
+func gistToken() string {
+	if token := os.Getenv("DOT_SYNC_GIST_TOKEN"); token != "" {
+		return token
+	}
+	return os.Getenv("GITHUB_TOKEN")
+}
+
+func (s *gistStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	data, err := s.request(http.MethodGet, s.storage.apiURL()+"/gists/"+s.storage.ID, nil)
+	if err != nil {
+		return err
+	}
+	var gist struct {
+		Files map[string]gistFile `json:"files"`
+	}
+	if err := json.Unmarshal(data, &gist); err != nil {
+		return fmt.Errorf("gist %s: invalid response: %w", s.storage.ID, err)
+	}
+	s.files = gist.Files
+	s.names = map[string]string{}
+	s.pending = map[string]*string{}
+	if index, ok := s.files[gistIndexName]; ok {
+		content, err := s.content(index)
+		if err != nil {
+			return err
+		}
+		var entries map[string]gistIndexEntry
+		if err := json.Unmarshal([]byte(content), &entries); err != nil {
+			return fmt.Errorf("gist %s: invalid %s: %w", s.storage.ID, gistIndexName, err)
+		}
+		for name, entry := range entries {
+			if !validKey(entry.Key) {
+				return fmt.Errorf("gist %s: invalid %s: bad path %q", s.storage.ID, gistIndexName, entry.Key)
+			}
+			s.names[entry.Key] = name
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+// content returns a file's content, downloading it separately when the API
+// truncated it.
+func (s *gistStore) content(file gistFile) (string, error) {
+	if !file.Truncated {
+		return file.Content, nil
+	}
+	data, err := s.request(http.MethodGet, file.RawURL, nil)
+	return string(data), err
+}
+
+func (s *gistStore) name(key string) string {
+	if key == manifestKey {
+		return gistManifestName
+	}
+	return s.names[key]
+}
+
+func (s *gistStore) ReadObject(key string) ([]byte, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	name := s.name(key)
+	file, ok := s.files[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	content, err := s.content(file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(name, gistBinarySuffix) {
+		return base64.StdEncoding.DecodeString(content)
+	}
+	return []byte(content), nil
+}
+
+func (s *gistStore) WriteObject(key string, data []byte) error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	// Gists only hold non-empty text; the decoder ignores the newline
+	// standing in for an empty file
+	content, binary := string(data), false
+	if len(data) == 0 || !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		content, binary = base64.StdEncoding.EncodeToString(data)+"\n", true
+	}
+	name := s.name(key)
+	if key != manifestKey && (name == "" || strings.HasSuffix(name, gistBinarySuffix) != binary) {
+		if name != "" {
+			s.pending[name] = nil
+		}
+		name = s.newName(key, binary)
+		s.names[key] = name
+	}
+	s.pending[name] = &content
+	return nil
+}
+
+// newName picks an unused, readable gist file name for key, such as
+// "3-nvim-init.lua" for files/3/nvim/init.lua.
+func (s *gistStore) newName(key string, binary bool) string {
+	base := strings.ReplaceAll(strings.TrimPrefix(key, "files/"), "/", "-")
+	suffix := ""
+	if binary {
+		suffix = gistBinarySuffix
+	}
+	used := map[string]bool{gistIndexName: true, gistManifestName: true}
+	for _, name := range s.names {
+		used[name] = true
+	}
+	name := base + suffix
+	for i := 2; used[name] || strings.HasPrefix(name, "gistfile"); i++ {
+		name = base + "~" + strconv.Itoa(i) + suffix
+	}
+	return name
+}
+
+func (s *gistStore) DeleteObject(key string) error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	if name := s.name(key); name != "" {
+		s.pending[name] = nil
+		delete(s.names, key)
+	}
+	return nil
+}
+
+// Flush sends the pending changes together with the updated index.
+func (s *gistStore) Flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	paths := s.recordPaths()
+	index := map[string]gistIndexEntry{}
+	for key, name := range s.names {
+		index[name] = gistIndexEntry{Key: key, Path: dotfilePath(paths, key)}
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	content := string(data)
+	s.pending[gistIndexName] = &content
+
+	files := map[string]any{}
+	for name, content := range s.pending {
+		if content == nil {
+			// Deleting a file the gist never had is an error
+			if _, ok := s.files[name]; ok {
+				files[name] = nil
+			}
+			continue
+		}
+		files[name] = map[string]string{"content": *content}
+	}
+	body, err := json.Marshal(map[string]any{"files": files})
+	if err != nil {
+		return err
+	}
+	if _, err := s.request(http.MethodPatch, s.storage.apiURL()+"/gists/"+s.storage.ID, body); err != nil {
+		return err
+	}
+	s.loaded = false
+	return nil
+}
+
+// recordPaths returns the paths of the records in the staged state.db by ID,
+// in the form shown to users on any machine, such as ~/.zshrc. The index
+// just goes without them when state.db cannot be read.
+func (s *gistStore) recordPaths() map[string]string {
+	paths := map[string]string{}
+	if !shared.PathExists(s.stateDB) {
+		return paths
+	}
+	database, err := db.OpenDotSyncDBAt(s.stateDB)
+	if err != nil {
+		return paths
+	}
+	defer database.Close()
+	records, err := db.GetAllFilePaths(database)
+	if err != nil {
+		return paths
+	}
+	for _, rec := range records {
+		path := filepath.ToSlash(shared.ToStoragePath(rec.Path))
+		if path == "HOME" || strings.HasPrefix(path, "HOME/") {
+			path = "~" + strings.TrimPrefix(path, "HOME")
+		}
+		paths[strconv.Itoa(rec.ID)] = path
+	}
+	return paths
+}
+
+// dotfilePath returns the dotfile the staging path key holds, or "" when it
+// is not part of a record, given the record paths by ID.
+func dotfilePath(paths map[string]string, key string) string {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(key, "files/"), "/")
+	root, ok := paths[id]
+	if !ok || !strings.HasPrefix(key, "files/") {
+		return ""
+	}
+	if rest == "" {
+		return root
+	}
+	return path.Join(root, rest)
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tylerkeyes/dot-sync/internal/db"
+)
+
+// fakeGist is a stub of the Gist REST API serving a single gist. Files
+// longer than truncateAt are truncated in the API response, as GitHub does
+// for large files.
+type fakeGist struct {
+	id         string
+	truncateAt int
+	mu         sync.Mutex
+	files      map[string]string
+	patches    int
+}
+
+func newFakeGist(t *testing.T) (*fakeGist, *httptest.Server) {
+	fake := &fakeGist{id: "aa5a315d61ae9438b18d", truncateAt: 1 << 20, files: map[string]string{"gistfile1.txt": "created on the website"}}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.serve(w, r, server.URL)
+	}))
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeGist) serve(w http.ResponseWriter, r *http.Request, base string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if name, ok := strings.CutPrefix(r.URL.Path, "/raw/"); ok {
+		io.WriteString(w, f.files[name])
+		return
+	}
+	if r.URL.Path != "/gists/"+f.id {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"message": "Not Found"}`)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		files := map[string]any{}
+		for name, content := range f.files {
+			truncated := len(content) > f.truncateAt
+			if truncated {
+				content = content[:f.truncateAt]
+			}
+			files[name] = map[string]any{"filename": name, "content": content, "truncated": truncated, "raw_url": base + "/raw/" + name}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": f.id, "files": files})
+	case http.MethodPatch:
+		if r.Header.Get("Authorization") != "Bearer gist-token" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"message": "Not Found"}`)
+			return
+		}
+		var body struct {
+			Files map[string]*struct {
+				Content string `json:"content"`
+			} `json:"files"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for name, file := range body.Files {
+			if _, ok := f.files[name]; (file == nil && !ok) || (file != nil && file.Content == "") {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				io.WriteString(w, `{"message": "Validation Failed"}`)
+				return
+			}
+		}
+		for name, file := range body.Files {
+			if file == nil {
+				delete(f.files, name)
+			} else {
+				f.files[name] = file.Content
+			}
+		}
+		f.patches++
+		io.WriteString(w, `{}`)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestGistStorage(t *testing.T, fake *fakeGist, server *httptest.Server) *GistStorage {
+	t.Helper()
+	t.Setenv("DOT_SYNC_GIST_TOKEN", "gist-token")
+	s, err := NewGistStorage("https://gist.github.com/alice/" + fake.id)
+	if err != nil {
+		t.Fatalf("NewGistStorage failed: %v", err)
+	}
+	s.APIURL = server.URL
+	return s
+}
+
+func TestNewGistStorage(t *testing.T) {
+	for _, remote := range []string{"aa5a315d61ae9438b18d", "https://gist.github.com/alice/aa5a315d61ae9438b18d/", "https://gist.github.com/aa5a315d61ae9438b18d.git"} {
+		s, err := NewGistStorage(remote)
+		if err != nil || s.ID != "aa5a315d61ae9438b18d" {
+			t.Errorf("expected %q to name the gist, got %+v %v", remote, s, err)
+		}
+	}
+	for _, remote := range []string{"", "../gists", "https://gist.github.com/alice/"} {
+		if _, err := NewGistStorage(remote); err == nil {
+			t.Errorf("expected %q to be rejected", remote)
+		}
+	}
+}
+
+func TestGistStorage_PushAndPull(t *testing.T) {
+	fake, server := newFakeGist(t)
+	storage := newTestGistStorage(t, fake, server)
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	machineA := newTestMachine(t)
+	os.WriteFile(filepath.Join(machineA, "files", "3"), nil, 0644)
+	// The staged state.db names the dotfile of each record
+	os.Remove(filepath.Join(machineA, "state.db"))
+	database, _ := db.OpenDotSyncDBAt(filepath.Join(machineA, "state.db"))
+	db.EnsureFilesTable(database)
+	db.InsertFiles(database, []string{filepath.Join(home, ".netrc"), filepath.Join(home, ".config", "nvim"), filepath.Join(home, ".hushlogin")})
+	database.Close()
+	if err := storage.PushToStorage(machineA, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+	if fake.patches != 1 {
+		t.Errorf("expected a single update, got %d", fake.patches)
+	}
+	if fake.files["1"] != "file one" || fake.files["2-init.lua"] != "init" {
+		t.Errorf("expected readable gist files, got %v", fake.files)
+	}
+	if _, ok := fake.files["3.b64"]; !ok {
+		t.Errorf("expected the empty file to be encoded, got %v", fake.files)
+	}
+	var index map[string]gistIndexEntry
+	json.Unmarshal([]byte(fake.files[gistIndexName]), &index)
+	for name, expected := range map[string]gistIndexEntry{
+		"1":            {Key: "files/1", Path: "~/.netrc"},
+		"2-init.lua":   {Key: "files/2/init.lua", Path: "~/.config/nvim/init.lua"},
+		"3.b64":        {Key: "files/3", Path: "~/.hushlogin"},
+		"state.db.b64": {Key: "state.db"},
+	} {
+		if index[name] != expected {
+			t.Errorf("expected index entry %s to be %+v, got %+v", name, expected, index[name])
+		}
+	}
+	if fake.files["gistfile1.txt"] == "" {
+		t.Error("expected unrelated gist files to be kept")
+	}
+
+	// Large files are downloaded separately
+	fake.truncateAt = 4
+	machineB := filepath.Join(t.TempDir(), ".dot-sync")
+	if err := storage.PullFromStorage(machineB); err != nil {
+		t.Fatalf("PullFromStorage failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(machineB, "files", "1")); string(data) != "file one" {
+		t.Errorf("expected files/1 to be pulled, got %q", data)
+	}
+	if data, err := os.ReadFile(filepath.Join(machineB, "files", "3")); err != nil || len(data) != 0 {
+		t.Errorf("expected the empty file to be pulled, got %q %v", data, err)
+	}
+	if target, _ := os.Readlink(filepath.Join(machineB, "files", "2", "alias.lua")); target != "init.lua" {
+		t.Errorf("expected the symlink to be pulled, got %q", target)
+	}
+
+	// Removed records disappear from the gist
+	os.RemoveAll(filepath.Join(machineB, "files", "2"))
+	os.WriteFile(filepath.Join(machineB, "files", "1"), []byte{0xff, 0x00}, 0600)
+	if err := storage.PushToStorage(machineB, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage from B failed: %v", err)
+	}
+	if _, ok := fake.files["2-init.lua"]; ok {
+		t.Error("expected the removed record's file to be deleted")
+	}
+	if _, ok := fake.files["1"]; ok || fake.files["1.b64"] != "/wA=\n" {
+		t.Errorf("expected files/1 to be stored as binary, got %v", fake.files)
+	}
+
+	os.WriteFile(filepath.Join(machineA, "files", "1"), []byte("edited on A"), 0600)
+	var conflictErr *ConflictError
+	if err := storage.PushToStorage(machineA, PushOptions{}); !errors.As(err, &conflictErr) {
+		t.Errorf("expected ConflictError, got %v", err)
+	}
+}
+
+func TestGistStorage_ReportsMissingToken(t *testing.T) {
+	fake, server := newFakeGist(t)
+	storage := newTestGistStorage(t, fake, server)
+	t.Setenv("DOT_SYNC_GIST_TOKEN", "")
+	t.Setenv("GITHUB_TOKEN", "")
+
+	err := storage.PushToStorage(newTestMachine(t), PushOptions{})
+	if err == nil || !strings.Contains(err.Error(), "DOT_SYNC_GIST_TOKEN") {
+		t.Errorf("expected a hint about the token, got %v", err)
+	}
+}
+
+func TestGistStorage_Check(t *testing.T) {
+	fake, server := newFakeGist(t)
+	storage := newTestGistStorage(t, fake, server)
+
+	if err := storage.Check(t.TempDir()); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if len(fake.files) != 2 || fake.files["gistfile1.txt"] == "" {
+		t.Errorf("expected only the index to be added, got %v", fake.files)
+	}
+
+	t.Setenv("DOT_SYNC_GIST_TOKEN", "read-only")
+	if err := storage.Check(t.TempDir()); err == nil {
+		t.Error("expected a token without write access to fail the check")
+	}
+}
@@ -0,0 +1,589 @@
+package storage
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+type GitStorage struct {
+	RemoteURL string
+	// Remote is the name of the git remote; empty means origin.
+	Remote string
+	// Branch is the remote branch pushed to and pulled from; empty means
+	// the checked out branch, or main before the first commit.
+	Branch string
+	// Author is who commits are made as, written "Name <email>"; empty means
+	// git's user.name and user.email.
+	Author string
+	// Message is the commit message template, see commitMessage; empty
+	// means defaultCommitMessage.
+	Message string
+}
+
+const defaultCommitMessage = "sync: update dotfiles"
+
+var (
+	gitAuthorPattern = regexp.MustCompile(`^([^<>]*[^<>\s])\s*<([^<>\s]+)>$`)
+	gitBranchPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/-]*$`)
+)
+
+// NewGitStorage returns git storage for a remote recorded under name, with
+// the branch, author and message options of 'storage init'.
+func NewGitStorage(name, remoteURL string, options map[string]string) (*GitStorage, error) {
+	s := &GitStorage{RemoteURL: remoteURL, Remote: name, Branch: options["branch"], Author: options["author"], Message: options["message"]}
+	if s.Branch != "" && (!gitBranchPattern.MatchString(s.Branch) || strings.Contains(s.Branch, "..") ||
+		strings.HasSuffix(s.Branch, "/") || strings.HasSuffix(s.Branch, ".lock")) {
+		return nil, fmt.Errorf("invalid branch name %q", s.Branch)
+	}
+	if s.Author != "" && !gitAuthorPattern.MatchString(s.Author) {
+		return nil, fmt.Errorf("invalid author %q (expected \"Name <email>\")", s.Author)
+	}
+	return s, nil
+}
+
+func (s *GitStorage) remote() string {
+	if s.Remote == "" {
+		return "origin"
+	}
+	return s.Remote
+}
+
+func init() {
+	RegisterProvider(Provider{
+		Name:       "git",
+		RemoteHint: "the repository URL",
+		Options: []ProviderOption{
+			{Name: "branch", Usage: "Branch to sync with instead of the checked out one"},
+			{Name: "author", Usage: `Commit author, as "Name <email>"`},
+			{Name: "message", Usage: "Commit message template; {host}, {time}, {count} and {files} are replaced"},
+			{Name: "engine", Usage: `How to run git: "git" runs the git binary, "go" uses the built-in implementation`},
+		},
+		New: func(cfg RemoteConfig) (StorageProvider, error) {
+			s, err := NewGitStorage(cfg.Name, cfg.Remote, cfg.Options)
+			if err != nil {
+				return nil, err
+			}
+			switch cfg.Options["engine"] {
+			case "", "git":
+				return s, nil
+			case "go":
+				return &GoGitStorage{GitStorage: *s}, nil
+			default:
+				return nil, fmt.Errorf("invalid engine %q (expected git or go)", cfg.Options["engine"])
+			}
+		},
+	})
+}
+
+// localOnlyPaths are entries of the .dot-sync directory that belong to this
+// machine and must never be pushed.
+var localOnlyPaths = []string{"/backups/", "/base/", "/cache/", "/local.db*", "/plain/"}
+
+func (s *GitStorage) InitializeStorage() error {
+	home := shared.FindHomeDir()
+	dir := filepath.Join(home, shared.GetDotSyncDir())
+	filesDir := filepath.Join(home, shared.GetDotSyncFilesDir())
+
+	// Ensure both directories exist before running git commands
+	if err := shared.EnsureDir(dir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	if err := shared.EnsureDir(filesDir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filesDir, err)
+	}
+
+	// Initialize git repo if not already
+	cmd := exec.Command("git", "init")
+	cmd.Dir = dir
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to init git repo: %w", err)
+	}
+	if err := ensureGitignore(dir, localOnlyPaths); err != nil {
+		return fmt.Errorf("failed to update .gitignore: %w", err)
+	}
+	// Name the first commit's branch after the configured one
+	if s.Branch != "" && !gitRefExists(dir, "HEAD") {
+		if err := shared.RunCmd(dir, "git", "symbolic-ref", "HEAD", "refs/heads/"+s.Branch); err != nil {
+			return fmt.Errorf("failed to set branch: %w", err)
+		}
+	}
+	// Add the remote, or point it at RemoteURL when that changed since. The
+	// configured URL is read without applying url.<base>.insteadOf rewrites
+	out, err := exec.Command("git", "-C", dir, "config", "--get", "remote."+s.remote()+".url").Output()
+	if err != nil {
+		cmd = exec.Command("git", "remote", "add", s.remote(), s.RemoteURL)
+		cmd.Dir = dir
+		if err := cmd.Run(); err != nil {
+			// If remote already exists, ignore
+			if !isRemoteExistsError(err) {
+				return fmt.Errorf("failed to add remote: %w", err)
+			}
+		}
+	} else if strings.TrimSpace(string(out)) != s.RemoteURL {
+		if err := shared.RunCmd(dir, "git", "remote", "set-url", s.remote(), s.RemoteURL); err != nil {
+			return fmt.Errorf("failed to update remote: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *GitStorage) PushToStorage(filePath string, opts PushOptions) error {
+	fmt.Println("Pushing contents to storage...")
+
+	// Repositories initialized by older versions may miss newer entries
+	if err := ensureGitignore(filePath, localOnlyPaths); err != nil {
+		return fmt.Errorf("failed to update .gitignore: %w", err)
+	}
+	if err := shared.RunCmd(filePath, "git", "add", "."); err != nil {
+		return err
+	}
+	previous, _ := exec.Command("git", "-C", filePath, "rev-parse", "--verify", "-q", "HEAD").Output()
+	if err := s.commit(filePath); err != nil {
+		return err
+	}
+	branch := s.branch(filePath)
+	refspec := "HEAD:refs/heads/" + branch
+
+	if opts.Force {
+		return shared.RunCmd(filePath, "git", "push", "--force", "-u", s.remote(), refspec)
+	}
+
+	if err := s.Fetch(filePath); err != nil {
+		return err
+	}
+	if err := checkRemoteNotAhead(filePath, s.remote()+"/"+branch); err != nil {
+		// A refused sync must not leave its commit for the next one to
+		// build on; the changes stay staged
+		if resetErr := uncommit(filePath, strings.TrimSpace(string(previous))); resetErr != nil {
+			return fmt.Errorf("%w (and failed to undo the local commit: %v)", err, resetErr)
+		}
+		return err
+	}
+	if err := shared.RunCmd(filePath, "git", "push", "-u", s.remote(), refspec); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *GitStorage) PullFromStorage(filePath string) error {
+	fmt.Println("Pulling contents from storage...")
+
+	if err := s.Fetch(filePath); err != nil {
+		return err
+	}
+
+	branch := s.branch(filePath)
+
+	// Reset any local changes and pull from remote
+	if err := shared.RunCmd(filePath, "git", "reset", "--hard", s.remote()+"/"+branch); err != nil {
+		return fmt.Errorf("failed to reset to remote state: %w", err)
+	}
+
+	if err := shared.RunCmd(filePath, "git", "clean", "-fd"); err != nil {
+		return fmt.Errorf("failed to clean untracked files: %w", err)
+	}
+
+	return nil
+}
+
+func (s *GitStorage) Fetch(filePath string) error {
+	if err := shared.RunCmd(filePath, "git", "fetch", s.remote()); err != nil {
+		return fmt.Errorf("failed to fetch from remote: %w", err)
+	}
+	return nil
+}
+
+func (s *GitStorage) ExportRevision(filePath string, rev Revision, dest string) error {
+	remoteRef := s.remote() + "/" + s.branch(filePath)
+	var ref string
+	switch rev {
+	case RevisionBase:
+		// Nothing has been shared with the remote until it has the branch
+		if !gitRefExists(filePath, remoteRef) || !gitRefExists(filePath, "HEAD") {
+			return shared.EnsureDir(dest)
+		}
+		out, err := exec.Command("git", "-C", filePath, "merge-base", "HEAD", remoteRef).Output()
+		if err != nil {
+			// Unrelated histories have no common state
+			return shared.EnsureDir(dest)
+		}
+		ref = strings.TrimSpace(string(out))
+	case RevisionRemote:
+		ref = remoteRef
+	default:
+		return fmt.Errorf("unknown revision: %s", rev)
+	}
+
+	if err := shared.EnsureDir(dest); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dest, err)
+	}
+	// A revision without commits or without a files/ tree has nothing to export
+	if !gitRefExists(filePath, ref) {
+		return nil
+	}
+	out, err := exec.Command("git", "-C", filePath, "ls-tree", "--name-only", ref, "files").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", ref, err)
+	}
+	if strings.TrimSpace(string(out)) == "" {
+		return nil
+	}
+
+	cmd := exec.Command("git", "archive", "--format=tar", ref, "files")
+	cmd.Dir = filePath
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", ref, err)
+	}
+	extractErr := extractTar(stdout, "files", dest)
+	// Drain whatever is left so git can exit cleanly
+	_, _ = io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", ref, err)
+	}
+	return extractErr
+}
+
+// branch returns the remote branch to sync with.
+func (s *GitStorage) branch(repoPath string) string {
+	if s.Branch != "" {
+		return s.Branch
+	}
+	return currentBranchOrDefault(repoPath)
+}
+
+// commit records the staged changes, if there are any, with the configured
+// author and message.
+func (s *GitStorage) commit(repoPath string) error {
+	out, err := exec.Command("git", "-C", repoPath, "diff", "--cached", "--name-only", "-z").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list staged changes: %w", err)
+	}
+	changed := strings.FieldsFunc(string(out), func(r rune) bool { return r == 0 })
+	if len(changed) == 0 {
+		return nil
+	}
+
+	args := []string{"commit", "-q", "-m", s.commitMessage(repoPath, changed)}
+	// The author also commits, so no git identity needs to be configured
+	if m := gitAuthorPattern.FindStringSubmatch(s.Author); m != nil {
+		args = append([]string{"-c", "user.name=" + m[1], "-c", "user.email=" + m[2]}, append(args, "--author", s.Author)...)
+	}
+	if out, err := exec.Command("git", append([]string{"-C", repoPath}, args...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to commit: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// uncommit moves the branch back to previous, the commit HEAD was at
+// before commit, keeping the index and working tree. An empty previous
+// means the branch had no commits yet.
+func uncommit(repoPath, previous string) error {
+	if previous == "" {
+		return shared.RunCmd(repoPath, "git", "update-ref", "-d", "HEAD")
+	}
+	return shared.RunCmd(repoPath, "git", "reset", "-q", "--soft", previous)
+}
+
+// maxMessageFiles is how many changed files {files} lists by name.
+const maxMessageFiles = 10
+
+// commitMessage fills in the message template: {host} is this machine's
+// hostname, {time} the current time, {count} the number of changed files
+// and {files} their paths, such as ~/.config/nvim/init.lua.
+func (s *GitStorage) commitMessage(repoPath string, changed []string) string {
+	template := s.Message
+	if template == "" {
+		return defaultCommitMessage
+	}
+	files := changedRecordPaths(repoPath, changed)
+	listed := files
+	if len(listed) > maxMessageFiles {
+		listed = append(listed[:maxMessageFiles:maxMessageFiles], fmt.Sprintf("and %d more", len(files)-maxMessageFiles))
+	}
+	host, _ := os.Hostname()
+	return strings.NewReplacer(
+		"{host}", host,
+		"{time}", time.Now().Format("2006-01-02 15:04:05"),
+		"{count}", strconv.Itoa(len(files)),
+		"{files}", strings.Join(listed, ", "),
+	).Replace(template)
+}
+
+// changedRecordPaths maps changed staging paths below files/ to the live
+// paths of their records, as far as the staged state.db knows them.
+func changedRecordPaths(repoPath string, changed []string) []string {
+	records := map[string]string{}
+	if dbPath := filepath.Join(repoPath, "state.db"); shared.PathExists(dbPath) {
+		if database, err := db.OpenDotSyncDBAt(dbPath); err == nil {
+			if stored, err := db.GetAllFilePaths(database); err == nil {
+				for _, r := range stored {
+					records[strconv.Itoa(r.ID)] = r.Path
+				}
+			}
+			database.Close()
+		}
+	}
+	home := shared.FindHomeDir()
+	var paths []string
+	for _, p := range changed {
+		rest, ok := strings.CutPrefix(p, "files/")
+		if !ok {
+			continue
+		}
+		id, sub, _ := strings.Cut(rest, "/")
+		live, ok := records[id]
+		if !ok {
+			paths = append(paths, p)
+			continue
+		}
+		if sub != "" {
+			live = filepath.Join(live, filepath.FromSlash(sub))
+		}
+		if home != "" && strings.HasPrefix(live, home+string(filepath.Separator)) {
+			live = "~" + strings.TrimPrefix(live, home)
+		}
+		paths = append(paths, live)
+	}
+	return paths
+}
+
+// Check lists the remote's branches, then asks the server to accept a push
+// to a new branch without sending anything.
+func (s *GitStorage) Check(filePath string) error {
+	if out, err := exec.Command("git", "-C", filePath, "ls-remote", "--heads", s.remote()).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to reach %s: %s", s.RemoteURL, strings.TrimSpace(string(out)))
+	}
+	// Without commits there is nothing to push, even in a dry run
+	if !gitRefExists(filePath, "HEAD") {
+		return nil
+	}
+	out, err := exec.Command("git", "-C", filePath, "push", "--dry-run", "--porcelain", s.remote(), "HEAD:refs/heads/dot-sync-write-test").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("no write access to %s: %s", s.RemoteURL, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// localStateKey names the git remote, which both git engines keep in the
+// staging repository.
+func (s *GitStorage) localStateKey() string {
+	return "git remote " + s.remote()
+}
+
+// removeLocalState drops the git remote and its remote-tracking branches.
+func (s *GitStorage) removeLocalState(filePath string) error {
+	out, err := exec.Command("git", "-C", filePath, "remote", "remove", s.remote()).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "No such remote") {
+		return fmt.Errorf("failed to remove git remote %s: %s", s.remote(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func isRemoteExistsError(err error) bool {
+	// git returns exit code 3 or 128 and message contains "remote origin already exists"
+	return err != nil && (err.Error() == "exit status 3" || err.Error() == "exit status 128" ||
+		(err.Error() != "" && containsRemoteExistsMsg(err.Error())))
+}
+
+func containsRemoteExistsMsg(msg string) bool {
+	return msg != "" && (msg == "fatal: remote origin already exists." ||
+		msg == "fatal: remote origin already exists" ||
+		msg == "error: remote origin already exists." ||
+		msg == "error: remote origin already exists")
+}
+
+// currentBranchOrDefault returns the checked out branch, falling back to main
+// for repositories without commits.
+func currentBranchOrDefault(repoPath string) string {
+	branch, err := getCurrentGitBranch(repoPath)
+	if err != nil || branch == "" || branch == "HEAD" {
+		return "main"
+	}
+	return branch
+}
+
+func getCurrentGitBranch(repoPath string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	cmd.Dir = repoPath
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// checkRemoteNotAhead returns a *ConflictError when remoteRef has commits
+// that HEAD does not contain.
+func checkRemoteNotAhead(repoPath, remoteRef string) error {
+	if !gitRefExists(repoPath, remoteRef) {
+		return nil
+	}
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", remoteRef, "HEAD")
+	cmd.Dir = repoPath
+	if err := cmd.Run(); err == nil {
+		return nil
+	}
+
+	conflictErr := &ConflictError{}
+	base, err := exec.Command("git", "-C", repoPath, "merge-base", "HEAD", remoteRef).Output()
+	if err != nil {
+		// Unrelated histories: every path present on both sides conflicts
+		local, _ := gitTreeFiles(repoPath, "HEAD")
+		remote, _ := gitTreeFiles(repoPath, remoteRef)
+		conflictErr.Paths = intersectPaths(local, remote)
+		return conflictErr
+	}
+	baseRef := strings.TrimSpace(string(base))
+	local, err := gitChangedFiles(repoPath, baseRef, "HEAD")
+	if err != nil {
+		return err
+	}
+	remote, err := gitChangedFiles(repoPath, baseRef, remoteRef)
+	if err != nil {
+		return err
+	}
+	conflictErr.Paths = intersectPaths(local, remote)
+	return conflictErr
+}
+
+// gitChangedFiles lists the paths below files/ that differ between two refs.
+func gitChangedFiles(repoPath, from, to string) ([]string, error) {
+	out, err := exec.Command("git", "-C", repoPath, "diff", "--name-only", from, to, "--", "files").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare %s and %s: %w", from, to, err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// gitTreeFiles lists the paths below files/ present in ref.
+func gitTreeFiles(repoPath, ref string) ([]string, error) {
+	out, err := exec.Command("git", "-C", repoPath, "ls-tree", "-r", "--name-only", ref, "files").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func intersectPaths(a, b []string) []string {
+	inA := make(map[string]bool, len(a))
+	for _, path := range a {
+		inA[path] = true
+	}
+	var both []string
+	for _, path := range b {
+		if inA[path] {
+			both = append(both, path)
+		}
+	}
+	return both
+}
+
+// ensureGitignore appends any of patterns missing from dir/.gitignore.
+func ensureGitignore(dir string, patterns []string) error {
+	path := filepath.Join(dir, ".gitignore")
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	present := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		present[strings.TrimSpace(line)] = true
+	}
+
+	var missing strings.Builder
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		missing.WriteString("\n")
+	}
+	added := false
+	for _, pattern := range patterns {
+		if !present[pattern] {
+			missing.WriteString(pattern + "\n")
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(missing.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func gitRefExists(repoPath, ref string) bool {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	cmd.Dir = repoPath
+	return cmd.Run() == nil
+}
+
+// extractTar writes the entries of a tar stream found below prefix into dest,
+// stripping the prefix from their names.
+func extractTar(r io.Reader, prefix, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		rel, err := filepath.Rel(prefix, name)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		target := filepath.Join(dest, rel)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := shared.EnsureDir(target); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := shared.EnsureDir(filepath.Dir(target)); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := shared.EnsureDir(filepath.Dir(target)); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package storage
 
 import (
+	"errors"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/tylerkeyes/dot-sync/internal/db"
 	"github.com/tylerkeyes/dot-sync/internal/shared"
 )
 
@@ -13,14 +18,14 @@ func TestGitStorage_PushToStorage(t *testing.T) {
 	storage := &GitStorage{RemoteURL: "https://github.com/user/repo.git"}
 
 	// Test with non-existent path (should error)
-	err := storage.PushToStorage("/some/nonexistent/path")
+	err := storage.PushToStorage("/some/nonexistent/path", PushOptions{})
 	if err == nil {
 		t.Error("expected error for non-existent path, got nil")
 	}
 
 	// Test with non-git directory (should error at git commands)
 	temp := t.TempDir()
-	err = storage.PushToStorage(temp)
+	err = storage.PushToStorage(temp, PushOptions{})
 	if err == nil {
 		t.Error("expected error for non-git directory, got nil")
 	}
@@ -48,7 +53,7 @@ func TestGitStorage_PushToStorage_WithGitRepo(t *testing.T) {
 	}
 
 	// This will fail at push due to no remote, but tests the force push logic
-	err := storage.PushToStorage(temp)
+	err := storage.PushToStorage(temp, PushOptions{})
 	if err == nil {
 		t.Error("expected error due to missing remote, got nil")
 	}
@@ -417,3 +422,304 @@ type testError struct {
 func (e *testError) Error() string {
 	return e.msg
 }
+
+// newTestGitRepo creates a git repository with a bare "origin" remote and
+// returns the paths of both. It skips the test when git is unavailable.
+func newTestGitRepo(t *testing.T) (string, string) {
+	t.Helper()
+	t.Setenv("GIT_AUTHOR_NAME", "Test User")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "Test User")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	repo := t.TempDir()
+	if err := shared.RunCmd("", "git", "init", "--bare", remote); err != nil {
+		t.Skip("git not available for testing")
+	}
+	if err := shared.RunCmd(repo, "git", "init"); err != nil {
+		t.Skip("git not available for testing")
+	}
+	if err := shared.RunCmd(repo, "git", "remote", "add", "origin", remote); err != nil {
+		t.Fatalf("git remote add failed: %v", err)
+	}
+	return repo, remote
+}
+
+func TestGitStorage_ExportRevision(t *testing.T) {
+	repo, remote := newTestGitRepo(t)
+	storage := &GitStorage{RemoteURL: remote}
+
+	// Nothing committed yet: exports are empty
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := storage.ExportRevision(repo, RevisionBase, empty); err != nil {
+		t.Fatalf("ExportRevision on empty repo failed: %v", err)
+	}
+	if entries, _ := os.ReadDir(empty); len(entries) != 0 {
+		t.Errorf("expected empty export, got %d entries", len(entries))
+	}
+
+	os.MkdirAll(filepath.Join(repo, "files", "2"), 0700)
+	os.WriteFile(filepath.Join(repo, "files", "1"), []byte("file one"), 0600)
+	os.WriteFile(filepath.Join(repo, "files", "2", "nested.txt"), []byte("nested"), 0600)
+	if err := storage.PushToStorage(repo, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+
+	// Local changes after the push are not part of either revision
+	os.WriteFile(filepath.Join(repo, "files", "1"), []byte("edited"), 0600)
+
+	for _, rev := range []Revision{RevisionBase, RevisionRemote} {
+		dest := filepath.Join(t.TempDir(), string(rev))
+		if err := storage.Fetch(repo); err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		if err := storage.ExportRevision(repo, rev, dest); err != nil {
+			t.Fatalf("ExportRevision(%s) failed: %v", rev, err)
+		}
+		if data, err := os.ReadFile(filepath.Join(dest, "1")); err != nil || string(data) != "file one" {
+			t.Errorf("%s: unexpected content for 1: %v, %q", rev, err, data)
+		}
+		if data, err := os.ReadFile(filepath.Join(dest, "2", "nested.txt")); err != nil || string(data) != "nested" {
+			t.Errorf("%s: unexpected content for 2/nested.txt: %v, %q", rev, err, data)
+		}
+	}
+
+	if err := storage.ExportRevision(repo, Revision("bogus"), t.TempDir()); err == nil {
+		t.Error("expected error for unknown revision, got nil")
+	}
+}
+
+func TestGitStorage_PushToStorage_DetectsConflicts(t *testing.T) {
+	repo, remote := newTestGitRepo(t)
+	storage := &GitStorage{RemoteURL: remote}
+
+	os.MkdirAll(filepath.Join(repo, "files"), 0700)
+	os.WriteFile(filepath.Join(repo, "files", "1"), []byte("base"), 0600)
+	os.WriteFile(filepath.Join(repo, "files", "2"), []byte("base"), 0600)
+	if err := storage.PushToStorage(repo, PushOptions{}); err != nil {
+		t.Fatalf("initial PushToStorage failed: %v", err)
+	}
+
+	// Another machine changes files 1 and 2
+	clone := filepath.Join(t.TempDir(), "clone")
+	if err := shared.RunCmd("", "git", "clone", remote, clone); err != nil {
+		t.Fatalf("git clone failed: %v", err)
+	}
+	os.WriteFile(filepath.Join(clone, "files", "1"), []byte("theirs"), 0600)
+	os.WriteFile(filepath.Join(clone, "files", "2"), []byte("theirs"), 0600)
+	shared.RunCmd(clone, "git", "commit", "-am", "remote edit")
+	shared.RunCmd(clone, "git", "push")
+
+	// We only change file 1
+	before, _ := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+	os.WriteFile(filepath.Join(repo, "files", "1"), []byte("ours"), 0600)
+	err := storage.PushToStorage(repo, PushOptions{})
+	var conflictErr *ConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("expected ConflictError, got %v", err)
+	}
+
+	// The refused sync leaves no commit behind, only the staged change
+	after, _ := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+	if string(after) != string(before) {
+		t.Errorf("expected HEAD to stay at %s, got %s", before, after)
+	}
+	staged, _ := exec.Command("git", "-C", repo, "diff", "--cached", "--name-only").Output()
+	if strings.TrimSpace(string(staged)) != "files/1" {
+		t.Errorf("expected files/1 to stay staged, got %q", staged)
+	}
+	if !reflect.DeepEqual(conflictErr.Paths, []string{"files/1"}) {
+		t.Errorf("expected files/1 to conflict, got %v", conflictErr.Paths)
+	}
+	if !strings.Contains(err.Error(), "--force") {
+		t.Errorf("expected error to mention --force, got %v", err)
+	}
+
+	// The remote is left alone
+	out, _ := exec.Command("git", "-C", remote, "show", "HEAD:files/1").Output()
+	if string(out) != "theirs" {
+		t.Errorf("expected remote to keep its change, got %q", out)
+	}
+
+	// Forcing overwrites the remote
+	if err := storage.PushToStorage(repo, PushOptions{Force: true}); err != nil {
+		t.Fatalf("forced PushToStorage failed: %v", err)
+	}
+	out, _ = exec.Command("git", "-C", remote, "show", "HEAD:files/1").Output()
+	if string(out) != "ours" {
+		t.Errorf("expected forced push to overwrite remote, got %q", out)
+	}
+}
+
+func TestGitStorage_PushToStorage_RemoteAheadWithoutOverlap(t *testing.T) {
+	repo, remote := newTestGitRepo(t)
+	storage := &GitStorage{RemoteURL: remote}
+
+	os.MkdirAll(filepath.Join(repo, "files"), 0700)
+	os.WriteFile(filepath.Join(repo, "files", "1"), []byte("base"), 0600)
+	if err := storage.PushToStorage(repo, PushOptions{}); err != nil {
+		t.Fatalf("initial PushToStorage failed: %v", err)
+	}
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	shared.RunCmd("", "git", "clone", remote, clone)
+	os.WriteFile(filepath.Join(clone, "files", "2"), []byte("new on remote"), 0600)
+	shared.RunCmd(clone, "git", "add", ".")
+	shared.RunCmd(clone, "git", "commit", "-m", "remote add")
+	shared.RunCmd(clone, "git", "push")
+
+	err := storage.PushToStorage(repo, PushOptions{})
+	var conflictErr *ConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("expected ConflictError when remote is ahead, got %v", err)
+	}
+	if len(conflictErr.Paths) != 0 {
+		t.Errorf("expected no overlapping paths, got %v", conflictErr.Paths)
+	}
+}
+
+func TestIntersectPaths(t *testing.T) {
+	got := intersectPaths([]string{"files/1", "files/2/a", "state.db"}, []string{"files/2/a", "files/3"})
+	if !reflect.DeepEqual(got, []string{"files/2/a"}) {
+		t.Errorf("unexpected intersection: %v", got)
+	}
+	if got := intersectPaths(nil, []string{"files/1"}); len(got) != 0 {
+		t.Errorf("expected empty intersection, got %v", got)
+	}
+}
+
+func TestEnsureGitignore(t *testing.T) {
+	temp := t.TempDir()
+	path := filepath.Join(temp, ".gitignore")
+	os.WriteFile(path, []byte("*.swp"), 0644)
+
+	if err := ensureGitignore(temp, []string{"/backups/", "*.swp"}); err != nil {
+		t.Fatalf("ensureGitignore failed: %v", err)
+	}
+	// Running again doesn't duplicate entries
+	if err := ensureGitignore(temp, []string{"/backups/"}); err != nil {
+		t.Fatalf("ensureGitignore failed: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "*.swp\n/backups/\n" {
+		t.Errorf("unexpected .gitignore content: %q", data)
+	}
+}
+
+func TestGitStorage_InitializeStorage_UpdatesRemoteURL(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotSyncDir := filepath.Join(home, ".dot-sync")
+
+	for _, url := range []string{"https://example.com/old.git", "https://example.com/new.git"} {
+		storage := &GitStorage{RemoteURL: url}
+		if err := storage.InitializeStorage(); err != nil {
+			t.Skipf("git not available for testing: %v", err)
+		}
+		out, err := exec.Command("git", "-C", dotSyncDir, "remote", "get-url", "origin").Output()
+		if err != nil || strings.TrimSpace(string(out)) != url {
+			t.Errorf("expected origin to point at %s, got %q %v", url, out, err)
+		}
+	}
+}
+
+func TestGitStorage_Check(t *testing.T) {
+	repo, remote := newTestGitRepo(t)
+	storage := &GitStorage{RemoteURL: remote}
+	if err := storage.Check(repo); err != nil {
+		t.Errorf("expected an empty repository to pass, got %v", err)
+	}
+
+	os.WriteFile(filepath.Join(repo, "state.db"), []byte("db"), 0644)
+	shared.RunCmd(repo, "git", "add", ".")
+	shared.RunCmd(repo, "git", "commit", "-m", "initial")
+	if err := storage.Check(repo); err != nil {
+		t.Errorf("expected the check to pass, got %v", err)
+	}
+	if out, _ := exec.Command("git", "-C", remote, "branch", "--list").Output(); len(out) != 0 {
+		t.Errorf("expected the remote to be left unchanged, got branches %q", out)
+	}
+
+	os.RemoveAll(remote)
+	if err := storage.Check(repo); err == nil {
+		t.Error("expected a missing remote to fail the check")
+	}
+}
+
+func TestNewGitStorage(t *testing.T) {
+	s, err := NewGitStorage("backup", "https://example.com/dotfiles.git", map[string]string{"branch": "dotfiles/laptop", "author": "Alice Smith <alice@example.com>"})
+	if err != nil || s.remote() != "backup" || s.Branch != "dotfiles/laptop" {
+		t.Errorf("unexpected storage %+v %v", s, err)
+	}
+	for _, options := range []map[string]string{
+		{"branch": "-f"},
+		{"branch": "a..b"},
+		{"branch": "with space"},
+		{"author": "alice@example.com"},
+		{"author": "<alice@example.com>"},
+	} {
+		if _, err := NewGitStorage("origin", "https://example.com/dotfiles.git", options); err == nil {
+			t.Errorf("expected %v to be rejected", options)
+		}
+	}
+}
+
+func TestGitStorage_PushToStorage_ConfiguredCommits(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	repo, remote := newTestGitRepo(t)
+
+	database, _ := db.OpenDotSyncDBAt(filepath.Join(repo, "state.db"))
+	db.EnsureFilesTable(database)
+	db.InsertFiles(database, []string{filepath.Join(home, ".zshrc"), filepath.Join(home, ".config", "nvim")})
+	database.Close()
+	os.MkdirAll(filepath.Join(repo, "files", "2"), 0755)
+	os.WriteFile(filepath.Join(repo, "files", "1"), []byte("export EDITOR=vim"), 0644)
+	os.WriteFile(filepath.Join(repo, "files", "2", "init lua"), []byte("init"), 0644)
+
+	storage, err := NewGitStorage("origin", remote, map[string]string{
+		"branch":  "dotfiles",
+		"author":  "Dot Sync <dot-sync@example.com>",
+		"message": "sync from {host}: {count} files ({files})",
+	})
+	if err != nil {
+		t.Fatalf("NewGitStorage failed: %v", err)
+	}
+	if err := storage.PushToStorage(repo, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+
+	out, err := exec.Command("git", "-C", remote, "log", "-1", "--format=%an <%ae>%n%s", "dotfiles").Output()
+	if err != nil {
+		t.Fatalf("expected the dotfiles branch to be pushed: %v", err)
+	}
+	host, _ := os.Hostname()
+	want := "Dot Sync <dot-sync@example.com>\nsync from " + host + ": 2 files (~/.zshrc, ~/.config/nvim/init lua)\n"
+	if string(out) != want {
+		t.Errorf("expected commit\n%q, got\n%q", want, out)
+	}
+
+	// Nothing changed: no empty commit is attempted
+	if err := storage.PushToStorage(repo, PushOptions{}); err != nil {
+		t.Errorf("expected a push without changes to succeed, got %v", err)
+	}
+	if err := storage.PullFromStorage(repo); err != nil {
+		t.Errorf("expected a pull from the configured branch to succeed, got %v", err)
+	}
+}
+
+func TestCommitMessageListsFewFiles(t *testing.T) {
+	var changed []string
+	for i := 1; i <= 12; i++ {
+		changed = append(changed, "files/"+strconv.Itoa(i))
+	}
+	storage := &GitStorage{Message: "{count}: {files}"}
+	got := storage.commitMessage(t.TempDir(), append(changed, "state.db"))
+	if !strings.HasPrefix(got, "12: files/1, files/2,") || !strings.HasSuffix(got, "files/10, and 2 more") {
+		t.Errorf("unexpected message %q", got)
+	}
+	if got := (&GitStorage{}).commitMessage(t.TempDir(), changed); got != defaultCommitMessage {
+		t.Errorf("expected the default message, got %q", got)
+	}
+}
@@ -0,0 +1,822 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// Errors of the built-in git engine. They are wrapped along with the
+// underlying error, so check for them with errors.Is.
+var (
+	ErrGitAuth           = errors.New("git authentication failed")
+	ErrGitNonFastForward = errors.New("remote branch has commits that are not in local storage")
+	ErrGitRemoteNotFound = errors.New("git repository not found")
+)
+
+// GoGitStorage is git storage that uses go-git instead of running the git
+// binary, selected with --engine go. It keeps the repository layout and
+// options of GitStorage, so a remote can switch engines at any time.
+type GoGitStorage struct {
+	GitStorage
+}
+
+// localRepoLoader opens the repository of a local-path remote. Unlike
+// go-git's loader it also accepts a repository with a worktree.
+type localRepoLoader struct{}
+
+func (localRepoLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	for _, dir := range []string{filepath.Join(ep.Path, git.GitDirName), ep.Path} {
+		e := *ep
+		e.Path = dir
+		if s, err := server.DefaultLoader.Load(&e); err == nil {
+			return s, nil
+		}
+	}
+	return nil, transport.ErrRepositoryNotFound
+}
+
+// localRemote opens the repository of a local-path remote, or returns nil
+// for other remotes. go-git runs git-upload-pack and git-receive-pack for
+// local paths, which the built-in engine is meant to do without, so it
+// copies objects and references between the two repositories itself.
+func (s *GoGitStorage) localRemote() (storer.Storer, error) {
+	ep, err := transport.NewEndpoint(s.RemoteURL)
+	if err != nil || ep.Protocol != "file" {
+		return nil, nil
+	}
+	return localRepoLoader{}.Load(ep)
+}
+
+// fetchLocal copies the branches of a local remote into its remote-tracking
+// branches, along with the objects they need.
+func (s *GoGitStorage) fetchLocal(repo *git.Repository, remote storer.Storer) error {
+	refs, err := remote.IterReferences()
+	if err != nil {
+		return err
+	}
+	defer refs.Close()
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || !ref.Name().IsBranch() {
+			return nil
+		}
+		if err := copyObjects(remote, repo.Storer, ref.Hash()); err != nil {
+			return err
+		}
+		tracking := plumbing.NewRemoteReferenceName(s.remote(), ref.Name().Short())
+		return repo.Storer.SetReference(plumbing.NewHashReference(tracking, ref.Hash()))
+	})
+}
+
+// pushLocal points branch of a local remote at head, refusing to drop
+// commits of the remote unless force is set.
+func pushLocal(repo *git.Repository, remote storer.Storer, head plumbing.Hash, branch string, force bool) error {
+	name := plumbing.NewBranchReferenceName(branch)
+	old, err := remote.Reference(name)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		old = nil
+	} else if err != nil {
+		return err
+	}
+	if old != nil && old.Hash() == head {
+		return nil
+	}
+	if old != nil && !force {
+		local, err := repo.CommitObject(head)
+		if err != nil {
+			return err
+		}
+		// A commit this repository doesn't have was pushed since the fetch
+		previous, err := repo.CommitObject(old.Hash())
+		if err != nil {
+			return ErrGitNonFastForward
+		}
+		if ok, err := previous.IsAncestor(local); err != nil || !ok {
+			return ErrGitNonFastForward
+		}
+	}
+	if err := copyObjects(repo.Storer, remote, head); err != nil {
+		return err
+	}
+	if err := remote.CheckAndSetReference(plumbing.NewHashReference(name, head), old); err != nil {
+		return ErrGitNonFastForward
+	}
+	return nil
+}
+
+// copyObjects copies the objects reachable from root that dst lacks. An
+// object dst has is taken to come with everything it refers to, as it does
+// in a repository, so the copy stops there. Objects are written after those
+// they refer to, which keeps that true if the copy is interrupted.
+func copyObjects(src, dst storer.EncodedObjectStorer, root plumbing.Hash) error {
+	var missing []plumbing.EncodedObject
+	seen := map[plumbing.Hash]bool{}
+	pending := []plumbing.Hash{root}
+	for len(pending) > 0 {
+		h := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[h] || dst.HasEncodedObject(h) == nil {
+			continue
+		}
+		seen[h] = true
+		obj, err := src.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return err
+		}
+		missing = append(missing, obj)
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			c, err := object.DecodeCommit(src, obj)
+			if err != nil {
+				return err
+			}
+			pending = append(append(pending, c.TreeHash), c.ParentHashes...)
+		case plumbing.TreeObject:
+			t, err := object.DecodeTree(src, obj)
+			if err != nil {
+				return err
+			}
+			for _, e := range t.Entries {
+				if e.Mode != filemode.Submodule {
+					pending = append(pending, e.Hash)
+				}
+			}
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(src, obj)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, t.Target)
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if _, err := dst.SetEncodedObject(missing[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GoGitStorage) InitializeStorage() error {
+	home := shared.FindHomeDir()
+	dir := filepath.Join(home, shared.GetDotSyncDir())
+	filesDir := filepath.Join(home, shared.GetDotSyncFilesDir())
+
+	if err := shared.EnsureDir(dir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	if err := shared.EnsureDir(filesDir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filesDir, err)
+	}
+
+	repo, err := git.PlainOpen(dir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		branch := s.Branch
+		if branch == "" {
+			branch = "main"
+		}
+		repo, err = git.PlainInitWithOptions(dir, &git.PlainInitOptions{
+			InitOptions: git.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName(branch)},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to init git repo: %w", err)
+	}
+	if err := ensureGitignore(dir, localOnlyPaths); err != nil {
+		return fmt.Errorf("failed to update .gitignore: %w", err)
+	}
+	// Name the first commit's branch after the configured one
+	if _, err := repo.Head(); s.Branch != "" && errors.Is(err, plumbing.ErrReferenceNotFound) {
+		head := plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(s.Branch))
+		if err := repo.Storer.SetReference(head); err != nil {
+			return fmt.Errorf("failed to set branch: %w", err)
+		}
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return fmt.Errorf("failed to read git config: %w", err)
+	}
+	remote, ok := cfg.Remotes[s.remote()]
+	switch {
+	case !ok:
+		if _, err := repo.CreateRemote(&config.RemoteConfig{Name: s.remote(), URLs: []string{s.RemoteURL}}); err != nil {
+			return fmt.Errorf("failed to add remote: %w", err)
+		}
+	case len(remote.URLs) != 1 || remote.URLs[0] != s.RemoteURL:
+		remote.URLs = []string{s.RemoteURL}
+		if err := repo.SetConfig(cfg); err != nil {
+			return fmt.Errorf("failed to update remote: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *GoGitStorage) PushToStorage(filePath string, opts PushOptions) error {
+	fmt.Println("Pushing contents to storage...")
+
+	if err := ensureGitignore(filePath, localOnlyPaths); err != nil {
+		return fmt.Errorf("failed to update .gitignore: %w", err)
+	}
+	repo, err := git.PlainOpen(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open git repo: %w", err)
+	}
+	var previous plumbing.Hash
+	if head, err := repo.Head(); err == nil {
+		previous = head.Hash()
+	}
+	if err := s.commit(repo, filePath); err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("nothing to push: %w", err)
+	}
+	branch := s.branchOf(repo)
+
+	// The commit itself is pushed, so a detached HEAD works like in git
+	refspec := head.Hash().String() + ":" + plumbing.NewBranchReferenceName(branch).String()
+	if opts.Force {
+		refspec = "+" + refspec
+	} else {
+		if err := s.fetch(repo); err != nil {
+			return err
+		}
+		if err := s.checkRemoteNotAhead(repo, head.Hash(), branch); err != nil {
+			// A refused sync must not leave its commit for the next one to
+			// build on; the changes stay staged
+			if resetErr := resetHead(repo, previous); resetErr != nil {
+				return fmt.Errorf("%w (and failed to undo the local commit: %v)", err, resetErr)
+			}
+			return err
+		}
+	}
+
+	local, err := s.localRemote()
+	if err != nil {
+		return fmt.Errorf("failed to push: %w", gitError(err))
+	}
+	if local != nil {
+		err = pushLocal(repo, local, head.Hash(), branch, opts.Force)
+	} else {
+		var auth transport.AuthMethod
+		if auth, err = s.auth(); err != nil {
+			return err
+		}
+		err = repo.Push(&git.PushOptions{
+			RemoteName: s.remote(),
+			RefSpecs:   []config.RefSpec{config.RefSpec(refspec)},
+			Auth:       auth,
+			Force:      opts.Force,
+		})
+	}
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		err = gitError(err)
+		// Someone pushed since the fetch above
+		if errors.Is(err, ErrGitNonFastForward) {
+			return &ConflictError{Err: err}
+		}
+		return fmt.Errorf("failed to push: %w", err)
+	}
+	tracking := plumbing.NewHashReference(plumbing.NewRemoteReferenceName(s.remote(), branch), head.Hash())
+	return repo.Storer.SetReference(tracking)
+}
+
+func (s *GoGitStorage) PullFromStorage(filePath string) error {
+	fmt.Println("Pulling contents from storage...")
+
+	repo, err := git.PlainOpen(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open git repo: %w", err)
+	}
+	if err := s.fetch(repo); err != nil {
+		return err
+	}
+	branch := s.branchOf(repo)
+	remote, err := repo.Reference(plumbing.NewRemoteReferenceName(s.remote(), branch), true)
+	if err != nil {
+		return fmt.Errorf("failed to reset to remote state: %s has no branch %s", s.RemoteURL, branch)
+	}
+
+	// Before the first commit there is no branch for the reset to move
+	if _, err := repo.Head(); errors.Is(err, plumbing.ErrReferenceNotFound) {
+		head, err := repo.Storer.Reference(plumbing.HEAD)
+		if err != nil {
+			return fmt.Errorf("failed to read HEAD: %w", err)
+		}
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(head.Target(), remote.Hash())); err != nil {
+			return fmt.Errorf("failed to reset to remote state: %w", err)
+		}
+	}
+	if err := resetHard(repo, filePath, remote.Hash()); err != nil {
+		return fmt.Errorf("failed to reset to remote state: %w", err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	// Ignored files such as local.db are left alone, like with git clean -fd
+	if err := wt.Clean(&git.CleanOptions{Dir: true}); err != nil {
+		return fmt.Errorf("failed to clean untracked files: %w", err)
+	}
+	return nil
+}
+
+func (s *GoGitStorage) Fetch(filePath string) error {
+	repo, err := git.PlainOpen(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open git repo: %w", err)
+	}
+	return s.fetch(repo)
+}
+
+func (s *GoGitStorage) fetch(repo *git.Repository) error {
+	local, err := s.localRemote()
+	if err != nil {
+		return fmt.Errorf("failed to fetch from remote: %w", gitError(err))
+	}
+	if local != nil {
+		if err := s.fetchLocal(repo, local); err != nil {
+			return fmt.Errorf("failed to fetch from remote: %w", err)
+		}
+		return nil
+	}
+	auth, err := s.auth()
+	if err != nil {
+		return err
+	}
+	err = repo.Fetch(&git.FetchOptions{RemoteName: s.remote(), Auth: auth})
+	// An empty repository has nothing to fetch yet
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return fmt.Errorf("failed to fetch from remote: %w", gitError(err))
+	}
+	return nil
+}
+
+func (s *GoGitStorage) ExportRevision(filePath string, rev Revision, dest string) error {
+	repo, err := git.PlainOpen(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open git repo: %w", err)
+	}
+	remoteRef, remoteErr := repo.Reference(plumbing.NewRemoteReferenceName(s.remote(), s.branchOf(repo)), true)
+	var commit *object.Commit
+	switch rev {
+	case RevisionBase:
+		// Nothing has been shared with the remote until it has the branch
+		head, err := repo.Head()
+		if remoteErr != nil || err != nil {
+			return shared.EnsureDir(dest)
+		}
+		local, err := repo.CommitObject(head.Hash())
+		if err != nil {
+			return err
+		}
+		remote, err := repo.CommitObject(remoteRef.Hash())
+		if err != nil {
+			return err
+		}
+		bases, err := local.MergeBase(remote)
+		if err != nil {
+			return err
+		}
+		// Unrelated histories have no common state
+		if len(bases) == 0 {
+			return shared.EnsureDir(dest)
+		}
+		commit = bases[0]
+	case RevisionRemote:
+		if remoteErr == nil {
+			if commit, err = repo.CommitObject(remoteRef.Hash()); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown revision: %s", rev)
+	}
+
+	if err := shared.EnsureDir(dest); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dest, err)
+	}
+	if commit == nil {
+		return nil
+	}
+	return exportFilesTree(commit, dest)
+}
+
+// resetHead moves the checked out branch, or a detached HEAD, to commit
+// without touching the index or worktree, like git reset --soft. A zero
+// commit removes the branch, as before its first commit.
+func resetHead(repo *git.Repository, commit plumbing.Hash) error {
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
+	}
+	name := plumbing.HEAD
+	if head.Type() == plumbing.SymbolicReference {
+		name = head.Target()
+	}
+	if commit.IsZero() {
+		return repo.Storer.RemoveReference(name)
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(name, commit))
+}
+
+// resetHard points the checked out branch, the index and the worktree at
+// commit, like git reset --hard. go-git's hard reset also deletes untracked
+// files, local.db among them, so only the index is reset by go-git and the
+// worktree is written here.
+func resetHard(repo *git.Repository, repoPath string, commit plumbing.Hash) error {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: commit, Mode: git.MixedReset}); err != nil {
+		return err
+	}
+	c, err := repo.CommitObject(commit)
+	if err != nil {
+		return err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return err
+	}
+
+	// Remove what was tracked and is gone now, then write out the tree
+	for _, e := range idx.Entries {
+		if entry, err := tree.FindEntry(e.Name); (err == nil && entry.Mode != filemode.Dir) || !filepath.IsLocal(filepath.FromSlash(e.Name)) {
+			continue
+		}
+		path := filepath.Join(repoPath, filepath.FromSlash(e.Name))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// Drop directories left empty, stopping at one that isn't
+		for dir := filepath.Dir(path); dir != repoPath; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return writeTree(tree, repoPath)
+}
+
+// exportFilesTree writes the files/ tree of commit into dest.
+func exportFilesTree(commit *object.Commit, dest string) error {
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	files, err := tree.Tree("files")
+	if errors.Is(err, object.ErrDirectoryNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeTree(files, dest)
+}
+
+// writeTree writes the files of tree into dest, replacing what is there.
+func writeTree(tree *object.Tree, dest string) error {
+	return tree.Files().ForEach(func(f *object.File) error {
+		if !filepath.IsLocal(filepath.FromSlash(f.Name)) {
+			return nil
+		}
+		target := filepath.Join(dest, filepath.FromSlash(f.Name))
+		if err := shared.EnsureDir(filepath.Dir(target)); err != nil {
+			return err
+		}
+		// Never write through a symlink, and make way for a file that was
+		// a directory before
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if f.Mode == filemode.Symlink {
+			link, err := f.Contents()
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+		r, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// branch returns the remote branch to sync with.
+func (s *GoGitStorage) branch(repoPath string) string {
+	if s.Branch != "" {
+		return s.Branch
+	}
+	repo, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return "main"
+	}
+	return s.branchOf(repo)
+}
+
+func (s *GoGitStorage) branchOf(repo *git.Repository) string {
+	if s.Branch != "" {
+		return s.Branch
+	}
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil || head.Type() != plumbing.SymbolicReference || !head.Target().IsBranch() {
+		return "main"
+	}
+	return head.Target().Short()
+}
+
+// commit stages everything and records it, if anything changed, with the
+// configured author and message.
+func (s *GoGitStorage) commit(repo *git.Repository, repoPath string) error {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := wt.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return fmt.Errorf("failed to stage changes: %w", err)
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return fmt.Errorf("failed to list staged changes: %w", err)
+	}
+	var changed []string
+	for path, st := range status {
+		if st.Staging != git.Unmodified && st.Staging != git.Untracked {
+			changed = append(changed, path)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	sort.Strings(changed)
+
+	sig := s.signature(repo)
+	if _, err := wt.Commit(s.commitMessage(repoPath, changed), &git.CommitOptions{Author: sig, Committer: sig}); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// signature returns who commits are made as: the configured author, else
+// git's user.name and user.email, else dot-sync at this machine.
+func (s *GoGitStorage) signature(repo *git.Repository) *object.Signature {
+	var name, email string
+	if m := gitAuthorPattern.FindStringSubmatch(s.Author); m != nil {
+		name, email = m[1], m[2]
+	} else if cfg, err := repo.ConfigScoped(config.SystemScope); err == nil {
+		name, email = cfg.User.Name, cfg.User.Email
+	}
+	if name == "" {
+		name = "dot-sync"
+	}
+	if email == "" {
+		host, _ := os.Hostname()
+		email = "dot-sync@" + host
+	}
+	return &object.Signature{Name: name, Email: email, When: time.Now()}
+}
+
+// checkRemoteNotAhead returns a *ConflictError when the remote branch has
+// commits that head does not contain.
+func (s *GoGitStorage) checkRemoteNotAhead(repo *git.Repository, head plumbing.Hash, branch string) error {
+	ref, err := repo.Reference(plumbing.NewRemoteReferenceName(s.remote(), branch), true)
+	if err != nil {
+		return nil
+	}
+	remote, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return err
+	}
+	local, err := repo.CommitObject(head)
+	if err != nil {
+		return err
+	}
+	if ok, err := remote.IsAncestor(local); err != nil || ok {
+		return err
+	}
+
+	conflictErr := &ConflictError{Err: ErrGitNonFastForward}
+	bases, err := local.MergeBase(remote)
+	if err != nil {
+		return err
+	}
+	if len(bases) == 0 {
+		// Unrelated histories: every path present on both sides conflicts
+		localFiles, _ := commitTreeFiles(local)
+		remoteFiles, _ := commitTreeFiles(remote)
+		conflictErr.Paths = intersectPaths(localFiles, remoteFiles)
+		return conflictErr
+	}
+	localChanges, err := commitChangedFiles(bases[0], local)
+	if err != nil {
+		return err
+	}
+	remoteChanges, err := commitChangedFiles(bases[0], remote)
+	if err != nil {
+		return err
+	}
+	conflictErr.Paths = intersectPaths(localChanges, remoteChanges)
+	return conflictErr
+}
+
+// commitChangedFiles lists the paths below files/ that differ between two
+// commits.
+func commitChangedFiles(from, to *object.Commit) ([]string, error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare %s and %s: %w", from.Hash, to.Hash, err)
+	}
+	var paths []string
+	for _, c := range changes {
+		path := c.To.Name
+		if path == "" {
+			path = c.From.Name
+		}
+		if strings.HasPrefix(path, "files/") {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// commitTreeFiles lists the paths below files/ present in commit.
+func commitTreeFiles(commit *object.Commit) ([]string, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if strings.HasPrefix(f.Name, "files/") {
+			paths = append(paths, f.Name)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// Check lists the remote's branches, then opens a push session without
+// sending anything to see that the server accepts one. A local remote only
+// has to be a repository.
+func (s *GoGitStorage) Check(filePath string) error {
+	ep, err := transport.NewEndpoint(s.RemoteURL)
+	if err != nil {
+		return fmt.Errorf("invalid remote URL %s: %w", s.RemoteURL, err)
+	}
+	if ep.Protocol == "file" {
+		if _, err := (localRepoLoader{}).Load(ep); err != nil {
+			return fmt.Errorf("failed to reach %s: %w", s.RemoteURL, gitError(err))
+		}
+		return nil
+	}
+	auth, err := s.auth()
+	if err != nil {
+		return err
+	}
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return err
+	}
+	if err := advertisedRefs(c.NewUploadPackSession(ep, auth)); err != nil {
+		return fmt.Errorf("failed to reach %s: %w", s.RemoteURL, gitError(err))
+	}
+	if err := advertisedRefs(c.NewReceivePackSession(ep, auth)); err != nil {
+		return fmt.Errorf("no write access to %s: %w", s.RemoteURL, gitError(err))
+	}
+	return nil
+}
+
+// advertisedRefs reads the references the server advertises in a new
+// session and closes it; an empty repository is not an error.
+func advertisedRefs(sess transport.Session, err error) error {
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	if _, err := sess.AdvertisedReferences(); err != nil && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return err
+	}
+	return nil
+}
+
+func (s *GoGitStorage) localStateKey() string {
+	return "git remote " + s.remote()
+}
+
+// removeLocalState drops the git remote and its remote-tracking branches.
+func (s *GoGitStorage) removeLocalState(filePath string) error {
+	repo, err := git.PlainOpen(filePath)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := repo.DeleteRemote(s.remote()); err != nil && !errors.Is(err, git.ErrRemoteNotFound) {
+		return fmt.Errorf("failed to remove git remote %s: %w", s.remote(), err)
+	}
+	refs, err := repo.References()
+	if err != nil {
+		return err
+	}
+	var tracking []plumbing.ReferenceName
+	prefix := "refs/remotes/" + s.remote() + "/"
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), prefix) {
+			tracking = append(tracking, ref.Name())
+		}
+		return nil
+	})
+	for _, name := range tracking {
+		if err := repo.Storer.RemoveReference(name); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// auth returns the credentials for the remote: a token from
+// DOT_SYNC_GIT_TOKEN for https remotes. SSH remotes use the SSH agent and
+// known_hosts, which go-git does without any.
+func (s *GoGitStorage) auth() (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(s.RemoteURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote URL %s: %w", s.RemoteURL, err)
+	}
+	token := os.Getenv("DOT_SYNC_GIT_TOKEN")
+	if token == "" || (ep.Protocol != "https" && ep.Protocol != "http") {
+		return nil, nil
+	}
+	user := ep.User
+	if user == "" {
+		// Hosts such as GitHub take any user name along with a token
+		user = "dot-sync"
+	}
+	return &githttp.BasicAuth{Username: user, Password: token}, nil
+}
+
+// gitError wraps an error of go-git in the ErrGit* error it stands for.
+func gitError(err error) error {
+	var kind error
+	msg := err.Error()
+	switch {
+	case errors.Is(err, transport.ErrAuthenticationRequired), errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod), strings.Contains(msg, "unable to authenticate"):
+		kind = ErrGitAuth
+	case errors.Is(err, transport.ErrRepositoryNotFound), errors.Is(err, git.ErrRemoteNotFound):
+		kind = ErrGitRemoteNotFound
+	case errors.Is(err, git.ErrNonFastForwardUpdate), strings.Contains(msg, "non-fast-forward update"):
+		kind = ErrGitNonFastForward
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %v", kind, err)
+}
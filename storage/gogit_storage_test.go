@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/file"
+)
+
+// newGoGitMachine points HOME at a new directory and initializes built-in
+// git storage there for remote, returning the staging directory.
+func newGoGitMachine(t *testing.T, remote string) (*GoGitStorage, string) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	s := &GoGitStorage{GitStorage: GitStorage{RemoteURL: remote, Author: "Test User <test@example.com>"}}
+	if err := s.InitializeStorage(); err != nil {
+		t.Fatalf("InitializeStorage failed: %v", err)
+	}
+	return s, filepath.Join(home, ".dot-sync")
+}
+
+func newBareRemote(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if _, err := git.PlainInit(dir, true); err != nil {
+		t.Fatalf("failed to init remote: %v", err)
+	}
+	return dir
+}
+
+// remoteFile returns the contents of path on branch of the repository at
+// dir, or "" when it is missing.
+func remoteFile(t *testing.T, dir, branch, path string) string {
+	t.Helper()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", dir, err)
+	}
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		return ""
+	}
+	commit, _ := repo.CommitObject(ref.Hash())
+	f, err := commit.File(path)
+	if err != nil {
+		return ""
+	}
+	contents, _ := f.Contents()
+	return contents
+}
+
+func writeStagingFile(t *testing.T, dir, path, contents string) {
+	t.Helper()
+	full := filepath.Join(dir, filepath.FromSlash(path))
+	os.MkdirAll(filepath.Dir(full), 0755)
+	if err := os.WriteFile(full, []byte(contents), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestGoGitStorage_PushAndPull(t *testing.T) {
+	remote := newBareRemote(t)
+
+	laptop, laptopDir := newGoGitMachine(t, remote)
+	writeStagingFile(t, laptopDir, "files/1/init.lua", "set number")
+	writeStagingFile(t, laptopDir, "files/2", "old")
+	writeStagingFile(t, laptopDir, "local.db", "laptop only")
+	if err := os.Symlink("init.lua", filepath.Join(laptopDir, "files/1/link.lua")); err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.PushToStorage(laptopDir, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+	if got := remoteFile(t, remote, "main", "files/1/init.lua"); got != "set number" {
+		t.Errorf("expected the file on the remote's main branch, got %q", got)
+	}
+	if got := remoteFile(t, remote, "main", "local.db"); got != "" {
+		t.Errorf("expected local.db to stay local, got %q", got)
+	}
+
+	desktop, desktopDir := newGoGitMachine(t, remote)
+	writeStagingFile(t, desktopDir, "local.db", "desktop only")
+	writeStagingFile(t, desktopDir, "cache/manifest.json", "{}")
+	writeStagingFile(t, desktopDir, "files/9", "stray")
+	if err := desktop.PullFromStorage(desktopDir); err != nil {
+		t.Fatalf("PullFromStorage failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(desktopDir, "files/1/init.lua")); string(data) != "set number" {
+		t.Errorf("expected the pulled file, got %q", data)
+	}
+	if link, _ := os.Readlink(filepath.Join(desktopDir, "files/1/link.lua")); link != "init.lua" {
+		t.Errorf("expected the symlink to be pulled, got %q", link)
+	}
+	if data, _ := os.ReadFile(filepath.Join(desktopDir, "local.db")); string(data) != "desktop only" {
+		t.Errorf("expected local.db to survive the pull, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(desktopDir, "cache/manifest.json")); err != nil {
+		t.Errorf("expected cache/ to survive the pull: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(desktopDir, "files/9")); !os.IsNotExist(err) {
+		t.Errorf("expected untracked files to be cleaned, got %v", err)
+	}
+
+	// Removals are pushed too, and a file may become a directory
+	os.Remove(filepath.Join(desktopDir, "files/2"))
+	writeStagingFile(t, desktopDir, "files/3/a", "dir")
+	writeStagingFile(t, desktopDir, "files/1/init.lua", "set relativenumber")
+	if err := desktop.PushToStorage(desktopDir, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+	if got := remoteFile(t, remote, "main", "files/2"); got != "" {
+		t.Errorf("expected the removal to be pushed, got %q", got)
+	}
+
+	dest := t.TempDir()
+	if err := laptop.Fetch(laptopDir); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if err := laptop.ExportRevision(laptopDir, RevisionRemote, filepath.Join(dest, "remote")); err != nil {
+		t.Fatalf("ExportRevision failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "remote/1/init.lua")); string(data) != "set relativenumber" {
+		t.Errorf("expected the remote revision, got %q", data)
+	}
+	if err := laptop.ExportRevision(laptopDir, RevisionBase, filepath.Join(dest, "base")); err != nil {
+		t.Fatalf("ExportRevision failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "base/2")); string(data) != "old" {
+		t.Errorf("expected the base revision, got %q", data)
+	}
+
+	writeStagingFile(t, laptopDir, "files/3", "file")
+	laptop.PushToStorage(laptopDir, PushOptions{Force: true})
+	if err := desktop.PullFromStorage(desktopDir); err != nil {
+		t.Fatalf("PullFromStorage failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(desktopDir, "files/3")); string(data) != "file" {
+		t.Errorf("expected the directory to become a file, got %q", data)
+	}
+}
+
+func TestGoGitStorage_PushToStorage_DetectsConflicts(t *testing.T) {
+	remote := newBareRemote(t)
+	laptop, laptopDir := newGoGitMachine(t, remote)
+	writeStagingFile(t, laptopDir, "files/1", "v1")
+	writeStagingFile(t, laptopDir, "files/2", "v1")
+	if err := laptop.PushToStorage(laptopDir, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+
+	desktop, desktopDir := newGoGitMachine(t, remote)
+	if err := desktop.PullFromStorage(desktopDir); err != nil {
+		t.Fatalf("PullFromStorage failed: %v", err)
+	}
+	writeStagingFile(t, desktopDir, "files/1", "desktop")
+	if err := desktop.PushToStorage(desktopDir, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+
+	repo, _ := git.PlainOpen(laptopDir)
+	before, _ := repo.Head()
+	writeStagingFile(t, laptopDir, "files/1", "laptop")
+	writeStagingFile(t, laptopDir, "files/2", "laptop")
+	err := laptop.PushToStorage(laptopDir, PushOptions{})
+	var conflictErr *ConflictError
+	if !errors.As(err, &conflictErr) || !errors.Is(err, ErrGitNonFastForward) {
+		t.Fatalf("expected a non-fast-forward conflict, got %v", err)
+	}
+	// The refused sync leaves no commit behind
+	if after, _ := repo.Head(); after.Hash() != before.Hash() {
+		t.Errorf("expected HEAD to stay at %s, got %s", before.Hash(), after.Hash())
+	}
+	if !reflect.DeepEqual(conflictErr.Paths, []string{"files/1"}) {
+		t.Errorf("expected files/1 to conflict, got %v", conflictErr.Paths)
+	}
+
+	if err := laptop.PushToStorage(laptopDir, PushOptions{Force: true}); err != nil {
+		t.Fatalf("forced PushToStorage failed: %v", err)
+	}
+	if got := remoteFile(t, remote, "main", "files/1"); got != "laptop" {
+		t.Errorf("expected the forced push to overwrite the remote, got %q", got)
+	}
+}
+
+func TestGoGitStorage_Errors(t *testing.T) {
+	remote := newBareRemote(t)
+	s, dir := newGoGitMachine(t, remote)
+	if err := s.Check(dir); err != nil {
+		t.Errorf("expected Check to pass on an empty remote, got %v", err)
+	}
+
+	missing := &GoGitStorage{GitStorage: GitStorage{RemoteURL: filepath.Join(t.TempDir(), "missing.git")}}
+	if err := missing.Check(dir); !errors.Is(err, ErrGitRemoteNotFound) {
+		t.Errorf("expected ErrGitRemoteNotFound from Check, got %v", err)
+	}
+	if err := missing.InitializeStorage(); err != nil {
+		t.Fatalf("InitializeStorage failed: %v", err)
+	}
+	if err := missing.Fetch(dir); !errors.Is(err, ErrGitRemoteNotFound) {
+		t.Errorf("expected ErrGitRemoteNotFound from Fetch, got %v", err)
+	}
+
+	for _, tt := range []struct {
+		err  error
+		want error
+	}{
+		{transport.ErrAuthenticationRequired, ErrGitAuth},
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate"), ErrGitAuth},
+		{errors.New("non-fast-forward update: refs/heads/main"), ErrGitNonFastForward},
+		{git.ErrRemoteNotFound, ErrGitRemoteNotFound},
+	} {
+		if got := gitError(tt.err); !errors.Is(got, tt.want) || !strings.Contains(got.Error(), tt.err.Error()) {
+			t.Errorf("gitError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+	if err := errors.New("other"); gitError(err) != err {
+		t.Error("expected other errors to be returned as they are")
+	}
+}
+
+func TestGoGitStorage_Auth(t *testing.T) {
+	t.Setenv("DOT_SYNC_GIT_TOKEN", "secret")
+	s := &GoGitStorage{GitStorage: GitStorage{RemoteURL: "https://github.com/alice/dotfiles.git"}}
+	if auth, err := s.auth(); err != nil || auth == nil || !strings.Contains(auth.String(), "dot-sync") {
+		t.Errorf("expected the token to be used for https, got %v %v", auth, err)
+	}
+	s.RemoteURL = "git@github.com:alice/dotfiles.git"
+	if auth, err := s.auth(); err != nil || auth != nil {
+		t.Errorf("expected ssh remotes to use the default auth, got %v %v", auth, err)
+	}
+}
+
+func TestGitEngineOption(t *testing.T) {
+	sp, err := NewProvider("git", RemoteConfig{Name: "origin", Remote: "/srv/dotfiles.git", Options: map[string]string{"engine": "go", "branch": "laptop"}})
+	if err != nil {
+		t.Fatalf("NewProvider failed: %v", err)
+	}
+	if s, ok := sp.(*GoGitStorage); !ok || s.Branch != "laptop" {
+		t.Errorf("expected built-in git storage with the options, got %#v", sp)
+	}
+	if sp, _ := NewProvider("git", RemoteConfig{Name: "origin", Remote: "/srv/dotfiles.git"}); reflect.TypeOf(sp) != reflect.TypeOf(&GitStorage{}) {
+		t.Errorf("expected the git binary by default, got %T", sp)
+	}
+	if _, err := NewProvider("git", RemoteConfig{Remote: "/srv/dotfiles.git", Options: map[string]string{"engine": "jgit"}}); err == nil {
+		t.Error("expected an unknown engine to be rejected")
+	}
+}
+
+func TestGoGitStorage_LeavesTransportsAlone(t *testing.T) {
+	// Programs embedding this package keep go-git's own file transport
+	if client.Protocols["file"] != file.DefaultClient {
+		t.Errorf("expected go-git's file transport, got %#v", client.Protocols["file"])
+	}
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// LocalStorage keeps the remote copy in a plain directory, such as a USB
+// drive, a network mount or a folder synced by another tool.
+type LocalStorage struct {
+	Path string
+}
+
+func init() {
+	RegisterProvider(Provider{
+		Name:            "local",
+		RemoteHint:      "the directory to store dotfiles in",
+		NormalizeRemote: filepath.Abs,
+		New: func(cfg RemoteConfig) (StorageProvider, error) {
+			return &LocalStorage{Path: cfg.Remote}, nil
+		},
+	})
+}
+
+func (s *LocalStorage) InitializeStorage() error {
+	home := shared.FindHomeDir()
+	dir := filepath.Join(home, shared.GetDotSyncDir())
+	filesDir := filepath.Join(home, shared.GetDotSyncFilesDir())
+
+	if err := shared.EnsureDir(dir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	if err := shared.EnsureDir(filesDir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filesDir, err)
+	}
+	return s.checkTarget(dir)
+}
+
+// checkTarget verifies that the storage directory can be written, creating
+// it when its parent exists. An unmounted drive is reported rather than
+// recreated on the local disk.
+func (s *LocalStorage) checkTarget(dotSyncDir string) error {
+	if !filepath.IsAbs(s.Path) {
+		return fmt.Errorf("storage directory %q must be an absolute path", s.Path)
+	}
+	target := filepath.Clean(s.Path)
+	if rel, err := filepath.Rel(dotSyncDir, target); err == nil && (rel == "." || filepath.IsLocal(rel)) {
+		return fmt.Errorf("storage directory %s must be outside %s", target, dotSyncDir)
+	}
+	info, err := os.Stat(target)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Dir(target)); err != nil {
+			return fmt.Errorf("storage directory %s is not available (is the drive mounted?)", target)
+		}
+		if err := os.Mkdir(target, 0700); err != nil {
+			return fmt.Errorf("failed to create storage directory %s: %w", target, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("storage directory %s is not available: %w", target, err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("storage directory %s is not a directory", target)
+	}
+
+	probe, err := os.CreateTemp(target, ".dot-sync-write-test-")
+	if err != nil {
+		return fmt.Errorf("storage directory %s is not writable: %w", target, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func (s *LocalStorage) mirror() *mirror {
+	return &mirror{store: dirStore{root: s.Path}, name: mirrorName("local", s.Path)}
+}
+
+func (s *LocalStorage) PushToStorage(filePath string, opts PushOptions) error {
+	if err := s.checkAvailable(); err != nil {
+		return err
+	}
+	return s.mirror().PushToStorage(filePath, opts)
+}
+
+func (s *LocalStorage) PullFromStorage(filePath string) error {
+	if err := s.checkAvailable(); err != nil {
+		return err
+	}
+	return s.mirror().PullFromStorage(filePath)
+}
+
+func (s *LocalStorage) Fetch(filePath string) error {
+	if err := s.checkAvailable(); err != nil {
+		return err
+	}
+	return s.mirror().Fetch(filePath)
+}
+
+func (s *LocalStorage) ExportRevision(filePath string, rev Revision, dest string) error {
+	return s.mirror().ExportRevision(filePath, rev, dest)
+}
+
+func (s *LocalStorage) Check(filePath string) error {
+	if err := s.checkAvailable(); err != nil {
+		return err
+	}
+	return s.mirror().Check()
+}
+
+func (s *LocalStorage) localStateKey() string {
+	return s.mirror().name
+}
+
+func (s *LocalStorage) removeLocalState(filePath string) error {
+	return s.mirror().removeCache(filePath)
+}
+
+// checkAvailable keeps an unmounted drive from looking like an empty remote.
+func (s *LocalStorage) checkAvailable() error {
+	if info, err := os.Stat(s.Path); err != nil || !info.IsDir() {
+		return fmt.Errorf("storage directory %s is not available (is the drive mounted?)", s.Path)
+	}
+	return nil
+}
+
+// dirStore stores objects as files below root.
+type dirStore struct {
+	root string
+}
+
+func (d dirStore) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(key))
+}
+
+func (d dirStore) ReadObject(key string) ([]byte, error) {
+	return os.ReadFile(d.path(key))
+}
+
+// WriteObject replaces the object through a rename, so a reader on another
+// machine never sees a partly written file.
+func (d dirStore) WriteObject(key string, data []byte) error {
+	dst := d.path(key)
+	if err := shared.EnsureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".dot-sync-tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (d dirStore) DeleteObject(key string) error {
+	dst := d.path(key)
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// Drop directories left empty, such as those of deleted records
+	for dir := filepath.Dir(dst); dir != filepath.Clean(d.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// countingStore records the objects written to a dirStore.
+type countingStore struct {
+	dirStore
+	written []string
+}
+
+func (c *countingStore) WriteObject(key string, data []byte) error {
+	c.written = append(c.written, key)
+	return c.dirStore.WriteObject(key, data)
+}
+
+// newTestMachine returns a .dot-sync directory with a tracked file and a
+// tracked directory holding a symlink.
+func newTestMachine(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), ".dot-sync")
+	os.MkdirAll(filepath.Join(dir, "files", "2"), 0700)
+	os.MkdirAll(filepath.Join(dir, "backups"), 0700)
+	os.WriteFile(filepath.Join(dir, "files", "1"), []byte("file one"), 0600)
+	os.WriteFile(filepath.Join(dir, "files", "2", "init.lua"), []byte("init"), 0644)
+	os.Symlink("init.lua", filepath.Join(dir, "files", "2", "alias.lua"))
+	os.WriteFile(filepath.Join(dir, "state.db"), []byte("db"), 0644)
+	os.WriteFile(filepath.Join(dir, "local.db"), []byte("local"), 0644)
+	os.WriteFile(filepath.Join(dir, "backups", "old"), []byte("backup"), 0644)
+	return dir
+}
+
+func TestLocalStorage_InitializeStorage(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	target := filepath.Join(t.TempDir(), "usb", "dotfiles")
+	os.MkdirAll(filepath.Dir(target), 0755)
+	if err := (&LocalStorage{Path: target}).InitializeStorage(); err != nil {
+		t.Fatalf("InitializeStorage failed: %v", err)
+	}
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		t.Errorf("expected the storage directory to be created, got %v", err)
+	}
+	unmounted := filepath.Join(t.TempDir(), "missing", "drive", "dotfiles")
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, []byte("x"), 0644)
+	for _, path := range []string{"relative/dir", unmounted, file, filepath.Join(home, ".dot-sync", "files")} {
+		if err := (&LocalStorage{Path: path}).InitializeStorage(); err == nil {
+			t.Errorf("expected an error for storage directory %s", path)
+		}
+	}
+	if _, err := os.Stat(unmounted); !os.IsNotExist(err) {
+		t.Error("expected a missing drive not to be created")
+	}
+}
+
+func TestLocalStorage_PushAndPull(t *testing.T) {
+	target := t.TempDir()
+	storage := &LocalStorage{Path: target}
+	machineA := newTestMachine(t)
+	if err := storage.PushToStorage(machineA, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+	for _, path := range []string{"local.db", "backups", "cache", filepath.Join("files", "2", "alias.lua")} {
+		if _, err := os.Lstat(filepath.Join(target, path)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be stored as a file", path)
+		}
+	}
+
+	// A second machine with nothing staged pulls everything
+	machineB := filepath.Join(t.TempDir(), ".dot-sync")
+	os.MkdirAll(filepath.Join(machineB, "files", "9"), 0700)
+	os.WriteFile(filepath.Join(machineB, "files", "9", "stale"), []byte("stale"), 0644)
+	if err := storage.PullFromStorage(machineB); err != nil {
+		t.Fatalf("PullFromStorage failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(machineB, "files", "2", "init.lua")); string(data) != "init" {
+		t.Errorf("expected init.lua to be pulled, got %q", data)
+	}
+	if target, err := os.Readlink(filepath.Join(machineB, "files", "2", "alias.lua")); err != nil || target != "init.lua" {
+		t.Errorf("expected the link to be pulled, got %q (%v)", target, err)
+	}
+	if info, err := os.Stat(filepath.Join(machineB, "files", "1")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected files/1 to keep mode 0600, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(machineB, "files", "9")); !os.IsNotExist(err) {
+		t.Error("expected entries missing from the remote to be removed")
+	}
+
+	// Only changed objects are uploaded
+	os.WriteFile(filepath.Join(machineB, "files", "1"), []byte("edited on B"), 0600)
+	counting := &countingStore{dirStore: dirStore{root: target}}
+	mirrorB := &mirror{store: counting, name: mirrorName("local", target)}
+	if err := mirrorB.PushToStorage(machineB, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage from B failed: %v", err)
+	}
+	if !reflect.DeepEqual(counting.written, []string{"files/1", manifestKey}) {
+		t.Errorf("expected only files/1 and the manifest to be uploaded, got %v", counting.written)
+	}
+
+	// Machine A changed the same file without pulling
+	os.WriteFile(filepath.Join(machineA, "files", "1"), []byte("edited on A"), 0600)
+	err := storage.PushToStorage(machineA, PushOptions{})
+	var conflictErr *ConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("expected ConflictError, got %v", err)
+	}
+	if !reflect.DeepEqual(conflictErr.Paths, []string{"files/1"}) {
+		t.Errorf("expected files/1 to conflict, got %v", conflictErr.Paths)
+	}
+
+	// Base and remote revisions tell the two versions apart
+	if err := storage.Fetch(machineA); err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	for rev, expected := range map[Revision]string{RevisionBase: "file one", RevisionRemote: "edited on B"} {
+		dest := filepath.Join(t.TempDir(), string(rev))
+		if err := storage.ExportRevision(machineA, rev, dest); err != nil {
+			t.Fatalf("ExportRevision(%s) failed: %v", rev, err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dest, "1")); string(data) != expected {
+			t.Errorf("%s: expected %q, got %q", rev, expected, data)
+		}
+	}
+
+	if err := storage.PushToStorage(machineA, PushOptions{Force: true}); err != nil {
+		t.Fatalf("forced PushToStorage failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(target, "files", "1")); string(data) != "edited on A" {
+		t.Errorf("expected forced push to overwrite the remote, got %q", data)
+	}
+}
+
+func TestLocalStorage_PushDeletesRemovedRecords(t *testing.T) {
+	target := t.TempDir()
+	storage := &LocalStorage{Path: target}
+	machine := newTestMachine(t)
+	storage.PushToStorage(machine, PushOptions{})
+
+	os.RemoveAll(filepath.Join(machine, "files", "2"))
+	if err := storage.PushToStorage(machine, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "files", "2")); !os.IsNotExist(err) {
+		t.Error("expected the removed record to be deleted from storage")
+	}
+}
+
+func TestLocalStorage_Unavailable(t *testing.T) {
+	storage := &LocalStorage{Path: filepath.Join(t.TempDir(), "unmounted")}
+	machine := newTestMachine(t)
+	if err := storage.PushToStorage(machine, PushOptions{}); err == nil {
+		t.Error("expected push to a missing directory to fail")
+	}
+	if err := storage.PullFromStorage(machine); err == nil {
+		t.Error("expected pull from a missing directory to fail")
+	}
+}
+
+func TestParseManifestRejectsEscapingPaths(t *testing.T) {
+	for _, key := range []string{"../evil", "/etc/passwd", "files/../../x", manifestKey} {
+		data := []byte(`{"revision":"x","entries":{"` + key + `":{"hash":"00"}}}`)
+		if _, err := parseManifest(data); err == nil {
+			t.Errorf("expected manifest path %q to be rejected", key)
+		}
+	}
+}
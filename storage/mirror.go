@@ -0,0 +1,585 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// Mirrored storage
+//
+// Providers without version control of their own (plain directories, object
+// stores, file servers) keep a copy of the pushable part of ~/.dot-sync on the
+// remote, next to a manifest listing every entry with its hash. The manifests
+// last exchanged with and last fetched from the remote are kept, with the
+// files they list, in a per-remote cache below ~/.dot-sync/cache, where they
+// play the roles of git's merge base and remote-tracking branch.
+
+const (
+	manifestKey    = "manifest.json"
+	mirrorCacheDir = "cache"
+)
+
+// objectStore is the remote side of a mirror: a flat set of objects named by
+// slash-separated keys such as "files/3/init.lua".
+type objectStore interface {
+	// ReadObject returns the object stored under key, or an error matching
+	// fs.ErrNotExist when there is none.
+	ReadObject(key string) ([]byte, error)
+	WriteObject(key string, data []byte) error
+	// DeleteObject removes an object; deleting a missing object is not an
+	// error.
+	DeleteObject(key string) error
+}
+
+// versionedStore is implemented by object stores that can replace an object
+// only while it is unchanged, so two machines pushing at once cannot
+// overwrite each other's objects unnoticed.
+type versionedStore interface {
+	// ObjectVersions returns an opaque version, such as an ETag, for every
+	// stored object.
+	ObjectVersions() (map[string]string, error)
+	// WriteObjectIf writes an object only if its version is still version,
+	// or if it does not exist when version is empty, and returns
+	// errStaleObject otherwise.
+	WriteObjectIf(key string, data []byte, version string) error
+}
+
+// batchStore is implemented by object stores that collect the writes and
+// deletes of a push and apply them together.
+type batchStore interface {
+	Flush() error
+}
+
+// errStaleObject is returned by versionedStore.WriteObjectIf when the object
+// changed since its version was read.
+var errStaleObject = errors.New("object changed on the remote")
+
+type manifestEntry struct {
+	// Hash is the SHA-256 of a file's content; symlinks have none.
+	Hash string      `json:"hash,omitempty"`
+	Mode fs.FileMode `json:"mode,omitempty"`
+	// Link is the target of a symlink, which is only stored in the manifest.
+	Link string `json:"link,omitempty"`
+}
+
+type manifest struct {
+	// Revision identifies the content listed in Entries; it is empty for a
+	// remote nothing was pushed to.
+	Revision string                   `json:"revision"`
+	Entries  map[string]manifestEntry `json:"entries"`
+}
+
+// mirror implements StorageProvider on top of an objectStore.
+type mirror struct {
+	store objectStore
+	// name identifies the remote in the cache directory.
+	name string
+}
+
+// mirrorName derives a cache name for a remote from its provider type and
+// address.
+func mirrorName(storageType, remote string) string {
+	sum := sha256.Sum256([]byte(remote))
+	return storageType + "-" + hex.EncodeToString(sum[:6])
+}
+
+// pushableRules matches the entries of the .dot-sync directory that are not
+// mirrored: machine-local data and git's own files.
+func pushableRules() *shared.IgnoreRules {
+	return shared.NewIgnoreRules(append([]string{"/.git/", "/.gitignore"}, localOnlyPaths...))
+}
+
+func (m *mirror) snapshotDir(filePath string, rev Revision) string {
+	return filepath.Join(filePath, mirrorCacheDir, m.name, string(rev))
+}
+
+// removeCache deletes the snapshots kept for the remote.
+func (m *mirror) removeCache(filePath string) error {
+	return os.RemoveAll(filepath.Join(filePath, mirrorCacheDir, m.name))
+}
+
+func (m *mirror) Fetch(filePath string) error {
+	remote, err := m.readRemoteManifest()
+	if err != nil {
+		return fmt.Errorf("failed to fetch from remote: %w", err)
+	}
+	dir := m.snapshotDir(filePath, RevisionRemote)
+	cached, err := readSnapshotManifest(dir)
+	if err != nil {
+		return err
+	}
+	if cached.Revision == remote.Revision && cached.Revision != "" {
+		return nil
+	}
+
+	// Content already on this machine does not need to be downloaded again
+	known := map[string]string{}
+	for _, root := range []string{m.snapshotDir(filePath, RevisionBase), dir, filePath} {
+		local, err := scanTree(root)
+		if err != nil {
+			return err
+		}
+		for key, entry := range local.Entries {
+			if entry.Hash != "" {
+				known[entry.Hash] = filepath.Join(root, filepath.FromSlash(key))
+			}
+		}
+	}
+
+	if err := shared.EnsureDir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(filepath.Dir(dir), "fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	for _, key := range sortedEntryKeys(remote) {
+		entry := remote.Entries[key]
+		dst := filepath.Join(staging, filepath.FromSlash(key))
+		if entry.Link != "" {
+			if err := shared.WriteLink(entry.Link, dst); err != nil {
+				return err
+			}
+			continue
+		}
+		var data []byte
+		if src, ok := known[entry.Hash]; ok {
+			data, err = os.ReadFile(src)
+		} else {
+			data, err = m.store.ReadObject(key)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", key, err)
+		}
+		if hashBytes(data) != entry.Hash {
+			return fmt.Errorf("failed to fetch %s: content does not match the manifest; the remote may have changed during the fetch, try again", key)
+		}
+		if err := writeEntry(dst, data, entry.Mode); err != nil {
+			return err
+		}
+	}
+	if err := writeSnapshotManifest(staging, remote); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(staging, dir)
+}
+
+func (m *mirror) PushToStorage(filePath string, opts PushOptions) error {
+	fmt.Println("Pushing contents to storage...")
+
+	local, err := scanTree(filePath)
+	if err != nil {
+		return err
+	}
+	// Versions are listed before the manifest is read, so a push that
+	// completes in between makes the manifest upload below fail
+	versioned, guarded := m.store.(versionedStore)
+	guarded = guarded && !opts.Force
+	var versions map[string]string
+	if guarded {
+		if versions, err = versioned.ObjectVersions(); err != nil {
+			return fmt.Errorf("failed to list remote objects: %w", err)
+		}
+	}
+	upload := func(key string, data []byte) error {
+		if guarded {
+			return versioned.WriteObjectIf(key, data, versions[key])
+		}
+		return m.store.WriteObject(key, data)
+	}
+	remote, err := m.readRemoteManifest()
+	if err != nil {
+		return fmt.Errorf("failed to read remote manifest: %w", err)
+	}
+	if !opts.Force {
+		base, err := readSnapshotManifest(m.snapshotDir(filePath, RevisionBase))
+		if err != nil {
+			return err
+		}
+		if remote.Revision != base.Revision {
+			return &ConflictError{Paths: intersectPaths(changedFiles(base, local), changedFiles(base, remote))}
+		}
+	}
+
+	for _, key := range sortedEntryKeys(local) {
+		entry := local.Entries[key]
+		if entry.Hash == "" || remote.Entries[key].Hash == entry.Hash {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(filePath, filepath.FromSlash(key)))
+		if err != nil {
+			return err
+		}
+		if err := upload(key, data); errors.Is(err, errStaleObject) {
+			return m.racedPushConflict(filePath, local)
+		} else if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+	}
+	// The manifest goes last, so readers never see entries that are not
+	// uploaded yet
+	data, err := json.MarshalIndent(local, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := upload(manifestKey, data); errors.Is(err, errStaleObject) {
+		return m.racedPushConflict(filePath, local)
+	} else if err != nil {
+		return fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	for _, key := range sortedEntryKeys(remote) {
+		if remote.Entries[key].Hash != "" && local.Entries[key].Hash == "" {
+			if err := m.store.DeleteObject(key); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", key, err)
+			}
+		}
+	}
+	if err := m.flush(); err != nil {
+		return fmt.Errorf("failed to upload: %w", err)
+	}
+
+	// What was pushed is now both the shared and the remote state
+	for _, rev := range []Revision{RevisionBase, RevisionRemote} {
+		if err := writeSnapshot(filePath, m.snapshotDir(filePath, rev), local); err != nil {
+			return fmt.Errorf("failed to record pushed state: %w", err)
+		}
+	}
+	return nil
+}
+
+// racedPushConflict describes a push that lost the race against a push from
+// another machine.
+func (m *mirror) racedPushConflict(filePath string, local manifest) error {
+	remote, err := m.readRemoteManifest()
+	if err != nil {
+		return &ConflictError{}
+	}
+	base, err := readSnapshotManifest(m.snapshotDir(filePath, RevisionBase))
+	if err != nil {
+		return &ConflictError{}
+	}
+	return &ConflictError{Paths: intersectPaths(changedFiles(base, local), changedFiles(base, remote))}
+}
+
+func (m *mirror) PullFromStorage(filePath string) error {
+	fmt.Println("Pulling contents from storage...")
+
+	if err := m.Fetch(filePath); err != nil {
+		return err
+	}
+	remoteDir := m.snapshotDir(filePath, RevisionRemote)
+	remote, err := readSnapshotManifest(remoteDir)
+	if err != nil {
+		return err
+	}
+	local, err := scanTree(filePath)
+	if err != nil {
+		return err
+	}
+
+	// Reset the staging directory to the remote state
+	for key, entry := range local.Entries {
+		if _, ok := remote.Entries[key]; !ok || remote.Entries[key] != entry {
+			if err := os.Remove(filepath.Join(filePath, filepath.FromSlash(key))); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to reset %s: %w", key, err)
+			}
+		}
+	}
+	// A file may replace a directory that is now empty
+	if err := removeEmptyDirs(filepath.Join(filePath, "files")); err != nil {
+		return err
+	}
+	for key, entry := range remote.Entries {
+		if local.Entries[key] == entry {
+			continue
+		}
+		if err := shared.CopyPath(filepath.Join(remoteDir, filepath.FromSlash(key)), filepath.Join(filePath, filepath.FromSlash(key))); err != nil {
+			return fmt.Errorf("failed to reset %s: %w", key, err)
+		}
+	}
+	return writeSnapshot(remoteDir, m.snapshotDir(filePath, RevisionBase), remote)
+}
+
+func (m *mirror) ExportRevision(filePath string, rev Revision, dest string) error {
+	if rev != RevisionBase && rev != RevisionRemote {
+		return fmt.Errorf("unknown revision: %s", rev)
+	}
+	if err := shared.EnsureDir(dest); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dest, err)
+	}
+	files := filepath.Join(m.snapshotDir(filePath, rev), "files")
+	if !shared.PathExists(files) {
+		return nil
+	}
+	return shared.CopyDir(files, dest)
+}
+
+// Check reads the remote manifest, then writes, reads back and deletes a
+// probe object.
+func (m *mirror) Check() error {
+	if _, err := m.readRemoteManifest(); err != nil {
+		return fmt.Errorf("failed to read from remote: %w", err)
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	key := ".dot-sync-write-test-" + hex.EncodeToString(suffix)
+	data := []byte("written by dot-sync storage test\n")
+	if err := m.store.WriteObject(key, data); err != nil {
+		return fmt.Errorf("failed to write to remote: %w", err)
+	}
+	if err := m.flush(); err != nil {
+		return fmt.Errorf("failed to write to remote: %w", err)
+	}
+	stored, readErr := m.store.ReadObject(key)
+	if err := m.store.DeleteObject(key); err != nil {
+		return fmt.Errorf("failed to delete %s from remote: %w", key, err)
+	}
+	if err := m.flush(); err != nil {
+		return fmt.Errorf("failed to delete %s from remote: %w", key, err)
+	}
+	if readErr != nil {
+		return fmt.Errorf("failed to read back from remote: %w", readErr)
+	}
+	if !bytes.Equal(stored, data) {
+		return fmt.Errorf("remote returned different content than was written")
+	}
+	return nil
+}
+
+// flush applies the pending changes of a batchStore.
+func (m *mirror) flush() error {
+	if batch, ok := m.store.(batchStore); ok {
+		return batch.Flush()
+	}
+	return nil
+}
+
+func (m *mirror) readRemoteManifest() (manifest, error) {
+	data, err := m.store.ReadObject(manifestKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return manifest{Entries: map[string]manifestEntry{}}, nil
+	}
+	if err != nil {
+		return manifest{}, err
+	}
+	return parseManifest(data)
+}
+
+func parseManifest(data []byte) (manifest, error) {
+	var man manifest
+	if err := json.Unmarshal(data, &man); err != nil {
+		return manifest{}, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if man.Entries == nil {
+		man.Entries = map[string]manifestEntry{}
+	}
+	for key := range man.Entries {
+		if !validKey(key) {
+			return manifest{}, fmt.Errorf("invalid manifest: bad path %q", key)
+		}
+	}
+	return man, nil
+}
+
+// validKey reports whether key names a path inside the mirrored tree.
+func validKey(key string) bool {
+	return key != "" && key != manifestKey && !path.IsAbs(key) && path.Clean(key) == key &&
+		key != ".." && !strings.HasPrefix(key, "../")
+}
+
+// scanTree lists the pushable entries below root. A missing root has none.
+func scanTree(root string) (manifest, error) {
+	man := manifest{Entries: map[string]manifestEntry{}}
+	if !shared.PathExists(root) {
+		return man, nil
+	}
+	err := shared.WalkTree(root, shared.TreeOptions{Ignore: pushableRules()}, func(rel, p string, info fs.FileInfo) error {
+		key := filepath.ToSlash(rel)
+		switch {
+		case info.IsDir():
+			return nil
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			man.Entries[key] = manifestEntry{Link: target}
+		case info.Mode().IsRegular():
+			if key == manifestKey {
+				return nil
+			}
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			man.Entries[key] = manifestEntry{Hash: hashBytes(data), Mode: info.Mode().Perm()}
+		}
+		return nil
+	})
+	if err != nil {
+		return manifest{}, err
+	}
+	man.Revision = manifestRevision(man.Entries)
+	return man, nil
+}
+
+// manifestRevision hashes the entries, so identical trees get identical
+// revisions and an empty tree gets none.
+func manifestRevision(entries map[string]manifestEntry) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		entry := entries[key]
+		fmt.Fprintf(h, "%s\x00%s\x00%o\x00%s\n", key, entry.Hash, entry.Mode, entry.Link)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// changedFiles lists the paths below files/ that differ between two
+// manifests.
+func changedFiles(from, to manifest) []string {
+	var changed []string
+	for _, key := range sortedKeysOf(from.Entries, to.Entries) {
+		if !strings.HasPrefix(key, "files/") {
+			continue
+		}
+		fromEntry, inFrom := from.Entries[key]
+		toEntry, inTo := to.Entries[key]
+		if inFrom != inTo || fromEntry != toEntry {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+func sortedKeysOf(sets ...map[string]manifestEntry) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, set := range sets {
+		for key := range set {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedEntryKeys(man manifest) []string {
+	return sortedKeysOf(man.Entries)
+}
+
+func readSnapshotManifest(dir string) (manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestKey))
+	if os.IsNotExist(err) {
+		return manifest{Entries: map[string]manifestEntry{}}, nil
+	}
+	if err != nil {
+		return manifest{}, err
+	}
+	return parseManifest(data)
+}
+
+func writeSnapshotManifest(dir string, man manifest) error {
+	data, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, manifestKey), data, 0644)
+}
+
+// writeSnapshot replaces dir with the entries of man copied from srcRoot.
+func writeSnapshot(srcRoot, dir string, man manifest) error {
+	if err := shared.EnsureDir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(filepath.Dir(dir), "snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	for key := range man.Entries {
+		if err := shared.CopyPath(filepath.Join(srcRoot, filepath.FromSlash(key)), filepath.Join(staging, filepath.FromSlash(key))); err != nil {
+			return err
+		}
+	}
+	if err := writeSnapshotManifest(staging, man); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(staging, dir)
+}
+
+func writeEntry(dst string, data []byte, mode fs.FileMode) error {
+	if err := shared.EnsureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := os.WriteFile(dst, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode)
+}
+
+// removeEmptyDirs deletes the directories below root that hold no files.
+func removeEmptyDirs(root string) error {
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		if err := removeEmptyDirs(dir); err != nil {
+			return err
+		}
+		if rest, err := os.ReadDir(dir); err == nil && len(rest) == 0 {
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
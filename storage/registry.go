@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+)
+
+// Provider registry
+//
+// Every storage backend registers itself under the name given to --provider,
+// along with the options it accepts and a constructor. The storage commands
+// and the loading of configured remotes only go through the registry, so a
+// program importing github.com/tylerkeyes/dot-sync/storage adds a backend by
+// calling RegisterProvider from an init function.
+
+// Provider describes a storage backend.
+type Provider struct {
+	// Name selects the provider with --provider and is recorded with each
+	// remote.
+	Name string
+	// RemoteHint describes the --remote-url the provider expects, such as
+	// "s3://bucket/prefix".
+	RemoteHint string
+	// Options are the settings the provider accepts beyond the remote URL.
+	Options []ProviderOption
+	// NormalizeRemote, if set, rewrites --remote-url before it is recorded,
+	// for example to make a path absolute.
+	NormalizeRemote func(remote string) (string, error)
+	// New returns the provider of a configured remote.
+	New func(cfg RemoteConfig) (StorageProvider, error)
+}
+
+// ProviderOption is a setting of a provider. It is given to 'storage init'
+// and 'storage add' as --<Name> and recorded with the remote. Providers may
+// share an option name when it means the same to them.
+type ProviderOption struct {
+	Name  string
+	Usage string
+}
+
+// RemoteConfig is what is recorded for a remote.
+type RemoteConfig struct {
+	// Name is the name of the remote, such as origin.
+	Name   string
+	Remote string
+	// Options holds the values of the provider's options that were given.
+	Options map[string]string
+}
+
+var providers []Provider
+
+// reservedFlags are flags of the storage commands that options cannot use.
+var reservedFlags = map[string]bool{"provider": true, "remote-url": true, "default": true, "help": true}
+
+// RegisterProvider makes a storage backend available. It panics when the
+// provider has no name or constructor, its name is taken or an option uses
+// the name of a storage command flag.
+func RegisterProvider(p Provider) {
+	if p.Name == "" || p.New == nil {
+		panic("storage: RegisterProvider needs a name and a constructor")
+	}
+	if _, ok := lookupProvider(p.Name); ok {
+		panic("storage: provider " + p.Name + " is already registered")
+	}
+	for _, opt := range p.Options {
+		if opt.Name == "" || reservedFlags[opt.Name] {
+			panic(fmt.Sprintf("storage: provider %s has an invalid option name %q", p.Name, opt.Name))
+		}
+	}
+	providers = append(providers, p)
+}
+
+// ProviderNames returns the names of the registered providers in the order
+// they were registered.
+func ProviderNames() []string {
+	names := make([]string, len(providers))
+	for i, p := range providers {
+		names[i] = p.Name
+	}
+	return names
+}
+
+func lookupProvider(name string) (Provider, bool) {
+	for _, p := range providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Provider{}, false
+}
+
+func (p Provider) hasOption(name string) bool {
+	for _, opt := range p.Options {
+		if opt.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProvider returns the provider of a remote configured with the given
+// storage type.
+func NewProvider(storageType string, cfg RemoteConfig) (StorageProvider, error) {
+	p, ok := lookupProvider(storageType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage provider: %s", storageType)
+	}
+	return p.New(cfg)
+}
+
+func remoteConfig(r db.StorageRemote) RemoteConfig {
+	return RemoteConfig{Name: r.Name, Remote: r.Remote, Options: r.Options}
+}
+
+// configureRemote checks what a storage command was given for a remote and
+// returns its provider along with the config to record.
+func configureRemote(storageType string, cfg RemoteConfig) (StorageProvider, RemoteConfig, error) {
+	p, ok := lookupProvider(storageType)
+	if !ok {
+		return nil, cfg, fmt.Errorf("unsupported storage provider: %s", storageType)
+	}
+	if cfg.Remote == "" {
+		return nil, cfg, fmt.Errorf("--remote-url is required for %s provider (%s)", storageType, p.RemoteHint)
+	}
+	for name := range cfg.Options {
+		if !p.hasOption(name) {
+			return nil, cfg, fmt.Errorf("--%s is not supported by the %s provider", name, storageType)
+		}
+	}
+	if p.NormalizeRemote != nil {
+		remote, err := p.NormalizeRemote(cfg.Remote)
+		if err != nil {
+			return nil, cfg, err
+		}
+		cfg.Remote = remote
+	}
+	sp, err := p.New(cfg)
+	return sp, cfg, err
+}
+
+// addProviderFlags adds --provider, --remote-url and the options of every
+// registered provider.
+func addProviderFlags(cmd *cobra.Command, provider, remoteURL *string) {
+	var hints []string
+	for _, p := range providers {
+		hints = append(hints, fmt.Sprintf("%s for %s", p.RemoteHint, p.Name))
+	}
+	cmd.Flags().StringVar(provider, "provider", "git", "Storage provider to use ("+strings.Join(ProviderNames(), ", ")+")")
+	cmd.Flags().StringVar(remoteURL, "remote-url", "", "Where to store the dotfiles: "+strings.Join(hints, ", "))
+	for _, p := range providers {
+		for _, opt := range p.Options {
+			if cmd.Flags().Lookup(opt.Name) == nil {
+				cmd.Flags().String(opt.Name, "", fmt.Sprintf("%s (%s)", opt.Usage, p.Name))
+			}
+		}
+	}
+}
+
+// optionsFromFlags returns the provider options given on the command line.
+func optionsFromFlags(cmd *cobra.Command) map[string]string {
+	options := map[string]string{}
+	for _, p := range providers {
+		for _, opt := range p.Options {
+			if cmd.Flags().Changed(opt.Name) {
+				options[opt.Name], _ = cmd.Flags().GetString(opt.Name)
+			}
+		}
+	}
+	return options
+}
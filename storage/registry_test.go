@@ -0,0 +1,115 @@
+package storage_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/storage"
+)
+
+// fakeProvider is a provider added from outside the package, the way a
+// program embedding dot-sync would add its own.
+type fakeProvider struct {
+	storage.LocalStorage
+	cfg storage.RemoteConfig
+}
+
+func (p *fakeProvider) InitializeStorage() error {
+	return nil
+}
+
+func registerFakeProvider(t *testing.T) {
+	t.Helper()
+	storage.RegisterProvider(storage.Provider{
+		Name:       "fake",
+		RemoteHint: "a bucket name",
+		Options:    []storage.ProviderOption{{Name: "shards", Usage: "Number of shards"}, {Name: "region", Usage: "Region of the bucket"}},
+		NormalizeRemote: func(remote string) (string, error) {
+			return strings.ToLower(remote), nil
+		},
+		New: func(cfg storage.RemoteConfig) (storage.StorageProvider, error) {
+			return &fakeProvider{cfg: cfg}, nil
+		},
+	})
+	t.Cleanup(func() { storage.UnregisterProvider("fake") })
+}
+
+// runStorageCmd runs a storage command and returns what it printed.
+func runStorageCmd(args ...string) (string, error) {
+	cmd := storage.NewStorageProviderCmd()
+	cmd.SetArgs(args)
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+	orig := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err := cmd.Execute()
+	w.Close()
+	os.Stdout = orig
+	var buf bytes.Buffer
+	buf.ReadFrom(r)
+	return buf.String(), err
+}
+
+func TestRegisteredProvider(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	os.MkdirAll(filepath.Join(home, ".dot-sync"), 0755)
+	registerFakeProvider(t)
+
+	if _, err := runStorageCmd("init", "--provider", "fake", "--remote-url", "Bucket", "--shards", "4", "--region", "eu"); err != nil {
+		t.Fatalf("storage init failed: %v", err)
+	}
+	database, _ := db.OpenDotSyncDB()
+	r, err := db.GetDefaultStorageRemote(database)
+	database.Close()
+	if err != nil || r.StorageType != "fake" || r.Remote != "bucket" || r.Options["shards"] != "4" || r.Options["region"] != "eu" {
+		t.Fatalf("expected the provider and its options to be recorded, got %+v %v", r, err)
+	}
+
+	if output, _ := runStorageCmd("show"); !strings.Contains(output, "shards:    4") {
+		t.Errorf("expected the options to be shown, got %q", output)
+	}
+
+	remote, err := storage.OpenRemote("origin")
+	if err != nil {
+		t.Fatalf("OpenRemote failed: %v", err)
+	}
+	if p, ok := remote.Provider.(*fakeProvider); !ok || p.cfg.Name != "origin" || p.cfg.Options["shards"] != "4" {
+		t.Errorf("expected the registered constructor to get the config, got %#v", remote.Provider)
+	}
+
+	// Options of other providers are rejected
+	_, err = runStorageCmd("add", "backup", "--provider", "local", "--remote-url", t.TempDir(), "--shards", "2")
+	if err == nil || !strings.Contains(err.Error(), "--shards is not supported by the local provider") {
+		t.Errorf("expected a foreign option to be rejected, got %v", err)
+	}
+}
+
+func TestRegisterProviderRejectsInvalidProviders(t *testing.T) {
+	noop := func(storage.RemoteConfig) (storage.StorageProvider, error) { return nil, nil }
+	for _, p := range []storage.Provider{
+		{Name: "git", New: noop},
+		{Name: "no-constructor"},
+		{Name: "bad-option", New: noop, Options: []storage.ProviderOption{{Name: "remote-url"}}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected registering %q to panic", p.Name)
+				}
+			}()
+			storage.RegisterProvider(p)
+		}()
+	}
+	names := strings.Join(storage.ProviderNames(), ",")
+	for _, name := range []string{"git", "local", "s3", "sftp", "webdav", "gist"} {
+		if !strings.Contains(","+names+",", ","+name+",") {
+			t.Errorf("expected the %s provider to be registered, got %s", name, names)
+		}
+	}
+}
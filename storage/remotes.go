@@ -0,0 +1,470 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// Named remotes
+//
+// Any number of backends can be configured under a name, such as a git
+// repository as "origin" and an S3 bucket as an offsite "backup". Sync and
+// pull use the default remote; sync can also push to others by name.
+
+// Remote is a configured remote along with its provider.
+type Remote struct {
+	db.StorageRemote
+	Provider StorageProvider
+}
+
+var remoteNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// defaultRemoteName returns the name of the default remote, or origin when
+// none is configured yet.
+func defaultRemoteName() string {
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		return db.DefaultRemoteName
+	}
+	defer database.Close()
+	if err := db.EnsureStorageTable(database); err != nil {
+		return db.DefaultRemoteName
+	}
+	r, err := db.GetDefaultStorageRemote(database)
+	if err != nil {
+		return db.DefaultRemoteName
+	}
+	return r.Name
+}
+
+// OpenRemote returns the remote configured under name, ready for use.
+func OpenRemote(name string) (*Remote, error) {
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %w", err)
+	}
+	defer database.Close()
+	if err := db.EnsureStorageTable(database); err != nil {
+		return nil, fmt.Errorf("failed to ensure storage_provider table: %w", err)
+	}
+	r, err := db.GetStorageRemote(database, name)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no remote named %q (see 'dot-sync storage list')", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return openRemote(r)
+}
+
+// OpenAllRemotes returns every configured remote, the default first.
+func OpenAllRemotes() ([]*Remote, error) {
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %w", err)
+	}
+	defer database.Close()
+	if err := db.EnsureStorageTable(database); err != nil {
+		return nil, fmt.Errorf("failed to ensure storage_provider table: %w", err)
+	}
+	stored, err := db.ListStorageRemotes(database)
+	if err != nil {
+		return nil, err
+	}
+	var remotes []*Remote
+	for _, r := range stored {
+		remote, err := openRemote(r)
+		if err != nil {
+			return nil, err
+		}
+		if r.IsDefault {
+			remotes = append([]*Remote{remote}, remotes...)
+		} else {
+			remotes = append(remotes, remote)
+		}
+	}
+	return remotes, nil
+}
+
+func openRemote(r db.StorageRemote) (*Remote, error) {
+	sp, err := NewProvider(r.StorageType, remoteConfig(r))
+	if err != nil {
+		return nil, fmt.Errorf("remote %s: %w", r.Name, err)
+	}
+	if err := sp.InitializeStorage(); err != nil {
+		return nil, fmt.Errorf("remote %s: failed to initialize storage provider: %w", r.Name, err)
+	}
+	return &Remote{StorageRemote: r, Provider: sp}, nil
+}
+
+// localStateRemover is implemented by providers that keep state on this
+// machine for each remote, such as a git remote or a mirror cache.
+type localStateRemover interface {
+	// localStateKey identifies that state; remotes with the same key share
+	// it.
+	localStateKey() string
+	removeLocalState(filePath string) error
+}
+
+// brancher is implemented by providers that sync a branch of the staging
+// directory's repository.
+type brancher interface {
+	branch(repoPath string) string
+}
+
+func newAddCmd() *cobra.Command {
+	var provider string
+	var remoteURL string
+
+	cmd := &cobra.Command{
+		Use:   "add <name>",
+		Short: "Add a named storage remote",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			if !remoteNamePattern.MatchString(name) {
+				return fmt.Errorf("invalid remote name %q: use letters, digits, '.', '_' and '-'", name)
+			}
+			makeDefault, _ := cmd.Flags().GetBool("default")
+			sp, cfg, err := configureRemote(provider, RemoteConfig{Name: name, Remote: remoteURL, Options: optionsFromFlags(cmd)})
+			if err != nil {
+				return err
+			}
+
+			database, err := db.OpenDotSyncDB()
+			if err != nil {
+				return fmt.Errorf("failed to open db: %w", err)
+			}
+			defer database.Close()
+			if err := db.EnsureStorageTable(database); err != nil {
+				return fmt.Errorf("failed to ensure storage_provider table: %w", err)
+			}
+			if _, err := db.GetStorageRemote(database, name); err == nil {
+				return fmt.Errorf("remote %q already exists", name)
+			}
+			if err := sp.InitializeStorage(); err != nil {
+				return fmt.Errorf("failed to initialize storage: %w", err)
+			}
+			if err := db.AddStorageRemote(database, name, provider, cfg.Remote); err != nil {
+				return err
+			}
+			if err := db.SetStorageRemoteOptions(database, name, cfg.Options); err != nil {
+				return err
+			}
+			if makeDefault {
+				if err := db.SetDefaultStorageRemote(database, name); err != nil {
+					return err
+				}
+			}
+			fmt.Printf("Added remote %s (%s).\n", name, provider)
+			return nil
+		},
+	}
+	addProviderFlags(cmd, &provider, &remoteURL)
+	cmd.Flags().Bool("default", false, "Make the new remote the default")
+	return cmd
+}
+
+func newListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List storage remotes; the default is marked with *",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			database, err := db.OpenDotSyncDB()
+			if err != nil {
+				return fmt.Errorf("failed to open db: %w", err)
+			}
+			defer database.Close()
+			if err := db.EnsureStorageTable(database); err != nil {
+				return fmt.Errorf("failed to ensure storage_provider table: %w", err)
+			}
+			remotes, err := db.ListStorageRemotes(database)
+			if err != nil {
+				return err
+			}
+			if len(remotes) == 0 {
+				fmt.Println("No storage remotes configured. Run: dot-sync storage init")
+				return nil
+			}
+			nameWidth, typeWidth := 0, 0
+			for _, r := range remotes {
+				nameWidth = max(nameWidth, len(r.Name))
+				typeWidth = max(typeWidth, len(r.StorageType))
+			}
+			for _, r := range remotes {
+				marker := " "
+				if r.IsDefault {
+					marker = "*"
+				}
+				fmt.Printf("%s %-*s  %-*s  %s\n", marker, nameWidth, r.Name, typeWidth, r.StorageType, r.Remote)
+			}
+			return nil
+		},
+	}
+}
+
+func newRemoveCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove a named storage remote",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+			database, err := db.OpenDotSyncDB()
+			if err != nil {
+				return fmt.Errorf("failed to open db: %w", err)
+			}
+			defer database.Close()
+			if err := db.EnsureStorageTable(database); err != nil {
+				return fmt.Errorf("failed to ensure storage_provider table: %w", err)
+			}
+			r, err := db.GetStorageRemote(database, name)
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("no remote named %q", name)
+			}
+			if err != nil {
+				return err
+			}
+			if err := db.RemoveStorageRemote(database, name); err != nil {
+				return err
+			}
+			fmt.Printf("Removed remote %s.\n", name)
+
+			if err := removeUnusedLocalState(database, r); err != nil {
+				fmt.Printf("Warning: failed to remove local state of %s: %v\n", name, err)
+			}
+			if local, err := db.OpenLocalDB(); err == nil {
+				if db.EnsureRemoteActivityTable(local) == nil {
+					db.DeleteRemoteActivity(local, name)
+				}
+				local.Close()
+			}
+			if r.IsDefault {
+				if def, err := db.GetDefaultStorageRemote(database); err == nil {
+					fmt.Printf("%s is now the default remote.\n", def.Name)
+				} else {
+					fmt.Println("No storage remotes left. Run: dot-sync storage init")
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// removeUnusedLocalState drops what this machine kept for a remote as it was
+// configured before, unless a configured remote still uses it.
+func removeUnusedLocalState(database *sql.DB, old db.StorageRemote) error {
+	sp, err := NewProvider(old.StorageType, remoteConfig(old))
+	if err != nil {
+		return nil
+	}
+	remover, ok := sp.(localStateRemover)
+	if !ok {
+		return nil
+	}
+	remotes, err := db.ListStorageRemotes(database)
+	if err != nil {
+		return err
+	}
+	for _, r := range remotes {
+		other, err := NewProvider(r.StorageType, remoteConfig(r))
+		if err != nil {
+			continue
+		}
+		if o, ok := other.(localStateRemover); ok && o.localStateKey() == remover.localStateKey() {
+			return nil
+		}
+	}
+	return remover.removeLocalState(dotSyncDir())
+}
+
+// lookupRemote returns the remote named by the first of args, or the default
+// remote when there are none.
+func lookupRemote(database *sql.DB, args []string) (db.StorageRemote, error) {
+	if len(args) == 0 {
+		r, err := db.GetDefaultStorageRemote(database)
+		if err == sql.ErrNoRows {
+			return r, fmt.Errorf("no storage remotes configured. Run: dot-sync storage init")
+		}
+		return r, err
+	}
+	r, err := db.GetStorageRemote(database, args[0])
+	if err == sql.ErrNoRows {
+		return r, fmt.Errorf("no remote named %q", args[0])
+	}
+	return r, err
+}
+
+func newShowCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "show [name]",
+		Short: "Show the configuration of a remote, the default one if no name is given",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			database, err := db.OpenDotSyncDB()
+			if err != nil {
+				return fmt.Errorf("failed to open db: %w", err)
+			}
+			defer database.Close()
+			if err := db.EnsureStorageTable(database); err != nil {
+				return fmt.Errorf("failed to ensure storage_provider table: %w", err)
+			}
+			r, err := lookupRemote(database, args)
+			if err != nil {
+				return err
+			}
+
+			var activity db.RemoteActivity
+			if local, err := db.OpenLocalDB(); err == nil {
+				if db.EnsureRemoteActivityTable(local) == nil {
+					activity, _ = db.GetRemoteActivity(local, r.Name)
+				}
+				local.Close()
+			}
+
+			name := r.Name
+			if r.IsDefault {
+				name += " (default)"
+			}
+			fmt.Printf("Name:      %s\n", name)
+			fmt.Printf("Provider:  %s\n", r.StorageType)
+			fmt.Printf("Remote:    %s\n", r.Remote)
+			names := make([]string, 0, len(r.Options))
+			for name := range r.Options {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Printf("%-10s %s\n", name+":", r.Options[name])
+			}
+			if sp, err := NewProvider(r.StorageType, remoteConfig(r)); err == nil {
+				if git, ok := sp.(brancher); ok {
+					fmt.Printf("Branch:    %s\n", git.branch(dotSyncDir()))
+				}
+			}
+			fmt.Printf("Last push: %s\n", formatActivity(activity.LastPush))
+			fmt.Printf("Last pull: %s\n", formatActivity(activity.LastPull))
+			return nil
+		},
+	}
+}
+
+func formatActivity(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+func newSetRemoteCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set-remote [name] <remote-url>",
+		Short: "Change where a remote is stored, the default one if no name is given",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			database, err := db.OpenDotSyncDB()
+			if err != nil {
+				return fmt.Errorf("failed to open db: %w", err)
+			}
+			defer database.Close()
+			if err := db.EnsureStorageTable(database); err != nil {
+				return fmt.Errorf("failed to ensure storage_provider table: %w", err)
+			}
+			old, err := lookupRemote(database, args[:len(args)-1])
+			if err != nil {
+				return err
+			}
+			cfg := remoteConfig(old)
+			cfg.Remote = args[len(args)-1]
+			sp, cfg, err := configureRemote(old.StorageType, cfg)
+			if err != nil {
+				return err
+			}
+			remote := cfg.Remote
+			if remote == old.Remote {
+				fmt.Printf("Remote %s already uses %s.\n", old.Name, remote)
+				return nil
+			}
+			// Initializing also points the git remote at the new URL
+			if err := sp.InitializeStorage(); err != nil {
+				return fmt.Errorf("failed to initialize storage: %w", err)
+			}
+			if err := db.UpdateStorageRemote(database, old.Name, old.StorageType, remote); err != nil {
+				return err
+			}
+			if err := removeUnusedLocalState(database, old); err != nil {
+				fmt.Printf("Warning: failed to remove local state of the old location: %v\n", err)
+			}
+			fmt.Printf("Remote %s now uses %s.\n", old.Name, remote)
+			return nil
+		},
+	}
+}
+
+func newTestCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "test [name]",
+		Short: "Check that a remote can be reached and written to, the default one if no name is given",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			database, err := db.OpenDotSyncDB()
+			if err != nil {
+				return fmt.Errorf("failed to open db: %w", err)
+			}
+			defer database.Close()
+			if err := db.EnsureStorageTable(database); err != nil {
+				return fmt.Errorf("failed to ensure storage_provider table: %w", err)
+			}
+			r, err := lookupRemote(database, args)
+			if err != nil {
+				return err
+			}
+			remote, err := openRemote(r)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Testing %s (%s)...\n", r.Name, r.StorageType)
+			if err := remote.Provider.Check(dotSyncDir()); err != nil {
+				return fmt.Errorf("remote %s failed the check: %w", r.Name, err)
+			}
+			fmt.Printf("Remote %s is reachable and writable.\n", r.Name)
+			return nil
+		},
+	}
+}
+
+func newDefaultCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "default <name>",
+		Short: "Make a named remote the one sync and pull use",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			database, err := db.OpenDotSyncDB()
+			if err != nil {
+				return fmt.Errorf("failed to open db: %w", err)
+			}
+			defer database.Close()
+			if err := db.EnsureStorageTable(database); err != nil {
+				return fmt.Errorf("failed to ensure storage_provider table: %w", err)
+			}
+			if err := db.SetDefaultStorageRemote(database, args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("%s is now the default remote.\n", args[0])
+			return nil
+		},
+	}
+}
+
+func dotSyncDir() string {
+	return filepath.Join(shared.FindHomeDir(), shared.GetDotSyncDir())
+}
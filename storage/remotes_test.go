@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+func runStorageCmd(t *testing.T, args ...string) error {
+	t.Helper()
+	cmd := NewStorageProviderCmd()
+	cmd.SetArgs(args)
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+	return cmd.Execute()
+}
+
+// runStorageCmdOutput runs a storage command and returns what it printed.
+func runStorageCmdOutput(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	orig := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err := runStorageCmd(t, args...)
+	w.Close()
+	os.Stdout = orig
+	var buf bytes.Buffer
+	buf.ReadFrom(r)
+	return buf.String(), err
+}
+
+func TestStorageRemoteCommands(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	primary := filepath.Join(t.TempDir(), "primary")
+	backup := filepath.Join(t.TempDir(), "backup")
+
+	if err := runStorageCmd(t, "init", "--provider", "local", "--remote-url", primary); err != nil {
+		t.Fatalf("storage init failed: %v", err)
+	}
+	if err := runStorageCmd(t, "add", "backup", "--provider", "local", "--remote-url", backup); err != nil {
+		t.Fatalf("storage add failed: %v", err)
+	}
+	if err := runStorageCmd(t, "add", "backup", "--provider", "local", "--remote-url", backup); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("expected a duplicate name to be rejected, got %v", err)
+	}
+	if err := runStorageCmd(t, "add", "../evil", "--provider", "local", "--remote-url", backup); err == nil {
+		t.Error("expected an invalid name to be rejected")
+	}
+
+	remotes, err := OpenAllRemotes()
+	if err != nil || len(remotes) != 2 {
+		t.Fatalf("expected two remotes, got %v %v", remotes, err)
+	}
+	if remotes[0].Name != "origin" || !remotes[0].IsDefault || remotes[1].Name != "backup" || remotes[1].IsDefault {
+		t.Errorf("expected origin to stay the default, got %+v %+v", remotes[0].StorageRemote, remotes[1].StorageRemote)
+	}
+
+	if err := runStorageCmd(t, "default", "backup"); err != nil {
+		t.Fatalf("storage default failed: %v", err)
+	}
+	database, _ := db.OpenDotSyncDB()
+	_, remote, _ := db.GetStorageProvider(database)
+	database.Close()
+	if remote != backup {
+		t.Errorf("expected backup to be the default, got %q", remote)
+	}
+	if err := runStorageCmd(t, "default", "missing"); err == nil {
+		t.Error("expected an unknown remote to be rejected")
+	}
+
+	// storage init now replaces the default remote, whatever its name
+	if err := runStorageCmd(t, "init", "--provider", "local", "--remote-url", primary); err != nil {
+		t.Fatalf("storage init failed: %v", err)
+	}
+	if remote, err := OpenRemote("backup"); err != nil || remote.Remote != primary {
+		t.Errorf("expected init to update the default remote, got %+v %v", remote, err)
+	}
+
+	cache := filepath.Join(home, ".dot-sync", "cache", mirrorName("local", primary))
+	os.MkdirAll(cache, 0755)
+	if err := runStorageCmd(t, "remove", "backup"); err != nil {
+		t.Fatalf("storage remove failed: %v", err)
+	}
+	if _, err := OpenRemote("backup"); err == nil {
+		t.Error("expected the remote to be removed")
+	}
+	if remote, err := OpenRemote("origin"); err != nil || !remote.IsDefault {
+		t.Errorf("expected origin to become the default again, got %+v %v", remote, err)
+	}
+	if !shared.PathExists(cache) {
+		t.Error("expected the cache of a directory still used by origin to be kept")
+	}
+	if err := runStorageCmd(t, "remove", "origin"); err != nil {
+		t.Fatalf("storage remove failed: %v", err)
+	}
+	if shared.PathExists(cache) {
+		t.Error("expected the cache of the removed remote to be deleted")
+	}
+}
+
+func TestStorageInspectCommands(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	primary := filepath.Join(t.TempDir(), "primary")
+	moved := filepath.Join(t.TempDir(), "moved")
+
+	if err := runStorageCmd(t, "init", "--provider", "local", "--remote-url", primary); err != nil {
+		t.Fatalf("storage init failed: %v", err)
+	}
+	local, _ := db.OpenLocalDB()
+	db.EnsureRemoteActivityTable(local)
+	db.RecordRemotePush(local, "origin", time.Date(2024, 5, 1, 9, 30, 0, 0, time.Local))
+	local.Close()
+
+	output, err := runStorageCmdOutput(t, "show")
+	if err != nil {
+		t.Fatalf("storage show failed: %v", err)
+	}
+	for _, want := range []string{"origin (default)", "Provider:  local", "Remote:    " + primary, "Last push: 2024-05-01 09:30:00", "Last pull: never"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in %q", want, output)
+		}
+	}
+	if _, err := runStorageCmdOutput(t, "show", "missing"); err == nil {
+		t.Error("expected an unknown remote to be rejected")
+	}
+
+	output, err = runStorageCmdOutput(t, "test")
+	if err != nil || !strings.Contains(output, "reachable and writable") {
+		t.Errorf("expected the check to pass, got %q %v", output, err)
+	}
+	if entries, _ := os.ReadDir(primary); len(entries) != 0 {
+		t.Errorf("expected the check to leave the directory empty, got %v", entries)
+	}
+
+	cache := filepath.Join(home, ".dot-sync", "cache", mirrorName("local", primary))
+	os.MkdirAll(cache, 0755)
+	if err := runStorageCmd(t, "set-remote", "origin", moved); err != nil {
+		t.Fatalf("storage set-remote failed: %v", err)
+	}
+	if remote, err := OpenRemote("origin"); err != nil || remote.Remote != moved {
+		t.Errorf("expected origin to use the new directory, got %+v %v", remote, err)
+	}
+	if shared.PathExists(cache) {
+		t.Error("expected the cache of the old directory to be deleted")
+	}
+	if err := runStorageCmd(t, "set-remote", filepath.Join(t.TempDir(), "missing", "dir")); err == nil {
+		t.Error("expected an unavailable directory to be rejected")
+	}
+
+	// The drive holding the directory is unmounted
+	os.RemoveAll(filepath.Dir(moved))
+	if _, err := runStorageCmdOutput(t, "test"); err == nil {
+		t.Error("expected an unavailable directory to fail the check")
+	}
+}
+
+func TestRemoveKeepsSharedLocalState(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	// The same bucket name on two servers has two caches
+	if err := runStorageCmd(t, "init", "--provider", "s3", "--remote-url", "s3://dotfiles", "--endpoint", "https://minio.a.example"); err != nil {
+		t.Fatalf("storage init failed: %v", err)
+	}
+	if err := runStorageCmd(t, "add", "backup", "--provider", "s3", "--remote-url", "s3://dotfiles", "--endpoint", "https://minio.b.example"); err != nil {
+		t.Fatalf("storage add failed: %v", err)
+	}
+	if err := runStorageCmd(t, "add", "mirror", "--provider", "s3", "--remote-url", "s3://dotfiles?endpoint=https://minio.a.example"); err != nil {
+		t.Fatalf("storage add failed: %v", err)
+	}
+	originCache := filepath.Join(home, ".dot-sync", "cache", (&S3Storage{Endpoint: "https://minio.a.example", Bucket: "dotfiles"}).cacheName())
+	backupCache := filepath.Join(home, ".dot-sync", "cache", (&S3Storage{Endpoint: "https://minio.b.example", Bucket: "dotfiles"}).cacheName())
+	os.MkdirAll(originCache, 0755)
+	os.MkdirAll(backupCache, 0755)
+
+	if err := runStorageCmd(t, "remove", "backup"); err != nil {
+		t.Fatalf("storage remove failed: %v", err)
+	}
+	if shared.PathExists(backupCache) {
+		t.Error("expected the cache of the removed remote to be deleted")
+	}
+	if err := runStorageCmd(t, "remove", "origin"); err != nil {
+		t.Fatalf("storage remove failed: %v", err)
+	}
+	if !shared.PathExists(originCache) {
+		t.Error("expected the cache still used by mirror to be kept")
+	}
+}
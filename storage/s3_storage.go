@@ -0,0 +1,406 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// s3Timeout bounds each request to the bucket.
+const s3Timeout = 60 * time.Second
+
+// S3Storage keeps the remote copy in an S3 bucket or an S3-compatible object
+// store such as MinIO. The remote is written as
+//
+//	s3://bucket/prefix?endpoint=http://minio.local:9000&region=eu-west-1&profile=work
+//
+// where every query parameter is optional. Credentials come from the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables or from a
+// profile in ~/.aws/credentials.
+type S3Storage struct {
+	RemoteURL string
+	Bucket    string
+	Prefix    string
+	// Endpoint is the base URL of an S3-compatible server, addressed with
+	// path-style URLs. It is empty for AWS.
+	Endpoint string
+	Region   string
+	Profile  string
+	// Transport is used for requests; nil means the default transport.
+	Transport http.RoundTripper
+}
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+func init() {
+	RegisterProvider(Provider{
+		Name:       "s3",
+		RemoteHint: "s3://bucket/prefix",
+		Options: []ProviderOption{
+			{Name: "endpoint", Usage: "Base URL of an S3-compatible server such as MinIO"},
+			{Name: "region", Usage: "Region of the bucket"},
+			{Name: "profile", Usage: "Profile in ~/.aws/credentials"},
+		},
+		New: func(cfg RemoteConfig) (StorageProvider, error) {
+			return newS3Storage(cfg.Remote, cfg.Options)
+		},
+	})
+}
+
+// NewS3Storage parses a remote of the form s3://bucket/prefix?options.
+func NewS3Storage(remote string) (*S3Storage, error) {
+	return newS3Storage(remote, nil)
+}
+
+// newS3Storage parses remote like NewS3Storage. Options given to 'storage
+// init' take precedence over the query parameters.
+func newS3Storage(remote string, options map[string]string) (*S3Storage, error) {
+	u, err := url.Parse(remote)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 remote %q (expected s3://bucket/prefix)", remote)
+	}
+	query := u.Query()
+	for name, value := range options {
+		query.Set(name, value)
+	}
+	s := &S3Storage{
+		RemoteURL: remote,
+		Bucket:    u.Host,
+		Prefix:    strings.Trim(u.Path, "/"),
+		Endpoint:  strings.TrimRight(query.Get("endpoint"), "/"),
+		Region:    query.Get("region"),
+		Profile:   query.Get("profile"),
+	}
+	if s.Endpoint != "" {
+		if e, err := url.Parse(s.Endpoint); err != nil || (e.Scheme != "http" && e.Scheme != "https") || e.Host == "" || e.Path != "" {
+			return nil, fmt.Errorf("invalid s3 endpoint %q", s.Endpoint)
+		}
+	}
+	return s, nil
+}
+
+func (s *S3Storage) InitializeStorage() error {
+	home := shared.FindHomeDir()
+	dir := filepath.Join(home, shared.GetDotSyncDir())
+	filesDir := filepath.Join(home, shared.GetDotSyncFilesDir())
+
+	if err := shared.EnsureDir(dir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	if err := shared.EnsureDir(filesDir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filesDir, err)
+	}
+	return nil
+}
+
+// mirror resolves the credentials, so only the commands that talk to the
+// bucket need them.
+func (s *S3Storage) mirror() (*mirror, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	store := &s3Store{client: client, bucket: s.Bucket, prefix: s.Prefix}
+	return &mirror{store: store, name: s.cacheName()}, nil
+}
+
+// client returns a client for AWS or, with an endpoint, for an
+// S3-compatible server addressed with path-style URLs.
+func (s *S3Storage) client() (*minio.Client, error) {
+	creds, err := s.credentials()
+	if err != nil {
+		return nil, err
+	}
+	opts := &minio.Options{
+		Creds:     credentials.NewStaticV4(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken),
+		Secure:    true,
+		Transport: s.Transport,
+		Region:    s.region(),
+	}
+	host := "s3.amazonaws.com"
+	if s.Endpoint != "" {
+		endpoint, err := url.Parse(s.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		host = endpoint.Host
+		opts.Secure = endpoint.Scheme == "https"
+		opts.BucketLookup = minio.BucketLookupPath
+	}
+	return minio.New(host, opts)
+}
+
+func (s *S3Storage) PushToStorage(filePath string, opts PushOptions) error {
+	m, err := s.mirror()
+	if err != nil {
+		return err
+	}
+	return m.PushToStorage(filePath, opts)
+}
+
+func (s *S3Storage) PullFromStorage(filePath string) error {
+	m, err := s.mirror()
+	if err != nil {
+		return err
+	}
+	return m.PullFromStorage(filePath)
+}
+
+func (s *S3Storage) Fetch(filePath string) error {
+	m, err := s.mirror()
+	if err != nil {
+		return err
+	}
+	return m.Fetch(filePath)
+}
+
+func (s *S3Storage) ExportRevision(filePath string, rev Revision, dest string) error {
+	m := &mirror{name: s.cacheName()}
+	return m.ExportRevision(filePath, rev, dest)
+}
+
+func (s *S3Storage) Check(filePath string) error {
+	m, err := s.mirror()
+	if err != nil {
+		return err
+	}
+	return m.Check()
+}
+
+func (s *S3Storage) localStateKey() string {
+	return s.cacheName()
+}
+
+func (s *S3Storage) removeLocalState(filePath string) error {
+	return (&mirror{name: s.cacheName()}).removeCache(filePath)
+}
+
+// cacheName names the cache of the remote after the server, bucket and
+// prefix it resolves to, so the same bucket name on two S3-compatible
+// servers gets two caches.
+func (s *S3Storage) cacheName() string {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	return mirrorName("s3", endpoint+"/"+s.Bucket+"/"+s.Prefix)
+}
+
+// credentials returns the keys from the environment or, when a profile is
+// configured or the environment has none, from the shared credentials file.
+func (s *S3Storage) credentials() (awsCredentials, error) {
+	if s.Profile == "" && os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		creds := awsCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if creds.SecretAccessKey == "" {
+			return awsCredentials{}, errors.New("AWS_ACCESS_KEY_ID is set but AWS_SECRET_ACCESS_KEY is not")
+		}
+		return creds, nil
+	}
+	profile := s.profile()
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if file == "" {
+		file = filepath.Join(shared.FindHomeDir(), ".aws", "credentials")
+	}
+	sections, err := readINI(file)
+	if err != nil && !os.IsNotExist(err) {
+		return awsCredentials{}, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	section, ok := sections[profile]
+	if !ok || section["aws_access_key_id"] == "" || section["aws_secret_access_key"] == "" {
+		return awsCredentials{}, fmt.Errorf("no S3 credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or add profile %q to %s", profile, file)
+	}
+	return awsCredentials{
+		AccessKeyID:     section["aws_access_key_id"],
+		SecretAccessKey: section["aws_secret_access_key"],
+		SessionToken:    section["aws_session_token"],
+	}, nil
+}
+
+func (s *S3Storage) profile() string {
+	if s.Profile != "" {
+		return s.Profile
+	}
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return profile
+	}
+	return "default"
+}
+
+// region returns the configured region, then the one from the environment
+// or ~/.aws/config, defaulting to us-east-1.
+func (s *S3Storage) region() string {
+	if s.Region != "" {
+		return s.Region
+	}
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region
+		}
+	}
+	file := os.Getenv("AWS_CONFIG_FILE")
+	if file == "" {
+		file = filepath.Join(shared.FindHomeDir(), ".aws", "config")
+	}
+	if sections, err := readINI(file); err == nil {
+		profile := s.profile()
+		for _, name := range []string{"profile " + profile, profile} {
+			if region := sections[name]["region"]; region != "" {
+				return region
+			}
+		}
+	}
+	return "us-east-1"
+}
+
+// readINI parses the sections of an AWS credentials or config file.
+func readINI(file string) (map[string]map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sections := map[string]map[string]string{}
+	var current map[string]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			current = map[string]string{}
+			sections[name] = current
+		case current != nil:
+			if key, value, ok := strings.Cut(line, "="); ok {
+				current[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	return sections, scanner.Err()
+}
+
+// s3Store reads and writes objects below the configured prefix. Writes
+// from a push are conditional on the ETag of the object they replace, with
+// If-Match, or on there being none, with If-None-Match, so a machine that
+// pushes at the same time cannot overwrite them unnoticed.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) objectName(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+func (s *s3Store) ReadObject(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	obj, err := s.client.GetObject(ctx, s.bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err, http.MethodGet, key)
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, s3Error(err, http.MethodGet, key)
+	}
+	return data, nil
+}
+
+func (s *s3Store) WriteObject(key string, data []byte) error {
+	if err := s.put(key, data, minio.PutObjectOptions{}); err != nil {
+		return s3Error(err, http.MethodPut, key)
+	}
+	return nil
+}
+
+// WriteObjectIf writes an object with If-Match on its ETag, or with
+// If-None-Match when it should not exist yet.
+func (s *s3Store) WriteObjectIf(key string, data []byte, version string) error {
+	var opts minio.PutObjectOptions
+	if version == "" {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(version)
+	}
+	err := s.put(key, data, opts)
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).StatusCode {
+	// S3 answers 409 when a conflicting write is still in progress
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return errStaleObject
+	}
+	return s3Error(err, http.MethodPut, key)
+}
+
+func (s *s3Store) put(key string, data []byte, opts minio.PutObjectOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	opts.ContentType = "application/octet-stream"
+	_, err := s.client.PutObject(ctx, s.bucket, s.objectName(key), bytes.NewReader(data), int64(len(data)), opts)
+	return err
+}
+
+func (s *s3Store) DeleteObject(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	if err := s.client.RemoveObject(ctx, s.bucket, s.objectName(key), minio.RemoveObjectOptions{}); err != nil {
+		return s3Error(err, http.MethodDelete, key)
+	}
+	return nil
+}
+
+// ObjectVersions lists the ETags of the objects below the prefix.
+func (s *s3Store) ObjectVersions() (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	versions := map[string]string{}
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, s3Error(obj.Err, http.MethodGet, prefix)
+		}
+		versions[strings.TrimPrefix(obj.Key, prefix)] = obj.ETag
+	}
+	return versions, nil
+}
+
+// s3Error describes a failed request using the error document S3 returns.
+func s3Error(err error, method, key string) error {
+	if resp := minio.ToErrorResponse(err); resp.Code != "" {
+		return fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Code, resp.Message)
+	}
+	return fmt.Errorf("s3 %s %s: %w", method, key, err)
+}
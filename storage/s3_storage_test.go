@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-process S3-compatible server holding one bucket in memory.
+// It only accepts requests signed with its access key, and evaluates
+// If-Match and If-None-Match on uploads.
+type fakeS3 struct {
+	t         *testing.T
+	bucket    string
+	accessKey string
+	mu        sync.Mutex
+	objects   map[string][]byte
+	puts      []string
+	// beforePut runs before each upload, to simulate other clients.
+	beforePut func(key string)
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		t:         t,
+		bucket:    bucket,
+		accessKey: "minio",
+		objects:   map[string][]byte{},
+	}
+	// Over TLS the client sends plain bodies rather than signed chunks
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func s3ETag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(data))
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, strings.ToLower(code))
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+f.accessKey+"/") {
+		writeS3Error(w, http.StatusForbidden, "InvalidAccessKeyId")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if r.Method == http.MethodPut && f.beforePut != nil {
+		f.beforePut(key)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", s3ETag(data))
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodPut:
+		current, exists := f.objects[key]
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || (match != "*" && match != s3ETag(current))) {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+		f.puts = append(f.puts, key)
+		w.Header().Set("ETag", s3ETag(data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list answers ListObjectsV2 with every object below prefix.
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type object struct {
+		Key  string
+		ETag string
+		Size int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []object
+	}{Name: f.bucket, Prefix: prefix}
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, object{Key: key, ETag: s3ETag(f.objects[key]), Size: len(f.objects[key])})
+	}
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestS3Storage(t *testing.T, server *httptest.Server) *S3Storage {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minio-secret")
+	t.Setenv("AWS_REGION", "us-east-1")
+	s, err := NewS3Storage("s3://dotfiles/team/alice?endpoint=" + server.URL)
+	if err != nil {
+		t.Fatalf("NewS3Storage failed: %v", err)
+	}
+	s.Transport = server.Client().Transport
+	return s
+}
+
+func TestNewS3Storage(t *testing.T) {
+	s, err := NewS3Storage("s3://dotfiles/team/alice/?endpoint=http://minio.local:9000/&region=eu-west-1&profile=work")
+	if err != nil {
+		t.Fatalf("NewS3Storage failed: %v", err)
+	}
+	if s.Bucket != "dotfiles" || s.Prefix != "team/alice" || s.Endpoint != "http://minio.local:9000" ||
+		s.Region != "eu-west-1" || s.Profile != "work" {
+		t.Errorf("unexpected storage %+v", s)
+	}
+	for _, remote := range []string{"https://example.com/bucket", "s3:///prefix", "s3://bucket?endpoint=minio.local"} {
+		if _, err := NewS3Storage(remote); err == nil {
+			t.Errorf("expected %q to be rejected", remote)
+		}
+	}
+}
+
+func TestS3Storage_Client(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minio-secret")
+	s, _ := NewS3Storage("s3://dotfiles/team?region=eu-west-1")
+	client, err := s.client()
+	if err != nil {
+		t.Fatalf("client failed: %v", err)
+	}
+	if u := client.EndpointURL(); u.String() != "https://s3.amazonaws.com" {
+		t.Errorf("unexpected AWS endpoint %q", u)
+	}
+	s, _ = NewS3Storage("s3://dotfiles?endpoint=http://minio.local:9000")
+	if client, err = s.client(); err != nil {
+		t.Fatalf("client failed: %v", err)
+	}
+	if u := client.EndpointURL(); u.String() != "http://minio.local:9000" {
+		t.Errorf("unexpected endpoint %q", u)
+	}
+	if _, err := NewS3Storage("s3://dotfiles?endpoint=http://minio.local:9000/s3"); err == nil {
+		t.Error("expected an endpoint with a path to be rejected")
+	}
+}
+
+func TestS3Storage_Credentials(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "")
+	t.Setenv("AWS_CONFIG_FILE", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	os.MkdirAll(filepath.Join(home, ".aws"), 0700)
+	os.WriteFile(filepath.Join(home, ".aws", "credentials"), []byte(
+		"[default]\naws_access_key_id = AKDEFAULT\naws_secret_access_key = secret\n\n"+
+			"[work]\naws_access_key_id=AKWORK\naws_secret_access_key=worksecret\naws_session_token=token\n"), 0600)
+	os.WriteFile(filepath.Join(home, ".aws", "config"), []byte("[profile work]\nregion = eu-central-1\n"), 0600)
+
+	s, _ := NewS3Storage("s3://bucket")
+	if creds, err := s.credentials(); err != nil || creds.AccessKeyID != "AKDEFAULT" {
+		t.Errorf("expected the default profile, got %+v %v", creds, err)
+	}
+	if region := s.region(); region != "us-east-1" {
+		t.Errorf("expected the default region, got %q", region)
+	}
+
+	s, _ = NewS3Storage("s3://bucket?profile=work")
+	if creds, err := s.credentials(); err != nil || creds.AccessKeyID != "AKWORK" || creds.SessionToken != "token" {
+		t.Errorf("expected the work profile, got %+v %v", creds, err)
+	}
+	if region := s.region(); region != "eu-central-1" {
+		t.Errorf("expected the profile's region, got %q", region)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+	s, _ = NewS3Storage("s3://bucket")
+	if creds, err := s.credentials(); err != nil || creds.AccessKeyID != "AKENV" {
+		t.Errorf("expected environment credentials, got %+v %v", creds, err)
+	}
+
+	s, _ = NewS3Storage("s3://bucket?profile=missing")
+	if _, err := s.credentials(); err == nil {
+		t.Error("expected an error for a missing profile")
+	}
+	// Only talking to the bucket needs credentials
+	if err := s.InitializeStorage(); err != nil {
+		t.Errorf("expected InitializeStorage to work without credentials, got %v", err)
+	}
+	if err := s.Check(t.TempDir()); err == nil {
+		t.Error("expected Check to fail without credentials")
+	}
+}
+
+func TestS3Storage_CacheName(t *testing.T) {
+	a, _ := NewS3Storage("s3://dotfiles/alice?endpoint=https://minio.a.example")
+	b, _ := NewS3Storage("s3://dotfiles/alice?endpoint=https://minio.b.example")
+	c, _ := newS3Storage("s3://dotfiles/alice", map[string]string{"endpoint": "https://minio.a.example/"})
+	if a.cacheName() == b.cacheName() {
+		t.Errorf("expected buckets on different servers to get different caches, both got %q", a.cacheName())
+	}
+	if a.cacheName() != c.cacheName() {
+		t.Errorf("expected the same server to get the same cache, got %q and %q", a.cacheName(), c.cacheName())
+	}
+}
+
+func TestS3Storage_PushAndPull(t *testing.T) {
+	fake, server := newFakeS3(t, "dotfiles")
+	storage := newTestS3Storage(t, server)
+
+	machineA := newTestMachine(t)
+	if err := storage.PushToStorage(machineA, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+	if string(fake.objects["team/alice/files/1"]) != "file one" {
+		t.Errorf("expected files/1 below the prefix, got %v", fake.objects)
+	}
+	if _, ok := fake.objects["team/alice/local.db"]; ok {
+		t.Error("expected the local database not to be uploaded")
+	}
+
+	machineB := filepath.Join(t.TempDir(), ".dot-sync")
+	if err := storage.PullFromStorage(machineB); err != nil {
+		t.Fatalf("PullFromStorage failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(machineB, "files", "2", "init.lua")); string(data) != "init" {
+		t.Errorf("expected init.lua to be pulled, got %q", data)
+	}
+
+	// Only changed objects are uploaded again
+	fake.puts = nil
+	os.WriteFile(filepath.Join(machineB, "files", "1"), []byte("edited on B"), 0600)
+	if err := storage.PushToStorage(machineB, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage from B failed: %v", err)
+	}
+	if !reflect.DeepEqual(fake.puts, []string{"team/alice/files/1", "team/alice/manifest.json"}) {
+		t.Errorf("expected only the changed file and the manifest, got %v", fake.puts)
+	}
+
+	os.WriteFile(filepath.Join(machineA, "files", "1"), []byte("edited on A"), 0600)
+	var conflictErr *ConflictError
+	if err := storage.PushToStorage(machineA, PushOptions{}); !errors.As(err, &conflictErr) {
+		t.Errorf("expected ConflictError, got %v", err)
+	}
+}
+
+func TestS3Storage_ConcurrentPush(t *testing.T) {
+	fake, server := newFakeS3(t, "dotfiles")
+	storage := newTestS3Storage(t, server)
+	machineA := newTestMachine(t)
+	if err := storage.PushToStorage(machineA, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+
+	// Another machine finishes a push while this one is uploading
+	manifest := "team/alice/manifest.json"
+	fake.beforePut = func(key string) {
+		if key == "team/alice/files/1" {
+			fake.mu.Lock()
+			fake.objects[manifest] = []byte(strings.Replace(string(fake.objects[manifest]), `"revision": "`, `"revision": "other`, 1))
+			fake.mu.Unlock()
+		}
+	}
+	os.WriteFile(filepath.Join(machineA, "files", "1"), []byte("edited on A"), 0600)
+	var conflictErr *ConflictError
+	if err := storage.PushToStorage(machineA, PushOptions{}); !errors.As(err, &conflictErr) {
+		t.Fatalf("expected ConflictError, got %v", err)
+	}
+	if !strings.Contains(string(fake.objects[manifest]), `"revision": "other`) {
+		t.Error("expected the other machine's manifest to be kept")
+	}
+
+	// Forcing overwrites it
+	fake.beforePut = nil
+	if err := storage.PushToStorage(machineA, PushOptions{Force: true}); err != nil {
+		t.Fatalf("forced PushToStorage failed: %v", err)
+	}
+	if strings.Contains(string(fake.objects[manifest]), `"revision": "other`) {
+		t.Error("expected a forced push to replace the manifest")
+	}
+}
+
+func TestS3Storage_ReportsErrors(t *testing.T) {
+	_, server := newFakeS3(t, "dotfiles")
+	storage := newTestS3Storage(t, server)
+	t.Setenv("AWS_ACCESS_KEY_ID", "wrong")
+
+	err := storage.PushToStorage(newTestMachine(t), PushOptions{})
+	if err == nil || !strings.Contains(err.Error(), "InvalidAccessKeyId") {
+		t.Errorf("expected the S3 error code, got %v", err)
+	}
+}
+
+func TestS3Options(t *testing.T) {
+	s, err := newS3Storage("s3://bucket/prefix?region=us-east-1&profile=work", map[string]string{"region": "eu-west-1", "endpoint": "http://minio.local:9000/"})
+	if err != nil {
+		t.Fatalf("newS3Storage failed: %v", err)
+	}
+	if s.Region != "eu-west-1" || s.Profile != "work" || s.Endpoint != "http://minio.local:9000" {
+		t.Errorf("expected options to take precedence over the query, got %+v", s)
+	}
+	if _, err := newS3Storage("s3://bucket", map[string]string{"endpoint": "minio.local"}); err == nil {
+		t.Error("expected an invalid endpoint option to be rejected")
+	}
+}
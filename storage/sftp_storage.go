@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// SFTPStorage keeps the remote copy in a directory on a machine reachable
+// over SFTP. It runs the system ssh client with the sftp subsystem, so the
+// SSH agent, ~/.ssh/config and known_hosts apply as usual, password prompts
+// are disabled and SFTP-only or chrooted accounts work. The remote is
+// written as user@host:/path or sftp://user@host:port/path, where a relative
+// path starts in the remote home directory.
+type SFTPStorage struct {
+	RemoteURL string
+	// Target is what ssh connects to, such as "user@host".
+	Target string
+	Port   string
+	Path   string
+	// SSH is the ssh binary to run; empty means "ssh" from PATH.
+	SSH string
+}
+
+func init() {
+	RegisterProvider(Provider{
+		Name:       "sftp",
+		RemoteHint: "user@host:/path",
+		New: func(cfg RemoteConfig) (StorageProvider, error) {
+			return NewSFTPStorage(cfg.Remote)
+		},
+	})
+}
+
+// NewSFTPStorage parses a remote of the form user@host:/path or
+// sftp://user@host:port/path.
+func NewSFTPStorage(remote string) (*SFTPStorage, error) {
+	s := &SFTPStorage{RemoteURL: remote}
+	if strings.HasPrefix(remote, "sftp://") {
+		u, err := url.Parse(remote)
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid sftp remote %q (expected sftp://user@host:port/path)", remote)
+		}
+		s.Target = u.Hostname()
+		if u.User != nil {
+			s.Target = u.User.Username() + "@" + s.Target
+		}
+		s.Port = u.Port()
+		s.Path = u.Path
+	} else {
+		target, dir, ok := strings.Cut(remote, ":")
+		if !ok || target == "" || strings.Contains(target, "/") {
+			return nil, fmt.Errorf("invalid sftp remote %q (expected user@host:/path)", remote)
+		}
+		s.Target, s.Path = target, dir
+	}
+	if strings.HasPrefix(s.Target, "-") {
+		return nil, fmt.Errorf("invalid sftp host %q", s.Target)
+	}
+	// Nothing on the remote expands ~, and relative paths already start in
+	// the home directory
+	if s.Path == "~" {
+		s.Path = "."
+	}
+	s.Path = strings.TrimRight(strings.TrimPrefix(s.Path, "~/"), "/")
+	if s.Path == "" {
+		return nil, fmt.Errorf("sftp remote %q has no directory", remote)
+	}
+	return s, nil
+}
+
+func (s *SFTPStorage) InitializeStorage() error {
+	home := shared.FindHomeDir()
+	dir := filepath.Join(home, shared.GetDotSyncDir())
+	filesDir := filepath.Join(home, shared.GetDotSyncFilesDir())
+
+	if err := shared.EnsureDir(dir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	if err := shared.EnsureDir(filesDir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filesDir, err)
+	}
+	return nil
+}
+
+// mirror returns the mirror of the remote and its store, which connects on
+// first use and has to be closed.
+func (s *SFTPStorage) mirror() (*mirror, *sftpStore) {
+	store := &sftpStore{storage: s}
+	return &mirror{store: store, name: mirrorName("sftp", s.RemoteURL)}, store
+}
+
+func (s *SFTPStorage) PushToStorage(filePath string, opts PushOptions) error {
+	m, store := s.mirror()
+	defer store.close()
+	return m.PushToStorage(filePath, opts)
+}
+
+func (s *SFTPStorage) PullFromStorage(filePath string) error {
+	m, store := s.mirror()
+	defer store.close()
+	return m.PullFromStorage(filePath)
+}
+
+func (s *SFTPStorage) Fetch(filePath string) error {
+	m, store := s.mirror()
+	defer store.close()
+	return m.Fetch(filePath)
+}
+
+func (s *SFTPStorage) ExportRevision(filePath string, rev Revision, dest string) error {
+	m, _ := s.mirror()
+	return m.ExportRevision(filePath, rev, dest)
+}
+
+func (s *SFTPStorage) Check(filePath string) error {
+	m, store := s.mirror()
+	defer store.close()
+	return m.Check()
+}
+
+func (s *SFTPStorage) localStateKey() string {
+	m, _ := s.mirror()
+	return m.name
+}
+
+func (s *SFTPStorage) removeLocalState(filePath string) error {
+	m, _ := s.mirror()
+	return m.removeCache(filePath)
+}
+
+// sftpStore reads and writes the remote directory over one SFTP session,
+// started on first use with 'ssh -s host sftp'.
+type sftpStore struct {
+	storage *SFTPStorage
+	cmd     *exec.Cmd
+	client  *sftp.Client
+	stderr  bytes.Buffer
+}
+
+func (s *sftpStore) connect() (*sftp.Client, error) {
+	if s.client != nil {
+		return s.client, nil
+	}
+	bin := s.storage.SSH
+	if bin == "" {
+		bin = "ssh"
+	}
+	args := []string{"-o", "BatchMode=yes"}
+	if s.storage.Port != "" {
+		args = append(args, "-p", s.storage.Port)
+	}
+	args = append(args, "-s", "--", s.storage.Target, "sftp")
+
+	cmd := exec.Command(bin, args...)
+	cmd.Stderr = &s.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ssh %s: %w", s.storage.Target, err)
+	}
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		stdin.Close()
+		cmd.Wait()
+		// What ssh printed, such as a host key mismatch, says more than the
+		// closed pipe
+		if msg := strings.TrimSpace(s.stderr.String()); msg != "" {
+			return nil, fmt.Errorf("ssh %s: %s", s.storage.Target, msg)
+		}
+		return nil, fmt.Errorf("ssh %s: %w", s.storage.Target, err)
+	}
+	s.cmd, s.client = cmd, client
+	return client, nil
+}
+
+// close ends the session, if one was started.
+func (s *sftpStore) close() {
+	if s.client == nil {
+		return
+	}
+	s.client.Close()
+	s.cmd.Wait()
+	s.client, s.cmd = nil, nil
+}
+
+func (s *sftpStore) remotePath(key string) string {
+	return path.Join(s.storage.Path, key)
+}
+
+func (s *sftpStore) remoteError(err error) error {
+	return fmt.Errorf("sftp %s: %w", s.storage.Target, err)
+}
+
+func (s *sftpStore) ReadObject(key string) ([]byte, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(s.remotePath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, s.remoteError(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, s.remoteError(err)
+	}
+	return data, nil
+}
+
+// WriteObject uploads into a temporary file renamed into place, so a reader
+// on another machine never sees a partly written file.
+func (s *sftpStore) WriteObject(key string, data []byte) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	p := s.remotePath(key)
+	if err := client.MkdirAll(path.Dir(p)); err != nil {
+		return s.remoteError(err)
+	}
+	tmp := p + ".dot-sync-tmp"
+	f, err := client.Create(tmp)
+	if err != nil {
+		return s.remoteError(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return s.remoteError(err)
+	}
+	if err := f.Close(); err != nil {
+		return s.remoteError(err)
+	}
+	// Plain SFTP renames refuse to replace a file; servers without the
+	// posix-rename extension need it removed first
+	if err := client.PosixRename(tmp, p); err != nil {
+		if err := client.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return s.remoteError(err)
+		}
+		if err := client.Rename(tmp, p); err != nil {
+			return s.remoteError(err)
+		}
+	}
+	return nil
+}
+
+func (s *sftpStore) DeleteObject(key string) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	if err := client.Remove(s.remotePath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return s.remoteError(err)
+	}
+	// Drop directories left empty, such as those of deleted records
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if client.RemoveDirectory(s.remotePath(dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
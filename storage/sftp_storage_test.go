@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// fakeSFTPEnv makes the test binary serve SFTP on its standard input and
+// output instead of running the tests, and names the file it logs its
+// arguments to.
+const fakeSFTPEnv = "DOT_SYNC_TEST_SFTP_SERVER"
+
+func TestMain(m *testing.M) {
+	if log := os.Getenv(fakeSFTPEnv); log != "" {
+		os.Exit(serveFakeSFTP(log))
+	}
+	os.Exit(m.Run())
+}
+
+// serveFakeSFTP stands in for 'ssh -s host sftp', serving the local file
+// system.
+func serveFakeSFTP(log string) int {
+	if f, err := os.OpenFile(log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err == nil {
+		fmt.Fprintln(f, strings.Join(os.Args[1:], " "))
+		f.Close()
+	}
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{os.Stdin, os.Stdout})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := server.Serve(); err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// newFakeSSH returns an ssh stand-in that serves SFTP locally and the file
+// it logs the arguments of each session to.
+func newFakeSSH(t *testing.T) (string, string) {
+	t.Helper()
+	bin, err := os.Executable()
+	if err != nil {
+		t.Fatalf("failed to find the test binary: %v", err)
+	}
+	log := filepath.Join(t.TempDir(), "sessions.log")
+	t.Setenv(fakeSFTPEnv, log)
+	return bin, log
+}
+
+func TestNewSFTPStorage(t *testing.T) {
+	s, err := NewSFTPStorage("alice@example.com:/srv/dotfiles/")
+	if err != nil {
+		t.Fatalf("NewSFTPStorage failed: %v", err)
+	}
+	if s.Target != "alice@example.com" || s.Path != "/srv/dotfiles" || s.Port != "" {
+		t.Errorf("unexpected storage %+v", s)
+	}
+	s, err = NewSFTPStorage("sftp://alice@example.com:2222/srv/dotfiles")
+	if err != nil {
+		t.Fatalf("NewSFTPStorage failed: %v", err)
+	}
+	if s.Target != "alice@example.com" || s.Path != "/srv/dotfiles" || s.Port != "2222" {
+		t.Errorf("unexpected storage %+v", s)
+	}
+	s, err = NewSFTPStorage("alice@example.com:~/dotfiles")
+	if err != nil {
+		t.Fatalf("NewSFTPStorage failed: %v", err)
+	}
+	if s.Path != "dotfiles" {
+		t.Errorf("expected ~/ to be dropped, got %q", s.Path)
+	}
+	for _, remote := range []string{"/srv/dotfiles", "example.com:", "-oProxyCommand=x:/tmp", "sftp:///srv"} {
+		if _, err := NewSFTPStorage(remote); err == nil {
+			t.Errorf("expected %q to be rejected", remote)
+		}
+	}
+}
+
+func TestSFTPStorage_PushAndPull(t *testing.T) {
+	ssh, log := newFakeSSH(t)
+	remoteDir := filepath.Join(t.TempDir(), "dot files")
+	storage, err := NewSFTPStorage("alice@example.com:" + remoteDir)
+	if err != nil {
+		t.Fatalf("NewSFTPStorage failed: %v", err)
+	}
+	storage.SSH = ssh
+
+	machineA := newTestMachine(t)
+	if err := storage.PushToStorage(machineA, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(remoteDir, "files", "1")); string(data) != "file one" {
+		t.Errorf("expected files/1 on the remote, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "local.db")); err == nil {
+		t.Error("expected the local database not to be uploaded")
+	}
+
+	machineB := filepath.Join(t.TempDir(), ".dot-sync")
+	if err := storage.PullFromStorage(machineB); err != nil {
+		t.Fatalf("PullFromStorage failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(machineB, "files", "2", "init.lua")); string(data) != "init" {
+		t.Errorf("expected init.lua to be pulled, got %q", data)
+	}
+
+	sessions, _ := os.ReadFile(log)
+	if !strings.HasSuffix(strings.Split(string(sessions), "\n")[0], "-s -- alice@example.com sftp") {
+		t.Errorf("expected ssh to start the sftp subsystem, got %q", sessions)
+	}
+
+	// Only the changed file and the manifest are uploaded again
+	old := time.Now().Add(-time.Hour)
+	filepath.WalkDir(remoteDir, func(path string, d fs.DirEntry, err error) error {
+		return os.Chtimes(path, old, old)
+	})
+	os.WriteFile(filepath.Join(machineB, "files", "1"), []byte("edited on B"), 0600)
+	os.RemoveAll(filepath.Join(machineB, "files", "2"))
+	if err := storage.PushToStorage(machineB, PushOptions{}); err != nil {
+		t.Fatalf("PushToStorage from B failed: %v", err)
+	}
+	var uploaded []string
+	filepath.WalkDir(remoteDir, func(path string, d fs.DirEntry, err error) error {
+		if info, err := d.Info(); err == nil && d.Type().IsRegular() && info.ModTime().After(old) {
+			uploaded = append(uploaded, path)
+		}
+		return nil
+	})
+	if len(uploaded) != 2 {
+		t.Errorf("expected 2 uploads, got %v", uploaded)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "files", "2")); !os.IsNotExist(err) {
+		t.Error("expected the removed record's directory to be deleted remotely")
+	}
+
+	os.WriteFile(filepath.Join(machineA, "files", "1"), []byte("edited on A"), 0600)
+	var conflictErr *ConflictError
+	if err := storage.PushToStorage(machineA, PushOptions{}); !errors.As(err, &conflictErr) {
+		t.Errorf("expected ConflictError, got %v", err)
+	}
+}
+
+func TestSFTPStorage_ReportsSSHErrors(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "ssh")
+	os.WriteFile(script, []byte("#!/bin/sh\necho 'Host key verification failed.' >&2\nexit 255\n"), 0755)
+	storage, _ := NewSFTPStorage("alice@example.com:/srv/dotfiles")
+	storage.SSH = script
+
+	err := storage.PushToStorage(newTestMachine(t), PushOptions{})
+	if err == nil || !strings.Contains(err.Error(), "Host key verification failed") {
+		t.Errorf("expected the ssh error, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// Revision identifies a version of the staging directory known to a provider.
+type Revision string
+
+const (
+	// RevisionBase is the last state shared by the local storage and the
+	// remote, i.e. what was last pushed or pulled.
+	RevisionBase Revision = "base"
+	// RevisionRemote is the state of the remote as of the last Fetch.
+	RevisionRemote Revision = "remote"
+)
+
+// PushOptions controls how PushToStorage treats the remote.
+type PushOptions struct {
+	// Force overwrites the remote even if it has changes we don't have.
+	Force bool
+}
+
+// ConflictError is returned by PushToStorage when the remote has changes
+// that are not in the local storage.
+type ConflictError struct {
+	// Paths lists the staging paths (e.g. "files/3") changed on both sides.
+	Paths []string
+	// Err is the cause reported by the provider, such as
+	// ErrGitNonFastForward, if any.
+	Err error
+}
+
+func (e *ConflictError) Error() string {
+	msg := "remote has changes that are not in local storage; run 'dot-sync pull' first or sync with --force"
+	if len(e.Paths) > 0 {
+		msg += "; changed on both sides: " + strings.Join(e.Paths, ", ")
+	}
+	return msg
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+type StorageProvider interface {
+	InitializeStorage() error
+	PushToStorage(filePath string, opts PushOptions) error
+	PullFromStorage(filePath string) error
+	// Fetch refreshes the provider's view of the remote without changing
+	// the files in the staging directory.
+	Fetch(filePath string) error
+	// ExportRevision writes the files/ tree of the given revision into dest,
+	// so that dest/<id> mirrors files/<id>. Records absent from the revision
+	// are simply not written.
+	ExportRevision(filePath string, rev Revision, dest string) error
+	// Check verifies that the remote can be reached and written to, leaving
+	// it as it was.
+	Check(filePath string) error
+}
+
+// recordStorageProvider stores the provider as the default remote, replacing
+// the one configured before.
+func recordStorageProvider(storageType string, cfg RemoteConfig) error {
+	database, err := db.OpenDotSyncDB()
+	if err != nil {
+		return fmt.Errorf("failed to open db: %w", err)
+	}
+	defer database.Close()
+
+	if err := db.EnsureStorageTable(database); err != nil {
+		return fmt.Errorf("failed to ensure storage_provider table: %w", err)
+	}
+
+	_, _, err = db.GetStorageProvider(database)
+	if err != nil {
+		if err := db.InsertStorageProvider(database, storageType, cfg.Remote); err != nil {
+			return fmt.Errorf("failed to insert storage provider: %w", err)
+		}
+	} else {
+		if err := db.UpdateStorageProvider(database, storageType, cfg.Remote); err != nil {
+			return fmt.Errorf("failed to update storage provider: %w", err)
+		}
+	}
+	r, err := db.GetDefaultStorageRemote(database)
+	if err != nil {
+		return err
+	}
+	return db.SetStorageRemoteOptions(database, r.Name, cfg.Options)
+}
+
+func NewStorageProviderCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "storage",
+		Short: "Manage dotfile storage backends",
+		// The storage commands manage the remotes themselves
+		Annotations: map[string]string{shared.GetSkipStorageAnnotation(): "true"},
+	}
+	cmd.AddCommand(newInitCmd())
+	cmd.AddCommand(newAddCmd())
+	cmd.AddCommand(newListCmd())
+	cmd.AddCommand(newRemoveCmd())
+	cmd.AddCommand(newDefaultCmd())
+	cmd.AddCommand(newShowCmd())
+	cmd.AddCommand(newSetRemoteCmd())
+	cmd.AddCommand(newTestCmd())
+	return cmd
+}
+
+func newInitCmd() *cobra.Command {
+	var provider string
+	var remoteURL string
+
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Initialize backend storage provider",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sp, cfg, err := configureRemote(provider, RemoteConfig{Name: defaultRemoteName(), Remote: remoteURL, Options: optionsFromFlags(cmd)})
+			if err != nil {
+				return err
+			}
+			if err := sp.InitializeStorage(); err != nil {
+				return fmt.Errorf("failed to initialize storage: %w", err)
+			}
+			if err := recordStorageProvider(provider, cfg); err != nil {
+				return err
+			}
+			fmt.Println("Storage initialized successfully.")
+			return nil
+		},
+	}
+	addProviderFlags(initCmd, &provider, &remoteURL)
+	initCmd.MarkFlagRequired("provider")
+	return initCmd
+}
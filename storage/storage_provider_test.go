@@ -1,10 +1,13 @@
 package storage
 
 import (
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/spf13/cobra"
+	"github.com/tylerkeyes/dot-sync/internal/db"
+	"github.com/tylerkeyes/dot-sync/internal/shared"
 )
 
 func TestNewStorageProviderCmd(t *testing.T) {
@@ -94,3 +97,29 @@ func TestInitCmdExecution(t *testing.T) {
 	// Test with git provider and remote URL would require database setup
 	// This is more of an integration test, so we'll skip detailed execution testing
 }
+
+func TestInitCmdLocalProvider(t *testing.T) {
+	cmd := newInitCmd()
+	cmd.SetArgs([]string{"--provider", "local"})
+	err := cmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "remote-url is required for local provider") {
+		t.Errorf("expected error about the missing directory, got %v", err)
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	target := filepath.Join(t.TempDir(), "dotfiles")
+	cmd = newInitCmd()
+	cmd.SetArgs([]string{"--provider", "local", "--remote-url", target})
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("expected local storage to initialize, got %v", err)
+	}
+	if !shared.PathExists(target) {
+		t.Error("expected the storage directory to be created")
+	}
+	database, _ := db.OpenDotSyncDB()
+	storageType, remote, err := db.GetStorageProvider(database)
+	database.Close()
+	if err != nil || storageType != "local" || remote != target {
+		t.Errorf("expected local provider to be recorded, got %q %q %v", storageType, remote, err)
+	}
+}
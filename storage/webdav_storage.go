@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tylerkeyes/dot-sync/internal/shared"
+)
+
+// WebDAVStorage keeps the remote copy in a folder on a WebDAV server such as
+// Nextcloud, e.g.
+//
+//	https://alice@cloud.example.com/remote.php/dav/files/alice/dotfiles
+//
+// The password is never part of the remote, which is stored in the synced
+// database; it comes from DOT_SYNC_WEBDAV_PASSWORD, or a bearer token from
+// DOT_SYNC_WEBDAV_TOKEN.
+type WebDAVStorage struct {
+	RemoteURL string
+	// Endpoint is the folder URL without user information.
+	Endpoint *url.URL
+	Username string
+	// Client is used for requests; nil means a client with a timeout.
+	Client *http.Client
+}
+
+func init() {
+	RegisterProvider(Provider{
+		Name:       "webdav",
+		RemoteHint: "https://user@host/path",
+		New: func(cfg RemoteConfig) (StorageProvider, error) {
+			return NewWebDAVStorage(cfg.Remote)
+		},
+	})
+}
+
+// NewWebDAVStorage parses a remote of the form https://user@host/path.
+func NewWebDAVStorage(remote string) (*WebDAVStorage, error) {
+	u, err := url.Parse(remote)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webdav remote %q (expected https://user@host/path)", remote)
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, errors.New("the webdav remote must not contain a password; set DOT_SYNC_WEBDAV_PASSWORD instead")
+	}
+	s := &WebDAVStorage{RemoteURL: remote, Username: u.User.Username()}
+	endpoint := *u
+	endpoint.User = nil
+	endpoint.RawQuery = ""
+	endpoint.Fragment = ""
+	endpoint.Path = strings.TrimRight(endpoint.Path, "/")
+	endpoint.RawPath = ""
+	s.Endpoint = &endpoint
+	return s, nil
+}
+
+func (s *WebDAVStorage) InitializeStorage() error {
+	home := shared.FindHomeDir()
+	dir := filepath.Join(home, shared.GetDotSyncDir())
+	filesDir := filepath.Join(home, shared.GetDotSyncFilesDir())
+
+	if err := shared.EnsureDir(dir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	if err := shared.EnsureDir(filesDir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filesDir, err)
+	}
+	return nil
+}
+
+func (s *WebDAVStorage) mirror() *mirror {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
+	return &mirror{store: &davStore{storage: s, client: client}, name: mirrorName("webdav", s.RemoteURL)}
+}
+
+func (s *WebDAVStorage) PushToStorage(filePath string, opts PushOptions) error {
+	return s.mirror().PushToStorage(filePath, opts)
+}
+
+func (s *WebDAVStorage) PullFromStorage(filePath string) error {
+	return s.mirror().PullFromStorage(filePath)
+}
+
+func (s *WebDAVStorage) Fetch(filePath string) error {
+	return s.mirror().Fetch(filePath)
+}
+
+func (s *WebDAVStorage) ExportRevision(filePath string, rev Revision, dest string) error {
+	return s.mirror().ExportRevision(filePath, rev, dest)
+}
+
+func (s *WebDAVStorage) Check(filePath string) error {
+	return s.mirror().Check()
+}
+
+func (s *WebDAVStorage) localStateKey() string {
+	return s.mirror().name
+}
+
+func (s *WebDAVStorage) removeLocalState(filePath string) error {
+	return s.mirror().removeCache(filePath)
+}
+
+// davStore reads and writes objects below the configured folder. Object
+// versions are the ETags the server reports.
+type davStore struct {
+	storage *WebDAVStorage
+	client  *http.Client
+}
+
+// anyVersion stands for an object the server reports without an ETag.
+const anyVersion = "*"
+
+func (s *davStore) url(key string, collection bool) string {
+	u := *s.storage.Endpoint
+	u.Path = path.Join(u.Path, key)
+	if collection {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (s *davStore) do(method, target string, body []byte, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if token := os.Getenv("DOT_SYNC_WEBDAV_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if s.storage.Username != "" || os.Getenv("DOT_SYNC_WEBDAV_PASSWORD") != "" {
+		req.SetBasicAuth(s.storage.Username, os.Getenv("DOT_SYNC_WEBDAV_PASSWORD"))
+	}
+	return s.client.Do(req)
+}
+
+func (s *davStore) ReadObject(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, s.url(key, false), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, davError(resp, http.MethodGet, key)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *davStore) WriteObject(key string, data []byte) error {
+	return s.put(key, data, nil)
+}
+
+func (s *davStore) WriteObjectIf(key string, data []byte, version string) error {
+	header := http.Header{}
+	switch version {
+	case "":
+		header.Set("If-None-Match", "*")
+	case anyVersion:
+		header.Set("If-Match", "*")
+	default:
+		header.Set("If-Match", version)
+	}
+	return s.put(key, data, header)
+}
+
+// put uploads an object, creating the folders above it when the server
+// reports them missing.
+func (s *davStore) put(key string, data []byte, header http.Header) error {
+	if data == nil {
+		data = []byte{}
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := s.do(http.MethodPut, s.url(key, false), data, header)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusNoContent:
+			return nil
+		case resp.StatusCode == http.StatusPreconditionFailed:
+			return errStaleObject
+		// RFC 4918 asks for 409 when a parent folder is missing; some
+		// servers, such as golang.org/x/net/webdav, answer 404
+		case (resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusNotFound) && attempt == 0:
+			if err := s.makeCollections(path.Dir(key)); err != nil {
+				return err
+			}
+		default:
+			return davError(resp, http.MethodPut, key)
+		}
+	}
+}
+
+// makeCollections creates the folder dir below the root, and the root
+// itself, along with any missing parents.
+func (s *davStore) makeCollections(dir string) error {
+	dirs := []string{""}
+	if dir != "." {
+		parts := strings.Split(dir, "/")
+		for i := range parts {
+			dirs = append(dirs, strings.Join(parts[:i+1], "/"))
+		}
+	}
+	for _, d := range dirs {
+		resp, err := s.do("MKCOL", s.url(d, true), nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		// 405 means the folder already exists
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return davError(resp, "MKCOL", d)
+		}
+	}
+	return nil
+}
+
+func (s *davStore) DeleteObject(key string) error {
+	if err := s.delete(key, false); err != nil {
+		return err
+	}
+	// Drop folders left empty, such as those of deleted records
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		children, err := s.propfind(dir)
+		if err != nil || len(children) > 0 {
+			return err
+		}
+		if err := s.delete(dir, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *davStore) delete(key string, collection bool) error {
+	resp, err := s.do(http.MethodDelete, s.url(key, collection), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return davError(resp, http.MethodDelete, key)
+	}
+	return nil
+}
+
+// ObjectVersions walks the folder one level at a time, since servers such
+// as Nextcloud refuse PROPFIND with infinite depth.
+func (s *davStore) ObjectVersions() (map[string]string, error) {
+	versions := map[string]string{}
+	pending := []string{""}
+	for len(pending) > 0 {
+		dir := pending[0]
+		pending = pending[1:]
+		children, err := s.propfind(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			if child.collection {
+				pending = append(pending, child.key)
+			} else if child.etag != "" {
+				versions[child.key] = child.etag
+			} else {
+				versions[child.key] = anyVersion
+			}
+		}
+	}
+	return versions, nil
+}
+
+type davEntry struct {
+	key        string
+	etag       string
+	collection bool
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				ETag         string `xml:"DAV: getetag"`
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/><d:resourcetype/></d:prop></d:propfind>`
+
+// propfind lists the entries of the folder dir below the root; a missing
+// folder has none.
+func (s *davStore) propfind(dir string) ([]davEntry, error) {
+	header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := s.do("PROPFIND", s.url(dir, true), []byte(propfindBody), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, davError(resp, "PROPFIND", dir)
+	}
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav PROPFIND %s: invalid response: %w", dir, err)
+	}
+
+	root := strings.TrimSuffix(s.storage.Endpoint.Path, "/") + "/"
+	var entries []davEntry
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		key := strings.Trim(strings.TrimPrefix(href.Path, root), "/")
+		if !strings.HasPrefix(href.Path+"/", root) || key == strings.Trim(dir, "/") || (!validKey(key) && key != manifestKey) {
+			continue
+		}
+		entry := davEntry{key: key}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			entry.etag = ps.Prop.ETag
+			entry.collection = ps.Prop.ResourceType.Collection != nil
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func davError(resp *http.Response, method, key string) error {
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("webdav %s %s: %s (set DOT_SYNC_WEBDAV_PASSWORD or DOT_SYNC_WEBDAV_TOKEN)", method, key, resp.Status)
+	}
+	return fmt.Errorf("webdav %s %s: %s", method, key, resp.Status)
+}